@@ -0,0 +1,80 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// A media range from an Accept header, such as audio/* or audio/mpeg;q=0.8
+type mediaRange struct {
+	mediaType string // wildcards like audio/* are kept as is
+	q         float64
+}
+
+func parseAccept(header string) []mediaRange {
+	var ranges []mediaRange
+	for _, part := range strings.Split(header, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if value, ok := params["q"]; ok {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+				q = parsed
+			}
+		}
+		ranges = append(ranges, mediaRange{mediaType: mediaType, q: q})
+	}
+	return ranges
+}
+
+// Whether contentType is acceptable, going by the most specific range that
+// matches it so that "audio/*, audio/flac;q=0" still rules out FLAC
+func acceptsType(ranges []mediaRange, contentType string) bool {
+	major, _, _ := strings.Cut(contentType, "/")
+
+	best, q := -1, 0.0
+	for _, r := range ranges {
+		specificity := -1
+		switch r.mediaType {
+		case contentType:
+			specificity = 2
+		case major + "/*":
+			specificity = 1
+		case "*/*":
+			specificity = 0
+		}
+		if specificity > best {
+			best, q = specificity, r.q
+		}
+	}
+	return q > 0
+}
+
+// Narrow the candidates to formats the client says it can play. Without an
+// Accept header, or when no candidate matches it, the list is left as is.
+func preferAccepted(req *http.Request, fileNames []string) []string {
+	header := req.Header.Get("Accept")
+	if header == "" {
+		return fileNames
+	}
+	ranges := parseAccept(header)
+	if len(ranges) == 0 {
+		return fileNames
+	}
+
+	var accepted []string
+	for _, name := range fileNames {
+		if acceptsType(ranges, audioContentType(name)) {
+			accepted = append(accepted, name)
+		}
+	}
+	if len(accepted) == 0 {
+		return fileNames
+	}
+	return accepted
+}
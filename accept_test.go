@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestMP3OnlyClientNeverGetsFLAC(t *testing.T) {
+	setB2Env(t)
+	useListing(t, []string{"a.flac", "b.mp3", "c.flac", "d.mp3", "e.flac"})
+	useStation(t, modeRandom)
+
+	for range 50 {
+		req := httptest.NewRequest(http.MethodGet, "/stream", nil)
+		req.Header.Set("Accept", "audio/mpeg")
+		rec := httptest.NewRecorder()
+		newStreamHandler(t).stream(rec, req)
+
+		location, err := url.Parse(rec.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if file := location.Query().Get("file"); filepath.Ext(file) != ".mp3" {
+			t.Fatalf("an MP3-only client was sent %s", file)
+		}
+	}
+}
+
+func TestPreferAccepted(t *testing.T) {
+	files := []string{"a.flac", "b.mp3", "c.ogg"}
+	tests := []struct {
+		accept string
+		want   []string
+	}{
+		{"", files},
+		{"*/*", files},
+		{"audio/*", files},
+		{"audio/*, audio/flac;q=0", []string{"b.mp3", "c.ogg"}},
+		{"audio/ogg, audio/mpeg;q=0.5", []string{"b.mp3", "c.ogg"}},
+		{"audio/flac", []string{"a.flac"}},
+		// Nothing matches, so any track beats none
+		{"audio/wav", files},
+		{"not a media type;;", files},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/stream", nil)
+		if tt.accept != "" {
+			req.Header.Set("Accept", tt.accept)
+		}
+		if got := preferAccepted(req, files); !slices.Equal(got, tt.want) {
+			t.Errorf("Accept %q: got %q, want %q", tt.accept, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const defaultAccessLogMaxBytes = 100 << 20
+
+// One JSON line per completed stream, for aggregating plays per track into
+// royalty reports
+type accessRecord struct {
+	Time       time.Time `json:"time"`
+	File       string    `json:"file"`
+	Station    string    `json:"station,omitempty"`
+	Bytes      int64     `json:"bytes"`
+	DurationMs int64     `json:"duration_ms"`
+	Ranged     bool      `json:"ranged"`
+	CacheHit   bool      `json:"cache_hit"`
+	Client     string    `json:"client"` // salted hash of the client IP
+}
+
+// Writes access records to stdout or a file that is rotated to <path>.1 once
+// it reaches maxBytes
+type accessLogger struct {
+	mu       sync.Mutex
+	out      io.Writer
+	file     *os.File
+	path     string
+	size     int64
+	maxBytes int64 // 0 never rotates
+	salt     []byte
+}
+
+// Set from ACCESS_LOG; nil disables access logging
+var accessLog *accessLogger
+
+func openAccessLog(sink string, maxBytes int64, salt string) (*accessLogger, error) {
+	l := &accessLogger{path: sink, maxBytes: maxBytes, salt: []byte(salt)}
+	if salt == "" {
+		// Without a configured salt, hashes are only comparable within a run
+		l.salt = make([]byte, 16)
+		if _, err := rand.Read(l.salt); err != nil {
+			return nil, err
+		}
+	}
+
+	if sink == "stdout" {
+		l.out = os.Stdout
+		return l, nil
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *accessLogger) open() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	l.file, l.out, l.size = file, file, info.Size()
+	return nil
+}
+
+func (l *accessLogger) rotate() error {
+	l.file.Close()
+	if err := os.Rename(l.path, l.path+".1"); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+func (l *accessLogger) hashClient(ip string) string {
+	sum := sha256.Sum256(append(append([]byte{}, l.salt...), ip...))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (l *accessLogger) write(record accessRecord) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("Failed to encode access record: %v", err)
+		return
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file != nil && l.maxBytes > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxBytes {
+		if err := l.rotate(); err != nil {
+			log.Printf("Failed to rotate access log: %v", err)
+		}
+	}
+
+	n, err := l.out.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		log.Printf("Failed to write access log: %v", err)
+	}
+}
+
+func (l *accessLogger) record(record streamRecord) {
+	l.write(accessRecord{
+		Time:       time.Now().UTC(),
+		File:       record.file,
+		Station:    record.station,
+		Bytes:      record.bytes,
+		DurationMs: record.duration.Milliseconds(),
+		Ranged:     record.ranged,
+		CacheHit:   record.cacheHit,
+		Client:     l.hashClient(record.client),
+	})
+}
+
+// The client's IP without the port
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
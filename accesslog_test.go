@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func useAccessLog(t *testing.T, maxBytes int64) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "access.log")
+	logger, err := openAccessLog(path, maxBytes, "salt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previous := accessLog
+	t.Cleanup(func() {
+		accessLog = previous
+		logger.file.Close()
+	})
+	accessLog = logger
+	return path
+}
+
+func readAccessLog(t *testing.T, path string) []map[string]any {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var records []map[string]any
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("invalid JSON line %q: %v", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestCompletedStreamIsLogged(t *testing.T) {
+	t.Chdir(t.TempDir())
+	path := useAccessLog(t, 0)
+	useStation(t, modeRandom)
+	stub := newS3Stub(t, map[string][]byte{"song.mp3": []byte("twelve bytes")})
+	stub.useEnv(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/stream?file=song.mp3", nil)
+	req.RemoteAddr = "203.0.113.7:51234"
+	rec := httptest.NewRecorder()
+	newStreamHandler(t).stream(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+
+	records := readAccessLog(t, path)
+	if len(records) != 1 {
+		t.Fatalf("%d access records, want 1", len(records))
+	}
+	record := records[0]
+	for _, field := range []string{"time", "file", "station", "bytes", "duration_ms", "ranged", "cache_hit", "client"} {
+		if _, ok := record[field]; !ok {
+			t.Errorf("record has no %s: %v", field, record)
+		}
+	}
+	if record["file"] != "song.mp3" || record["bytes"] != float64(12) || record["ranged"] != false || record["station"] != defaultStationName {
+		t.Fatalf("unexpected record %v", record)
+	}
+	if client, _ := record["client"].(string); client == "" || strings.Contains(client, "203.0.113.7") {
+		t.Fatalf("client %q, want a hash rather than the IP", client)
+	}
+	if record["client"] != accessLog.hashClient("203.0.113.7") {
+		t.Fatal("the client hash should ignore the port")
+	}
+}
+
+func TestAccessLogRotates(t *testing.T) {
+	// Small enough that every record after the first rotates the file
+	path := useAccessLog(t, 10)
+
+	for _, file := range []string{"first.mp3", "second.mp3", "third.mp3"} {
+		accessLog.record(streamRecord{file: file, bytes: 1, client: "198.51.100.1"})
+	}
+
+	current, rotated := readAccessLog(t, path), readAccessLog(t, path+".1")
+	if len(current) != 1 || current[0]["file"] != "third.mp3" {
+		t.Fatalf("current log %v, want only the latest record", current)
+	}
+	if len(rotated) != 1 || rotated[0]["file"] != "second.mp3" {
+		t.Fatalf("rotated log %v, want the record before it", rotated)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Keys that may be selected or streamed, loaded from ALLOWLIST_FILE for a
+// curated subset of the bucket. Nil allows every key.
+var allowlist map[string]bool
+
+// Read a manifest of keys: a JSON array of strings, or one key per line with
+// blank lines and # comments skipped
+func loadAllowlist(path string) (map[string]bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read allowlist: %w", err)
+	}
+
+	var keys []string
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &keys); err != nil {
+			return nil, fmt.Errorf("failed to parse allowlist: %w", err)
+		}
+	} else {
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line != "" && !strings.HasPrefix(line, "#") {
+				keys = append(keys, line)
+			}
+		}
+	}
+
+	allowed := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if key = normalizeKey(key); key != "" {
+			allowed[key] = true
+		}
+	}
+	return allowed, nil
+}
+
+func isAllowed(fileName string) bool {
+	return allowlist == nil || allowlist[fileName]
+}
+
+func filterAllowed(fileNames []string) []string {
+	if allowlist == nil {
+		return fileNames
+	}
+
+	var allowed []string
+	for _, name := range fileNames {
+		if allowlist[name] {
+			allowed = append(allowed, name)
+		}
+	}
+	return allowed
+}
+
+// Whether any allowed key lies under folder, so folder views can hide
+// folders with nothing playable in them
+func allowsUnder(folder string) bool {
+	if allowlist == nil {
+		return true
+	}
+	for key := range allowlist {
+		if strings.HasPrefix(key, folder) {
+			return true
+		}
+	}
+	return false
+}
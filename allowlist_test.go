@@ -0,0 +1,147 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func useAllowlist(t *testing.T, keys ...string) {
+	previous := allowlist
+	t.Cleanup(func() { allowlist = previous })
+	allowlist = map[string]bool{}
+	for _, key := range keys {
+		allowlist[key] = true
+	}
+}
+
+func TestAllowlistRestrictsSelectionAndStreaming(t *testing.T) {
+	t.Chdir(t.TempDir())
+	stub := newS3Stub(t, map[string][]byte{
+		"curated/a.mp3": []byte("a"),
+		"curated/b.mp3": []byte("b"),
+		"other/c.mp3":   []byte("c"),
+	})
+	stub.useEnv(t)
+	useListing(t, []string{"curated/a.mp3", "curated/b.mp3", "other/c.mp3"})
+	st := useStation(t, modeRandom)
+	useAllowlist(t, "curated/a.mp3", "other/c.mp3")
+
+	candidates, err := selectionCandidates(newFakeB2(t, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 20 {
+		name, err := st.selector.selectFile(candidates)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name == "curated/b.mp3" {
+			t.Fatal("selected a track outside the allowlist")
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	newStreamHandler(t).stream(rec, httptest.NewRequest(http.MethodGet, "/stream?file=curated/b.mp3", nil))
+	if rec.Code != http.StatusNotFound || stub.getCount("curated/b.mp3") != 0 {
+		t.Fatalf("status %d, want 404 without fetching the unlisted track", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	newStreamHandler(t).stream(rec, httptest.NewRequest(http.MethodGet, "/stream?file=curated/a.mp3", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "a" {
+		t.Fatalf("status %d body %q, want the allowlisted track", rec.Code, rec.Body)
+	}
+}
+
+func TestAllowlistCombinesWithStationPrefix(t *testing.T) {
+	useListing(t, []string{"curated/a.mp3", "curated/b.mp3", "other/c.mp3"})
+	useAllowlist(t, "curated/a.mp3", "other/c.mp3")
+	previous := stations
+	t.Cleanup(func() { stations = previous })
+	stations = &stationRegistry{stations: map[string]*station{}}
+	if err := stations.add("curated", "curated/", selectorConfig{mode: modeRandom, seed: 1}); err != nil {
+		t.Fatal(err)
+	}
+	st, _ := stations.get("curated")
+
+	files, err := st.candidates(newFakeB2(t, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0] != "curated/a.mp3" {
+		t.Fatalf("candidates %q, want only the allowlisted track under the prefix", files)
+	}
+}
+
+func TestLoadAllowlist(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"list.txt":  "# curated\n/curated/a.mp3\n\n  other/c.mp3  \n",
+		"list.json": `["curated/a.mp3", "/other/c.mp3"]`,
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		allowed, err := loadAllowlist(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(allowed) != 2 || !allowed["curated/a.mp3"] || !allowed["other/c.mp3"] {
+			t.Errorf("%s: got %v", name, allowed)
+		}
+	}
+
+	bad := filepath.Join(dir, "bad.json")
+	os.WriteFile(bad, []byte(`["unterminated`), 0o644)
+	if _, err := loadAllowlist(bad); err == nil {
+		t.Fatal("expected an error for malformed JSON")
+	}
+}
+
+func TestAllowlistGuardsEveryKeyedEndpoint(t *testing.T) {
+	t.Chdir(t.TempDir())
+	useFakeFFmpeg(t)
+	stub := newS3Stub(t, map[string][]byte{"curated/a.mp3": []byte("a"), "hidden/b.mp3": []byte("b")})
+	stub.useEnv(t)
+	useListing(t, []string{"curated/a.mp3", "hidden/b.mp3"})
+	useStation(t, modeRandom)
+	useAllowlist(t, "curated/a.mp3")
+
+	for _, endpoint := range []struct {
+		name   string
+		serve  http.HandlerFunc
+		target string
+	}{
+		{"meta", meta, "/meta?file=hidden/b.mp3"},
+		{"art", art, "/art?file=hidden/b.mp3"},
+		{"chapters", chaptersHandler, "/chapters?file=hidden/b.mp3"},
+		{"hls", hlsHandler, "/hls/hidden/b.mp3/playlist.m3u8"},
+		{"listen", listen, "/listen?file=hidden/b.mp3"},
+	} {
+		rec := httptest.NewRecorder()
+		endpoint.serve(rec, httptest.NewRequest(http.MethodGet, endpoint.target, nil))
+		if rec.Code != http.StatusNotFound || !strings.Contains(rec.Body.String(), "File not found") {
+			t.Errorf("%s: status %d body %q, want the 404 /stream gives", endpoint.name, rec.Code, rec.Body)
+		}
+	}
+	if stub.getCount("hidden/b.mp3") != 0 {
+		t.Fatal("fetched a track outside the allowlist")
+	}
+	rec := httptest.NewRecorder()
+	playlistM3U(rec, httptest.NewRequest(http.MethodGet, "/playlist.m3u", nil))
+	if strings.Contains(rec.Body.String(), "hidden") || !strings.Contains(rec.Body.String(), "file=curated%2Fa.mp3") {
+		t.Fatalf("playlist lists keys outside the allowlist:\n%s", rec.Body)
+	}
+
+	// The allowlisted track is still served
+	rec = httptest.NewRecorder()
+	hlsHandler(rec, httptest.NewRequest(http.MethodGet, "/hls/curated/a.mp3/segment000.ts", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "a" {
+		t.Fatalf("status %d body %q, want the allowlisted track", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// Extracted cover art is kept beside the cache, hidden from eviction scans
+var artDir = filepath.Join(cacheDir, ".art")
+
+const placeholderArt = `<svg xmlns="http://www.w3.org/2000/svg" width="300" height="300" viewBox="0 0 300 300">
+<rect width="300" height="300" fill="#e8ecf1"/>
+<circle cx="150" cy="150" r="90" fill="#1a1a1a"/>
+<circle cx="150" cy="150" r="25" fill="#e8ecf1"/>
+</svg>
+`
+
+func artPath(fileName string) string {
+	return filepath.Join(artDir, localName(fileName))
+}
+
+// Cover art embedded in a track, falling back to cover.jpg in the same
+// prefix and finally a placeholder image
+func art(w http.ResponseWriter, req *http.Request) {
+	fileName := fileParam(req)
+	if fileName == "" {
+		http.Error(w, "Missing file parameter", http.StatusBadRequest)
+		return
+	}
+	if err := validateKey(fileName); err != nil {
+		http.Error(w, "Invalid file parameter", http.StatusBadRequest)
+		return
+	}
+	if !isAllowed(fileName) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	cached := artPath(fileName)
+	if _, err := os.Stat(cached); err == nil {
+		http.ServeFile(w, req, cached)
+		return
+	}
+
+	b2Client, err := b2ClientFromEnv()
+	if err != nil {
+		http.Error(w, "Failed to create B2 client", http.StatusInternalServerError)
+		log.Printf("Failed to create B2 client: %v", err)
+		return
+	}
+
+	image, err := findArt(b2Client, fileName)
+	if err != nil {
+		log.Printf("No cover art for %s: %v", fileName, err)
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.Write([]byte(placeholderArt))
+		return
+	}
+
+	if cacheEnabled {
+		if err := os.MkdirAll(filepath.Dir(cached), 0755); err != nil {
+			log.Printf("Failed to create art cache directory: %v", err)
+		} else if err := os.WriteFile(cached, image, 0644); err != nil {
+			log.Printf("Failed to cache cover art: %v", err)
+		}
+	}
+
+	w.Header().Set("Content-Type", http.DetectContentType(image))
+	w.Write(image)
+}
+
+func findArt(b2Client B2, fileName string) ([]byte, error) {
+	coverKey := "cover.jpg"
+	if dir := path.Dir(fileName); dir != "." {
+		coverKey = dir + "/cover.jpg"
+	}
+
+	// Embedded art needs the file on disk, so proxy mode only has cover.jpg
+	if !cacheEnabled {
+		result, err := b2Client.fetchRange(coverKey, "")
+		if err != nil {
+			return nil, err
+		}
+		defer result.body.Close()
+		return io.ReadAll(io.LimitReader(result.body, maxTagBytes))
+	}
+
+	filePath := cachePath(fileName)
+	if _, err := statCached(filePath); err != nil {
+		filePath, err = b2Client.downloadFile(fileName)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	pic, err := readPicture(filePath)
+	if err == nil {
+		return pic.data, nil
+	}
+	if !errors.Is(err, errNoTags) {
+		log.Printf("Failed to read cover art from %s: %v", filePath, err)
+	}
+
+	coverPath, err := b2Client.downloadFile(coverKey)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(coverPath)
+}
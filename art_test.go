@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+var pngImage = []byte("\x89PNG\r\n\x1a\nfront")
+
+func apicFrame(kind byte, mimeType string, image []byte) []byte {
+	data := append([]byte{0}, mimeType...)
+	data = append(data, 0, kind)
+	data = append(data, "cover"...)
+	data = append(data, 0)
+	return id3Frame4("APIC", append(data, image...))
+}
+
+func flacPictureBlock(kind uint32, mimeType string, image []byte) []byte {
+	data := binary.BigEndian.AppendUint32(nil, kind)
+	data = binary.BigEndian.AppendUint32(data, uint32(len(mimeType)))
+	data = append(data, mimeType...)
+	data = binary.BigEndian.AppendUint32(data, 0)
+	data = append(data, make([]byte, 16)...)
+	data = binary.BigEndian.AppendUint32(data, uint32(len(image)))
+	return append(data, image...)
+}
+
+func TestReadPictureID3PrefersFrontCover(t *testing.T) {
+	data := id3Tag(4,
+		apicFrame(4, "image/jpeg", []byte("back")),
+		apicFrame(frontCoverPicture, "image/png", pngImage),
+	)
+	pic, err := readPicture(writeTemp(t, "track.mp3", data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pic.mimeType != "image/png" || !bytes.Equal(pic.data, pngImage) {
+		t.Fatalf("got %s picture %q, want the front cover", pic.mimeType, pic.data)
+	}
+}
+
+func TestReadPictureFLAC(t *testing.T) {
+	data := flacStream(
+		flacBlock{kind: 0, data: make([]byte, 34)},
+		flacBlock{kind: flacPicture, data: flacPictureBlock(frontCoverPicture, "image/png", pngImage)},
+	)
+	pic, err := readPicture(writeTemp(t, "track.flac", data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(pic.data, pngImage) {
+		t.Fatalf("got %q, want the embedded image", pic.data)
+	}
+}
+
+func TestReadPictureWithoutArt(t *testing.T) {
+	data := id3Tag(4, id3Frame4("TIT2", id3Text("No art")))
+	if _, err := readPicture(writeTemp(t, "track.mp3", data)); err != errNoTags {
+		t.Fatalf("got %v, want errNoTags", err)
+	}
+}
+
+func TestFindArtFallsBackToCoverFile(t *testing.T) {
+	t.Chdir(t.TempDir())
+	client := newFakeB2(t, map[string][]byte{
+		"album/01.mp3":    id3Tag(4, id3Frame4("TIT2", id3Text("No art"))),
+		"album/cover.jpg": []byte("\xff\xd8\xffjpeg"),
+	})
+
+	image, err := findArt(client, "album/01.mp3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(image) != "\xff\xd8\xffjpeg" {
+		t.Fatalf("got %q, want cover.jpg", image)
+	}
+}
+
+func TestArtHandler(t *testing.T) {
+	t.Chdir(t.TempDir())
+	stub := newS3Stub(t, map[string][]byte{
+		"album/01.mp3": id3Tag(4, apicFrame(frontCoverPicture, "image/png", pngImage)),
+		"loose.mp3":    id3Tag(4, id3Frame4("TIT2", id3Text("No art"))),
+	})
+	stub.useEnv(t)
+
+	rec := httptest.NewRecorder()
+	art(rec, httptest.NewRequest(http.MethodGet, "/art?file=album/01.mp3", nil))
+	if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), pngImage) {
+		t.Fatalf("status %d body %q, want the embedded art", rec.Code, rec.Body)
+	}
+	if _, err := os.Stat(artPath("album/01.mp3")); err != nil {
+		t.Fatal("extracted art wasn't cached")
+	}
+
+	rec = httptest.NewRecorder()
+	art(rec, httptest.NewRequest(http.MethodGet, "/art?file=loose.mp3", nil))
+	if rec.Header().Get("Content-Type") != "image/svg+xml" || !strings.Contains(rec.Body.String(), "<svg") {
+		t.Fatalf("got %s %q, want the placeholder", rec.Header().Get("Content-Type"), rec.Body)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func useOriginSecret(t *testing.T, secret string) {
+	previous := originSecret
+	t.Cleanup(func() { originSecret = previous })
+	originSecret = []byte(secret)
+}
+
+func signedRequest(target string, at time.Time) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	req.Header.Set(originTimestampHeader, timestamp)
+	req.Header.Set(originSignatureHeader, originSignature(req.URL.EscapedPath(), req.URL.Query(), timestamp))
+	return req
+}
+
+func TestOriginSignature(t *testing.T) {
+	useOriginSecret(t, "cdn secret")
+	handler := requireOriginSignature(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	now := time.Now()
+	forged := signedRequest("/stream", now)
+	forged.Header.Set(originSignatureHeader, "00"+forged.Header.Get(originSignatureHeader)[2:])
+	otherPath := signedRequest("/random", now)
+	otherPath.URL.Path = "/stream"
+	otherFile := signedRequest("/stream?file=a.mp3", now)
+	otherFile.URL.RawQuery = "file=b.mp3"
+	reordered := signedRequest("/stream?file=a.mp3&quality=low", now)
+	reordered.URL.RawQuery = "quality=low&file=a.mp3"
+	unsigned := httptest.NewRequest(http.MethodGet, "/stream", nil)
+
+	tests := []struct {
+		name string
+		req  *http.Request
+		want int
+	}{
+		{"valid", signedRequest("/stream?file=a.mp3", now), http.StatusNoContent},
+		{"within the window", signedRequest("/stream", now.Add(-signatureWindow+time.Minute)), http.StatusNoContent},
+		{"expired", signedRequest("/stream", now.Add(-signatureWindow-time.Minute)), http.StatusForbidden},
+		{"from the future", signedRequest("/stream", now.Add(signatureWindow+time.Minute)), http.StatusForbidden},
+		{"forged", forged, http.StatusForbidden},
+		{"signed for another path", otherPath, http.StatusForbidden},
+		{"signed for another query", otherFile, http.StatusForbidden},
+		{"query reordered", reordered, http.StatusNoContent},
+		{"unsigned", unsigned, http.StatusForbidden},
+		{"health probe", httptest.NewRequest(http.MethodGet, "/healthz", nil), http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, tt.req)
+		if rec.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+
+	// Signed with a different secret
+	req := signedRequest("/stream", now)
+	useOriginSecret(t, "other secret")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("wrong secret: status %d, want 403", rec.Code)
+	}
+}
+
+func TestNoOriginSecretAllowsAll(t *testing.T) {
+	useOriginSecret(t, "")
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+	rec := httptest.NewRecorder()
+	requireOriginSignature(next).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stream", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d with signing off", rec.Code)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// Errors the B2 methods wrap SDK failures in, so handlers can pick a status
+// with errors.Is rather than inspecting SDK types. The SDK error stays in the
+// chain for logging and errors.As.
+var (
+	errNotFound           = errors.New("object not found")
+	errNoFiles            = errors.New("no files found")
+	errThrottled          = errors.New("request throttled by B2")
+	errBucketUnreachable  = errors.New("bucket unreachable")
+	errRangeUnsatisfiable = errors.New("range not satisfiable")
+	errUnauthorized       = errors.New("credentials rejected by B2")
+)
+
+// Wrap an SDK error in the matching sentinel. Errors that match none, or are
+// already classified, are returned unchanged.
+func classifyB2Error(err error) error {
+	if err == nil || errors.Is(err, errNotFound) || errors.Is(err, errThrottled) || errors.Is(err, errBucketUnreachable) || errors.Is(err, errRangeUnsatisfiable) || errors.Is(err, errUnauthorized) {
+		return err
+	}
+
+	var noSuchKey *types.NoSuchKey
+	var noSuchBucket *types.NoSuchBucket
+	switch {
+	case errors.As(err, &noSuchKey):
+		return fmt.Errorf("%w: %w", errNotFound, err)
+	case errors.As(err, &noSuchBucket):
+		return fmt.Errorf("%w: %w", errBucketUnreachable, err)
+	}
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "SlowDown", "TooManyRequests", "Throttling", "ThrottlingException", "RequestLimitExceeded":
+			return fmt.Errorf("%w: %w", errThrottled, err)
+		case "NoSuchBucket":
+			return fmt.Errorf("%w: %w", errBucketUnreachable, err)
+		case "InvalidRange":
+			return fmt.Errorf("%w: %w", errRangeUnsatisfiable, err)
+		case "InvalidAccessKeyId", "SignatureDoesNotMatch", "ExpiredToken", "bad_auth_token", "expired_auth_token", "unauthorized":
+			return fmt.Errorf("%w: %w", errUnauthorized, err)
+		}
+	}
+
+	var responseErr *awshttp.ResponseError
+	if errors.As(err, &responseErr) {
+		switch status := responseErr.HTTPStatusCode(); {
+		case status == http.StatusNotFound:
+			return fmt.Errorf("%w: %w", errNotFound, err)
+		case status == http.StatusRequestedRangeNotSatisfiable:
+			return fmt.Errorf("%w: %w", errRangeUnsatisfiable, err)
+		case status == http.StatusUnauthorized || status == http.StatusForbidden:
+			return fmt.Errorf("%w: %w", errUnauthorized, err)
+		case status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable:
+			return fmt.Errorf("%w: %w", errThrottled, err)
+		case status >= http.StatusInternalServerError:
+			return fmt.Errorf("%w: %w", errBucketUnreachable, err)
+		}
+		return err
+	}
+
+	// No HTTP response at all: DNS, connection or timeout failures
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %w", errBucketUnreachable, err)
+	}
+	return err
+}
+
+// HTTP status for a failed B2 call
+func b2ErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errNotFound), errors.Is(err, errNoFiles):
+		return http.StatusNotFound
+	case errors.Is(err, errThrottled):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, errBucketUnreachable):
+		return http.StatusBadGateway
+	case errors.Is(err, errInsufficientStorage):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, errRangeUnsatisfiable):
+		return http.StatusRequestedRangeNotSatisfiable
+	}
+	return http.StatusInternalServerError
+}
+
+// The status B2 answered a failed call with, or the one b2ErrorStatus picks
+// when there was no response
+func b2ResponseStatus(err error) int {
+	var responseErr *awshttp.ResponseError
+	if errors.As(err, &responseErr) {
+		return responseErr.HTTPStatusCode()
+	}
+	return b2ErrorStatus(err)
+}
+
+// Write the error response for a failed B2 call, asking throttled clients to
+// back off before retrying
+func b2Error(w http.ResponseWriter, message string, err error) {
+	if errors.Is(err, errThrottled) {
+		w.Header().Set("Retry-After", "5")
+	}
+	recentErrors.add(fmt.Sprintf("%s: %v", message, err))
+	http.Error(w, message, b2ErrorStatus(err))
+	setProblemType(w, err)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+func responseError(status int) error {
+	return &awshttp.ResponseError{ResponseError: &smithyhttp.ResponseError{
+		Response: &smithyhttp.Response{Response: &http.Response{StatusCode: status}},
+		Err:      errors.New("operation error"),
+	}}
+}
+
+func TestClassifyB2Error(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"NoSuchKey", &types.NoSuchKey{}, errNotFound},
+		{"wrapped NoSuchKey", fmt.Errorf("get: %w", &types.NoSuchKey{}), errNotFound},
+		{"NoSuchBucket", &types.NoSuchBucket{}, errBucketUnreachable},
+		{"NoSuchBucket code", &smithy.GenericAPIError{Code: "NoSuchBucket"}, errBucketUnreachable},
+		{"SlowDown", &smithy.GenericAPIError{Code: "SlowDown"}, errThrottled},
+		{"TooManyRequests", &smithy.GenericAPIError{Code: "TooManyRequests"}, errThrottled},
+		{"404 response", responseError(http.StatusNotFound), errNotFound},
+		{"429 response", responseError(http.StatusTooManyRequests), errThrottled},
+		{"503 response", responseError(http.StatusServiceUnavailable), errThrottled},
+		{"500 response", responseError(http.StatusInternalServerError), errBucketUnreachable},
+		{"401 response", responseError(http.StatusUnauthorized), errUnauthorized},
+		{"403 response", responseError(http.StatusForbidden), errUnauthorized},
+		{"InvalidAccessKeyId", &smithy.GenericAPIError{Code: "InvalidAccessKeyId"}, errUnauthorized},
+		{"dial failure", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, errBucketUnreachable},
+		{"deadline", fmt.Errorf("get: %w", context.DeadlineExceeded), errBucketUnreachable},
+	}
+	for _, tt := range tests {
+		got := classifyB2Error(tt.err)
+		if !errors.Is(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+		if !errors.Is(got, tt.err) {
+			t.Errorf("%s: the SDK error was dropped from the chain", tt.name)
+		}
+	}
+}
+
+func TestClassifyB2ErrorLeavesOthersAlone(t *testing.T) {
+	for _, err := range []error{
+		nil,
+		errors.New("something else"),
+		responseError(http.StatusMethodNotAllowed),
+		&smithy.GenericAPIError{Code: "AccessDenied"},
+	} {
+		if got := classifyB2Error(err); got != err {
+			t.Errorf("%v: got %v, want it unchanged", err, got)
+		}
+	}
+
+	once := classifyB2Error(&types.NoSuchKey{})
+	if twice := classifyB2Error(once); twice != once {
+		t.Fatalf("classifying twice wrapped again: %v", twice)
+	}
+}
+
+func TestB2ErrorStatus(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{classifyB2Error(&types.NoSuchKey{}), http.StatusNotFound},
+		{errNoFiles, http.StatusNotFound},
+		{classifyB2Error(responseError(http.StatusTooManyRequests)), http.StatusServiceUnavailable},
+		{classifyB2Error(&types.NoSuchBucket{}), http.StatusBadGateway},
+		{errors.New("something else"), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		if got := b2ErrorStatus(tt.err); got != tt.status {
+			t.Errorf("%v: status %d, want %d", tt.err, got, tt.status)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	b2Error(rec, "Failed to fetch file", classifyB2Error(&smithy.GenericAPIError{Code: "SlowDown"}))
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("status %d Retry-After %q, want 503 with a Retry-After", rec.Code, rec.Header().Get("Retry-After"))
+	}
+}
+
+func TestB2ClientReturnsSentinels(t *testing.T) {
+	stub := newS3Stub(t, map[string][]byte{"a.mp3": []byte("a")})
+	client, err := NewB2Client(stub.URL, "us-east-1", "key", "secret", "bucket", b2Options{usePathStyle: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.headFile("missing.mp3"); !errors.Is(err, errNotFound) {
+		t.Fatalf("head of a missing key: %v, want errNotFound", err)
+	}
+	if _, err := client.fetchRange("missing.mp3", ""); !errors.Is(err, errNotFound) {
+		t.Fatalf("fetch of a missing key: %v, want errNotFound", err)
+	}
+	if _, err := client.selectRandomFile(nil); !errors.Is(err, errNoFiles) {
+		t.Fatalf("selecting from nothing: %v, want errNoFiles", err)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type browseFile struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+type browseResponse struct {
+	Prefix  string       `json:"prefix"`
+	Folders []string     `json:"folders"`
+	Files   []browseFile `json:"files"`
+}
+
+// List one level of the bucket: files directly under ?prefix= and the
+// folders below it, via a delimited listing rather than the cached flat one
+func browse(w http.ResponseWriter, req *http.Request) {
+	prefix := normalizeKey(req.URL.Query().Get("prefix"))
+	if prefix != "" {
+		if err := validateKey(strings.TrimSuffix(prefix, "/")); err != nil {
+			http.Error(w, "Invalid prefix parameter", http.StatusBadRequest)
+			return
+		}
+		if !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+	}
+
+	b2Client, err := b2ClientFromEnv()
+	if err != nil {
+		http.Error(w, "Failed to create B2 client", http.StatusInternalServerError)
+		log.Printf("Failed to create B2 client: %v", err)
+		return
+	}
+
+	objects, folders, err := b2Client.listPrefix(prefix, "/")
+	if err != nil {
+		b2Error(w, "Failed to list folder", err)
+		log.Printf("Failed to list %q: %v", prefix, err)
+		return
+	}
+
+	response := browseResponse{Prefix: prefix, Folders: []string{}, Files: []browseFile{}}
+	for _, folder := range folders {
+		folder = normalizeKey(folder)
+		if !allowsUnder(folder) {
+			continue
+		}
+		response.Folders = append(response.Folders, folder)
+	}
+	for _, object := range objects {
+		key := normalizeKey(object.Key)
+		// Folder placeholder objects, as some tools create
+		if strings.HasSuffix(key, "/") || !isAudio(key) || !isAllowed(key) {
+			continue
+		}
+		response.Files = append(response.Files, browseFile{Key: key, Size: object.Size, LastModified: object.LastModified})
+	}
+
+	writeJSON(w, response)
+}
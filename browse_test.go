@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func getBrowse(t *testing.T, target string) browseResponse {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	browse(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("%s: status %d: %s", target, rec.Code, rec.Body)
+	}
+	var response browseResponse
+	if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func browseKeys(response browseResponse) []string {
+	var keys []string
+	for _, file := range response.Files {
+		keys = append(keys, file.Key)
+	}
+	return keys
+}
+
+func TestBrowseListsOneLevel(t *testing.T) {
+	stub := newS3Stub(t, map[string][]byte{
+		"top.mp3":               []byte("t"),
+		"jazz/a.mp3":            []byte("aa"),
+		"jazz/b.mp3":            []byte("b"),
+		"jazz/":                 nil,
+		"jazz/live/c.mp3":       []byte("c"),
+		"jazz/studio/d.mp3":     []byte("d"),
+		"jazz/studio/old/e.mp3": []byte("e"),
+		"rock/f.mp3":            []byte("f"),
+	})
+	stub.useEnv(t)
+
+	root := getBrowse(t, "/browse")
+	if !slices.Equal(root.Folders, []string{"jazz/", "rock/"}) || !slices.Equal(browseKeys(root), []string{"top.mp3"}) {
+		t.Fatalf("root: folders %q files %q", root.Folders, browseKeys(root))
+	}
+
+	jazz := getBrowse(t, "/browse?prefix=jazz")
+	if jazz.Prefix != "jazz/" {
+		t.Fatalf("prefix %q, want the slash added", jazz.Prefix)
+	}
+	if !slices.Equal(jazz.Folders, []string{"jazz/live/", "jazz/studio/"}) {
+		t.Fatalf("folders %q", jazz.Folders)
+	}
+	if !slices.Equal(browseKeys(jazz), []string{"jazz/a.mp3", "jazz/b.mp3"}) {
+		t.Fatalf("files %q, want the placeholder left out", browseKeys(jazz))
+	}
+	if jazz.Files[0].Size != 2 {
+		t.Fatalf("size %d, want 2", jazz.Files[0].Size)
+	}
+}
+
+func TestBrowseHonorsAllowlist(t *testing.T) {
+	stub := newS3Stub(t, map[string][]byte{
+		"jazz/a.mp3":      []byte("a"),
+		"jazz/b.mp3":      []byte("b"),
+		"jazz/live/c.mp3": []byte("c"),
+		"rock/d.mp3":      []byte("d"),
+	})
+	stub.useEnv(t)
+	useAllowlist(t, "jazz/b.mp3")
+
+	root := getBrowse(t, "/browse")
+	if !slices.Equal(root.Folders, []string{"jazz/"}) {
+		t.Fatalf("folders %q, want only the one with allowed tracks", root.Folders)
+	}
+	jazz := getBrowse(t, "/browse?prefix=jazz/")
+	if len(jazz.Folders) != 0 || !slices.Equal(browseKeys(jazz), []string{"jazz/b.mp3"}) {
+		t.Fatalf("folders %q files %q", jazz.Folders, browseKeys(jazz))
+	}
+}
+
+func TestBrowseRejectsTraversal(t *testing.T) {
+	rec := httptest.NewRecorder()
+	browse(rec, httptest.NewRequest(http.MethodGet, "/browse?prefix=../secret", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status %d, want 400", rec.Code)
+	}
+}
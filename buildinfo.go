@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// Set at build time, e.g.
+// go build -ldflags "-X main.version=1.2.0 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%FT%TZ)"
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+var startTime = time.Now()
+
+type versionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+}
+
+type runtimeInfo struct {
+	versionInfo
+	Uptime        string `json:"uptime"`
+	Goroutines    int    `json:"goroutines"`
+	ActiveStreams int64  `json:"active_streams"`
+	HeapAlloc     uint64 `json:"heap_alloc_bytes"`
+	HeapSys       uint64 `json:"heap_sys_bytes"`
+	TotalAlloc    uint64 `json:"total_alloc_bytes"`
+	NumGC         uint32 `json:"num_gc"`
+}
+
+func currentVersion() versionInfo {
+	info := versionInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+	}
+
+	// Fall back to the VCS stamp the go tool embeds when ldflags weren't set
+	if build, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range build.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = setting.Value
+			case setting.Key == "vcs.time" && info.BuildDate == "":
+				info.BuildDate = setting.Value
+			}
+		}
+	}
+
+	return info
+}
+
+func versionHandler(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, currentVersion())
+}
+
+func buildInfoHandler(w http.ResponseWriter, req *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	writeJSON(w, runtimeInfo{
+		versionInfo:   currentVersion(),
+		Uptime:        time.Since(startTime).Round(time.Second).String(),
+		Goroutines:    runtime.NumGoroutine(),
+		ActiveStreams: streams.active.Load(),
+		HeapAlloc:     mem.HeapAlloc,
+		HeapSys:       mem.HeapSys,
+		TotalAlloc:    mem.TotalAlloc,
+		NumGC:         mem.NumGC,
+	})
+}
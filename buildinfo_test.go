@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+)
+
+func TestVersionReportsInjectedVersion(t *testing.T) {
+	previousVersion, previousCommit := version, commit
+	t.Cleanup(func() { version, commit = previousVersion, previousCommit })
+	version, commit = "1.2.3", "abc123"
+
+	rec := httptest.NewRecorder()
+	versionHandler(rec, httptest.NewRequest(http.MethodGet, "/version", nil))
+
+	if got := rec.Header().Get("Content-Type"); got != "application/json" {
+		t.Fatalf("Content-Type %s, want application/json", got)
+	}
+	var info versionInfo
+	if err := json.NewDecoder(rec.Body).Decode(&info); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	if info.Version != "1.2.3" || info.Commit != "abc123" || info.GoVersion != runtime.Version() {
+		t.Fatalf("unexpected version info %+v", info)
+	}
+}
+
+func TestBuildInfoRequiresAdmin(t *testing.T) {
+	previous := adminToken
+	t.Cleanup(func() { adminToken = previous })
+	adminToken = "secret"
+	handler := requireAdmin(buildInfoHandler)
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/buildinfo", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("status %d without a token, want 401", rec.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/buildinfo", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec = httptest.NewRecorder()
+	handler(rec, req)
+
+	var fields map[string]any
+	if err := json.NewDecoder(rec.Body).Decode(&fields); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	for _, name := range []string{"version", "go_version", "uptime", "goroutines", "active_streams", "heap_alloc_bytes"} {
+		if _, ok := fields[name]; !ok {
+			t.Errorf("missing %s", name)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	pathEncodingNone = "none"
+	pathEncodingSafe = "safe"
+)
+
+// How object keys are turned into cache paths, set from CACHE_PATH_ENCODING.
+// "none" uses keys as they are; "safe" percent-encodes what Windows and some
+// network filesystems reject, so any B2 key can be cached.
+var cachePathEncoding = pathEncodingNone
+
+const (
+	keyCaseExact = "exact"
+	keyCaseFold  = "fold"
+)
+
+// Whether keys differing only in case share a cache entry, set from
+// CACHE_KEY_CASE. B2 keys are case-sensitive, so "exact" is the only
+// correct policy: with "fold", Song.MP3 and song.mp3 are cached as one
+// file, and should the bucket hold both with different audio, whichever
+// was downloaded first is served for either until it's evicted. It also
+// resolves ?file= case-insensitively against the listing, to the first
+// listed key when several match. Worth it for buckets where case varies by
+// accident rather than on purpose.
+var cacheKeyCase = keyCaseExact
+
+// Form a key is compared in under the case policy
+func foldKey(key string) string {
+	if cacheKeyCase != keyCaseFold {
+		return key
+	}
+	// Version IDs are case-sensitive even when file names aren't
+	if rest, ok := strings.CutPrefix(key, versionsDir+"/"); ok {
+		if versionID, fileName, ok := strings.Cut(rest, "/"); ok {
+			return versionsDir + "/" + versionID + "/" + strings.ToLower(fileName)
+		}
+	}
+	return strings.ToLower(key)
+}
+
+// Characters invalid in Windows filenames, plus "%" so that encoded names
+// decode back to the key with url.PathUnescape
+const unsafePathChars = `<>:"\|?*%`
+
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+func percentEncode(b byte) string {
+	return fmt.Sprintf("%%%02X", b)
+}
+
+// Local path for an object key, relative to the cache directories. Only the
+// path changes: the key is still what appears in listings and headers.
+func localName(key string) string {
+	key = foldKey(key)
+	if cachePathEncoding != pathEncodingSafe {
+		return key
+	}
+
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = safeSegment(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+func safeSegment(segment string) string {
+	var b strings.Builder
+	for i := 0; i < len(segment); i++ {
+		c := segment[i]
+		if c < 0x20 || c == 0x7F || strings.IndexByte(unsafePathChars, c) >= 0 {
+			b.WriteString(percentEncode(c))
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	encoded := b.String()
+
+	// Windows drops trailing dots and spaces
+	if n := len(encoded); n > 0 && (encoded[n-1] == '.' || encoded[n-1] == ' ') {
+		encoded = encoded[:n-1] + percentEncode(encoded[n-1])
+	}
+
+	// "CON", "con.mp3" and the like name devices, whatever the extension
+	base, _, _ := strings.Cut(encoded, ".")
+	if reservedNames[strings.ToUpper(base)] {
+		encoded = percentEncode(encoded[0]) + encoded[1:]
+	}
+	return encoded
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func usePathEncoding(t *testing.T, encoding string) {
+	previous := cachePathEncoding
+	t.Cleanup(func() { cachePathEncoding = previous })
+	cachePathEncoding = encoding
+}
+
+func TestSafeLocalNames(t *testing.T) {
+	usePathEncoding(t, pathEncodingSafe)
+
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"jazz/Blue Train.mp3", "jazz/Blue Train.mp3"},
+		{"live/12:30 set.mp3", "live/12%3A30 set.mp3"},
+		{`what?/a"b"*.mp3`, "what%3F/a%22b%22%2A.mp3"},
+		{"100%/a.mp3", "100%25/a.mp3"},
+		{"CON.mp3", "%43ON.mp3"},
+		{"albums/nul/aux.flac", "albums/%6Eul/%61ux.flac"},
+		{"console.mp3", "console.mp3"},
+		{"album./track .mp3", "album%2E/track .mp3"},
+		{"Café/01.mp3", "Café/01.mp3"},
+	}
+	for _, tt := range tests {
+		got := localName(tt.key)
+		if got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.key, got, tt.want)
+		}
+		// Encoded names map back to their key
+		if decoded, err := url.PathUnescape(got); err != nil || decoded != tt.key {
+			t.Errorf("%q: %q decodes to %q (%v)", tt.key, got, decoded, err)
+		}
+	}
+}
+
+func TestNoPathEncodingKeepsKeys(t *testing.T) {
+	usePathEncoding(t, pathEncodingNone)
+	if got := localName("live/12:30 CON.mp3"); got != "live/12:30 CON.mp3" {
+		t.Fatalf("got %q, want the key unchanged", got)
+	}
+}
+
+func TestUnsafeKeysAreCachedAndServed(t *testing.T) {
+	t.Chdir(t.TempDir())
+	usePathEncoding(t, pathEncodingSafe)
+	useStation(t, modeRandom)
+	key := "live/12:30/CON.mp3"
+	stub := newS3Stub(t, map[string][]byte{key: []byte("audio")})
+	stub.useEnv(t)
+	useListing(t, []string{key})
+
+	rec := httptest.NewRecorder()
+	newStreamHandler(t).stream(rec, httptest.NewRequest(http.MethodGet, "/stream?file="+url.QueryEscape(key), nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "audio" {
+		t.Fatalf("status %d body %q", rec.Code, rec.Body)
+	}
+	if _, err := os.Stat(filepath.Join(cacheDir, "live", "12%3A30", "%43ON.mp3")); err != nil {
+		t.Fatalf("not cached under the encoded path: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(cacheDir, "live", "12:30")); err == nil {
+		t.Fatal("the raw key was used as a path")
+	}
+}
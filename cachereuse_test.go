@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCachedCopyIsReusedWhileSizesMatch(t *testing.T) {
+	t.Chdir(t.TempDir())
+	stub := newS3Stub(t, map[string][]byte{"a.mp3": []byte("audio")})
+	stub.useEnv(t)
+	client, err := b2ClientFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for range 2 {
+		if _, err := client.downloadFile("a.mp3"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if gets := stub.getCount("a.mp3"); gets != 1 {
+		t.Fatalf("%d GETs, want the second call served from the cache", gets)
+	}
+
+	// A new upload of another size is fetched again
+	stub.mu.Lock()
+	stub.objects["a.mp3"] = []byte("longer audio")
+	stub.mu.Unlock()
+	path, err := client.downloadFile("a.mp3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gets := stub.getCount("a.mp3"); gets != 2 {
+		t.Fatalf("%d GETs, want the resized object downloaded again", gets)
+	}
+	rec := httptest.NewRecorder()
+	serveCached(rec, httptest.NewRequest(http.MethodGet, "/stream", nil), path)
+	if rec.Body.String() != "longer audio" {
+		t.Fatalf("cached %q, want the new upload", rec.Body)
+	}
+}
+
+func TestStreamCountsReusedCopyAsHit(t *testing.T) {
+	t.Chdir(t.TempDir())
+	useStation(t, modeRandom)
+	stub := newS3Stub(t, map[string][]byte{"a.mp3": []byte("audio")})
+	stub.useEnv(t)
+	useSizedListing(t, newFakeB2(t, map[string][]byte{"a.mp3": []byte("audio")}))
+
+	hits, misses := metrics.cacheHits.Load(), metrics.cacheMisses.Load()
+	for range 2 {
+		rec := httptest.NewRecorder()
+		newStreamHandler(t).stream(rec, httptest.NewRequest(http.MethodGet, "/stream?file=a.mp3", nil))
+		if rec.Code != http.StatusOK || rec.Body.String() != "audio" {
+			t.Fatalf("status %d body %q", rec.Code, rec.Body)
+		}
+	}
+	if stub.getCount("a.mp3") != 1 {
+		t.Fatalf("%d GETs, want one download", stub.getCount("a.mp3"))
+	}
+	if metrics.cacheHits.Load()-hits != 1 || metrics.cacheMisses.Load()-misses != 1 {
+		t.Fatal("want a miss for the download and a hit for the reused copy")
+	}
+}
+
+func TestStaleCopyIsCheckedOnce(t *testing.T) {
+	t.Chdir(t.TempDir())
+	useStation(t, modeRandom)
+	stub := newS3Stub(t, map[string][]byte{"a.mp3": []byte("new audio")})
+	stub.useEnv(t)
+	writeCached(t, "a.mp3", 3, time.Hour)
+
+	// Nothing is listed, so only a HeadObject can tell the copy is stale
+	rec := httptest.NewRecorder()
+	newStreamHandler(t).stream(rec, httptest.NewRequest(http.MethodGet, "/stream?file=a.mp3", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "new audio" {
+		t.Fatalf("status %d body %q", rec.Code, rec.Body)
+	}
+	heads := 0
+	stub.mu.Lock()
+	for _, request := range stub.requests {
+		if request == "HEAD /bucket/a.mp3" {
+			heads++
+		}
+	}
+	stub.mu.Unlock()
+	if heads != 1 {
+		t.Fatalf("%d HEADs of the stale copy, want one", heads)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func useCacheShards(t *testing.T, shards ...string) {
+	previous := cacheShards
+	t.Cleanup(func() { cacheShards = previous })
+	cacheShards = shards
+}
+
+func TestKeysSpreadAcrossShards(t *testing.T) {
+	t.Chdir(t.TempDir())
+	useStation(t, modeRandom)
+	useCacheShards(t, "disk1", "disk2", "disk3")
+
+	files := map[string][]byte{}
+	var keys []string
+	for i := range 30 {
+		key := fmt.Sprintf("track%02d.mp3", i)
+		files[key] = []byte(key)
+		keys = append(keys, key)
+	}
+	stub := newS3Stub(t, files)
+	stub.useEnv(t)
+	useListing(t, keys)
+
+	used := map[string]int{}
+	for _, key := range keys {
+		shard := shardFor(key)
+		used[shard]++
+		if shardFor(key) != shard {
+			t.Fatalf("%s moved shards", key)
+		}
+
+		rec := httptest.NewRecorder()
+		newStreamHandler(t).stream(rec, httptest.NewRequest(http.MethodGet, "/stream?file="+key, nil))
+		if rec.Code != http.StatusOK || rec.Body.String() != key {
+			t.Fatalf("%s: status %d body %q", key, rec.Code, rec.Body)
+		}
+		if _, err := os.Stat(filepath.Join(shard, key)); err != nil {
+			t.Fatalf("%s not cached in %s: %v", key, shard, err)
+		}
+	}
+	if len(used) != len(cacheShards) {
+		t.Fatalf("keys landed in %v, want all %d shards used", used, len(cacheShards))
+	}
+
+	// Each cached file is found again through its key
+	for _, key := range keys {
+		rec := httptest.NewRecorder()
+		serveCached(rec, httptest.NewRequest(http.MethodGet, "/stream?file="+key, nil), cachePath(key))
+		if rec.Code != http.StatusOK || rec.Body.String() != key {
+			t.Fatalf("%s: status %d body %q from the cache", key, rec.Code, rec.Body)
+		}
+	}
+
+	cached, _, err := listCachedFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cached) != len(keys) {
+		t.Fatalf("listed %d cached files across shards, want %d", len(cached), len(keys))
+	}
+}
+
+func TestParseCacheShards(t *testing.T) {
+	for value, want := range map[string][]string{
+		"":                   {cacheDir},
+		"/mnt/a":             {"/mnt/a"},
+		" /mnt/a , /mnt/b/ ": {"/mnt/a", "/mnt/b"},
+	} {
+		got, err := parseCacheShards(value)
+		if err != nil || fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%q: got %v (%v), want %v", value, got, err, want)
+		}
+	}
+	for _, value := range []string{"/mnt/a,/mnt/a", "/mnt/a,/mnt/a/b", "/mnt/a/b,/mnt/a"} {
+		if _, err := parseCacheShards(value); err == nil {
+			t.Errorf("%q: expected an overlap error", value)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+type chapter struct {
+	Title string  `json:"title"`
+	Start float64 `json:"start"` // seconds
+	End   float64 `json:"end"`
+}
+
+// Chapter markers from ID3v2 CHAP frames or MP4 Nero (chpl) chapters. Files
+// without chapters report an empty list.
+func readChapters(filePath string) ([]chapter, error) {
+	file, err := openCached(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	magic := make([]byte, 8)
+	if _, err := io.ReadFull(file, magic); err != nil {
+		return []chapter{}, nil
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, []byte("ID3")):
+		frames, err := readID3Frames(bufio.NewReader(file))
+		if err != nil {
+			return nil, err
+		}
+		return id3Chapters(frames), nil
+	case string(magic[4:8]) == "ftyp":
+		info, err := file.Stat()
+		if err != nil {
+			return nil, err
+		}
+		return mp4Chapters(file, info.Size())
+	}
+
+	return []chapter{}, nil
+}
+
+// CHAP: element ID, start/end times in ms, byte offsets, then sub-frames
+// (TIT2 holds the chapter title)
+func id3Chapters(frames []id3Frame) []chapter {
+	chapters := []chapter{}
+	for _, frame := range frames {
+		if frame.id != "CHAP" {
+			continue
+		}
+
+		elementID, rest := splitID3String(0, frame.data)
+		if len(rest) < 16 {
+			continue
+		}
+
+		ch := chapter{
+			Title: string(elementID),
+			Start: float64(binary.BigEndian.Uint32(rest[0:4])) / 1000,
+			End:   float64(binary.BigEndian.Uint32(rest[4:8])) / 1000,
+		}
+		for _, sub := range parseID3Frames(rest[16:], frame.version) {
+			if sub.id == "TIT2" && len(sub.data) > 0 {
+				ch.Title = decodeID3Text(sub.data[0], sub.data[1:])
+			}
+		}
+		chapters = append(chapters, ch)
+	}
+
+	sort.Slice(chapters, func(i, j int) bool { return chapters[i].Start < chapters[j].Start })
+	return chapters
+}
+
+// Find a child box by type within [start, end) of an MP4 file, returning
+// the payload's offset and size
+func findMP4Box(r io.ReaderAt, start, end int64, boxType string) (int64, int64, error) {
+	header := make([]byte, 16)
+	for offset := start; offset+8 <= end; {
+		if _, err := r.ReadAt(header[:8], offset); err != nil {
+			return 0, 0, err
+		}
+
+		size := int64(binary.BigEndian.Uint32(header[:4]))
+		headerSize := int64(8)
+		switch size {
+		case 0:
+			size = end - offset
+		case 1:
+			if _, err := r.ReadAt(header[8:16], offset+8); err != nil {
+				return 0, 0, err
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:16]))
+			headerSize = 16
+		}
+		if size < headerSize || offset+size > end {
+			return 0, 0, errors.New("invalid mp4 box")
+		}
+
+		if string(header[4:8]) == boxType {
+			return offset + headerSize, size - headerSize, nil
+		}
+		offset += size
+	}
+	return 0, 0, errNoTags
+}
+
+func readMP4Box(r io.ReaderAt, start, end int64, path ...string) ([]byte, error) {
+	var size int64
+	var err error
+	for _, boxType := range path {
+		start, size, err = findMP4Box(r, start, end, boxType)
+		if err != nil {
+			return nil, err
+		}
+		end = start + size
+	}
+	if size > maxTagBytes {
+		return nil, errors.New("mp4 box too large")
+	}
+
+	data := make([]byte, size)
+	if _, err := r.ReadAt(data, start); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Duration from the movie header, used to close the final chapter
+func mp4Duration(r io.ReaderAt, size int64) float64 {
+	mvhd, err := readMP4Box(r, 0, size, "moov", "mvhd")
+	if err != nil || len(mvhd) < 20 {
+		return 0
+	}
+
+	if mvhd[0] == 1 {
+		if len(mvhd) < 32 {
+			return 0
+		}
+		timescale := binary.BigEndian.Uint32(mvhd[20:24])
+		duration := binary.BigEndian.Uint64(mvhd[24:32])
+		if timescale == 0 {
+			return 0
+		}
+		return float64(duration) / float64(timescale)
+	}
+
+	timescale := binary.BigEndian.Uint32(mvhd[12:16])
+	duration := binary.BigEndian.Uint32(mvhd[16:20])
+	if timescale == 0 {
+		return 0
+	}
+	return float64(duration) / float64(timescale)
+}
+
+// Nero chapters (moov/udta/chpl): start times in 100ns units and titles
+func mp4Chapters(r io.ReaderAt, size int64) ([]chapter, error) {
+	chpl, err := readMP4Box(r, 0, size, "moov", "udta", "chpl")
+	if errors.Is(err, errNoTags) {
+		return []chapter{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(chpl) < 5 {
+		return []chapter{}, nil
+	}
+
+	data := chpl[4:]
+	if chpl[0] == 1 {
+		if len(data) < 4 {
+			return []chapter{}, nil
+		}
+		data = data[4:]
+	}
+	if len(data) < 1 {
+		return []chapter{}, nil
+	}
+
+	count := int(data[0])
+	data = data[1:]
+
+	chapters := []chapter{}
+	for range count {
+		if len(data) < 9 {
+			break
+		}
+		start := float64(binary.BigEndian.Uint64(data[:8])) / 1e7
+		titleLength := int(data[8])
+		data = data[9:]
+		if titleLength > len(data) {
+			break
+		}
+
+		chapters = append(chapters, chapter{Title: string(data[:titleLength]), Start: start})
+		data = data[titleLength:]
+	}
+
+	// chpl only stores start times, each chapter runs until the next
+	for i := range chapters {
+		if i+1 < len(chapters) {
+			chapters[i].End = chapters[i+1].Start
+		}
+	}
+	if len(chapters) > 0 {
+		last := &chapters[len(chapters)-1]
+		last.End = max(mp4Duration(r, size), last.Start)
+	}
+	return chapters, nil
+}
+
+func vttTimestamp(seconds float64) string {
+	d := time.Duration(seconds * float64(time.Second))
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60, d.Milliseconds()%1000)
+}
+
+// Chapters of a track as JSON, or WebVTT with ?format=vtt
+func chaptersHandler(w http.ResponseWriter, req *http.Request) {
+	fileName := fileParam(req)
+	if fileName == "" {
+		http.Error(w, "Missing file parameter", http.StatusBadRequest)
+		return
+	}
+	if err := validateKey(fileName); err != nil {
+		http.Error(w, "Invalid file parameter", http.StatusBadRequest)
+		return
+	}
+	if !isAllowed(fileName) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	if !cacheEnabled {
+		writeJSON(w, []chapter{})
+		return
+	}
+
+	filePath := cachePath(fileName)
+	if _, err := statCached(filePath); err != nil {
+		b2Client, err := b2ClientFromEnv()
+		if err != nil {
+			http.Error(w, "Failed to create B2 client", http.StatusInternalServerError)
+			log.Printf("Failed to create B2 client: %v", err)
+			return
+		}
+
+		filePath, err = b2Client.downloadFile(fileName)
+		if err != nil {
+			b2Error(w, "Failed to download file", err)
+			log.Printf("Failed to download file: %v", err)
+			return
+		}
+	}
+
+	// Parsed chapters are cached in the metadata sidecar
+	metadata, err := loadMetadata(fileName, filePath)
+	if err != nil {
+		http.Error(w, "Failed to read chapters", http.StatusInternalServerError)
+		log.Printf("Failed to read chapters for %s: %v", fileName, err)
+		return
+	}
+
+	if metadata.Chapters == nil {
+		metadata.Chapters = []chapter{}
+	}
+
+	if req.URL.Query().Get("format") != "vtt" {
+		writeJSON(w, metadata.Chapters)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+	fmt.Fprint(w, "WEBVTT\n")
+	for i, ch := range metadata.Chapters {
+		fmt.Fprintf(w, "\n%d\n%s --> %s\n%s\n", i+1, vttTimestamp(ch.Start), vttTimestamp(ch.End), ch.Title)
+	}
+}
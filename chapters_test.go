@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func chapFrame(elementID string, startMs, endMs uint32, title string) []byte {
+	data := append([]byte(elementID), 0)
+	data = binary.BigEndian.AppendUint32(data, startMs)
+	data = binary.BigEndian.AppendUint32(data, endMs)
+	data = append(data, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)
+	if title != "" {
+		data = append(data, id3Frame4("TIT2", id3Text(title))...)
+	}
+	return id3Frame4("CHAP", data)
+}
+
+func mp4Box(boxType string, payload ...[]byte) []byte {
+	body := []byte{}
+	for _, p := range payload {
+		body = append(body, p...)
+	}
+	box := binary.BigEndian.AppendUint32(nil, uint32(8+len(body)))
+	return append(append(box, boxType...), body...)
+}
+
+// An MP4 with Nero chapters at the given offsets (in seconds) and a movie
+// duration of 300s
+func mp4WithChapters(titles []string, starts []uint64) []byte {
+	chpl := []byte{1, 0, 0, 0, 0, 0, 0, 0, byte(len(titles))}
+	for i, title := range titles {
+		chpl = binary.BigEndian.AppendUint64(chpl, starts[i]*10_000_000)
+		chpl = append(chpl, byte(len(title)))
+		chpl = append(chpl, title...)
+	}
+
+	mvhd := make([]byte, 20)
+	binary.BigEndian.PutUint32(mvhd[12:16], 1000)
+	binary.BigEndian.PutUint32(mvhd[16:20], 300_000)
+
+	ftyp := mp4Box("ftyp", []byte("M4A \x00\x00\x00\x00"))
+	return append(ftyp, mp4Box("moov", mp4Box("mvhd", mvhd), mp4Box("udta", mp4Box("chpl", chpl)))...)
+}
+
+func TestReadChaptersID3(t *testing.T) {
+	data := id3Tag(4,
+		id3Frame4("TIT2", id3Text("Mix")),
+		chapFrame("ch1", 90_500, 200_000, "Second"),
+		chapFrame("ch0", 0, 90_500, "Intro"),
+		chapFrame("ch2", 200_000, 3_600_000, ""),
+	)
+	chapters, err := readChapters(writeTemp(t, "mix.mp3", data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []chapter{
+		{Title: "Intro", Start: 0, End: 90.5},
+		{Title: "Second", Start: 90.5, End: 200},
+		{Title: "ch2", Start: 200, End: 3600},
+	}
+	if !reflect.DeepEqual(chapters, want) {
+		t.Fatalf("got %+v, want %+v", chapters, want)
+	}
+}
+
+func TestReadChaptersMP4(t *testing.T) {
+	data := mp4WithChapters([]string{"Opening", "Main"}, []uint64{0, 120})
+	chapters, err := readChapters(writeTemp(t, "mix.m4a", data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []chapter{{Title: "Opening", Start: 0, End: 120}, {Title: "Main", Start: 120, End: 300}}
+	if !reflect.DeepEqual(chapters, want) {
+		t.Fatalf("got %+v, want %+v", chapters, want)
+	}
+}
+
+func TestReadChaptersWithoutMarkers(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"plain.mp3": id3Tag(4, id3Frame4("TIT2", id3Text("No chapters"))),
+		"plain.m4a": mp4Box("ftyp", []byte("M4A \x00\x00\x00\x00")),
+		"short.ogg": []byte("OggS"),
+	} {
+		chapters, err := readChapters(writeTemp(t, name, data))
+		if err != nil || chapters == nil || len(chapters) != 0 {
+			t.Errorf("%s: got %v (%v), want an empty list", name, chapters, err)
+		}
+	}
+}
+
+func TestChaptersHandler(t *testing.T) {
+	t.Chdir(t.TempDir())
+	stub := newS3Stub(t, map[string][]byte{
+		"mix.mp3": id3Tag(4, chapFrame("a", 0, 61_250, "Intro"), chapFrame("b", 61_250, 3_723_004, "Outro")),
+	})
+	stub.useEnv(t)
+
+	rec := httptest.NewRecorder()
+	chaptersHandler(rec, httptest.NewRequest(http.MethodGet, "/chapters?file=mix.mp3", nil))
+	var chapters []chapter
+	if err := json.NewDecoder(rec.Body).Decode(&chapters); err != nil {
+		t.Fatalf("status %d: %v", rec.Code, err)
+	}
+	if len(chapters) != 2 || chapters[1].Title != "Outro" {
+		t.Fatalf("got %+v", chapters)
+	}
+
+	rec = httptest.NewRecorder()
+	chaptersHandler(rec, httptest.NewRequest(http.MethodGet, "/chapters?file=mix.mp3&format=vtt", nil))
+	if got := rec.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/vtt") {
+		t.Fatalf("Content-Type %s, want text/vtt", got)
+	}
+	want := "WEBVTT\n\n1\n00:00:00.000 --> 00:01:01.250\nIntro\n\n2\n00:01:01.250 --> 01:02:03.004\nOutro\n"
+	if rec.Body.String() != want {
+		t.Fatalf("got %q, want %q", rec.Body, want)
+	}
+
+	// The second request is answered from the cache, not a new download
+	if gets := stub.getCount("mix.mp3"); gets != 1 {
+		t.Fatalf("%d downloads, want the parsed chapters cached", gets)
+	}
+}
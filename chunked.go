@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultFlushInterval     = 200 * time.Millisecond
+	defaultStreamBufferBytes = 32 * 1024
+)
+
+// How often streamed audio is flushed to the client, and how much is
+// buffered between flushes, set from STREAM_FLUSH_INTERVAL and
+// STREAM_BUFFER_BYTES. A zero interval only flushes when the buffer fills.
+var (
+	streamFlushInterval = defaultFlushInterval
+	streamBufferBytes   = defaultStreamBufferBytes
+)
+
+// Writes a response of unknown length (transcoder output, a continuous radio
+// feed) with chunked transfer encoding, flushing periodically so the client
+// receives audio steadily.
+type chunkedWriter struct {
+	w          http.ResponseWriter
+	out        io.Writer // w, or a writer interleaving metadata into it
+	ctx        context.Context
+	controller *http.ResponseController
+	lastFlush  time.Time
+	written    int64
+}
+
+// Ask proxies not to recompress audio. A gzip layer added in front changes
+// the byte offsets, so Range and Content-Range no longer line up with the
+// file. No handler here compresses responses itself.
+func noTransform(header http.Header) {
+	if existing := header.Get("Cache-Control"); existing != "" {
+		header.Set("Cache-Control", existing+", no-transform")
+		return
+	}
+	header.Set("Cache-Control", "no-transform")
+}
+
+func newChunkedWriter(w http.ResponseWriter, req *http.Request, contentType string) *chunkedWriter {
+	// Without a Content-Length the server falls back to chunked encoding
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", contentType)
+	noTransform(w.Header())
+	w.WriteHeader(http.StatusOK)
+
+	return &chunkedWriter{
+		w:          w,
+		out:        w,
+		ctx:        req.Context(),
+		controller: http.NewResponseController(w),
+		lastFlush:  time.Now(),
+	}
+}
+
+func (c *chunkedWriter) flush() error {
+	c.lastFlush = time.Now()
+	if err := c.controller.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	return nil
+}
+
+func (c *chunkedWriter) copyFrom(src io.Reader) error {
+	buf := make([]byte, streamBufferBytes)
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			log.Printf("Client disconnected after %d bytes", c.written)
+			return c.ctx.Err()
+		default:
+		}
+
+		n, readErr := src.Read(buf)
+		if n > 0 {
+			if _, err := c.out.Write(buf[:n]); err != nil {
+				return err
+			}
+			c.written += int64(n)
+
+			if streamFlushInterval > 0 && time.Since(c.lastFlush) >= streamFlushInterval {
+				if err := c.flush(); err != nil {
+					return err
+				}
+			}
+		}
+
+		if readErr == io.EOF {
+			return c.flush()
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+}
+
+// Buffers a response proxied from B2 and flushes it on a steady interval, so
+// uneven reads from B2 reach the client as an even flow rather than bursts
+type flushingWriter struct {
+	buf        *bufio.Writer
+	controller *http.ResponseController
+	interval   time.Duration
+	lastFlush  time.Time
+}
+
+// Range responses are usually seeks the client wants answered in one piece,
+// so they only get buffering and skip the periodic flush
+func newFlushingWriter(w http.ResponseWriter, periodic bool) *flushingWriter {
+	f := &flushingWriter{
+		buf:        bufio.NewWriterSize(w, streamBufferBytes),
+		controller: http.NewResponseController(w),
+		lastFlush:  time.Now(),
+	}
+	if periodic {
+		f.interval = streamFlushInterval
+	}
+	return f
+}
+
+func (f *flushingWriter) Write(p []byte) (int, error) {
+	n, err := f.buf.Write(p)
+	if err == nil && f.interval > 0 && time.Since(f.lastFlush) >= f.interval {
+		err = f.Flush()
+	}
+	return n, err
+}
+
+func (f *flushingWriter) Flush() error {
+	f.lastFlush = time.Now()
+	if err := f.buf.Flush(); err != nil {
+		return err
+	}
+	if err := f.controller.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	return nil
+}
+
+// Stream a single source of unknown length. Returns the number of bytes written.
+func streamChunked(w http.ResponseWriter, req *http.Request, src io.Reader, contentType string) (int64, error) {
+	cw := newChunkedWriter(w, req, contentType)
+	err := cw.copyFrom(src)
+	return cw.written, err
+}
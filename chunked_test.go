@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// A reader that hands out its data a little at a time, like a transcoder
+type trickleReader struct {
+	data []byte
+	step int
+}
+
+func (r *trickleReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	n := min(r.step, len(p), len(r.data))
+	copy(p, r.data[:n])
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestStreamChunked(t *testing.T) {
+	payload := bytes.Repeat([]byte("audio"), 20000)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		written, err := streamChunked(w, req, &trickleReader{data: payload, step: 4096}, "audio/mpeg")
+		if err != nil {
+			t.Errorf("streamChunked: %v", err)
+		}
+		if written != int64(len(payload)) {
+			t.Errorf("wrote %d bytes, want %d", written, len(payload))
+		}
+	}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if len(resp.TransferEncoding) != 1 || resp.TransferEncoding[0] != "chunked" {
+		t.Fatalf("Transfer-Encoding %v, want chunked", resp.TransferEncoding)
+	}
+	if resp.ContentLength != -1 {
+		t.Fatalf("Content-Length %d, want none", resp.ContentLength)
+	}
+	if got := resp.Header.Get("Content-Type"); got != "audio/mpeg" {
+		t.Fatalf("Content-Type %s, want audio/mpeg", got)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, payload) {
+		t.Fatalf("got %d bytes, want the %d streamed", len(body), len(payload))
+	}
+}
+
+// Get target from a live server running handler, which unlike a recorder
+// reports how the response was framed
+func getLive(t *testing.T, handler http.HandlerFunc, target string) *http.Response {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	resp, err := http.Get(srv.URL + target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func isChunked(resp *http.Response) bool {
+	return len(resp.TransferEncoding) == 1 && resp.TransferEncoding[0] == "chunked" && resp.ContentLength == -1
+}
+
+func TestProxyStreamsUnsizedBodyChunked(t *testing.T) {
+	disableCache(t)
+	useStation(t, modeRandom)
+	stub := newS3Stub(t, map[string][]byte{"a.mp3": bytes.Repeat([]byte("audio"), 1000)})
+	stub.unsized = map[string]bool{"a.mp3": true}
+	stub.useEnv(t)
+	useListing(t, []string{"a.mp3"})
+
+	resp := getLive(t, newStreamHandler(t).stream, "/stream?file=a.mp3")
+	if resp.StatusCode != http.StatusOK || !isChunked(resp) {
+		t.Fatalf("status %d Transfer-Encoding %v Content-Length %d, want a chunked response", resp.StatusCode, resp.TransferEncoding, resp.ContentLength)
+	}
+	if body, _ := io.ReadAll(resp.Body); !bytes.Equal(body, stub.objects["a.mp3"]) {
+		t.Fatalf("got %d bytes, want the whole object", len(body))
+	}
+}
+
+func TestEveryStreamModeDeliversUnsizedBodies(t *testing.T) {
+	for _, mode := range streamModes {
+		t.Run(mode, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			useStreamMode(t, mode)
+			useStation(t, modeRandom)
+			data := bytes.Repeat([]byte("audio"), 20000)
+			stub := newS3Stub(t, map[string][]byte{"a.mp3": data})
+			stub.unsized = map[string]bool{"a.mp3": true}
+			stub.useEnv(t)
+			useSizedListing(t, newFakeB2(t, stub.objects))
+
+			// Repeated, so a copy cached from the first is served too
+			for range 2 {
+				resp := getLive(t, newStreamHandler(t).stream, "/stream?file=a.mp3")
+				body, _ := io.ReadAll(resp.Body)
+				if resp.StatusCode != http.StatusOK || !bytes.Equal(body, data) {
+					t.Fatalf("status %d with %d bytes, want the whole object", resp.StatusCode, len(body))
+				}
+				if !isChunked(resp) && resp.ContentLength != int64(len(data)) {
+					t.Fatalf("Content-Length %d, want the object's or a chunked response", resp.ContentLength)
+				}
+			}
+		})
+	}
+}
+
+func TestCrossfadedRadioIsChunked(t *testing.T) {
+	useCrossfade(t, time.Second)
+	useRadioBucket(t)
+	t.Cleanup(waitForDownloads)
+
+	resp := getLive(t, radio, "/radio")
+	if resp.StatusCode != http.StatusOK || !isChunked(resp) {
+		t.Fatalf("status %d Transfer-Encoding %v Content-Length %d, want a chunked response", resp.StatusCode, resp.TransferEncoding, resp.ContentLength)
+	}
+	if resp.Header.Get("Content-Type") != crossfadeContentType {
+		t.Fatalf("Content-Type %s, want %s", resp.Header.Get("Content-Type"), crossfadeContentType)
+	}
+	if _, err := io.ReadFull(resp.Body, make([]byte, 16)); err != nil {
+		t.Fatalf("reading the crossfaded stream: %v", err)
+	}
+}
+
+// A ResponseWriter that discards the body and counts what reaches it
+type flushCountingWriter struct {
+	header  http.Header
+	writes  int
+	flushes int
+}
+
+func (c *flushCountingWriter) Header() http.Header {
+	if c.header == nil {
+		c.header = http.Header{}
+	}
+	return c.header
+}
+
+func (c *flushCountingWriter) Write(p []byte) (int, error) {
+	c.writes++
+	return len(p), nil
+}
+
+func (c *flushCountingWriter) WriteHeader(int) {}
+
+func (c *flushCountingWriter) Flush() { c.flushes++ }
+
+func TestFlushingWriterSkipsPeriodicFlushForRanges(t *testing.T) {
+	previous := streamFlushInterval
+	t.Cleanup(func() { streamFlushInterval = previous })
+	streamFlushInterval = time.Nanosecond
+
+	for _, periodic := range []bool{true, false} {
+		w := &flushCountingWriter{}
+		fw := newFlushingWriter(w, periodic)
+		if _, err := io.Copy(fw, &trickleReader{data: make([]byte, 10000), step: 100}); err != nil {
+			t.Fatal(err)
+		}
+		if periodic && w.flushes == 0 {
+			t.Fatal("a full response should be flushed on the interval")
+		}
+		if !periodic && w.flushes != 0 {
+			t.Fatalf("a range response was flushed %d times before its end", w.flushes)
+		}
+
+		if err := fw.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if w.writes == 0 {
+			t.Fatal("nothing reached the client after the final flush")
+		}
+	}
+}
+
+// Bytes arriving from B2 in small uneven reads, written straight through or
+// buffered and flushed on the interval
+func BenchmarkProxyDelivery(b *testing.B) {
+	payload := make([]byte, 4<<20)
+
+	b.Run("unbuffered", func(b *testing.B) {
+		b.SetBytes(int64(len(payload)))
+		var writes int
+		for b.Loop() {
+			w := &flushCountingWriter{}
+			io.Copy(w, &trickleReader{data: payload, step: 1400})
+			writes += w.writes
+		}
+		b.ReportMetric(float64(writes)/float64(b.N), "writes/op")
+	})
+
+	b.Run("buffered", func(b *testing.B) {
+		b.SetBytes(int64(len(payload)))
+		var writes, flushes int
+		for b.Loop() {
+			w := &flushCountingWriter{}
+			fw := newFlushingWriter(w, true)
+			io.CopyBuffer(fw, &trickleReader{data: payload, step: 1400}, make([]byte, streamBufferBytes))
+			fw.Flush()
+			writes += w.writes
+			flushes += w.flushes
+		}
+		b.ReportMetric(float64(writes)/float64(b.N), "writes/op")
+		b.ReportMetric(float64(flushes)/float64(b.N), "flushes/op")
+	})
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Suffix of cache entries stored gzipped. The entry is still addressed by
+// its plain path; openCached and statCached look for either form.
+const compressedSuffix = ".gz"
+
+// Whether uncompressed formats are gzipped in the disk cache, set from
+// CACHE_COMPRESS_WAV. Formats that are already compressed are stored as is.
+var compressWAV bool
+
+var uncompressedFormats = map[string]bool{
+	".wav":  true,
+	".wave": true,
+	".aif":  true,
+	".aiff": true,
+}
+
+func shouldCompress(fileName string) bool {
+	return compressWAV && uncompressedFormats[strings.ToLower(filepath.Ext(fileName))]
+}
+
+// Plain cache path for a file found on disk, so a gzipped entry matches the
+// path it's served and pinned under
+func logicalPath(path string) string {
+	if plain, ok := strings.CutSuffix(path, compressedSuffix); ok && uncompressedFormats[strings.ToLower(filepath.Ext(plain))] {
+		return plain
+	}
+	return path
+}
+
+// Write body to the cache entry at path, gzipped when the format wants it,
+// removing any copy in the other form. The entry is written under a
+// temporary name and moved into place, reporting progress to dl. Returns
+// the bytes read from body.
+func writeCacheEntry(path string, body io.Reader, size int64, dl *download) (int64, error) {
+	target, stale := path, path+compressedSuffix
+	compress := shouldCompress(path)
+	if compress {
+		target, stale = stale, target
+	}
+
+	// Dot names are skipped by listCachedFiles, so half-written files are
+	// never evicted or purged
+	file, err := os.CreateTemp(filepath.Dir(target), ".download-*")
+	if err != nil {
+		return 0, fmt.Errorf("failed to create file: %w", err)
+	}
+	tmpPath := file.Name()
+	defer os.Remove(tmpPath)
+
+	var written int64
+	if compress {
+		dl.begin("", size)
+		gz := gzip.NewWriter(file)
+		written, err = io.Copy(progressWriter{w: gz, dl: dl}, body)
+		if closeErr := gz.Close(); err == nil {
+			err = closeErr
+		}
+	} else {
+		dl.begin(tmpPath, size)
+		written, err = io.Copy(progressWriter{w: file, dl: dl}, body)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return written, fmt.Errorf("failed to copy file content: %w", err)
+	}
+	if err := os.Rename(tmpPath, target); err != nil {
+		return written, fmt.Errorf("failed to move file into place: %w", err)
+	}
+
+	if err := os.Remove(stale); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove stale cache entry %s: %v", stale, err)
+	}
+	return written, nil
+}
+
+// A cache entry opened for reading, decompressed on the fly when needed
+type cacheReader interface {
+	io.ReadSeekCloser
+	io.ReaderAt
+	Stat() (os.FileInfo, error)
+}
+
+// Open the cache entry at path, plain or gzipped
+func openCached(path string) (cacheReader, error) {
+	file, err := os.Open(path)
+	if err == nil {
+		return file, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	file, gzErr := os.Open(path + compressedSuffix)
+	if gzErr != nil {
+		// Report the plain path, which is what callers asked for
+		return nil, err
+	}
+	info, err := gzipInfo(file, path)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &gzipEntry{file: file, info: info}, nil
+}
+
+// Stat the cache entry at path, reporting a gzipped entry's plain size
+func statCached(path string) (os.FileInfo, error) {
+	info, err := os.Stat(path)
+	if err == nil || !os.IsNotExist(err) {
+		return info, err
+	}
+
+	file, gzErr := os.Open(path + compressedSuffix)
+	if gzErr != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return gzipInfo(file, path)
+}
+
+// Stat info for a gzipped entry, sized from the trailer's ISIZE field. That's
+// the plain size modulo 4 GiB, which is as large as WAV files get.
+func gzipInfo(file *os.File, path string) (os.FileInfo, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < 18 {
+		return nil, fmt.Errorf("compressed cache entry %s is truncated", file.Name())
+	}
+
+	trailer := make([]byte, 4)
+	if _, err := file.ReadAt(trailer, info.Size()-4); err != nil {
+		return nil, fmt.Errorf("failed to read compressed cache entry: %w", err)
+	}
+	return plainInfo{FileInfo: info, name: filepath.Base(path), size: int64(binary.LittleEndian.Uint32(trailer))}, nil
+}
+
+type plainInfo struct {
+	os.FileInfo
+	name string
+	size int64
+}
+
+func (i plainInfo) Name() string { return i.name }
+func (i plainInfo) Size() int64  { return i.size }
+
+// Seekable reader over a gzipped entry. Seeks are lazy: reads catch up by
+// skipping forward, or start over from the top when going back.
+type gzipEntry struct {
+	file  *os.File
+	info  os.FileInfo
+	gz    *gzip.Reader
+	pos   int64 // offset the caller seeked to
+	gzPos int64 // offset gz has decompressed up to
+}
+
+func (e *gzipEntry) sync() error {
+	if e.gz == nil || e.pos < e.gzPos {
+		if _, err := e.file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if e.gz == nil {
+			gz, err := gzip.NewReader(e.file)
+			if err != nil {
+				return err
+			}
+			e.gz = gz
+		} else if err := e.gz.Reset(e.file); err != nil {
+			return err
+		}
+		e.gzPos = 0
+	}
+
+	skipped, err := io.CopyN(io.Discard, e.gz, e.pos-e.gzPos)
+	e.gzPos += skipped
+	return err
+}
+
+func (e *gzipEntry) Read(p []byte) (int, error) {
+	if e.pos >= e.info.Size() {
+		return 0, io.EOF
+	}
+	if err := e.sync(); err != nil {
+		return 0, err
+	}
+
+	n, err := e.gz.Read(p)
+	e.pos += int64(n)
+	e.gzPos += int64(n)
+	return n, err
+}
+
+func (e *gzipEntry) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += e.pos
+	case io.SeekEnd:
+		offset += e.info.Size()
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("seek %s: negative position", e.info.Name())
+	}
+	e.pos = offset
+	return offset, nil
+}
+
+// ReadAt for header and trailer probes. Unlike os.File it isn't safe to
+// call concurrently, but it does leave the read offset where it was.
+func (e *gzipEntry) ReadAt(p []byte, off int64) (int, error) {
+	saved := e.pos
+	defer func() { e.pos = saved }()
+
+	e.pos = off
+	n, err := io.ReadFull(e, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (e *gzipEntry) Stat() (os.FileInfo, error) {
+	return e.info, nil
+}
+
+func (e *gzipEntry) Close() error {
+	if e.gz != nil {
+		e.gz.Close()
+	}
+	return e.file.Close()
+}
+
+// Serve the cache entry at path with range support, like http.ServeFile
+func serveCached(w http.ResponseWriter, req *http.Request, path string) {
+	if _, err := os.Stat(path); err == nil {
+		http.ServeFile(w, req, path)
+		return
+	}
+
+	entry, err := openCached(path)
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	defer entry.Close()
+
+	info, _ := entry.Stat()
+	http.ServeContent(w, req, info.Name(), info.ModTime(), entry)
+}
+
+// Path ffmpeg can read the entry at path from: the entry itself, or a
+// decompressed temporary copy that cleanup deletes
+func ffmpegInput(path string) (string, func(), error) {
+	if _, err := os.Stat(path); err == nil {
+		return path, func() {}, nil
+	}
+
+	entry, err := openCached(path)
+	if err != nil {
+		return "", nil, err
+	}
+	defer entry.Close()
+
+	tmp, err := os.CreateTemp("", "radio-*"+filepath.Ext(path))
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to decompress cache entry: %w", err)
+	}
+	cleanup := func() { os.Remove(tmp.Name()) }
+
+	_, err = io.Copy(tmp, entry)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("failed to decompress cache entry: %w", err)
+	}
+	return tmp.Name(), cleanup, nil
+}
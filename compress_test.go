@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func useCompression(t *testing.T) {
+	previous := compressWAV
+	t.Cleanup(func() { compressWAV = previous })
+	compressWAV = true
+}
+
+// A WAV header followed by a slowly rising sample ramp, so it compresses
+func testWAV(samples int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("RIFF\x00\x00\x00\x00WAVEfmt ")
+	for i := range samples {
+		buf.WriteByte(byte(i / 64))
+		buf.WriteByte(0)
+	}
+	return buf.Bytes()
+}
+
+func TestWAVRoundTripsThroughCompressedCache(t *testing.T) {
+	t.Chdir(t.TempDir())
+	useCompression(t)
+	useStation(t, modeRandom)
+	wav := testWAV(64 << 10)
+	stub := newS3Stub(t, map[string][]byte{"live/set.wav": wav, "live/set.mp3": []byte("mp3 audio")})
+	stub.useEnv(t)
+	useListing(t, []string{"live/set.wav", "live/set.mp3"})
+
+	rec := httptest.NewRecorder()
+	newStreamHandler(t).stream(rec, httptest.NewRequest(http.MethodGet, "/stream?file=live/set.wav", nil))
+	if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), wav) {
+		t.Fatalf("status %d with %d bytes, want the original %d", rec.Code, rec.Body.Len(), len(wav))
+	}
+
+	plain := filepath.Join(cacheDir, "live", "set.wav")
+	if _, err := os.Stat(plain); !os.IsNotExist(err) {
+		t.Fatal("the WAV was cached uncompressed")
+	}
+	info, err := os.Stat(plain + compressedSuffix)
+	if err != nil {
+		t.Fatalf("no compressed entry: %v", err)
+	}
+	if info.Size() >= int64(len(wav)) {
+		t.Fatalf("compressed entry is %d bytes for %d of audio", info.Size(), len(wav))
+	}
+
+	// Ranges are cut from the decompressed audio
+	req := httptest.NewRequest(http.MethodGet, "/stream?file=live/set.wav", nil)
+	req.Header.Set("Range", "bytes=40000-40099")
+	rec = httptest.NewRecorder()
+	newStreamHandler(t).stream(rec, req)
+	if rec.Code != http.StatusPartialContent || !bytes.Equal(rec.Body.Bytes(), wav[40000:40100]) {
+		t.Fatalf("range: status %d body %q", rec.Code, rec.Body)
+	}
+
+	// Compressed formats are stored as they are
+	rec = httptest.NewRecorder()
+	newStreamHandler(t).stream(rec, httptest.NewRequest(http.MethodGet, "/stream?file=live/set.mp3", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "mp3 audio" {
+		t.Fatalf("mp3: status %d body %q", rec.Code, rec.Body)
+	}
+	if _, err := os.Stat(filepath.Join(cacheDir, "live", "set.mp3")); err != nil {
+		t.Fatalf("the mp3 wasn't cached as is: %v", err)
+	}
+}
+
+func TestGzipEntrySeeksBothWays(t *testing.T) {
+	t.Chdir(t.TempDir())
+	useCompression(t)
+	wav := testWAV(4096)
+	path := filepath.Join(t.TempDir(), "a.wav")
+	if _, err := writeCacheEntry(path, bytes.NewReader(wav), int64(len(wav)), testDownload(path)); err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := openCached(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer entry.Close()
+	if info, _ := entry.Stat(); info.Size() != int64(len(wav)) || info.Name() != "a.wav" {
+		t.Fatalf("stat reports %s with %d bytes", info.Name(), info.Size())
+	}
+
+	buf := make([]byte, 16)
+	for _, off := range []int64{5000, 100, 8000, 0} {
+		if _, err := entry.Seek(off, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(entry, buf); err != nil || !bytes.Equal(buf, wav[off:off+16]) {
+			t.Fatalf("at %d: read %q (%v)", off, buf, err)
+		}
+	}
+
+	// Writing the file again uncompressed replaces the gzipped entry
+	compressWAV = false
+	if _, err := writeCacheEntry(path, bytes.NewReader(wav), int64(len(wav)), testDownload(path)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + compressedSuffix); !os.IsNotExist(err) {
+		t.Fatal("the stale compressed entry was kept")
+	}
+}
+
+// A download tracked on its own, outside the shared tracker
+func testDownload(key string) *download {
+	dl, _ := (&downloadTracker{active: map[string]*download{}}).start(key)
+	return dl
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+)
+
+// Concurrent long-lived streams per client IP, so one client can't take all
+// the bandwidth and download slots by opening many connections
+type ipStreamLimiter struct {
+	mu     sync.Mutex
+	limit  int // 0 means unlimited
+	active map[string]int
+}
+
+var streamsPerIP = newIPStreamLimiter(0)
+
+func newIPStreamLimiter(limit int) *ipStreamLimiter {
+	return &ipStreamLimiter{limit: limit, active: make(map[string]int)}
+}
+
+// Claim a stream slot for ip, returning the func that frees it, or false
+// when the client already has the maximum open
+func (l *ipStreamLimiter) acquire(ip string) (func(), bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.limit > 0 && l.active[ip] >= l.limit {
+		return nil, false
+	}
+	l.active[ip]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if l.active[ip]--; l.active[ip] <= 0 {
+				delete(l.active, ip)
+			}
+		})
+	}, true
+}
+
+func limitStreamsPerIP(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ip := clientIP(req)
+		release, ok := streamsPerIP.acquire(ip)
+		if !ok {
+			http.Error(w, "Too many concurrent streams from this address", http.StatusTooManyRequests)
+			log.Printf("Rejected %s from %s: %d streams already open", req.URL.Path, ip, streamsPerIP.limit)
+			return
+		}
+		defer release()
+
+		next(w, req)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func useStreamsPerIP(t *testing.T, limit int) {
+	previous := streamsPerIP
+	t.Cleanup(func() { streamsPerIP = previous })
+	streamsPerIP = newIPStreamLimiter(limit)
+}
+
+func TestStreamsPerIPLimit(t *testing.T) {
+	useStreamsPerIP(t, 2)
+
+	// Streams stay open until the test hangs up
+	started := make(chan struct{})
+	hangUp := make(chan struct{})
+	handler := limitStreamsPerIP(func(w http.ResponseWriter, req *http.Request) {
+		started <- struct{}{}
+		<-hangUp
+	})
+	request := func(ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/radio", nil)
+		req.RemoteAddr = ip + ":4000"
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			request("192.0.2.1")
+		}()
+		<-started
+	}
+
+	if rec := request("192.0.2.1"); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("third stream: status %d, want 429", rec.Code)
+	}
+
+	// Other addresses have their own allowance
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		request("192.0.2.2")
+	}()
+	<-started
+
+	close(hangUp)
+	wg.Wait()
+	if len(streamsPerIP.active) != 0 {
+		t.Fatalf("slots still held after every stream ended: %v", streamsPerIP.active)
+	}
+
+	// A disconnect frees the slot for the next connection
+	hangUp = make(chan struct{})
+	close(hangUp)
+	go func() { <-started }()
+	if rec := request("192.0.2.1"); rec.Code == http.StatusTooManyRequests {
+		t.Fatal("a new stream was rejected after the others disconnected")
+	}
+}
+
+func TestStreamsPerIPUnlimited(t *testing.T) {
+	limiter := newIPStreamLimiter(0)
+	for range 100 {
+		if _, ok := limiter.acquire("192.0.2.1"); !ok {
+			t.Fatal("a zero limit shouldn't reject streams")
+		}
+	}
+}
+
+func TestStreamSlotReleasedOnce(t *testing.T) {
+	limiter := newIPStreamLimiter(1)
+	release, _ := limiter.acquire("192.0.2.1")
+
+	release()
+	release()
+	if _, ok := limiter.acquire("192.0.2.1"); !ok {
+		t.Fatal("slot not freed")
+	}
+	if _, ok := limiter.acquire("192.0.2.1"); ok {
+		t.Fatal("releasing twice freed a second slot")
+	}
+}
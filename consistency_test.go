@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestGetObjectRetriesListedKey(t *testing.T) {
+	t.Chdir(t.TempDir())
+	stub := newS3Stub(t, map[string][]byte{"fresh.mp3": []byte("just uploaded")})
+	stub.useEnv(t)
+	stub.notReadable["fresh.mp3"] = 1
+	useListing(t, []string{"fresh.mp3"})
+
+	client, err := b2ClientFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, err := client.downloadFile("fresh.mp3")
+	if err != nil {
+		t.Fatalf("download failed after a single 404: %v", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "just uploaded" {
+		t.Fatalf("downloaded %q", data)
+	}
+
+	var getAttempts int
+	for _, request := range stub.requests {
+		if request == "GET /bucket/fresh.mp3" {
+			getAttempts++
+		}
+	}
+	if getAttempts != 2 {
+		t.Fatalf("%d GETs, want one 404 and one retry", getAttempts)
+	}
+}
+
+func TestGetObjectDoesNotRetryUnlistedKey(t *testing.T) {
+	t.Chdir(t.TempDir())
+	stub := newS3Stub(t, map[string][]byte{})
+	stub.useEnv(t)
+	useListing(t, []string{"other.mp3"})
+
+	client, err := b2ClientFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.downloadFile("gone.mp3"); !isNotFound(err) {
+		t.Fatalf("got %v, want a not-found error", err)
+	}
+	if len(stub.requests) != 1 {
+		t.Fatalf("requests %q, want a single GET for a key missing from the listing", stub.requests)
+	}
+}
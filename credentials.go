@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/joho/godotenv"
+)
+
+const defaultMaxReauths = 3
+
+// Times in a row the shared client may be rebuilt after B2 rejects its
+// credentials, set from B2_MAX_REAUTHS. A call that succeeds resets the count.
+var maxReauths = defaultMaxReauths
+
+// The B2 client every request shares, built on first use. When B2 starts
+// rejecting its credentials, as after the application key is rotated, the
+// first call to notice re-reads them and rebuilds it while the others wait,
+// then every call is retried once on the new client.
+type reauthClient struct {
+	mu          sync.Mutex
+	connect     func() (B2, error)
+	client      B2
+	credentials string
+	generation  int
+	reauths     int
+}
+
+var sharedB2 = &reauthClient{connect: newB2ClientFromEnv}
+
+func b2ClientFromEnv() (B2, error) {
+	if _, _, err := sharedB2.current(); err != nil {
+		return nil, err
+	}
+	return sharedB2, nil
+}
+
+func currentCredentials() string {
+	return os.Getenv("KEY_ID") + ":" + os.Getenv("APPLICATION_KEY")
+}
+
+// Pick up rotated credentials from the config file. The process environment
+// can't change under a running process, so the file is where new ones land.
+func reloadCredentials() {
+	values, err := godotenv.Read(configFile)
+	if err != nil {
+		log.Printf("Failed to re-read credentials: %v", err)
+		return
+	}
+	for _, name := range []string{"KEY_ID", "APPLICATION_KEY"} {
+		if value, ok := values[name]; ok {
+			os.Setenv(name, value)
+		}
+	}
+}
+
+// The client, building it if this is the first use. A failed build isn't
+// kept, so the next call tries again.
+func (r *reauthClient) current() (B2, int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.client == nil {
+		credentials := currentCredentials()
+		client, err := r.connect()
+		if err != nil {
+			return nil, 0, err
+		}
+		r.client, r.credentials = client, credentials
+	}
+	return r.client, r.generation, nil
+}
+
+// Rebuild the client that failed at generation from freshly read
+// credentials, reporting whether there is a new client to retry on. A call
+// that lost the race finds the client already rebuilt and just retries.
+func (r *reauthClient) reauth(generation int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if generation != r.generation {
+		return true
+	}
+	if r.reauths >= maxReauths {
+		return false
+	}
+
+	reloadCredentials()
+	credentials := currentCredentials()
+	if credentials == r.credentials {
+		// Nothing was rotated, so B2 means it: the key lacks access
+		return false
+	}
+
+	r.reauths++
+	client, err := r.connect()
+	if err != nil {
+		log.Printf("Failed to rebuild B2 client with new credentials: %v", err)
+		return false
+	}
+	log.Printf("B2 rejected the credentials, rebuilt the client with new ones (attempt %d of %d)", r.reauths, maxReauths)
+	r.client, r.credentials = client, credentials
+	r.generation++
+	return true
+}
+
+func (r *reauthClient) succeeded() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reauths = 0
+}
+
+func withReauth[T any](r *reauthClient, call func(B2) (T, error)) (T, error) {
+	var result T
+	client, generation, err := r.current()
+	if err != nil {
+		return result, err
+	}
+
+	result, err = call(client)
+	if errors.Is(err, errUnauthorized) && r.reauth(generation) {
+		if client, _, err = r.current(); err != nil {
+			return result, err
+		}
+		result, err = call(client)
+	}
+	if err == nil {
+		r.succeeded()
+	}
+	return result, err
+}
+
+func (r *reauthClient) listFiles() ([]string, error) {
+	return withReauth(r, func(c B2) ([]string, error) { return c.listFiles() })
+}
+
+func (r *reauthClient) listObjects() ([]objectInfo, error) {
+	return withReauth(r, func(c B2) ([]objectInfo, error) { return c.listObjects() })
+}
+
+func (r *reauthClient) listPrefix(prefix, delimiter string) ([]objectInfo, []string, error) {
+	type result struct {
+		objects  []objectInfo
+		prefixes []string
+	}
+	res, err := withReauth(r, func(c B2) (result, error) {
+		objects, prefixes, err := c.listPrefix(prefix, delimiter)
+		return result{objects, prefixes}, err
+	})
+	return res.objects, res.prefixes, err
+}
+
+func (r *reauthClient) headFile(fileName string) (*objectHead, error) {
+	return withReauth(r, func(c B2) (*objectHead, error) { return c.headFile(fileName) })
+}
+
+func (r *reauthClient) headBucket() error {
+	_, err := withReauth(r, func(c B2) (struct{}, error) { return struct{}{}, c.headBucket() })
+	return err
+}
+
+func (r *reauthClient) probeListing() error {
+	_, err := withReauth(r, func(c B2) (struct{}, error) { return struct{}{}, c.probeListing() })
+	return err
+}
+
+func (r *reauthClient) selectRandomFile(fileNames []string) (string, error) {
+	return withReauth(r, func(c B2) (string, error) { return c.selectRandomFile(fileNames) })
+}
+
+func (r *reauthClient) downloadFile(fileName string) (string, error) {
+	return withReauth(r, func(c B2) (string, error) { return c.downloadFile(fileName) })
+}
+
+func (r *reauthClient) downloadVersion(fileName, versionID string) (string, error) {
+	return withReauth(r, func(c B2) (string, error) { return c.downloadVersion(fileName, versionID) })
+}
+
+func (r *reauthClient) fetchVersion(fileName, versionID string) (string, error) {
+	return withReauth(r, func(c B2) (string, error) { return c.fetchVersion(fileName, versionID) })
+}
+
+func (r *reauthClient) fetchRange(fileName, rangeHeader string) (*rangeResult, error) {
+	return withReauth(r, func(c B2) (*rangeResult, error) { return c.fetchRange(fileName, rangeHeader) })
+}
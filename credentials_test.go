@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Point the shared client at a stub that only accepts the key ID accepted,
+// answering any other with 403, as B2 does once a key is rotated out
+func useRotatingStub(t *testing.T, accepted string, files map[string][]byte) *s3Stub {
+	stub := newS3Stub(t, files)
+	stub.useEnv(t)
+	rotating := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !strings.Contains(req.Header.Get("Authorization"), "Credential="+accepted+"/") {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `<Error><Code>InvalidAccessKeyId</Code><Message>Invalid key</Message></Error>`)
+			return
+		}
+		stub.serve(w, req)
+	}))
+	t.Cleanup(rotating.Close)
+	t.Setenv("ENDPOINT", rotating.URL)
+	return stub
+}
+
+func TestRotatedCredentialsRebuildClientOnce(t *testing.T) {
+	useRotatingStub(t, "rotated", map[string][]byte{"a.mp3": []byte("a")})
+	useConfigFile(t, "KEY_ID=rotated\nAPPLICATION_KEY=new-secret\n")
+
+	client, err := b2ClientFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every call is rejected on the old key; only one of them rebuilds
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for range 8 {
+		wg.Go(func() {
+			_, err := client.listFiles()
+			errs <- err
+		})
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("call failed after the rebuild: %v", err)
+		}
+	}
+	if sharedB2.generation != 1 || os.Getenv("KEY_ID") != "rotated" {
+		t.Fatalf("rebuilt %d times with key %s, want once with the rotated key", sharedB2.generation, os.Getenv("KEY_ID"))
+	}
+}
+
+func TestRejectedCredentialsWithoutRotation(t *testing.T) {
+	useRotatingStub(t, "rotated", map[string][]byte{"a.mp3": []byte("a")})
+	useConfigFile(t, "KEY_ID=key\nAPPLICATION_KEY=secret\n")
+
+	client, err := b2ClientFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.listFiles(); !errors.Is(err, errUnauthorized) {
+		t.Fatalf("got %v, want the rejection reported", err)
+	}
+	if sharedB2.generation != 0 {
+		t.Fatal("rebuilt the client with the same credentials")
+	}
+}
+
+func TestReauthsAreCapped(t *testing.T) {
+	useRotatingStub(t, "never", map[string][]byte{"a.mp3": []byte("a")})
+	previous := maxReauths
+	t.Cleanup(func() { maxReauths = previous })
+	maxReauths = 2
+
+	client, err := b2ClientFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each rotation is rejected too, until the cap stops the rebuilds
+	for i := range 4 {
+		useConfigFile(t, fmt.Sprintf("KEY_ID=key%d\n", i))
+		if _, err := client.listFiles(); !errors.Is(err, errUnauthorized) {
+			t.Fatalf("call %d: got %v, want the rejection reported", i, err)
+		}
+	}
+	if sharedB2.generation != 2 {
+		t.Fatalf("rebuilt %d times, want the cap of 2", sharedB2.generation)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Overlap between consecutive /radio tracks, set from RADIO_CROSSFADE. Zero
+// keeps the hard cut of copying files back to back.
+var radioCrossfade time.Duration
+
+// Crossfaded radio is re-encoded, so every track comes out in this format
+const (
+	crossfadeContentType = "audio/mpeg"
+	crossfadeBitrate     = "192k"
+)
+
+func crossfadeEnabled() bool {
+	return radioCrossfade > 0
+}
+
+// Crossfading decodes cached tracks with ffmpeg, so without ffmpeg or the
+// disk cache it is turned off
+func checkCrossfade() {
+	if !crossfadeEnabled() {
+		return
+	}
+	if !cacheEnabled {
+		log.Printf("RADIO_CROSSFADE needs the disk cache, radio tracks will cut hard")
+		radioCrossfade = 0
+		return
+	}
+	if _, err := exec.LookPath(ffmpegPath); err != nil {
+		log.Printf("RADIO_CROSSFADE needs ffmpeg, radio tracks will cut hard: %v", err)
+		radioCrossfade = 0
+	}
+}
+
+// ffmpeg rendering current as MP3, with its opening trimmed when it was
+// already mixed into the previous track and, when next is set, its ending
+// crossfaded into next's opening. Rendered back to back, the pieces play as
+// one continuous mix. The loudness filters go ahead of each input's
+// resampling.
+func crossfadeCommand(ctx context.Context, current string, next string, skipHead bool, currentLoudness, nextLoudness string) *exec.Cmd {
+	seconds := strconv.FormatFloat(radioCrossfade.Seconds(), 'f', 3, 64)
+	// Both sides of a crossfade need the same sample format
+	normalize := "aresample=44100,aformat=sample_fmts=fltp:channel_layouts=stereo"
+
+	head := currentLoudness + normalize
+	if skipHead {
+		head += ",atrim=start=" + seconds + ",asetpts=PTS-STARTPTS"
+	}
+
+	args := []string{"-nostdin", "-loglevel", "error", "-i", current}
+	filter := "[0:a]" + head + "[out]"
+	if next != "" {
+		args = append(args, "-i", next)
+		filter = strings.Join([]string{
+			"[0:a]" + head + "[a]",
+			"[1:a]" + nextLoudness + normalize + ",atrim=end=" + seconds + "[b]",
+			"[a][b]acrossfade=d=" + seconds + "[out]",
+		}, ";")
+	}
+
+	args = append(args, "-filter_complex", filter, "-map", "[out]", "-vn",
+		"-c:a", "libmp3lame", "-b:a", crossfadeBitrate,
+		// No Xing or ID3 headers, since pieces are concatenated mid-stream
+		"-write_xing", "0", "-id3v2_version", "0",
+		"-f", "mp3", "pipe:1")
+	return exec.CommandContext(ctx, ffmpegPath, args...)
+}
+
+// Play current through ffmpeg, mixing its end into next when there is one
+func playCrossfaded(ctx context.Context, cw *chunkedWriter, current, next radioTrack, skipHead bool, record streamRecord) error {
+	defer servingFiles.acquire(current.path)()
+	currentPath, cleanup, err := ffmpegInput(current.path)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	nextPath, nextLoudness := "", ""
+	if next.err == nil && next.path != "" {
+		defer servingFiles.acquire(next.path)()
+		if path, cleanup, err := ffmpegInput(next.path); err == nil {
+			nextPath = path
+			nextLoudness = loudnessFilter(next)
+			defer cleanup()
+		}
+	}
+
+	cmd := crossfadeCommand(ctx, currentPath, nextPath, skipHead, loudnessFilter(current), nextLoudness)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start ffmpeg: %w", err)
+	}
+
+	copyErr := streamRadioTrack(cw, stdout, current, record)
+	if copyErr != nil {
+		cmd.Process.Kill()
+	}
+	if err := cmd.Wait(); err != nil && copyErr == nil {
+		return fmt.Errorf("ffmpeg failed on %s: %w: %s", current.name, err, strings.TrimSpace(stderr.String()))
+	}
+	return copyErr
+}
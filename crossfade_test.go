@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Stand-in for ffmpeg's crossfade render: prints "[a+b]" for track a mixed
+// into b, with a leading "-" when a's opening was trimmed off
+const fakeCrossfadeFFmpeg = `#!/bin/sh
+inputs=""
+head=""
+while [ $# -gt 0 ]; do
+	case "$1" in
+	-i) inputs="$inputs $(basename "$2" .mp3)"; shift ;;
+	-filter_complex) case "$2" in *atrim=start*) head="-" ;; esac; shift ;;
+	esac
+	shift
+done
+printf '[%s%s]' "$head" "$(echo $inputs | tr ' ' '+')"
+`
+
+func useCrossfade(t *testing.T, overlap time.Duration) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "ffmpeg")
+	if err := os.WriteFile(script, []byte(fakeCrossfadeFFmpeg), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	previousPath, previousCrossfade, previousJitter := ffmpegPath, radioCrossfade, radioJitter
+	t.Cleanup(func() { ffmpegPath, radioCrossfade, radioJitter = previousPath, previousCrossfade, previousJitter })
+	ffmpegPath, radioCrossfade, radioJitter = script, overlap, 0
+}
+
+func useRadioBucket(t *testing.T) {
+	t.Chdir(t.TempDir())
+	stub := newS3Stub(t, map[string][]byte{
+		"a.mp3": []byte("aaaa"),
+		"b.mp3": []byte("bbbb"),
+		"c.mp3": []byte("cccc"),
+		"d.mp3": []byte("dddd"),
+	})
+	stub.useEnv(t)
+	useListing(t, []string{"a.mp3", "b.mp3", "c.mp3", "d.mp3"})
+	useStation(t, modeSequential)
+}
+
+// Play /radio until limit bytes have been streamed
+func listenToRadio(t *testing.T, limit int) *cancelAfterWriter {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w := &cancelAfterWriter{ResponseRecorder: httptest.NewRecorder(), limit: limit, cancel: cancel}
+
+	done := make(chan struct{})
+	go func() {
+		radio(w, httptest.NewRequest(http.MethodGet, "/radio", nil).WithContext(ctx))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("radio stream never reached the limit")
+	}
+	waitForDownloads()
+	return w
+}
+
+// Let the downloads a finished stream's prefetch started run out, so a
+// later test asking for the same key doesn't join one from a closed origin
+func waitForDownloads() {
+	deadline := time.Now().Add(5 * time.Second)
+	for idle := 0; idle < 5 && time.Now().Before(deadline); {
+		downloads.mu.Lock()
+		active := len(downloads.active)
+		downloads.mu.Unlock()
+		if active == 0 {
+			idle++
+		} else {
+			idle = 0
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestCrossfadeMixesEveryBoundary(t *testing.T) {
+	useCrossfade(t, 3*time.Second)
+	useRadioBucket(t)
+
+	w := listenToRadio(t, len("[a+b][-b+c][-c+d]"))
+	if ct := w.Header().Get("Content-Type"); ct != crossfadeContentType {
+		t.Fatalf("Content-Type %s, want the re-encoded %s", ct, crossfadeContentType)
+	}
+
+	// Each track's ending is mixed into the next track's opening, and that
+	// opening isn't played a second time, so there is no cut or gap
+	if got := w.Body.String(); !strings.HasPrefix(got, "[a+b][-b+c][-c+d]") {
+		t.Fatalf("streamed %q, want every boundary crossfaded", got)
+	}
+}
+
+func TestCrossfadeDisabledCutsHard(t *testing.T) {
+	useCrossfade(t, 0)
+	useRadioBucket(t)
+
+	w := listenToRadio(t, 12)
+	if got := w.Body.String(); !strings.HasPrefix(got, "aaaabbbbcccc") {
+		t.Fatalf("streamed %q, want the files back to back", got)
+	}
+}
+
+func TestCrossfadeNeedsFFmpeg(t *testing.T) {
+	useCrossfade(t, 3*time.Second)
+	ffmpegPath = filepath.Join(t.TempDir(), "missing-ffmpeg")
+
+	checkCrossfade()
+	if crossfadeEnabled() {
+		t.Fatal("crossfade should be turned off without ffmpeg")
+	}
+}
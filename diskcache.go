@@ -0,0 +1,423 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+const cacheDir = "cache"
+
+// Directories cached files are spread across, set from CACHE_SHARDS so a
+// cache can use several disks. Each key lives in the shard its hash picks;
+// derived data like tags and cover art stays under cacheDir.
+var cacheShards = []string{cacheDir}
+
+// The shard holding a cache key's file
+func shardFor(key string) string {
+	if len(cacheShards) == 1 {
+		return cacheShards[0]
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return cacheShards[h.Sum32()%uint32(len(cacheShards))]
+}
+
+// The shard a cache path is under
+func shardOf(path string) string {
+	path = filepath.Clean(path)
+	for _, shard := range cacheShards {
+		if strings.HasPrefix(path, filepath.Clean(shard)+string(filepath.Separator)) {
+			return shard
+		}
+	}
+	return cacheShards[0]
+}
+
+// Shards from a comma-separated list, none of them inside another, since
+// each one is walked on its own
+func parseCacheShards(value string) ([]string, error) {
+	var shards []string
+	for _, dir := range strings.Split(value, ",") {
+		if dir = strings.TrimSpace(dir); dir != "" {
+			shards = append(shards, filepath.Clean(dir))
+		}
+	}
+	if len(shards) == 0 {
+		return []string{cacheDir}, nil
+	}
+
+	for i, a := range shards {
+		for _, b := range shards[i+1:] {
+			if a == b || strings.HasPrefix(b, a+string(filepath.Separator)) || strings.HasPrefix(a, b+string(filepath.Separator)) {
+				return nil, fmt.Errorf("%s and %s overlap", a, b)
+			}
+		}
+	}
+	return shards, nil
+}
+
+// Total bytes the disk cache may hold, set from CACHE_MAX_BYTES. 0 means
+// unlimited.
+var cacheMaxBytes int64
+
+// Set from CACHE_ENABLED. Disabled, nothing is written under cache/: files
+// are proxied straight from B2 and cache management is a no-op.
+var cacheEnabled = true
+
+var evictionMu sync.Mutex
+
+var errCacheDisabled = errors.New("disk cache is disabled")
+
+var errUnsafeKey = errors.New("object key escapes the cache directory")
+var errUnsafeVersion = errors.New("invalid object version ID")
+
+// Canonical form of an object key: no leading slash, no empty path segments
+// and Unicode NFC, so differently encoded requests for one logical name
+// ("/a//Café" with a decomposed é, say) share a cache entry
+func normalizeKey(key string) string {
+	key = norm.NFC.String(key)
+	for strings.Contains(key, "//") {
+		key = strings.ReplaceAll(key, "//", "/")
+	}
+	return strings.TrimPrefix(key, "/")
+}
+
+// Cache directory holding pinned object versions, apart from the latest
+// copies stored under their plain key
+const versionsDir = ".versions"
+
+// Cache key of a file at a pinned version, so versions never collide with
+// each other or with the latest copy. The key keeps the file's extension.
+func versionedKey(fileName, versionID string) string {
+	if versionID == "" {
+		return fileName
+	}
+	return versionsDir + "/" + versionID + "/" + fileName
+}
+
+// The cached copy of fileName at versionID, if it is complete and current.
+// The latest copy must be the size of the object in B2 (from the listing, or
+// a HEAD for keys it doesn't have yet) and pass the ETag check when one is
+// due. Pinned versions never change and entries are only moved into place
+// once fully written, so any cached copy of one will do.
+func cachedCopy(b2Client B2, fileName, versionID string) (string, bool) {
+	filePath := cachePath(versionedKey(fileName, versionID))
+	info, err := statCached(filePath)
+	if err != nil {
+		return "", false
+	}
+	if versionID != "" {
+		return filePath, true
+	}
+
+	object, ok := listing.lookup(fileName)
+	if !ok {
+		head, err := b2Client.headFile(fileName)
+		if err != nil {
+			return "", false
+		}
+		object.Size = head.Size
+	}
+	if object.Size != info.Size() {
+		log.Printf("Cached %s is %d bytes but %d in B2, downloading it again", fileName, info.Size(), object.Size)
+		return "", false
+	}
+	return filePath, validateCached(b2Client, fileName)
+}
+
+// Version IDs become a cache directory, so only plain identifiers pass
+func validateVersion(versionID string) error {
+	if versionID == "" {
+		return nil
+	}
+	if versionID == "." || versionID == ".." || strings.ContainsFunc(versionID, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.')
+	}) {
+		return errUnsafeVersion
+	}
+	return nil
+}
+
+// Reject keys that would resolve outside the cache directory once joined
+// onto it, such as "../etc/passwd" or "/etc/passwd"
+func validateKey(fileName string) error {
+	if fileName == "" || strings.HasPrefix(fileName, "/") {
+		return errUnsafeKey
+	}
+	for _, part := range strings.Split(fileName, "/") {
+		if part == ".." {
+			return errUnsafeKey
+		}
+	}
+	return nil
+}
+
+// Files currently being served from the cache, which eviction and purges
+// must leave alone
+type inUseFiles struct {
+	mu    sync.Mutex
+	paths map[string]int
+}
+
+var servingFiles = &inUseFiles{paths: make(map[string]int)}
+
+// Mark a cache file as being served, returning the func that releases it
+func (u *inUseFiles) acquire(path string) func() {
+	path = filepath.Clean(path)
+
+	u.mu.Lock()
+	u.paths[path]++
+	u.mu.Unlock()
+
+	return func() {
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		if u.paths[path]--; u.paths[path] <= 0 {
+			delete(u.paths, path)
+		}
+	}
+}
+
+func (u *inUseFiles) inUse(path string) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.paths[filepath.Clean(path)] > 0
+}
+
+type cachedFile struct {
+	path string
+	info fs.FileInfo
+}
+
+// Cached files across every shard, or only those given
+func listCachedFiles(shards ...string) ([]cachedFile, int64, error) {
+	if len(shards) == 0 {
+		shards = cacheShards
+	}
+
+	var files []cachedFile
+	var total int64
+	for _, shard := range shards {
+		shardFiles, size, err := listShard(shard)
+		if err != nil {
+			return nil, 0, err
+		}
+		files = append(files, shardFiles...)
+		total += size
+	}
+	return files, total, nil
+}
+
+func listShard(shard string) ([]cachedFile, int64, error) {
+	var files []cachedFile
+	var total int64
+
+	err := filepath.WalkDir(shard, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// Dot directories hold derived data like cover art, except pinned
+		// versions, which are cached files like any other
+		if strings.HasPrefix(d.Name(), ".") && path != shard && path != filepath.Join(shard, versionsDir) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files = append(files, cachedFile{path: path, info: info})
+		total += info.Size()
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	}
+
+	return files, total, err
+}
+
+// Delete the least recently written files until the cache fits the limit,
+// never removing keep (the file about to be served)
+func enforceCacheLimit(keep string) {
+	limit := currentCacheMaxBytes()
+	if !cacheEnabled || limit <= 0 {
+		return
+	}
+
+	evictOldest(keep, nil, func(freed, total int64) bool { return total-freed <= limit })
+}
+
+// Delete the least recently written files in shards (all of them when nil),
+// except keep and files in use, until done reports enough was freed.
+// Returns the bytes freed.
+func evictOldest(keep string, shards []string, done func(freed, total int64) bool) int64 {
+	evictionMu.Lock()
+	defer evictionMu.Unlock()
+
+	files, total, err := listCachedFiles(shards...)
+	if err != nil {
+		log.Printf("Failed to scan cache: %v", err)
+		return 0
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].info.ModTime().Before(files[j].info.ModTime())
+	})
+
+	var freed int64
+	for _, file := range files {
+		if done(freed, total) {
+			break
+		}
+		if path := logicalPath(file.path); path == filepath.Clean(keep) || servingFiles.inUse(path) {
+			continue
+		}
+
+		if err := os.Remove(file.path); err != nil {
+			log.Printf("Failed to evict %s: %v", file.path, err)
+			continue
+		}
+		freed += file.info.Size()
+		log.Printf("Evicted cached file: %s", file.path)
+	}
+	return freed
+}
+
+// Free space to leave on the cache disk after a download, set from
+// DOWNLOAD_MIN_FREE_BYTES. 0 skips the check.
+var downloadHeadroom int64
+
+var errInsufficientStorage = errors.New("not enough free disk space to cache the file")
+
+// Make room to cache size more bytes at path, evicting old files from its
+// shard when the download would leave less than the headroom free on it
+func ensureDiskSpace(path string, size int64) error {
+	if downloadHeadroom <= 0 {
+		return nil
+	}
+
+	shard := shardOf(path)
+	free, err := diskFree(shard)
+	if err != nil {
+		// Without a reading, don't block downloads
+		log.Printf("Failed to check free disk space: %v", err)
+		return nil
+	}
+
+	needed := size + downloadHeadroom - int64(free)
+	if needed <= 0 {
+		return nil
+	}
+
+	// Don't empty the cache for a file that won't fit anyway
+	if _, cached, err := listCachedFiles(shard); err == nil && cached < needed {
+		return fmt.Errorf("%w: need %d more bytes than the whole cache holds", errInsufficientStorage, needed-cached)
+	}
+
+	log.Printf("Low disk space: %d bytes free, evicting %d bytes to cache a %d byte file", free, needed, size)
+	if freed := evictOldest("", []string{shard}, func(freed, total int64) bool { return freed >= needed }); freed < needed {
+		return fmt.Errorf("%w: need %d more bytes", errInsufficientStorage, needed-freed)
+	}
+	return nil
+}
+
+type purgeSummary struct {
+	Purged     int      `json:"purged"`
+	BytesFreed int64    `json:"bytes_freed"`
+	Skipped    []string `json:"skipped"`
+}
+
+func removeCachedFile(file cachedFile, summary *purgeSummary) {
+	if servingFiles.inUse(logicalPath(file.path)) {
+		summary.Skipped = append(summary.Skipped, file.path)
+		return
+	}
+
+	if err := os.Remove(file.path); err != nil {
+		log.Printf("Failed to purge %s: %v", file.path, err)
+		summary.Skipped = append(summary.Skipped, file.path)
+		return
+	}
+
+	summary.Purged++
+	summary.BytesFreed += file.info.Size()
+}
+
+// Delete one cached file (?file=) or the whole cache (?all=true). Files
+// being served are skipped and reported.
+func purgeCache(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	summary := purgeSummary{Skipped: []string{}}
+	if !cacheEnabled {
+		writeJSON(w, summary)
+		return
+	}
+
+	evictionMu.Lock()
+	defer evictionMu.Unlock()
+
+	fileName := fileParam(req)
+
+	switch {
+	case req.URL.Query().Get("all") == "true":
+		files, _, err := listCachedFiles()
+		if err != nil {
+			http.Error(w, "Failed to scan cache", http.StatusInternalServerError)
+			log.Printf("Failed to scan cache: %v", err)
+			return
+		}
+		for _, file := range files {
+			removeCachedFile(file, &summary)
+		}
+		memCache.clear()
+		servedRanges.clear()
+	case fileName != "":
+		if err := validateKey(fileName); err != nil {
+			http.Error(w, "Invalid file parameter", http.StatusBadRequest)
+			return
+		}
+
+		path := filepath.Clean(cachePath(fileName))
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			path += compressedSuffix
+			info, err = os.Stat(path)
+		}
+		if err != nil || info.IsDir() {
+			http.Error(w, "File not cached", http.StatusNotFound)
+			return
+		}
+		removeCachedFile(cachedFile{path: path, info: info}, &summary)
+		memCache.remove(fileName)
+		forgetRanges(fileName)
+	default:
+		http.Error(w, "Missing file or all parameter", http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("Purged %d cached files, freed %d bytes", summary.Purged, summary.BytesFreed)
+	writeJSON(w, summary)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeCached(t *testing.T, name string, size int, age time.Duration) string {
+	t.Helper()
+	path := filepath.Join(cacheDir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, make([]byte, size), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Now().Add(-age)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestEnforceCacheLimitEvictsOldest(t *testing.T) {
+	t.Chdir(t.TempDir())
+	previous := cacheMaxBytes
+	t.Cleanup(func() { cacheMaxBytes = previous })
+	cacheMaxBytes = 250
+
+	oldest := writeCached(t, "a/old.mp3", 100, 3*time.Hour)
+	older := writeCached(t, "b/older.mp3", 100, 2*time.Hour)
+	kept := writeCached(t, "new.mp3", 100, time.Hour)
+
+	enforceCacheLimit(kept)
+
+	if _, err := os.Stat(oldest); !os.IsNotExist(err) {
+		t.Fatal("the oldest file should have been evicted")
+	}
+	for _, path := range []string{older, kept} {
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("%s shouldn't have been evicted", path)
+		}
+	}
+}
+
+func TestEnforceCacheLimitKeepsServedFile(t *testing.T) {
+	t.Chdir(t.TempDir())
+	previous := cacheMaxBytes
+	t.Cleanup(func() { cacheMaxBytes = previous })
+	cacheMaxBytes = 50
+
+	keep := writeCached(t, "old.mp3", 100, 2*time.Hour)
+	other := writeCached(t, "new.mp3", 10, time.Hour)
+
+	enforceCacheLimit(keep)
+
+	if _, err := os.Stat(keep); err != nil {
+		t.Fatal("the file about to be served was evicted")
+	}
+	if _, err := os.Stat(other); !os.IsNotExist(err) {
+		t.Fatal("the other file should have been evicted")
+	}
+}
+
+func TestEnforceCacheLimitUnlimited(t *testing.T) {
+	t.Chdir(t.TempDir())
+	previous := cacheMaxBytes
+	t.Cleanup(func() { cacheMaxBytes = previous })
+	cacheMaxBytes = 0
+
+	path := writeCached(t, "a.mp3", 1000, time.Hour)
+	enforceCacheLimit("")
+
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal("nothing should be evicted without a limit")
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Set the headroom so that only available bytes are left for downloads,
+// whatever the test machine's disk actually has free
+func simulateLowDisk(t *testing.T, available int64) {
+	free, err := diskFree(cacheDir)
+	if err != nil {
+		t.Skipf("can't read free disk space: %v", err)
+	}
+
+	previous := downloadHeadroom
+	t.Cleanup(func() { downloadHeadroom = previous })
+	downloadHeadroom = int64(free) - available
+}
+
+func TestLowDiskEvictsBeforeDownloading(t *testing.T) {
+	t.Chdir(t.TempDir())
+	useStation(t, modeRandom)
+	track := bytes.Repeat([]byte("a"), 2<<20)
+	stub := newS3Stub(t, map[string][]byte{"new.mp3": track})
+	stub.useEnv(t)
+	useListing(t, []string{"new.mp3"})
+
+	old := writeCached(t, "old.mp3", 8<<20, time.Hour)
+	simulateLowDisk(t, 1<<20)
+
+	rec := httptest.NewRecorder()
+	newStreamHandler(t).stream(rec, httptest.NewRequest(http.MethodGet, "/stream?file=new.mp3", nil))
+	if rec.Code != http.StatusOK || rec.Body.Len() != len(track) {
+		t.Fatalf("status %d with %d bytes", rec.Code, rec.Body.Len())
+	}
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Fatal("the old file should have been evicted to make room")
+	}
+	if _, err := os.Stat(filepath.Join(cacheDir, "new.mp3")); err != nil {
+		t.Fatal("the new file wasn't cached")
+	}
+}
+
+func TestNoRoomStreamsUncached(t *testing.T) {
+	t.Chdir(t.TempDir())
+	useStation(t, modeRandom)
+	stub := newS3Stub(t, map[string][]byte{"new.mp3": bytes.Repeat([]byte("a"), 1<<20)})
+	stub.versions = map[string]map[string][]byte{"new.mp3": {"v1": []byte("pinned")}}
+	stub.useEnv(t)
+	useListing(t, []string{"new.mp3"})
+
+	kept := writeCached(t, "old.mp3", 1000, time.Hour)
+	simulateLowDisk(t, -(64 << 20))
+
+	rec := httptest.NewRecorder()
+	newStreamHandler(t).stream(rec, httptest.NewRequest(http.MethodGet, "/stream?file=new.mp3", nil))
+	if rec.Code != http.StatusOK || rec.Body.Len() != 1<<20 {
+		t.Fatalf("status %d with %d bytes, want the file streamed straight from B2", rec.Code, rec.Body.Len())
+	}
+	if _, err := os.Stat(filepath.Join(cacheDir, "new.mp3")); err == nil {
+		t.Fatal("cached a file there's no room for")
+	}
+	if _, err := os.Stat(kept); err != nil {
+		t.Fatal("emptied the cache for a file that couldn't fit anyway")
+	}
+
+	// Pinned versions are only served from the cache
+	rec = httptest.NewRecorder()
+	newStreamHandler(t).stream(rec, httptest.NewRequest(http.MethodGet, "/stream?file=new.mp3&version=v1", nil))
+	if rec.Code != http.StatusInsufficientStorage {
+		t.Fatalf("status %d, want 507", rec.Code)
+	}
+}
+
+func TestDiskSpaceCheckOff(t *testing.T) {
+	previous := downloadHeadroom
+	t.Cleanup(func() { downloadHeadroom = previous })
+	downloadHeadroom = 0
+
+	if err := ensureDiskSpace(cachePath("new.mp3"), 1<<50); err != nil {
+		t.Fatalf("got %v with no headroom configured", err)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	concurrentWait = "wait"
+	concurrentTail = "tail"
+)
+
+// How a request is served while another one is downloading the same file,
+// set from CONCURRENT_DOWNLOAD. "wait" serves it from the cache once the
+// download completes; "tail" streams the bytes already written and follows
+// the file as the rest arrives. Either way the file is fetched only once.
+var concurrentDownload = concurrentWait
+
+// A download into the cache in progress. Requests that arrive meanwhile
+// wait on done, or follow the temporary file through progress.
+type download struct {
+	mu       sync.Mutex
+	progress *sync.Cond
+	tmpPath  string // set once bytes are written; empty for gzipped entries
+	size     int64  // expected length, -1 when B2 didn't say
+	written  int64  // bytes of the object received so far
+	started  time.Time
+	finished bool
+	path     string
+	err      error
+	done     chan struct{}
+}
+
+type downloadTracker struct {
+	mu     sync.Mutex
+	active map[string]*download
+}
+
+var downloads = &downloadTracker{active: make(map[string]*download)}
+
+// Start tracking a download of key. When one is already under way, returns
+// it and false instead.
+func (t *downloadTracker) start(key string) (*download, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if d, ok := t.active[key]; ok {
+		return d, false
+	}
+	d := &download{size: -1, started: time.Now(), done: make(chan struct{})}
+	d.progress = sync.NewCond(&d.mu)
+	t.active[key] = d
+	return d, true
+}
+
+func (t *downloadTracker) get(key string) *download {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.active[key]
+}
+
+func (t *downloadTracker) finish(key string, d *download, path string, err error) {
+	t.mu.Lock()
+	delete(t.active, key)
+	t.mu.Unlock()
+
+	d.mu.Lock()
+	d.finished, d.path, d.err = true, path, err
+	d.progress.Broadcast()
+	d.mu.Unlock()
+	close(d.done)
+}
+
+// Wait for the download to complete, returning its cache path
+func (d *download) wait() (string, error) {
+	<-d.done
+	return d.path, d.err
+}
+
+// Record that bytes are being written to tmpPath, so tailing readers can
+// follow it. Gzipped entries pass no tmpPath and can't be followed.
+func (d *download) begin(tmpPath string, size int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.tmpPath, d.size = tmpPath, size
+	d.progress.Broadcast()
+}
+
+func (d *download) advance(n int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.written += n
+	d.progress.Broadcast()
+}
+
+// Block until more than pos bytes are written or the download ends
+func (d *download) waitFor(pos int64) (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for d.written <= pos && !d.finished {
+		d.progress.Wait()
+	}
+	return d.written, d.err
+}
+
+// Counts bytes into the download as they reach the temporary file
+type progressWriter struct {
+	w  io.Writer
+	dl *download
+}
+
+func (p progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.dl.advance(int64(n))
+	return n, err
+}
+
+// Reads a file that is still being written, blocking at the end of what's
+// there until the download adds more or finishes
+type tailReader struct {
+	file *os.File
+	dl   *download
+	pos  int64
+}
+
+func (r *tailReader) Read(p []byte) (int, error) {
+	written, err := r.dl.waitFor(r.pos)
+	if written <= r.pos {
+		if err != nil {
+			return 0, err
+		}
+		return 0, io.EOF
+	}
+
+	if available := written - r.pos; int64(len(p)) > available {
+		p = p[:available]
+	}
+	n, err := r.file.ReadAt(p, r.pos)
+	r.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Serve the file as the download writes it. Gzipped entries can't be
+// followed, nor can a download that already finished, so those wait and
+// are served from the cache.
+func (d *download) serveTail(w http.ResponseWriter, req *http.Request, fileName string) {
+	d.mu.Lock()
+	for d.tmpPath == "" && !d.finished {
+		d.progress.Wait()
+	}
+	tmpPath, size, finished := d.tmpPath, d.size, d.finished
+	d.mu.Unlock()
+
+	if !finished && tmpPath != "" {
+		// Fails once the download has moved the file into place
+		if file, err := os.Open(tmpPath); err == nil {
+			defer file.Close()
+
+			log.Printf("Tailing download in progress: %s", fileName)
+			w.Header().Set("Content-Type", audioContentType(fileName))
+			if size >= 0 {
+				w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+			}
+			if req.Method == http.MethodHead {
+				return
+			}
+			if _, err := io.Copy(w, &tailReader{file: file, dl: d}); err != nil {
+				log.Printf("Failed to tail download of %s: %v", fileName, err)
+			}
+			return
+		}
+	}
+
+	path, err := d.wait()
+	if err != nil {
+		b2Error(w, "Failed to download file", err)
+		log.Printf("Failed to download file: %v", err)
+		return
+	}
+	defer servingFiles.acquire(path)()
+	serveCached(w, req, path)
+}
+
+type downloadProgress struct {
+	File    string    `json:"file"`
+	Bytes   int64     `json:"bytes"`
+	Total   int64     `json:"total"`             // -1 when B2 didn't report a length
+	Percent *float64  `json:"percent,omitempty"` // unset without a total
+	Started time.Time `json:"started"`
+}
+
+// Progress of every download in flight, oldest first
+func (t *downloadTracker) progress() []downloadProgress {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	list := make([]downloadProgress, 0, len(t.active))
+	for key, d := range t.active {
+		list = append(list, d.report(key))
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Started.Before(list[j].Started) })
+	return list
+}
+
+func (d *download) report(key string) downloadProgress {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	p := downloadProgress{File: key, Bytes: d.written, Total: d.size, Started: d.started}
+	if d.size > 0 {
+		percent := min(100, float64(d.written)*100/float64(d.size))
+		p.Percent = &percent
+	}
+	return p
+}
+
+// Downloads into the cache in progress, with bytes received and percentages
+func downloadsHandler(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, downloads.progress())
+}
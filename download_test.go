@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Origin that sends the first half of the object, then holds the rest back
+// until release is closed
+type slowOrigin struct {
+	*httptest.Server
+	data    []byte
+	gets    atomic.Int32
+	release chan struct{}
+}
+
+func newSlowOrigin(t *testing.T, data []byte) *slowOrigin {
+	origin := &slowOrigin{data: data, release: make(chan struct{})}
+	origin.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		origin.gets.Add(1)
+		half := len(data) / 2
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data[:half])
+		w.(http.Flusher).Flush()
+		<-origin.release
+		w.Write(data[half:])
+	}))
+	t.Cleanup(origin.Close)
+	setB2Env(t)
+	t.Setenv("ENDPOINT", origin.URL)
+	return origin
+}
+
+// Closes wrote on the first body write
+type signalingRecorder struct {
+	*httptest.ResponseRecorder
+	once  sync.Once
+	wrote chan struct{}
+}
+
+func (r *signalingRecorder) Write(p []byte) (int, error) {
+	n, err := r.ResponseRecorder.Write(p)
+	r.once.Do(func() { close(r.wrote) })
+	return n, err
+}
+
+func useConcurrentDownload(t *testing.T, mode string) {
+	previous := concurrentDownload
+	t.Cleanup(func() { concurrentDownload = previous })
+	concurrentDownload = mode
+}
+
+// Start streaming fileName in the background and wait until its download
+// has written some bytes
+func startDownload(t *testing.T, fileName string) (*httptest.ResponseRecorder, *sync.WaitGroup, *download) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		newStreamHandler(t).stream(rec, httptest.NewRequest(http.MethodGet, "/stream?file="+fileName, nil))
+	})
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if dl := downloads.get(fileName); dl != nil {
+			if written, _ := dl.waitFor(0); written > 0 {
+				return rec, &wg, dl
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("the download never started")
+	return nil, nil, nil
+}
+
+func TestTailingReadFollowsDownload(t *testing.T) {
+	t.Chdir(t.TempDir())
+	useStation(t, modeRandom)
+	useConcurrentDownload(t, concurrentTail)
+	data := bytes.Repeat([]byte("0123456789"), 10_000)
+	origin := newSlowOrigin(t, data)
+	useListing(t, []string{"live.mp3"})
+
+	first, wg, _ := startDownload(t, "live.mp3")
+
+	// The second listener gets bytes before the download ends
+	second := &signalingRecorder{ResponseRecorder: httptest.NewRecorder(), wrote: make(chan struct{})}
+	tailing := make(chan struct{})
+	go func() {
+		defer close(tailing)
+		newStreamHandler(t).stream(second, httptest.NewRequest(http.MethodGet, "/stream?file=live.mp3", nil))
+	}()
+	select {
+	case <-second.wrote:
+	case <-tailing:
+		t.Fatal("the tailing request returned before the download finished")
+	case <-time.After(2 * time.Second):
+		t.Fatal("nothing was served while the download was under way")
+	}
+
+	close(origin.release)
+	wg.Wait()
+	<-tailing
+
+	for i, rec := range []*httptest.ResponseRecorder{first, second.ResponseRecorder} {
+		if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), data) {
+			t.Errorf("request %d: status %d with %d bytes, want %d", i+1, rec.Code, rec.Body.Len(), len(data))
+		}
+	}
+	if got := second.Header().Get("Content-Length"); got != strconv.Itoa(len(data)) {
+		t.Errorf("tailing Content-Length %q, want the full size", got)
+	}
+	if n := origin.gets.Load(); n != 1 {
+		t.Fatalf("fetched %d times, want the download shared", n)
+	}
+}
+
+func TestWaitingRequestServedFromCache(t *testing.T) {
+	t.Chdir(t.TempDir())
+	useStation(t, modeRandom)
+	useConcurrentDownload(t, concurrentWait)
+	data := bytes.Repeat([]byte("ab"), 5000)
+	origin := newSlowOrigin(t, data)
+	useListing(t, []string{"live.mp3"})
+
+	_, wg, dl := startDownload(t, "live.mp3")
+
+	second := httptest.NewRecorder()
+	wg.Go(func() {
+		newStreamHandler(t).stream(second, httptest.NewRequest(http.MethodGet, "/stream?file=live.mp3", nil))
+	})
+	time.Sleep(20 * time.Millisecond)
+	close(origin.release)
+	wg.Wait()
+
+	if path, err := dl.wait(); err != nil || path != cachePath("live.mp3") {
+		t.Fatalf("download finished at %q (%v)", path, err)
+	}
+	if second.Code != http.StatusOK || !bytes.Equal(second.Body.Bytes(), data) {
+		t.Fatalf("status %d with %d bytes", second.Code, second.Body.Len())
+	}
+	if n := origin.gets.Load(); n != 1 {
+		t.Fatalf("fetched %d times, want the download shared", n)
+	}
+}
+
+func TestTailReaderStopsAtEnd(t *testing.T) {
+	tracker := &downloadTracker{active: map[string]*download{}}
+	dl, _ := tracker.start("a.mp3")
+	path := filepath.Join(t.TempDir(), ".download-a")
+	if err := os.WriteFile(path, []byte("hello world"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	dl.begin(file.Name(), 11)
+	dl.advance(5)
+
+	r := &tailReader{file: file, dl: dl}
+	buf := make([]byte, 64)
+	if n, err := r.Read(buf); err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("read %q (%v), want only the written bytes", buf[:n], err)
+	}
+
+	go func() {
+		dl.advance(6)
+		tracker.finish("a.mp3", dl, "cache/a.mp3", nil)
+	}()
+	if n, err := r.Read(buf); err != nil || string(buf[:n]) != " world" {
+		t.Fatalf("read %q (%v) after the download advanced", buf[:n], err)
+	}
+	if _, err := r.Read(buf); err == nil {
+		t.Fatal("expected EOF once the download finished")
+	}
+}
+
+func listDownloads(t *testing.T) []downloadProgress {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	downloadsHandler(rec, httptest.NewRequest(http.MethodGet, "/downloads", nil))
+	var list []downloadProgress
+	if err := json.NewDecoder(rec.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	return list
+}
+
+func TestDownloadProgressReachesComplete(t *testing.T) {
+	t.Chdir(t.TempDir())
+	useStation(t, modeRandom)
+	data := bytes.Repeat([]byte("0123456789"), 10_000)
+	origin := newSlowOrigin(t, data)
+	useListing(t, []string{"big.flac"})
+
+	first, wg, dl := startDownload(t, "big.flac")
+	list := listDownloads(t)
+	if len(list) != 1 || list[0].File != "big.flac" || list[0].Total != int64(len(data)) {
+		t.Fatalf("got %+v, want big.flac in progress", list)
+	}
+	if p := list[0].Percent; p == nil || *p <= 0 || *p >= 100 {
+		t.Fatalf("percent %v halfway through", p)
+	}
+
+	close(origin.release)
+	wg.Wait()
+	if first.Code != http.StatusOK || first.Body.Len() != len(data) {
+		t.Fatalf("status %d with %d bytes", first.Code, first.Body.Len())
+	}
+	if p := dl.report("big.flac"); p.Bytes != int64(len(data)) || p.Percent == nil || *p.Percent != 100 {
+		t.Fatalf("finished download at %+v, want 100%%", p)
+	}
+	if list := listDownloads(t); len(list) != 0 {
+		t.Fatalf("got %+v, want the finished download removed", list)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// How far past the ID3 tag to look for the first MPEG frame, to step over
+// padding or junk some encoders leave
+const maxFrameSearch = 64 * 1024
+
+type mpegFrame struct {
+	version         int // 1, 2, or 25 for MPEG 2.5
+	layer           int
+	bitrate         int // kbps
+	sampleRate      int
+	samplesPerFrame int
+	mono            bool
+}
+
+var mpegBitrates = map[[2]int][15]int{
+	{1, 1}: {0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448},
+	{1, 2}: {0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},
+	{1, 3}: {0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+	{2, 1}: {0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256},
+	{2, 2}: {0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+	{2, 3}: {0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+}
+
+var mpegSampleRates = map[int][3]int{
+	1:  {44100, 48000, 32000},
+	2:  {22050, 24000, 16000},
+	25: {11025, 12000, 8000},
+}
+
+func parseMPEGFrame(header []byte) (mpegFrame, bool) {
+	if len(header) < 4 || header[0] != 0xFF || header[1]&0xE0 != 0xE0 {
+		return mpegFrame{}, false
+	}
+
+	var frame mpegFrame
+	switch (header[1] >> 3) & 3 {
+	case 0:
+		frame.version = 25
+	case 2:
+		frame.version = 2
+	case 3:
+		frame.version = 1
+	default:
+		return mpegFrame{}, false
+	}
+
+	frame.layer = 4 - int((header[1]>>1)&3)
+	bitrateIndex := int(header[2] >> 4)
+	rateIndex := int((header[2] >> 2) & 3)
+	if frame.layer == 4 || bitrateIndex == 0 || bitrateIndex == 15 || rateIndex == 3 {
+		return mpegFrame{}, false
+	}
+
+	// MPEG 2.5 shares the MPEG 2 bitrate tables
+	tableVersion := min(frame.version, 2)
+	frame.bitrate = mpegBitrates[[2]int{tableVersion, frame.layer}][bitrateIndex]
+	frame.sampleRate = mpegSampleRates[frame.version][rateIndex]
+	frame.mono = header[3]>>6 == 3
+
+	switch {
+	case frame.layer == 1:
+		frame.samplesPerFrame = 384
+	case frame.layer == 3 && frame.version != 1:
+		frame.samplesPerFrame = 576
+	default:
+		frame.samplesPerFrame = 1152
+	}
+	return frame, true
+}
+
+// Offset of the Xing/Info header within the first frame, after the frame
+// header and side information
+func (f mpegFrame) xingOffset() int {
+	switch {
+	case f.version == 1 && !f.mono:
+		return 4 + 32
+	case f.version != 1 && f.mono:
+		return 4 + 9
+	default:
+		return 4 + 17
+	}
+}
+
+// Duration in seconds, and whether the file is VBR MP3. For MP3 the frame
+// count in a Xing or VBRI header gives an exact duration; without one the
+// file is assumed CBR and the duration estimated from its size and first
+// frame's bitrate. MP4 reads the movie header, other formats report 0.
+func readDuration(filePath string) (float64, bool, error) {
+	file, err := openCached(filePath)
+	if err != nil {
+		return 0, false, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, false, err
+	}
+
+	header := make([]byte, 10)
+	if _, err := io.ReadFull(file, header); err != nil {
+		return 0, false, nil
+	}
+	switch {
+	case string(header[4:8]) == "ftyp":
+		return mp4Duration(file, info.Size()), false, nil
+	case string(header[:4]) == "OggS", string(header[:4]) == "fLaC", string(header[:4]) == "RIFF":
+		return 0, false, nil
+	}
+
+	var audioStart int64
+	if string(header[:3]) == "ID3" {
+		audioStart = 10 + int64(synchsafe(header[6:10]))
+		if header[5]&0x10 != 0 {
+			audioStart += 10 // footer
+		}
+	}
+
+	buf := make([]byte, maxFrameSearch)
+	n, err := file.ReadAt(buf, audioStart)
+	if err != nil && err != io.EOF {
+		return 0, false, err
+	}
+	buf = buf[:n]
+
+	// Demand a second frame header right after the first so stray 0xFF bytes
+	// aren't taken for a sync word
+	offset := -1
+	var frame mpegFrame
+	for i := 0; i+4 <= len(buf); i++ {
+		candidate, ok := parseMPEGFrame(buf[i:])
+		if !ok {
+			continue
+		}
+		next := i + candidate.frameLength(buf[i:])
+		if next >= len(buf) {
+			continue
+		}
+		if _, ok := parseMPEGFrame(buf[next:]); ok {
+			offset, frame = i, candidate
+			break
+		}
+	}
+	if offset < 0 {
+		return 0, false, nil
+	}
+	first := buf[offset:]
+
+	if frames, vbr, ok := frameCount(first, frame); ok && frames > 0 {
+		return float64(frames) * float64(frame.samplesPerFrame) / float64(frame.sampleRate), vbr, nil
+	}
+
+	audioBytes := info.Size() - audioStart - int64(offset)
+	if trailer := make([]byte, 3); info.Size() >= 128 {
+		if _, err := file.ReadAt(trailer, info.Size()-128); err == nil && string(trailer) == "TAG" {
+			audioBytes -= 128 // ID3v1
+		}
+	}
+	return float64(audioBytes) * 8 / float64(frame.bitrate*1000), false, nil
+}
+
+func (f mpegFrame) frameLength(header []byte) int {
+	padding := int(header[2]>>1) & 1
+	if f.layer == 1 {
+		return (12*f.bitrate*1000/f.sampleRate + padding) * 4
+	}
+	if f.layer == 3 && f.version != 1 {
+		return 72*f.bitrate*1000/f.sampleRate + padding
+	}
+	return 144*f.bitrate*1000/f.sampleRate + padding
+}
+
+// Total frames from a Xing/Info or VBRI header in the first frame. "Info" is
+// what LAME writes for CBR files, so only the other two mark the file VBR.
+func frameCount(first []byte, frame mpegFrame) (uint32, bool, bool) {
+	if xing := frame.xingOffset(); len(first) >= xing+12 {
+		tag := first[xing : xing+4]
+		if bytes.Equal(tag, []byte("Xing")) || bytes.Equal(tag, []byte("Info")) {
+			flags := binary.BigEndian.Uint32(first[xing+4:])
+			if flags&1 == 0 {
+				return 0, false, false
+			}
+			return binary.BigEndian.Uint32(first[xing+8:]), string(tag) == "Xing", true
+		}
+	}
+
+	const vbri = 4 + 32
+	if len(first) >= vbri+18 && string(first[vbri:vbri+4]) == "VBRI" {
+		return binary.BigEndian.Uint32(first[vbri+14:]), true, true
+	}
+	return 0, false, false
+}
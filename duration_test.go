@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+// MPEG-1 Layer III, 128 kbps, 44.1 kHz, stereo: 417 bytes and 1152 samples
+// per frame
+var mp3FrameHeader = []byte{0xFF, 0xFB, 0x90, 0x00}
+
+const mp3FrameLength = 417
+
+func mp3Frame(payload []byte) []byte {
+	frame := make([]byte, mp3FrameLength)
+	copy(frame, mp3FrameHeader)
+	copy(frame[4:], payload)
+	return frame
+}
+
+// The first frame carries a Xing (or other) header after the side information
+func vbrHeaderFrame(offset int, tag string, fields ...uint32) []byte {
+	payload := make([]byte, offset-4)
+	payload = append(payload, tag...)
+	for _, field := range fields {
+		payload = binary.BigEndian.AppendUint32(payload, field)
+	}
+	return mp3Frame(payload)
+}
+
+func mp3File(first []byte, frames int) []byte {
+	data := append([]byte{}, first...)
+	for range frames {
+		data = append(data, mp3Frame(nil)...)
+	}
+	return data
+}
+
+func TestReadDurationXing(t *testing.T) {
+	// 1000 frames of 1152 samples at 44.1 kHz, whatever the file size
+	data := id3Tag(4, id3Frame4("TIT2", id3Text("VBR")))
+	data = append(data, mp3File(vbrHeaderFrame(36, "Xing", 0x1, 1000), 3)...)
+
+	duration, vbr, err := readDuration(writeTemp(t, "vbr.mp3", data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 1000 * 1152 / 44100.0; math.Abs(duration-want) > 1e-9 || !vbr {
+		t.Fatalf("got %.3fs vbr=%t, want %.3fs vbr=true", duration, vbr, want)
+	}
+}
+
+func TestReadDurationInfoIsCBR(t *testing.T) {
+	data := mp3File(vbrHeaderFrame(36, "Info", 0x1, 441), 3)
+
+	duration, vbr, err := readDuration(writeTemp(t, "cbr.mp3", data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 441 * 1152 / 44100.0; math.Abs(duration-want) > 1e-9 || vbr {
+		t.Fatalf("got %.3fs vbr=%t, want %.3fs vbr=false", duration, vbr, want)
+	}
+}
+
+func TestReadDurationVBRI(t *testing.T) {
+	// VBRI: version, delay, quality (2 bytes each), byte count, frame count
+	payload := make([]byte, 32)
+	payload = append(payload, "VBRI"...)
+	payload = append(payload, 0, 1, 0, 0, 0, 75)
+	payload = binary.BigEndian.AppendUint32(payload, 123456)
+	payload = binary.BigEndian.AppendUint32(payload, 2000)
+	data := mp3File(mp3Frame(payload), 3)
+
+	duration, vbr, err := readDuration(writeTemp(t, "vbri.mp3", data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 2000 * 1152 / 44100.0; math.Abs(duration-want) > 1e-9 || !vbr {
+		t.Fatalf("got %.3fs vbr=%t, want %.3fs vbr=true", duration, vbr, want)
+	}
+}
+
+func TestReadDurationEstimatesWithoutHeader(t *testing.T) {
+	// Junk before the first frame, then 300 plain frames and an ID3v1 tag
+	data := append([]byte{0xFF, 0x00, 0x12}, mp3File(mp3Frame(nil), 299)...)
+	data = append(data, append([]byte("TAG"), bytes.Repeat([]byte{0}, 125)...)...)
+
+	duration, vbr, err := readDuration(writeTemp(t, "plain.mp3", data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 300 * mp3FrameLength * 8 / 128000.0; math.Abs(duration-want) > 1e-9 || vbr {
+		t.Fatalf("got %.3fs vbr=%t, want %.3fs estimated from the size", duration, vbr, want)
+	}
+}
+
+func TestReadDurationNonMP3(t *testing.T) {
+	if duration, _, err := readDuration(writeTemp(t, "a.ogg", []byte("OggS\x00\x02 not really ogg"))); err != nil || duration != 0 {
+		t.Fatalf("got %v (%v), want 0 for formats without an MPEG stream", duration, err)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+type egressState struct {
+	Day        string `json:"day"`
+	Served     int64  `json:"served"`
+	Downloaded int64  `json:"downloaded"`
+}
+
+type egressMeter struct {
+	mu        sync.Mutex
+	budget    int64 // 0 disables the guard
+	stateFile string
+	state     egressState
+}
+
+var egress = &egressMeter{}
+
+func newEgressMeter(budget int64, stateFile string) *egressMeter {
+	m := &egressMeter{
+		budget:    budget,
+		stateFile: stateFile,
+	}
+
+	if stateFile == "" {
+		return m
+	}
+
+	data, err := os.ReadFile(stateFile)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Failed to read egress state: %v", err)
+		}
+		return m
+	}
+
+	if err := json.Unmarshal(data, &m.state); err != nil {
+		log.Printf("Failed to parse egress state: %v", err)
+		m.state = egressState{}
+	}
+
+	return m
+}
+
+func today() string {
+	return time.Now().UTC().Format("2006-01-02")
+}
+
+// Reset the counters when the UTC day changes. Callers must hold mu.
+func (m *egressMeter) rollover() {
+	if day := today(); m.state.Day != day {
+		m.state = egressState{Day: day}
+	}
+}
+
+func (m *egressMeter) addServed(n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.rollover()
+	m.state.Served += n
+	m.save()
+}
+
+func (m *egressMeter) addDownloaded(n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.rollover()
+	m.state.Downloaded += n
+	m.save()
+}
+
+func (m *egressMeter) exceeded() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.budget <= 0 {
+		return false
+	}
+
+	m.rollover()
+	return m.state.Served >= m.budget || m.state.Downloaded >= m.budget
+}
+
+// Persist the running totals so a restart doesn't reset the budget. Callers
+// must hold mu.
+func (m *egressMeter) save() {
+	if m.stateFile == "" {
+		return
+	}
+
+	data, err := json.Marshal(m.state)
+	if err != nil {
+		log.Printf("Failed to encode egress state: %v", err)
+		return
+	}
+
+	tmpFile := m.stateFile + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0644); err != nil {
+		log.Printf("Failed to write egress state: %v", err)
+		return
+	}
+	if err := os.Rename(tmpFile, m.stateFile); err != nil {
+		log.Printf("Failed to write egress state: %v", err)
+	}
+}
+
+type countingResponseWriter struct {
+	http.ResponseWriter
+	bytes  int64
+	status int
+}
+
+func (c *countingResponseWriter) WriteHeader(status int) {
+	if c.status == 0 {
+		c.status = status
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *countingResponseWriter) Write(p []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	n, err := c.ResponseWriter.Write(p)
+	c.bytes += int64(n)
+	return n, err
+}
+
+func (c *countingResponseWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestEgressBudgetThreshold(t *testing.T) {
+	m := newEgressMeter(100, "")
+
+	m.addServed(99)
+	if m.exceeded() {
+		t.Fatal("exceeded one byte below the budget")
+	}
+	m.addServed(1)
+	if !m.exceeded() {
+		t.Fatal("not exceeded at the budget")
+	}
+}
+
+func TestEgressBudgetCountsDownloads(t *testing.T) {
+	m := newEgressMeter(100, "")
+
+	m.addDownloaded(100)
+	if !m.exceeded() {
+		t.Fatal("downloads at the budget didn't trip the guard")
+	}
+}
+
+func TestEgressBudgetDisabled(t *testing.T) {
+	m := newEgressMeter(0, "")
+
+	m.addServed(1 << 40)
+	if m.exceeded() {
+		t.Fatal("a zero budget should disable the guard")
+	}
+}
+
+func TestEgressStateSurvivesRestart(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "egress.json")
+
+	m := newEgressMeter(100, stateFile)
+	m.addServed(60)
+	m.addDownloaded(10)
+
+	restarted := newEgressMeter(100, stateFile)
+	if restarted.state.Served != 60 || restarted.state.Downloaded != 10 {
+		t.Fatalf("restored %+v, want 60 served and 10 downloaded", restarted.state)
+	}
+	restarted.addServed(40)
+	if !restarted.exceeded() {
+		t.Fatal("the restored total didn't count towards the budget")
+	}
+}
+
+func TestEgressStateFromAnotherDayIsReset(t *testing.T) {
+	m := newEgressMeter(100, "")
+	m.state = egressState{Day: "2000-01-01", Served: 500}
+
+	if m.exceeded() {
+		t.Fatal("yesterday's total counted against today's budget")
+	}
+}
+
+func TestStreamRejectedOverBudget(t *testing.T) {
+	setB2Env(t)
+	previous := egress
+	t.Cleanup(func() { egress = previous })
+	egress = newEgressMeter(10, "")
+	egress.addServed(10)
+
+	rec := httptest.NewRecorder()
+	newStreamHandler(t).stream(rec, httptest.NewRequest(http.MethodGet, "/stream?file=a.mp3", nil))
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status %d, want 503", rec.Code)
+	}
+}
+
+func TestCountingResponseWriter(t *testing.T) {
+	rec := httptest.NewRecorder()
+	cw := &countingResponseWriter{ResponseWriter: rec}
+
+	cw.Write([]byte("hello"))
+	cw.Write([]byte(", world"))
+
+	if cw.bytes != 12 {
+		t.Fatalf("counted %d bytes, want 12", cw.bytes)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ETag of each cached file as B2 reported it when the file was cached
+var etagDir = filepath.Join(cacheDir, ".etags")
+
+// How often a cached file is checked against B2 with a HeadObject before
+// being served, set from ETAG_VALIDATE_INTERVAL. 0 never checks.
+var etagValidateInterval time.Duration
+
+func etagPath(key string) string {
+	return filepath.Join(etagDir, localName(key))
+}
+
+func storeETag(key, etag string) {
+	if etag == "" {
+		return
+	}
+
+	path := etagPath(key)
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err == nil {
+		err = os.WriteFile(path, []byte(etag), 0644)
+	}
+	if err != nil {
+		log.Printf("Failed to store ETag of %s: %v", key, err)
+	}
+}
+
+func storedETag(key string) string {
+	data, err := os.ReadFile(etagPath(key))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// When each cached file last matched B2, so a busy file costs one
+// HeadObject per interval rather than per request
+type etagValidations struct {
+	mu      sync.Mutex
+	checked map[string]time.Time
+}
+
+var validatedETags = &etagValidations{checked: make(map[string]time.Time)}
+
+func (v *etagValidations) due(key string) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return time.Since(v.checked[key]) >= etagValidateInterval
+}
+
+func (v *etagValidations) record(key string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.checked[key] = time.Now()
+}
+
+func (v *etagValidations) forget(key string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	delete(v.checked, key)
+}
+
+func etagCheckDue(fileName string) bool {
+	return etagValidateInterval > 0 && validatedETags.due(fileName)
+}
+
+// Whether B2 still has the object version cached bytes were taken from. B2
+// errors other than a missing object count as a match, so an outage doesn't
+// throw the cache away.
+func etagMatches(b2Client B2, fileName, etag string) bool {
+	head, err := b2Client.headFile(fileName)
+	if err != nil && !errors.Is(err, errNotFound) {
+		log.Printf("Failed to validate cached %s: %v", fileName, err)
+		return true
+	}
+	if err == nil && (head.ETag == "" || head.ETag == etag) {
+		validatedETags.record(fileName)
+		return true
+	}
+	return false
+}
+
+// Whether the cached copy of fileName may be served. When a check is due
+// and the object's ETag no longer matches the one stored with the copy,
+// or none was stored, the copy is dropped so the caller fetches it afresh.
+func validateCached(b2Client B2, fileName string) bool {
+	if !etagCheckDue(fileName) || etagMatches(b2Client, fileName, storedETag(fileName)) {
+		return true
+	}
+
+	log.Printf("Cached %s no longer matches B2, invalidating it", fileName)
+	invalidateCached(fileName)
+	return false
+}
+
+// Drop every cached copy of fileName: on disk, in memory and in the range
+// cache
+func invalidateCached(fileName string) {
+	evictionMu.Lock()
+	defer evictionMu.Unlock()
+
+	path := cachePath(fileName)
+	for _, stale := range []string{path, path + compressedSuffix, etagPath(fileName)} {
+		if err := os.Remove(stale); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove %s: %v", stale, err)
+		}
+	}
+	memCache.remove(fileName)
+	forgetRanges(fileName)
+	validatedETags.forget(fileName)
+}
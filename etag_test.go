@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func useETagValidation(t *testing.T, interval time.Duration) {
+	previous := etagValidateInterval
+	t.Cleanup(func() {
+		etagValidateInterval = previous
+		validatedETags = &etagValidations{checked: make(map[string]time.Time)}
+	})
+	etagValidateInterval = interval
+	validatedETags = &etagValidations{checked: make(map[string]time.Time)}
+}
+
+func hybridGet(t *testing.T, client B2, rangeHeader string) (*httptest.ResponseRecorder, bool) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/stream?file=track.mp3", nil)
+	req.Header.Set("Range", rangeHeader)
+	rec := httptest.NewRecorder()
+	serve, hit := hybridServe(req, client, "track.mp3")
+	serve(rec)
+	return rec, hit
+}
+
+// Cache track.mp3 through a range request and wait for the backfill
+func backfillTrack(t *testing.T, client *fakeB2) {
+	t.Helper()
+	hybridGet(t, client, "bytes=0-9")
+	waitForFile(t, cachePath("track.mp3"))
+	waitForFile(t, etagPath("track.mp3"))
+}
+
+func TestChangedETagInvalidatesCache(t *testing.T) {
+	t.Chdir(t.TempDir())
+	t.Cleanup(backfills.Wait)
+	useETagValidation(t, time.Nanosecond)
+	original := bytes.Repeat([]byte("a"), 50_000)
+	client := newFakeB2(t, map[string][]byte{"track.mp3": original})
+	useSizedListing(t, client)
+	backfillTrack(t, client)
+	if got := storedETag("track.mp3"); got != fakeETag(original) {
+		t.Fatalf("stored ETag %q, want %q", got, fakeETag(original))
+	}
+
+	if rec, hit := hybridGet(t, client, "bytes=0-9"); !hit || rec.Body.String() != "aaaaaaaaaa" {
+		t.Fatalf("hit %t body %q, want the unchanged file served from the cache", hit, rec.Body)
+	}
+
+	// The object is replaced in B2
+	replaced := bytes.Repeat([]byte("b"), 40_000)
+	client.mu.Lock()
+	client.files["track.mp3"] = replaced
+	client.mu.Unlock()
+
+	rec, hit := hybridGet(t, client, "bytes=0-9")
+	if hit || rec.Body.String() != "bbbbbbbbbb" {
+		t.Fatalf("hit %t body %q, want the new object fetched from B2", hit, rec.Body)
+	}
+
+	waitForFile(t, etagPath("track.mp3"))
+	waitForFile(t, cachePath("track.mp3"))
+	cached, err := os.ReadFile(cachePath("track.mp3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(cached, replaced) {
+		t.Fatal("the cache kept bytes of the old object")
+	}
+}
+
+func TestETagCheckedOncePerInterval(t *testing.T) {
+	t.Chdir(t.TempDir())
+	t.Cleanup(backfills.Wait)
+	useETagValidation(t, time.Hour)
+	client := newFakeB2(t, map[string][]byte{"track.mp3": bytes.Repeat([]byte("a"), 10_000)})
+	useSizedListing(t, client)
+	backfillTrack(t, client)
+
+	for range 3 {
+		if _, hit := hybridGet(t, client, "bytes=0-9"); !hit {
+			t.Fatal("expected a cache hit")
+		}
+	}
+	if client.heads != 1 {
+		t.Fatalf("%d HeadObject calls, want 1 within the interval", client.heads)
+	}
+
+	useETagValidation(t, 0)
+	hybridGet(t, client, "bytes=0-9")
+	if client.heads != 1 {
+		t.Fatal("validated with ETAG_VALIDATE_INTERVAL off")
+	}
+}
+
+func TestSparseFileKeepsFirstETag(t *testing.T) {
+	entry := &sparseFile{}
+	if !entry.sameObject(`"v1"`) || !entry.sameObject(`"v1"`) || !entry.sameObject("") {
+		t.Fatal("the first version should be accepted, along with responses without an ETag")
+	}
+	if entry.sameObject(`"v2"`) {
+		t.Fatal("accepted bytes of a different object version")
+	}
+}
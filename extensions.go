@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Extensions of the keys listed and selected as tracks, set from
+// AUDIO_EXTENSIONS, so cover art, READMEs and .DS_Store files sharing the
+// bucket are never picked. The default is every format the server has a
+// content type for. Matched case-insensitively.
+var audioExtensions = defaultAudioExtensions()
+
+func defaultAudioExtensions() map[string]bool {
+	extensions := make(map[string]bool, len(audioContentTypes))
+	for ext := range audioContentTypes {
+		extensions[ext] = true
+	}
+	return extensions
+}
+
+// Parse AUDIO_EXTENSIONS, a comma-separated list like ".mp3,.ogg". The
+// leading dot is optional.
+func parseAudioExtensions(value string) (map[string]bool, error) {
+	extensions := map[string]bool{}
+	for _, ext := range strings.Split(value, ",") {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext == "" {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		if ext == "." || strings.ContainsAny(ext[1:], "./") {
+			return nil, fmt.Errorf("invalid extension %q", ext)
+		}
+		extensions[ext] = true
+	}
+	if len(extensions) == 0 {
+		return nil, fmt.Errorf("no extensions given")
+	}
+	return extensions, nil
+}
+
+func isAudio(fileName string) bool {
+	return audioExtensions[strings.ToLower(filepath.Ext(fileName))]
+}
+
+func filterAudio(fileNames []string) []string {
+	var audio []string
+	for _, name := range fileNames {
+		if isAudio(name) {
+			audio = append(audio, name)
+		}
+	}
+	return audio
+}
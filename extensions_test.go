@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sort"
+	"testing"
+)
+
+func useAudioExtensions(t *testing.T, value string) {
+	previous := audioExtensions
+	t.Cleanup(func() { audioExtensions = previous })
+	extensions, err := parseAudioExtensions(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	audioExtensions = extensions
+}
+
+// A bucket with the tracks sharing it with cover art, notes and junk
+var mixedBucket = map[string][]byte{
+	"album/01 Intro.mp3": []byte("a"),
+	"album/02 Song.OGG":  []byte("b"),
+	"album/03 Live.Flac": []byte("c"),
+	"album/cover.jpg":    []byte("jpeg"),
+	"album/README.txt":   []byte("notes"),
+	".DS_Store":          []byte("junk"),
+	"album/LICENSE":      []byte("no extension"),
+	"album.mp3/notes":    []byte("a directory named like a track"),
+}
+
+func TestListFilesKeepsOnlyAudio(t *testing.T) {
+	stub := newS3Stub(t, mixedBucket)
+	stub.useEnv(t)
+	client, err := b2ClientFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := client.listFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	if want := []string{"album/01 Intro.mp3", "album/02 Song.OGG", "album/03 Live.Flac"}; !slices.Equal(files, want) {
+		t.Fatalf("listed %q, want only the tracks, whatever their extension's case", files)
+	}
+}
+
+func TestSelectionAndSearchSkipOtherKeys(t *testing.T) {
+	setB2Env(t)
+	useListing(t, []string{"album/01 Intro.mp3", "album/cover.jpg", "album/LICENSE", "album/02 Song.Ogg"})
+	useAudioExtensions(t, "mp3, OGG")
+
+	candidates, err := selectionCandidates(newFakeB2(t, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"album/01 Intro.mp3", "album/02 Song.Ogg"}; !slices.Equal(candidates, want) {
+		t.Fatalf("candidates %q, want %q", candidates, want)
+	}
+
+	rec := httptest.NewRecorder()
+	search(rec, httptest.NewRequest(http.MethodGet, "/search?q=album", nil))
+	var response searchResponse
+	if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"album/01 Intro.mp3", "album/02 Song.Ogg"}; !slices.Equal(response.Results, want) {
+		t.Fatalf("search found %q, want %q", response.Results, want)
+	}
+}
+
+func TestParseAudioExtensions(t *testing.T) {
+	extensions, err := parseAudioExtensions(" .MP3,ogg ,,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(extensions) != 2 || !extensions[".mp3"] || !extensions[".ogg"] {
+		t.Fatalf("got %v", extensions)
+	}
+
+	for _, value := range []string{"", ",", ".", ".tar.gz", "a/b"} {
+		if _, err := parseAudioExtensions(value); err == nil {
+			t.Errorf("%q: expected an error", value)
+		}
+	}
+}
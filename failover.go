@@ -0,0 +1,227 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultFailoverThreshold = 3
+	defaultFailoverCooldown  = 30 * time.Second
+)
+
+type b2Endpoint struct {
+	url    string
+	region string
+}
+
+// Secondary endpoints tried in order when the primary ENDPOINT is failing,
+// set from FAILOVER_ENDPOINTS
+var failoverEndpoints []b2Endpoint
+
+// Parse FAILOVER_ENDPOINTS: comma-separated endpoint URLs, each optionally
+// prefixed with "region=" when it differs from REGION
+func parseFailoverEndpoints(value, defaultRegion string) ([]b2Endpoint, error) {
+	var endpoints []b2Endpoint
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		endpoint := b2Endpoint{url: entry, region: defaultRegion}
+		if region, url, ok := strings.Cut(entry, "="); ok {
+			endpoint = b2Endpoint{url: strings.TrimSpace(url), region: strings.TrimSpace(region)}
+		}
+		if !strings.HasPrefix(endpoint.url, "http://") && !strings.HasPrefix(endpoint.url, "https://") {
+			return nil, fmt.Errorf("invalid endpoint %q, expected an http(s) URL", entry)
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints, nil
+}
+
+// Health of each endpoint across requests. After threshold consecutive
+// failures an endpoint is skipped for the cooldown, then tried again; one
+// success brings it back.
+type endpointHealth struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  map[string]int
+	downUntil map[string]time.Time
+}
+
+var endpointStates = newEndpointHealth(defaultFailoverThreshold, defaultFailoverCooldown)
+
+func newEndpointHealth(threshold int, cooldown time.Duration) *endpointHealth {
+	return &endpointHealth{
+		threshold: threshold,
+		cooldown:  cooldown,
+		failures:  make(map[string]int),
+		downUntil: make(map[string]time.Time),
+	}
+}
+
+func (h *endpointHealth) available(endpoint string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return !time.Now().Before(h.downUntil[endpoint])
+}
+
+func (h *endpointHealth) recordFailure(endpoint string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.failures[endpoint]++
+	if h.failures[endpoint] >= h.threshold {
+		if _, down := h.downUntil[endpoint]; !down {
+			log.Printf("Endpoint %s failed %d times in a row, failing over for %s", endpoint, h.failures[endpoint], h.cooldown)
+		}
+		h.downUntil[endpoint] = time.Now().Add(h.cooldown)
+	}
+}
+
+func (h *endpointHealth) recordSuccess(endpoint string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, down := h.downUntil[endpoint]; down {
+		log.Printf("Endpoint %s recovered", endpoint)
+	}
+	delete(h.failures, endpoint)
+	delete(h.downUntil, endpoint)
+}
+
+type endpointStatus struct {
+	Endpoint  string     `json:"endpoint"`
+	Failures  int        `json:"consecutive_failures"`
+	DownUntil *time.Time `json:"down_until,omitempty"`
+}
+
+func (h *endpointHealth) status(endpoints []string) []endpointStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	statuses := make([]endpointStatus, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		status := endpointStatus{Endpoint: endpoint, Failures: h.failures[endpoint]}
+		if until, ok := h.downUntil[endpoint]; ok && time.Now().Before(until) {
+			status.DownUntil = &until
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+type endpointClient struct {
+	endpoint string
+	client   B2
+}
+
+// A B2 client spread over several endpoints, sending each call to the first
+// healthy one and moving on when an endpoint is unreachable or throttling
+type failoverClient struct {
+	clients []endpointClient // primary first
+}
+
+// Errors that say the endpoint rather than the request is at fault
+func isEndpointFailure(err error) bool {
+	return errors.Is(err, errBucketUnreachable) || errors.Is(err, errThrottled)
+}
+
+func withFailover[T any](f *failoverClient, call func(B2) (T, error)) (T, error) {
+	var candidates []endpointClient
+	for _, c := range f.clients {
+		if endpointStates.available(c.endpoint) {
+			candidates = append(candidates, c)
+		}
+	}
+	if len(candidates) == 0 {
+		// Every endpoint is cooling down; trying them beats failing outright
+		candidates = f.clients
+	}
+
+	var result T
+	var err error
+	for i, c := range candidates {
+		result, err = call(c.client)
+		if !isEndpointFailure(err) {
+			endpointStates.recordSuccess(c.endpoint)
+			return result, err
+		}
+
+		endpointStates.recordFailure(c.endpoint)
+		if i < len(candidates)-1 {
+			log.Printf("Endpoint %s failed, trying %s: %v", c.endpoint, candidates[i+1].endpoint, err)
+		}
+	}
+	return result, err
+}
+
+func (f *failoverClient) listFiles() ([]string, error) {
+	return withFailover(f, func(c B2) ([]string, error) { return c.listFiles() })
+}
+
+func (f *failoverClient) listObjects() ([]objectInfo, error) {
+	return withFailover(f, func(c B2) ([]objectInfo, error) { return c.listObjects() })
+}
+
+func (f *failoverClient) listPrefix(prefix, delimiter string) ([]objectInfo, []string, error) {
+	type result struct {
+		objects  []objectInfo
+		prefixes []string
+	}
+	r, err := withFailover(f, func(c B2) (result, error) {
+		objects, prefixes, err := c.listPrefix(prefix, delimiter)
+		return result{objects, prefixes}, err
+	})
+	return r.objects, r.prefixes, err
+}
+
+func (f *failoverClient) headFile(fileName string) (*objectHead, error) {
+	return withFailover(f, func(c B2) (*objectHead, error) { return c.headFile(fileName) })
+}
+
+func (f *failoverClient) headBucket() error {
+	_, err := withFailover(f, func(c B2) (struct{}, error) { return struct{}{}, c.headBucket() })
+	return err
+}
+
+func (f *failoverClient) probeListing() error {
+	_, err := withFailover(f, func(c B2) (struct{}, error) { return struct{}{}, c.probeListing() })
+	return err
+}
+
+func (f *failoverClient) selectRandomFile(fileNames []string) (string, error) {
+	return f.clients[0].client.selectRandomFile(fileNames)
+}
+
+func (f *failoverClient) downloadFile(fileName string) (string, error) {
+	return withFailover(f, func(c B2) (string, error) { return c.downloadFile(fileName) })
+}
+
+func (f *failoverClient) downloadVersion(fileName, versionID string) (string, error) {
+	return withFailover(f, func(c B2) (string, error) { return c.downloadVersion(fileName, versionID) })
+}
+
+func (f *failoverClient) fetchVersion(fileName, versionID string) (string, error) {
+	return withFailover(f, func(c B2) (string, error) { return c.fetchVersion(fileName, versionID) })
+}
+
+func (f *failoverClient) fetchRange(fileName, rangeHeader string) (*rangeResult, error) {
+	return withFailover(f, func(c B2) (*rangeResult, error) { return c.fetchRange(fileName, rangeHeader) })
+}
+
+// Endpoints in failover order, for reporting their health
+func configuredEndpoints() []string {
+	endpoints := []string{envString("ENDPOINT", "")}
+	for _, endpoint := range failoverEndpoints {
+		endpoints = append(endpoints, endpoint.url)
+	}
+	return endpoints
+}
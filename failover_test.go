@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// An endpoint whose bucket is gone, as during a regional outage. S3 clients
+// don't retry a NoSuchBucket, so each call fails once and fast.
+func outageEndpoint(t *testing.T) (*httptest.Server, *atomic.Int32) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `<Error><Code>NoSuchBucket</Code><Message>The specified bucket does not exist</Message></Error>`)
+	}))
+	t.Cleanup(server.Close)
+	return server, &calls
+}
+
+func useFailover(t *testing.T, threshold int, endpoints ...string) {
+	previousEndpoints, previousStates := failoverEndpoints, endpointStates
+	t.Cleanup(func() { failoverEndpoints, endpointStates = previousEndpoints, previousStates })
+
+	failoverEndpoints = nil
+	for _, endpoint := range endpoints {
+		failoverEndpoints = append(failoverEndpoints, b2Endpoint{url: endpoint, region: "us-east-1"})
+	}
+	endpointStates = newEndpointHealth(threshold, time.Hour)
+}
+
+func TestFailoverToSecondaryEndpoint(t *testing.T) {
+	primary, primaryCalls := outageEndpoint(t)
+	secondary := newS3Stub(t, map[string][]byte{"a.mp3": []byte("from the secondary")})
+	setB2Env(t)
+	t.Setenv("ENDPOINT", primary.URL)
+	useFailover(t, 2, secondary.URL)
+
+	client, err := b2ClientFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for range 3 {
+		result, err := client.fetchRange("a.mp3", "")
+		if err != nil {
+			t.Fatalf("fetch failed despite a healthy secondary: %v", err)
+		}
+		body, _ := io.ReadAll(result.body)
+		result.body.Close()
+		if string(body) != "from the secondary" {
+			t.Fatalf("got %q", body)
+		}
+	}
+	if files, err := client.listFiles(); err != nil || len(files) != 1 {
+		t.Fatalf("listing via the secondary: %q %v", files, err)
+	}
+
+	// After the threshold the primary is skipped instead of tried first
+	if calls := primaryCalls.Load(); calls != 2 {
+		t.Fatalf("primary called %d times, want it skipped after 2 failures", calls)
+	}
+
+	rec := httptest.NewRecorder()
+	stats(rec, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	var response statsResponse
+	if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Endpoints) != 2 || response.Endpoints[0].DownUntil == nil || response.Endpoints[1].DownUntil != nil {
+		t.Fatalf("/stats endpoints %+v, want the primary down and the secondary up", response.Endpoints)
+	}
+}
+
+func TestFailoverRecoversPrimary(t *testing.T) {
+	primary := newS3Stub(t, map[string][]byte{"a.mp3": []byte("from the primary")})
+	secondary := newS3Stub(t, map[string][]byte{"a.mp3": []byte("from the secondary")})
+	setB2Env(t)
+	t.Setenv("ENDPOINT", primary.URL)
+	useFailover(t, 1, secondary.URL)
+
+	client, err := b2ClientFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The primary's cooldown has run out, so it is tried again and a success
+	// brings it back
+	endpointStates.recordFailure(primary.URL)
+	endpointStates.downUntil[primary.URL] = time.Now().Add(-time.Second)
+
+	if _, err := client.headFile("a.mp3"); err != nil {
+		t.Fatal(err)
+	}
+	if primary.requestCount() != 1 || secondary.requestCount() != 0 {
+		t.Fatalf("primary served %d, secondary %d; want the recovered primary", primary.requestCount(), secondary.requestCount())
+	}
+	if !endpointStates.available(primary.URL) || endpointStates.failures[primary.URL] != 0 {
+		t.Fatal("a success should clear the primary's failures")
+	}
+}
+
+func TestRequestErrorsDontFailOver(t *testing.T) {
+	primary := newS3Stub(t, map[string][]byte{})
+	secondary := newS3Stub(t, map[string][]byte{"a.mp3": []byte("a")})
+	setB2Env(t)
+	t.Setenv("ENDPOINT", primary.URL)
+	useFailover(t, 1, secondary.URL)
+
+	client, err := b2ClientFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A missing key is the request's fault, not the endpoint's
+	if _, err := client.headFile("a.mp3"); err == nil {
+		t.Fatal("expected the primary's not found")
+	}
+	if secondary.requestCount() != 0 || !endpointStates.available(primary.URL) {
+		t.Fatal("a not found shouldn't fail over")
+	}
+}
+
+func TestParseFailoverEndpoints(t *testing.T) {
+	endpoints, err := parseFailoverEndpoints(" https://s3.eu-central-003.backblazeb2.com , eu-central-003=https://other.example.com,", "us-east-5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []b2Endpoint{
+		{url: "https://s3.eu-central-003.backblazeb2.com", region: "us-east-5"},
+		{url: "https://other.example.com", region: "eu-central-003"},
+	}
+	if len(endpoints) != len(want) || endpoints[0] != want[0] || endpoints[1] != want[1] {
+		t.Fatalf("got %+v, want %+v", endpoints, want)
+	}
+
+	if _, err := parseFailoverEndpoints("s3.example.com", "us-east-5"); err == nil {
+		t.Fatal("expected an error for an endpoint without a scheme")
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"path/filepath"
+)
+
+// Local clip (a "technical difficulties" message, say) played when no track
+// can be selected because the bucket is empty or B2 is unreachable. Set from
+// FALLBACK_FILE; empty keeps returning errors instead.
+var fallbackFile string
+
+// Serve the fallback clip in place of a selected track, reporting whether
+// one is configured
+func serveFallback(w http.ResponseWriter, req *http.Request, cause error) bool {
+	if fallbackFile == "" {
+		return false
+	}
+
+	log.Printf("FALLBACK: no track available, serving %s: %v", fallbackFile, cause)
+	w.Header().Set("Cache-Control", "no-store")
+	noTransform(w.Header())
+	http.ServeFile(w, req, fallbackFile)
+	return true
+}
+
+// The fallback clip as a radio track, or the original error without one
+func fallbackRadioTrack(cause error) radioTrack {
+	if fallbackFile == "" {
+		return radioTrack{err: cause}
+	}
+
+	log.Printf("FALLBACK: no radio track available, playing %s: %v", fallbackFile, cause)
+	return radioTrack{name: filepath.Base(fallbackFile), path: fallbackFile, fallback: true}
+}
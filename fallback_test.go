@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func useFallback(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "difficulties.mp3")
+	if err := os.WriteFile(path, []byte("technical difficulties"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	previous := fallbackFile
+	t.Cleanup(func() { fallbackFile = previous })
+	fallbackFile = path
+	return path
+}
+
+func TestStreamFallsBackOnEmptyBucket(t *testing.T) {
+	useFallback(t)
+	useStation(t, modeRandom)
+	stub := newS3Stub(t, map[string][]byte{})
+	stub.useEnv(t)
+	useListing(t, nil)
+
+	rec := httptest.NewRecorder()
+	newStreamHandler(t).stream(rec, httptest.NewRequest(http.MethodGet, "/stream", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "technical difficulties" {
+		t.Fatalf("status %d body %q, want the fallback clip", rec.Code, rec.Body)
+	}
+	if !strings.HasPrefix(rec.Header().Get("Cache-Control"), "no-store") {
+		t.Fatal("the fallback clip shouldn't be cached by clients")
+	}
+
+	// Once tracks are back and the listing expires, selection resumes
+	stub.mu.Lock()
+	stub.objects["song.mp3"] = []byte("song")
+	stub.mu.Unlock()
+	listing.mu.Lock()
+	listing.fetchedAt = time.Time{}
+	listing.mu.Unlock()
+	rec = httptest.NewRecorder()
+	newStreamHandler(t).stream(rec, httptest.NewRequest(http.MethodGet, "/stream", nil))
+	if rec.Code != redirectStatus {
+		t.Fatalf("status %d, want a redirect to the recovered track", rec.Code)
+	}
+}
+
+func TestStreamFallsBackOnListingError(t *testing.T) {
+	useFallback(t)
+	useStation(t, modeRandom)
+	stub := newS3Stub(t, map[string][]byte{"song.mp3": []byte("song")})
+	stub.denyList = true
+	stub.useEnv(t)
+	useListing(t, nil)
+
+	rec := httptest.NewRecorder()
+	newStreamHandler(t).stream(rec, httptest.NewRequest(http.MethodGet, "/stream", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "technical difficulties" {
+		t.Fatalf("status %d body %q, want the fallback clip", rec.Code, rec.Body)
+	}
+
+	// Without a fallback configured the error is reported as before
+	fallbackFile = ""
+	rec = httptest.NewRecorder()
+	newStreamHandler(t).stream(rec, httptest.NewRequest(http.MethodGet, "/stream", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("status %d, want 500 without a fallback", rec.Code)
+	}
+}
+
+func TestRadioTrackFallback(t *testing.T) {
+	path := useFallback(t)
+	st := useStation(t, modeRandom)
+	useListing(t, nil)
+
+	empty := newFakeB2(t, map[string][]byte{})
+	failing := newFakeB2(t, map[string][]byte{"song.mp3": nil})
+	failing.listErr = errors.New("B2 unreachable")
+
+	for name, client := range map[string]*fakeB2{"empty bucket": empty, "listing error": failing} {
+		track := nextRadioTrack(context.Background(), st, client, ".mp3")
+		if track.err != nil || !track.fallback || track.path != path {
+			t.Fatalf("%s: got %+v, want the fallback clip", name, track)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/xml"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Base URL stream links in /feed.opml point at, set from PUBLIC_URL. Empty
+// uses the scheme and host the request came in on.
+var publicURL string
+
+// Env suffix for a station's per-station settings: "late-night" reads
+// STATION_TITLE_LATE_NIGHT
+func stationEnvSuffix(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+type opmlDocument struct {
+	XMLName xml.Name      `xml:"opml"`
+	Version string        `xml:"version,attr"`
+	Title   string        `xml:"head>title"`
+	Created string        `xml:"head>dateCreated"`
+	Outline []opmlOutline `xml:"body>outline"`
+}
+
+type opmlOutline struct {
+	Type        string `xml:"type,attr"`
+	Text        string `xml:"text,attr"`
+	Description string `xml:"description,attr,omitempty"`
+	URL         string `xml:"URL,attr"`
+}
+
+func baseURL(req *http.Request) string {
+	if publicURL != "" {
+		return strings.TrimSuffix(publicURL, "/")
+	}
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + req.Host
+}
+
+// The stations and their /radio stream URLs as an OPML 2.0 outline, for
+// directories and aggregators to discover
+func feedOPML(w http.ResponseWriter, req *http.Request) {
+	base := baseURL(req)
+
+	doc := opmlDocument{
+		Version: "2.0",
+		Title:   "radio-paje stations",
+		Created: time.Now().UTC().Format(time.RFC1123),
+	}
+	for _, st := range stations.all() {
+		streamURL := base + "/radio"
+		if st.name != defaultStationName {
+			streamURL += "?station=" + url.QueryEscape(st.name)
+		}
+		doc.Outline = append(doc.Outline, opmlOutline{
+			Type:        "audio",
+			Text:        st.title,
+			Description: st.description,
+			URL:         streamURL,
+		})
+	}
+
+	w.Header().Set("Content-Type", "text/x-opml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(doc); err != nil {
+		log.Printf("Failed to encode station feed: %v", err)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFeedListsConfiguredStations(t *testing.T) {
+	t.Setenv("STATION_TITLE_LATE_NIGHT", "Late Night & Jazz")
+	t.Setenv("STATION_DESCRIPTION_LATE_NIGHT", "Slow records <after midnight>")
+	useStation(t, modeRandom)
+	if err := stations.add("late-night", "jazz/", selectorConfig{mode: modeRandom, seed: 1}); err != nil {
+		t.Fatal(err)
+	}
+	previous := publicURL
+	t.Cleanup(func() { publicURL = previous })
+	publicURL = "https://radio.example/"
+
+	rec := httptest.NewRecorder()
+	feedOPML(rec, httptest.NewRequest(http.MethodGet, "/feed.opml", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "text/x-opml; charset=utf-8" {
+		t.Fatalf("status %d type %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+
+	var doc opmlDocument
+	if err := xml.Unmarshal(rec.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("invalid XML: %v\n%s", err, rec.Body)
+	}
+	want := map[string]opmlOutline{
+		"https://radio.example/radio": {Type: "audio", Text: "radio-paje " + defaultStationName},
+		"https://radio.example/radio?station=late-night": {
+			Type:        "audio",
+			Text:        "Late Night & Jazz",
+			Description: "Slow records <after midnight>",
+		},
+	}
+	if len(doc.Outline) != len(want) {
+		t.Fatalf("got %d outlines, want %d", len(doc.Outline), len(want))
+	}
+	for _, outline := range doc.Outline {
+		expected, ok := want[outline.URL]
+		expected.URL = outline.URL
+		if !ok || outline != expected {
+			t.Errorf("unexpected outline %+v", outline)
+		}
+	}
+}
+
+func TestFeedUsesRequestHost(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/feed.opml", nil)
+	req.Host = "paje.local:8080"
+	if got := baseURL(req); got != "http://paje.local:8080" {
+		t.Fatalf("got %s", got)
+	}
+}
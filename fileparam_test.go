@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestFileParamDecoding(t *testing.T) {
+	useListing(t, []string{"My Song.mp3", "C++ Rocks.mp3", "a+b.mp3", "a b.mp3"})
+
+	tests := []struct {
+		rawQuery string
+		want     string
+	}{
+		{"file=My%20Song.mp3", "My Song.mp3"},
+		{"file=My+Song.mp3", "My Song.mp3"},
+		{"file=C%2B%2B%20Rocks.mp3", "C++ Rocks.mp3"},
+		// Unescaped plus signs that only make sense as literal ones
+		{"file=C++%20Rocks.mp3", "C++ Rocks.mp3"},
+		// Both readings are listed, so the standard decoding wins
+		{"file=a+b.mp3", "a b.mp3"},
+		{"file=a%2Bb.mp3", "a+b.mp3"},
+		{"station=jazz&file=My+Song.mp3", "My Song.mp3"},
+		{"file=Unlisted+Name.mp3", "Unlisted Name.mp3"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/stream?"+tt.rawQuery, nil)
+		if got := fileParam(req); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.rawQuery, got, tt.want)
+		}
+	}
+}
+
+func TestRedirectEscapesSpecialCharacters(t *testing.T) {
+	setB2Env(t)
+	useStation(t, modeRandom)
+
+	for _, name := range []string{"My Song.mp3", "C++ Rocks.mp3", "100% #1?.mp3"} {
+		useListing(t, []string{name})
+
+		rec := httptest.NewRecorder()
+		newStreamHandler(t).stream(rec, httptest.NewRequest(http.MethodGet, "/stream", nil))
+		location, err := url.Parse(rec.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fileParam(httptest.NewRequest(http.MethodGet, location.String(), nil)); got != name {
+			t.Errorf("redirect %s decodes to %q, want %q", location, got, name)
+		}
+	}
+}
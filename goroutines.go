@@ -0,0 +1,58 @@
+package main
+
+import (
+	"log"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultGoroutineCheckInterval = time.Minute
+	defaultGoroutinesPerStream    = 10
+	defaultGoroutineSlack         = 50
+)
+
+// Watches the goroutine count against the number of active streams, so a
+// stream path that leaks goroutines shows up as a warning long before the
+// process runs out of memory
+type goroutineMonitor struct {
+	baseline  int
+	perStream int // allowance per active stream
+	slack     int // allowance for idle connections and background work
+
+	last atomic.Int64
+}
+
+var goroutines *goroutineMonitor
+
+// Take the current count as the baseline, before any streams have started
+func newGoroutineMonitor(perStream, slack int) *goroutineMonitor {
+	m := &goroutineMonitor{baseline: runtime.NumGoroutine(), perStream: perStream, slack: slack}
+	m.last.Store(int64(m.baseline))
+	return m
+}
+
+// Most goroutines expected with active streams running
+func (m *goroutineMonitor) limit(active int64) int {
+	return m.baseline + m.slack + m.perStream*int(active)
+}
+
+// Sample the goroutine count, reporting whether it exceeds the limit
+func (m *goroutineMonitor) check(active int64) (int, bool) {
+	count := runtime.NumGoroutine()
+	m.last.Store(int64(count))
+	return count, count > m.limit(active)
+}
+
+func (m *goroutineMonitor) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		active := streams.active.Load()
+		if count, over := m.check(active); over {
+			log.Printf("Possible goroutine leak: %d goroutines with %d active streams (limit %d)", count, active, m.limit(active))
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// Wait for background goroutines to settle at or below want
+func settledGoroutines(want int) int {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		count := runtime.NumGoroutine()
+		if count <= want || time.Now().After(deadline) {
+			return count
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestStreamsDontLeakGoroutines(t *testing.T) {
+	usePlaylistBucket(t)
+	useStation(t, modeRandom)
+
+	// Share one S3 transport like main does, closing its connections soon
+	// after they go idle so they aren't counted as leaks
+	previous := clientOptions
+	t.Cleanup(func() { clientOptions = previous })
+	clientOptions.idleConnTimeout = 50 * time.Millisecond
+	clientOptions.sharedHTTPClient = clientOptions.httpClient()
+
+	server := httptest.NewServer(http.HandlerFunc(playList))
+	defer server.Close()
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+
+	// Serve one playlist first so anything started lazily is in the baseline
+	resp, err := client.Get(server.URL + "/play?list=one.mp3,two.mp3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	monitor := newGoroutineMonitor(defaultGoroutinesPerStream, 0)
+	baseline := settledGoroutines(monitor.baseline)
+
+	const connections = 20
+	var cancels []context.CancelFunc
+	for range connections {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancels = append(cancels, cancel)
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/play?list=one.mp3,two.mp3&loop=true", nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if _, err := io.ReadFull(resp.Body, make([]byte, 64)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if active := streams.active.Load(); active != connections {
+		t.Fatalf("%d active streams, want %d", active, connections)
+	}
+	if count, over := monitor.check(connections); over {
+		t.Fatalf("%d goroutines for %d streams is over the limit %d", count, connections, monitor.limit(connections))
+	}
+
+	for _, cancel := range cancels {
+		cancel()
+	}
+	for deadline := time.Now().Add(5 * time.Second); streams.active.Load() > 0 && time.Now().Before(deadline); {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if count := settledGoroutines(baseline); count > baseline {
+		t.Fatalf("%d goroutines after every connection closed, baseline %d", count, baseline)
+	}
+	if active := streams.active.Load(); active != 0 {
+		t.Fatalf("%d streams still active", active)
+	}
+	if _, over := monitor.check(0); over {
+		t.Fatal("the monitor still sees a leak once the streams are gone")
+	}
+}
+
+func TestGoroutineMonitorFlagsGrowth(t *testing.T) {
+	monitor := newGoroutineMonitor(1, 0)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	for range 5 {
+		go func() { <-stop }()
+	}
+
+	count, over := monitor.check(0)
+	if !over {
+		t.Fatalf("%d goroutines with no streams should exceed the limit %d", count, monitor.limit(0))
+	}
+	if monitor.last.Load() != int64(count) {
+		t.Fatalf("last sample %d, want %d", monitor.last.Load(), count)
+	}
+	if _, over := monitor.check(10); over {
+		t.Fatal("ten streams explain five extra goroutines")
+	}
+}
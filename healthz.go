@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	healthOK       = "ok"
+	healthDegraded = "degraded"
+	healthFailing  = "failing"
+)
+
+const defaultMinFreeBytes = 1 << 30
+
+// Free space on the cache disk below which the verbose health check reports
+// degraded, so an alert fires before the cache fills the disk
+var minFreeBytes int64 = defaultMinFreeBytes
+
+type healthCheck struct {
+	Status    string  `json:"status"`
+	LatencyMs float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+	FreeBytes *uint64 `json:"free_bytes,omitempty"`
+}
+
+type healthReport struct {
+	Status      string                 `json:"status"`
+	Phase       string                 `json:"phase"`
+	Maintenance maintenanceState       `json:"maintenance"`
+	Checks      map[string]healthCheck `json:"checks"`
+}
+
+// Liveness probe. The default response does no I/O; ?verbose=true runs each
+// dependency check and reports its timing.
+func healthz(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("X-Lifecycle-Phase", currentPhase())
+	// Still live while in maintenance, so probes don't restart the server
+	state := maintenance.get()
+	if state.Enabled {
+		w.Header().Set("X-Maintenance", "true")
+	}
+	if req.URL.Query().Get("verbose") != "true" {
+		if state.Enabled {
+			fmt.Fprintln(w, "ok (maintenance)")
+			return
+		}
+		fmt.Fprintln(w, "ok")
+		return
+	}
+
+	report := healthReport{
+		Status:      healthOK,
+		Phase:       currentPhase(),
+		Maintenance: state,
+		Checks: map[string]healthCheck{
+			"b2_list": checkB2Listing(),
+		},
+	}
+	if cacheEnabled {
+		report.Checks["cache_write"] = checkCacheWritable()
+		report.Checks["disk_free"] = checkDiskFree()
+	}
+
+	for _, check := range report.Checks {
+		switch {
+		case check.Status == healthFailing:
+			report.Status = healthFailing
+		case check.Status == healthDegraded && report.Status == healthOK:
+			report.Status = healthDegraded
+		}
+	}
+
+	if report.Status == healthFailing {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeJSON(w, report)
+}
+
+// Run a check, recording how long it took and turning an error into a
+// failing status
+func timeCheck(run func(*healthCheck) error) healthCheck {
+	check := healthCheck{Status: healthOK}
+
+	start := time.Now()
+	err := run(&check)
+	check.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+
+	if err != nil {
+		check.Status = healthFailing
+		check.Error = err.Error()
+	}
+	return check
+}
+
+func checkB2Listing() healthCheck {
+	return timeCheck(func(*healthCheck) error {
+		b2Client, err := b2ClientFromEnv()
+		if err != nil {
+			return err
+		}
+		return b2Client.probeListing()
+	})
+}
+
+func checkCacheWritable() healthCheck {
+	return timeCheck(func(*healthCheck) error {
+		for _, shard := range cacheShards {
+			if err := checkWritable(shard); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func checkWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(dir, ".healthz-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := file.WriteString("ok"); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func checkDiskFree() healthCheck {
+	return timeCheck(func(check *healthCheck) error {
+		// The fullest shard is the one that runs out first
+		var free uint64
+		for i, shard := range cacheShards {
+			shardFree, err := diskFree(shard)
+			if err != nil {
+				return err
+			}
+			if i == 0 || shardFree < free {
+				free = shardFree
+			}
+		}
+
+		check.FreeBytes = &free
+		if minFreeBytes > 0 && free < uint64(minFreeBytes) {
+			check.Status = healthDegraded
+		}
+		return nil
+	})
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHealthzDefaultIsCheap(t *testing.T) {
+	rec := httptest.NewRecorder()
+	healthz(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "ok\n" {
+		t.Fatalf("status %d body %q", rec.Code, rec.Body)
+	}
+}
+
+func TestHealthzVerbose(t *testing.T) {
+	t.Chdir(t.TempDir())
+	stub := newS3Stub(t, map[string][]byte{"a.mp3": {1}})
+	stub.useEnv(t)
+	previous := minFreeBytes
+	t.Cleanup(func() { minFreeBytes = previous })
+
+	verbose := func() (int, map[string]any) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		healthz(rec, httptest.NewRequest(http.MethodGet, "/healthz?verbose=true", nil))
+		var report map[string]any
+		if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+			t.Fatal(err)
+		}
+		return rec.Code, report
+	}
+
+	minFreeBytes = 1
+	code, report := verbose()
+	if code != http.StatusOK || report["status"] != healthOK {
+		t.Fatalf("status %d report %v, want ok", code, report)
+	}
+	checks, ok := report["checks"].(map[string]any)
+	if !ok || len(checks) != 3 {
+		t.Fatalf("checks %v, want b2_list, cache_write and disk_free", report["checks"])
+	}
+	for _, name := range []string{"b2_list", "cache_write", "disk_free"} {
+		check, ok := checks[name].(map[string]any)
+		if !ok {
+			t.Fatalf("missing check %s", name)
+		}
+		if check["status"] != healthOK {
+			t.Errorf("%s: %v", name, check)
+		}
+		if _, ok := check["latency_ms"].(float64); !ok {
+			t.Errorf("%s has no latency_ms", name)
+		}
+	}
+	if free, ok := checks["disk_free"].(map[string]any)["free_bytes"].(float64); !ok || free <= 0 {
+		t.Fatalf("disk_free reports %v free bytes", checks["disk_free"])
+	}
+
+	// Less free space than the threshold degrades without failing
+	minFreeBytes = math.MaxInt64
+	code, report = verbose()
+	if code != http.StatusOK || report["status"] != healthDegraded {
+		t.Fatalf("status %d report %v, want degraded", code, report)
+	}
+}
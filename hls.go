@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	hlsManifest              = "playlist.m3u8"
+	defaultHLSSegmentSeconds = 10
+)
+
+// Segmented renditions are kept beside the cache, hidden from eviction scans
+// like cover art, one directory per track
+var hlsDir = filepath.Join(cacheDir, ".hls")
+
+var (
+	// ffmpeg binary used to segment tracks, set from FFMPEG_PATH
+	ffmpegPath = "ffmpeg"
+
+	hlsSegmentSeconds = defaultHLSSegmentSeconds
+)
+
+var errFFmpegMissing = errors.New("ffmpeg not found")
+
+var hlsSegmentName = regexp.MustCompile(`^segment[0-9]+\.ts$`)
+
+var hlsContentTypes = map[string]string{
+	".m3u8": "application/vnd.apple.mpegurl",
+	".ts":   "video/mp2t",
+}
+
+// Builds in progress, so concurrent first requests for a track share one
+// ffmpeg run
+type hlsBuilder struct {
+	mu      sync.Mutex
+	pending map[string]chan struct{}
+}
+
+var hlsBuilds = &hlsBuilder{pending: make(map[string]chan struct{})}
+
+// Directory holding the track's manifest and segments, building it on first
+// use
+func (h *hlsBuilder) ensure(b2Client B2, fileName string) (string, error) {
+	dir := filepath.Join(hlsDir, localName(fileName))
+	for {
+		if _, err := os.Stat(filepath.Join(dir, hlsManifest)); err == nil {
+			return dir, nil
+		}
+
+		h.mu.Lock()
+		if wait, ok := h.pending[fileName]; ok {
+			h.mu.Unlock()
+			<-wait
+			// Use the finished build, or try again if it failed
+			continue
+		}
+		done := make(chan struct{})
+		h.pending[fileName] = done
+		h.mu.Unlock()
+
+		err := buildHLS(b2Client, fileName, dir)
+
+		h.mu.Lock()
+		delete(h.pending, fileName)
+		h.mu.Unlock()
+		close(done)
+
+		if err != nil {
+			return "", err
+		}
+		return dir, nil
+	}
+}
+
+// Segment the track with ffmpeg into a scratch directory, then move it into
+// place so requests never see a half-written manifest
+func buildHLS(b2Client B2, fileName, dir string) error {
+	ffmpeg, err := exec.LookPath(ffmpegPath)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errFFmpegMissing, err)
+	}
+
+	source, err := b2Client.downloadFile(fileName)
+	if err != nil {
+		return err
+	}
+	defer servingFiles.acquire(source)()
+	source, cleanup, err := ffmpegInput(source)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	source, err = filepath.Abs(source)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return fmt.Errorf("failed to create HLS directory: %w", err)
+	}
+	scratch, err := os.MkdirTemp(filepath.Dir(dir), ".build-")
+	if err != nil {
+		return fmt.Errorf("failed to create HLS directory: %w", err)
+	}
+	defer os.RemoveAll(scratch)
+
+	log.Printf("Segmenting %s for HLS", fileName)
+	cmd := exec.Command(ffmpeg, "-nostdin", "-loglevel", "error",
+		"-i", source, "-vn", "-c:a", "aac", "-b:a", "128k",
+		"-f", "hls", "-hls_time", strconv.Itoa(hlsSegmentSeconds), "-hls_playlist_type", "vod",
+		"-hls_segment_filename", "segment%03d.ts", hlsManifest)
+	// Run inside the scratch directory so the manifest lists segments by
+	// relative name
+	cmd.Dir = scratch
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("ffmpeg failed: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	os.RemoveAll(dir)
+	if err := os.Rename(scratch, dir); err != nil {
+		return fmt.Errorf("failed to move HLS output into place: %w", err)
+	}
+	return nil
+}
+
+// Serve /hls/<file>/playlist.m3u8 and the segments it lists, segmenting the
+// track on first request
+func hlsHandler(w http.ResponseWriter, req *http.Request) {
+	rest := strings.TrimPrefix(req.URL.Path, "/hls/")
+	fileName, asset := normalizeKey(path.Dir(rest)), path.Base(rest)
+	if err := validateKey(fileName); err != nil || fileName == "." {
+		http.Error(w, "Invalid file", http.StatusBadRequest)
+		return
+	}
+	if !isAllowed(fileName) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if asset != hlsManifest && !hlsSegmentName.MatchString(asset) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if !cacheEnabled {
+		http.Error(w, "HLS needs the disk cache", http.StatusNotImplemented)
+		return
+	}
+	if egress.exceeded() {
+		http.Error(w, "Daily egress quota exceeded, try again tomorrow", http.StatusServiceUnavailable)
+		log.Printf("Rejected HLS request: daily egress quota exceeded")
+		return
+	}
+
+	// Counted from before segmenting, so shutdown waits for ffmpeg too
+	done := streams.begin()
+	defer done()
+
+	b2Client, err := b2ClientFromEnv()
+	if err != nil {
+		http.Error(w, "Failed to create B2 client", http.StatusInternalServerError)
+		log.Printf("Failed to create B2 client: %v", err)
+		return
+	}
+
+	dir, err := hlsBuilds.ensure(b2Client, fileName)
+	if errors.Is(err, errFFmpegMissing) {
+		http.Error(w, "HLS is unavailable: ffmpeg is not installed", http.StatusNotImplemented)
+		log.Printf("Failed to segment %s: %v", fileName, err)
+		return
+	}
+	if err != nil {
+		b2Error(w, "Failed to prepare HLS stream", err)
+		log.Printf("Failed to segment %s: %v", fileName, err)
+		return
+	}
+
+	assetPath := filepath.Join(dir, asset)
+	if _, err := os.Stat(assetPath); err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", hlsContentTypes[path.Ext(asset)])
+	noTransform(w.Header())
+	cw := &countingResponseWriter{ResponseWriter: w}
+	http.ServeFile(cw, req, assetPath)
+	egress.addServed(cw.bytes)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Stand-in for ffmpeg that "segments" its input by copying it into one
+// segment, logging each run to runs.log beside itself
+const fakeFFmpeg = `#!/bin/sh
+dir=$(dirname "$0")
+echo run >> "$dir/runs.log"
+while [ "$1" != "-i" ]; do shift; done
+cp "$2" segment000.ts
+printf '#EXTM3U\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXTINF:10.0,\nsegment000.ts\n#EXT-X-ENDLIST\n' > playlist.m3u8
+`
+
+// Point ffmpegPath at the fake, returning the file its runs are logged to
+func useFakeFFmpeg(t *testing.T) string {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "ffmpeg")
+	if err := os.WriteFile(script, []byte(fakeFFmpeg), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	previous := ffmpegPath
+	t.Cleanup(func() { ffmpegPath = previous })
+	ffmpegPath = script
+	return filepath.Join(dir, "runs.log")
+}
+
+func getHLS(target string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	hlsHandler(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	return rec
+}
+
+func TestHLSManifestAndSegmentsServed(t *testing.T) {
+	t.Chdir(t.TempDir())
+	runs := useFakeFFmpeg(t)
+	stub := newS3Stub(t, map[string][]byte{"jazz/a.mp3": []byte("audio")})
+	stub.useEnv(t)
+
+	rec := getHLS("/hls/jazz/a.mp3/playlist.m3u8")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/vnd.apple.mpegurl" {
+		t.Fatalf("manifest: status %d type %s: %s", rec.Code, rec.Header().Get("Content-Type"), rec.Body)
+	}
+	if !strings.Contains(rec.Body.String(), "segment000.ts") {
+		t.Fatalf("manifest doesn't list the segment: %s", rec.Body)
+	}
+
+	rec = getHLS("/hls/jazz/a.mp3/segment000.ts")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "video/mp2t" || rec.Body.String() != "audio" {
+		t.Fatalf("segment: status %d type %s body %q", rec.Code, rec.Header().Get("Content-Type"), rec.Body)
+	}
+
+	// Later requests reuse the cached segments
+	getHLS("/hls/jazz/a.mp3/playlist.m3u8")
+	if ran, _ := os.ReadFile(runs); strings.Count(string(ran), "run") != 1 {
+		t.Fatalf("ffmpeg ran %d times, want once", strings.Count(string(ran), "run"))
+	}
+	if _, err := os.Stat(filepath.Join(hlsDir, "jazz", "a.mp3", hlsManifest)); err != nil {
+		t.Fatal("the manifest wasn't cached")
+	}
+}
+
+func TestHLSWithoutFFmpeg(t *testing.T) {
+	t.Chdir(t.TempDir())
+	previous := ffmpegPath
+	t.Cleanup(func() { ffmpegPath = previous })
+	ffmpegPath = filepath.Join(t.TempDir(), "missing-ffmpeg")
+	stub := newS3Stub(t, map[string][]byte{"a.mp3": []byte("audio")})
+	stub.useEnv(t)
+
+	if rec := getHLS("/hls/a.mp3/playlist.m3u8"); rec.Code != http.StatusNotImplemented {
+		t.Fatalf("status %d, want 501 without ffmpeg", rec.Code)
+	}
+}
+
+func TestHLSRejectsOtherAssets(t *testing.T) {
+	t.Chdir(t.TempDir())
+	useFakeFFmpeg(t)
+	setB2Env(t)
+
+	for target, status := range map[string]int{
+		"/hls/a.mp3/other.txt":           http.StatusNotFound,
+		"/hls/a.mp3/../../x/segment0.ts": http.StatusBadRequest,
+		"/hls/playlist.m3u8":             http.StatusBadRequest,
+	} {
+		if rec := getHLS(target); rec.Code != status {
+			t.Errorf("%s: status %d, want %d", target, rec.Code, status)
+		}
+	}
+}
+
+func TestHLSSegmentsCountAgainstEgressBudget(t *testing.T) {
+	t.Chdir(t.TempDir())
+	useFakeFFmpeg(t)
+	stub := newS3Stub(t, map[string][]byte{"jazz/a.mp3": []byte("audio")})
+	stub.useEnv(t)
+	previous := egress
+	t.Cleanup(func() { egress = previous })
+	egress = newEgressMeter(int64(len("audio")), "")
+
+	// The segment is served and counted, which uses up the budget
+	if rec := getHLS("/hls/jazz/a.mp3/segment000.ts"); rec.Code != http.StatusOK || rec.Body.String() != "audio" {
+		t.Fatalf("status %d body %q", rec.Code, rec.Body)
+	}
+	if served := egress.state.Served; served != int64(len("audio")) {
+		t.Fatalf("counted %d bytes served, want the segment's", served)
+	}
+	if rec := getHLS("/hls/jazz/a.mp3/playlist.m3u8"); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status %d over budget, want 503", rec.Code)
+	}
+}
+
+// Blocks in the middle of segmenting until a "go" file appears beside it
+const heldFFmpeg = `#!/bin/sh
+dir=$(dirname "$0")
+touch "$dir/started"
+while [ ! -f "$dir/go" ]; do sleep 0.01; done
+while [ "$1" != "-i" ]; do shift; done
+cp "$2" segment000.ts
+printf '#EXTM3U\n#EXTINF:10.0,\nsegment000.ts\n#EXT-X-ENDLIST\n' > playlist.m3u8
+`
+
+func TestShutdownWaitsForSegmenting(t *testing.T) {
+	t.Chdir(t.TempDir())
+	stub := newS3Stub(t, map[string][]byte{"jazz/a.mp3": []byte("audio")})
+	stub.useEnv(t)
+	dir := t.TempDir()
+	script := filepath.Join(dir, "ffmpeg")
+	if err := os.WriteFile(script, []byte(heldFFmpeg), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	previous := ffmpegPath
+	t.Cleanup(func() { ffmpegPath = previous })
+	ffmpegPath = script
+
+	before := streams.active.Load()
+	served := make(chan *httptest.ResponseRecorder)
+	go func() { served <- getHLS("/hls/jazz/a.mp3/playlist.m3u8") }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := os.Stat(filepath.Join(dir, "started")); err == nil {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if active := streams.active.Load(); active != before+1 {
+		t.Fatalf("%d streams active while ffmpeg runs, want %d for shutdown to wait on", active, before+1)
+	}
+
+	os.WriteFile(filepath.Join(dir, "go"), nil, 0o644)
+	if rec := <-served; rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if active := streams.active.Load(); active != before {
+		t.Fatalf("%d streams active after the request, want %d", active, before)
+	}
+}
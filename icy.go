@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"sync"
+)
+
+// Audio bytes between ICY metadata blocks, the value Icecast uses by default
+const icyMetaInt = 16000
+
+// Longest metadata a block can carry: the length byte counts 16-byte units
+const maxICYMetadata = 255 * 16
+
+// Interleaves Icecast (ICY) metadata into an audio stream for clients that
+// send "Icy-MetaData: 1". After every icyMetaInt bytes of audio comes one
+// length byte, then that many 16-byte units of StreamTitle='...'; padded
+// with zeros. A block is only filled when the title changed; otherwise the
+// length byte is 0.
+type icyWriter struct {
+	w     io.Writer
+	until int // audio bytes left before the next metadata block
+
+	mu      sync.Mutex
+	title   string
+	pending bool
+}
+
+func newICYWriter(w io.Writer) *icyWriter {
+	return &icyWriter{w: w, until: icyMetaInt}
+}
+
+func (i *icyWriter) setTitle(title string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.title = title
+	i.pending = true
+}
+
+func (i *icyWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		n := min(len(p), i.until)
+		if _, err := i.w.Write(p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+		i.until -= n
+
+		if i.until == 0 {
+			if _, err := i.w.Write(i.metadataBlock()); err != nil {
+				return written, err
+			}
+			i.until = icyMetaInt
+		}
+	}
+	return written, nil
+}
+
+func (i *icyWriter) metadataBlock() []byte {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if !i.pending {
+		return []byte{0}
+	}
+	i.pending = false
+
+	// A quote would end the value early, so swap it for a typographic one
+	title := strings.ReplaceAll(i.title, "'", "’")
+	meta := "StreamTitle='" + title + "';"
+	if len(meta) > maxICYMetadata {
+		meta = meta[:maxICYMetadata-2] + "';"
+	}
+
+	units := (len(meta) + 15) / 16
+	block := make([]byte, 1+units*16)
+	block[0] = byte(units)
+	copy(block[1:], meta)
+	return block
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// Split an ICY stream back into audio and the metadata blocks between it
+func splitICY(t *testing.T, stream []byte) ([]byte, []string) {
+	t.Helper()
+	var audio []byte
+	var blocks []string
+	for len(stream) > 0 {
+		n := min(icyMetaInt, len(stream))
+		audio = append(audio, stream[:n]...)
+		stream = stream[n:]
+		if n < icyMetaInt {
+			break
+		}
+		if len(stream) == 0 {
+			t.Fatal("stream ends where a metadata length byte is due")
+		}
+
+		size := int(stream[0]) * 16
+		if len(stream) < 1+size {
+			t.Fatalf("metadata block of %d bytes is truncated", size)
+		}
+		blocks = append(blocks, string(stream[1:1+size]))
+		stream = stream[1+size:]
+	}
+	return audio, blocks
+}
+
+func TestICYMetadataCadence(t *testing.T) {
+	var out bytes.Buffer
+	icy := newICYWriter(&out)
+	audio := bytes.Repeat([]byte{0xAA}, icyMetaInt*3+500)
+
+	icy.setTitle("Artist - First")
+	// Uneven writes must not shift where the blocks land
+	for rest := audio[:icyMetaInt*2+100]; len(rest) > 0; {
+		n := min(7001, len(rest))
+		icy.Write(rest[:n])
+		rest = rest[n:]
+	}
+	icy.setTitle("Artist - Second")
+	icy.Write(audio[icyMetaInt*2+100:])
+
+	gotAudio, blocks := splitICY(t, out.Bytes())
+	if !bytes.Equal(gotAudio, audio) {
+		t.Fatal("audio was altered by the metadata interleaving")
+	}
+	if len(blocks) != 3 {
+		t.Fatalf("%d metadata blocks, want one every %d bytes", len(blocks), icyMetaInt)
+	}
+
+	want := []string{"StreamTitle='Artist - First';", "", "StreamTitle='Artist - Second';"}
+	for i, block := range blocks {
+		if len(block)%16 != 0 {
+			t.Errorf("block %d is %d bytes, want a multiple of 16", i, len(block))
+		}
+		if got := strings.TrimRight(block, "\x00"); got != want[i] {
+			t.Errorf("block %d: got %q, want %q", i, got, want[i])
+		}
+	}
+}
+
+func TestICYMetadataEscapesAndTruncates(t *testing.T) {
+	var out bytes.Buffer
+	icy := newICYWriter(&out)
+
+	icy.setTitle("Rock 'n' Roll")
+	icy.Write(make([]byte, icyMetaInt))
+	if _, blocks := splitICY(t, out.Bytes()); strings.TrimRight(blocks[0], "\x00") != "StreamTitle='Rock ’n’ Roll';" {
+		t.Fatalf("got %q, want the quotes replaced", blocks[0])
+	}
+
+	out.Reset()
+	icy.setTitle(strings.Repeat("x", 5000))
+	icy.Write(make([]byte, icyMetaInt))
+	_, blocks := splitICY(t, out.Bytes())
+	if len(blocks[0]) != maxICYMetadata || !strings.HasSuffix(blocks[0], "';") {
+		t.Fatalf("block of %d bytes, want a terminated %d byte block", len(blocks[0]), maxICYMetadata)
+	}
+}
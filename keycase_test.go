@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Set the case policy and list files through it, so folded keys are built
+func useKeyCase(t *testing.T, policy string, files map[string][]byte) {
+	previous := cacheKeyCase
+	t.Cleanup(func() {
+		cacheKeyCase = previous
+		listing.mu.Lock()
+		listing.objects, listing.files, listing.bucketKeys, listing.foldedKeys, listing.fetchedAt = nil, nil, nil, nil, time.Time{}
+		listing.mu.Unlock()
+		listing.ready.Store(false)
+	})
+	cacheKeyCase = policy
+	if _, err := listing.get(newFakeB2(t, files)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func streamKey(t *testing.T, target string) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	newStreamHandler(t).stream(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("%s: status %d: %s", target, rec.Code, rec.Body)
+	}
+	return rec.Body.String()
+}
+
+func TestExactKeyCaseKeepsEntriesApart(t *testing.T) {
+	t.Chdir(t.TempDir())
+	useStation(t, modeRandom)
+	files := map[string][]byte{"Song.MP3": []byte("loud"), "song.mp3": []byte("quiet")}
+	stub := newS3Stub(t, files)
+	stub.useEnv(t)
+	useKeyCase(t, keyCaseExact, files)
+
+	if streamKey(t, "/stream?file=Song.MP3") != "loud" || streamKey(t, "/stream?file=song.mp3") != "quiet" {
+		t.Fatal("keys differing in case were served the same audio")
+	}
+	for key, want := range files {
+		if data, err := os.ReadFile(filepath.Join(cacheDir, key)); err != nil || string(data) != string(want) {
+			t.Errorf("%s cached as %q (%v), want its own entry", key, data, err)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/stream?file=SONG.mp3", nil)
+	if got := fileParam(req); got != "SONG.mp3" {
+		t.Fatalf("resolved to %s, want the name left as requested", got)
+	}
+}
+
+func TestFoldedKeyCaseSharesEntry(t *testing.T) {
+	t.Chdir(t.TempDir())
+	useStation(t, modeRandom)
+	files := map[string][]byte{"Albums/Song.MP3": []byte("audio")}
+	stub := newS3Stub(t, files)
+	stub.useEnv(t)
+	useKeyCase(t, keyCaseFold, files)
+
+	// Resolved against the listing, then fetched under its real key
+	if body := streamKey(t, "/stream?file=albums/SONG.mp3"); body != "audio" {
+		t.Fatalf("body %q", body)
+	}
+	if stub.getCount("Albums/Song.MP3") != 1 {
+		t.Fatal("didn't fetch the listed key")
+	}
+	if _, err := os.Stat(filepath.Join(cacheDir, "albums", "song.mp3")); err != nil {
+		t.Fatalf("not cached under the folded name: %v", err)
+	}
+	if cachePath("Albums/Song.MP3") != cachePath("ALBUMS/song.mp3") {
+		t.Fatal("keys differing in case got separate cache entries")
+	}
+
+	// Version IDs keep their case
+	if got := foldKey(versionsDir + "/AbC123/Song.MP3"); got != versionsDir+"/AbC123/song.mp3" {
+		t.Fatalf("versioned key folded to %s", got)
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import "strings"
+
+// Bucket keys live under the client's keyPrefix (KEY_PREFIX), which public
+// names leave out: with KEY_PREFIX=audio/library/, ?file=jazz/song.mp3 is
+// fetched from audio/library/jazz/song.mp3. Listings strip it again, so
+// nothing above the B2 layer ever sees it.
+
+// Bucket key a public file name is stored under
+func (b *B2Client) objectKey(fileName string) string {
+	return b.keyPrefix + listing.bucketKey(fileName)
+}
+
+// Public name of a bucket key, without the prefix
+func (b *B2Client) publicKey(key string) string {
+	return strings.TrimPrefix(key, b.keyPrefix)
+}
+
+// KEY_PREFIX as a folder: surrounding slashes dropped and one trailing slash
+// added, so "audio/library" and "/audio/library/" both mean the same thing
+func parseKeyPrefix(value string) string {
+	value = strings.Trim(value, "/")
+	if value == "" {
+		return ""
+	}
+	return value + "/"
+}
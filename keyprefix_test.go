@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io"
+	"slices"
+	"testing"
+)
+
+func TestPublicNamesMapToPrefixedKeys(t *testing.T) {
+	t.Chdir(t.TempDir())
+	useListing(t, nil)
+	stub := newS3Stub(t, map[string][]byte{
+		"audio/library/jazz/a.mp3": []byte("audio"),
+		"elsewhere/b.mp3":          []byte("other"),
+	})
+	client, err := NewB2Client(stub.URL, "us-east-1", "key", "secret", "bucket", b2Options{
+		usePathStyle: true,
+		keyPrefix:    parseKeyPrefix("/audio/library"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.downloadFile("jazz/a.mp3"); err != nil {
+		t.Fatal(err)
+	}
+	if stub.getCount("audio/library/jazz/a.mp3") != 1 {
+		t.Fatalf("requests %q, want jazz/a.mp3 fetched from audio/library/jazz/a.mp3", stub.requests)
+	}
+
+	result, err := client.fetchRange("jazz/a.mp3", "bytes=1-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer result.body.Close()
+	if data, _ := io.ReadAll(result.body); string(data) != "udio" {
+		t.Fatalf("range read %q", data)
+	}
+
+	files, err := client.listFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(files, []string{"jazz/a.mp3"}) {
+		t.Fatalf("listed %q, want the prefix stripped and keys outside it left out", files)
+	}
+}
+
+func TestParseKeyPrefix(t *testing.T) {
+	for value, want := range map[string]string{
+		"":                "",
+		"/":               "",
+		"audio/library":   "audio/library/",
+		"/audio/library/": "audio/library/",
+	} {
+		if got := parseKeyPrefix(value); got != want {
+			t.Errorf("%q: got %q, want %q", value, got, want)
+		}
+	}
+}
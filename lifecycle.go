@@ -0,0 +1,52 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"sync/atomic"
+)
+
+const (
+	phaseStarting = "starting"
+	phaseReady    = "ready"
+	phaseDraining = "draining"
+	phaseStopped  = "stopped"
+)
+
+// Lifecycle events go out as JSON lines on stderr, beside the plain log, so
+// automation can tell a booting instance from a draining one
+var lifecycleLog = slog.New(slog.NewJSONHandler(os.Stderr, nil))
+
+var lifecyclePhase atomic.Value
+
+func init() {
+	lifecyclePhase.Store(phaseStarting)
+}
+
+func currentPhase() string {
+	return lifecyclePhase.Load().(string)
+}
+
+// Move to phase and emit event with the given attributes
+func enterPhase(phase, event string, attrs ...any) {
+	lifecyclePhase.Store(phase)
+	lifecycleLog.Info(event, append([]any{"phase", phase}, attrs...)...)
+}
+
+// Settings worth seeing at a glance in the starting event
+func configSummary() slog.Attr {
+	names := make([]string, 0, len(stations.stations))
+	for _, st := range stations.all() {
+		names = append(names, st.name)
+	}
+
+	return slog.Group("config",
+		"version", currentVersion().Version,
+		"stream_mode", streamMode,
+		"cache_enabled", cacheEnabled,
+		"cache_max_bytes", currentCacheMaxBytes(),
+		"stations", names,
+		"failover_endpoints", len(failoverEndpoints),
+		"admin_enabled", adminToken != "",
+	)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Capture lifecycle events, restoring the phase and logger afterwards
+func useLifecycleLog(t *testing.T) *bytes.Buffer {
+	previousLog, previousPhase := lifecycleLog, currentPhase()
+	t.Cleanup(func() {
+		lifecycleLog = previousLog
+		lifecyclePhase.Store(previousPhase)
+	})
+
+	var buf bytes.Buffer
+	lifecycleLog = slog.New(slog.NewJSONHandler(&buf, nil))
+	return &buf
+}
+
+func healthzPhase(t *testing.T) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	healthz(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	return rec.Header().Get("X-Lifecycle-Phase")
+}
+
+func TestLifecyclePhasesInOrder(t *testing.T) {
+	buf := useLifecycleLog(t)
+	lifecyclePhase.Store(phaseStarting)
+	useStation(t, modeRandom)
+
+	if phase := healthzPhase(t); phase != phaseStarting {
+		t.Fatalf("phase %s before startup finished, want starting", phase)
+	}
+
+	steps := []struct{ phase, event string }{
+		{phaseStarting, "server.starting"},
+		{phaseReady, "server.ready"},
+		{phaseDraining, "server.shutdown.begin"},
+		{phaseStopped, "server.shutdown.complete"},
+	}
+	for _, step := range steps {
+		if step.event == "server.starting" {
+			enterPhase(step.phase, step.event, "addr", ":8090", configSummary())
+		} else {
+			enterPhase(step.phase, step.event, "addr", ":8090")
+		}
+		if phase := healthzPhase(t); phase != step.phase {
+			t.Fatalf("after %s /healthz reports %s, want %s", step.event, phase, step.phase)
+		}
+	}
+
+	scanner := bufio.NewScanner(buf)
+	for i := 0; scanner.Scan(); i++ {
+		var event struct {
+			Time   string         `json:"time"`
+			Msg    string         `json:"msg"`
+			Phase  string         `json:"phase"`
+			Addr   string         `json:"addr"`
+			Config map[string]any `json:"config"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("event %d isn't JSON: %s", i, scanner.Bytes())
+		}
+		if i >= len(steps) || event.Msg != steps[i].event || event.Phase != steps[i].phase {
+			t.Fatalf("event %d is %s (%s), want %+v", i, event.Msg, event.Phase, steps[min(i, len(steps)-1)])
+		}
+		if event.Time == "" || event.Addr != ":8090" {
+			t.Fatalf("event %s lacks a timestamp or address: %s", event.Msg, scanner.Bytes())
+		}
+		if i == 0 && event.Config["stations"] == nil {
+			t.Fatalf("starting event has no config summary: %s", scanner.Bytes())
+		}
+	}
+}
+
+func TestVerboseHealthzReportsPhase(t *testing.T) {
+	useLifecycleLog(t)
+	newS3Stub(t, map[string][]byte{"a.mp3": []byte("a")}).useEnv(t)
+	enterPhase(phaseDraining, "server.shutdown.begin")
+
+	rec := httptest.NewRecorder()
+	healthz(rec, httptest.NewRequest(http.MethodGet, "/healthz?verbose=true", nil))
+	var report healthReport
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Phase != phaseDraining {
+		t.Fatalf("phase %q, want draining", report.Phase)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	_ "embed"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+)
+
+//go:embed templates/listen.html
+var listenPage string
+
+var listenTemplate = template.Must(template.New("listen").Parse(listenPage))
+
+type listenData struct {
+	Title     string
+	StreamURL string
+	ArtURL    string
+	NextURL   string
+}
+
+// Shareable player page for ?file=, or a track picked by the station's
+// selector. The play itself is recorded when the page requests /stream.
+func listen(w http.ResponseWriter, req *http.Request) {
+	st, ok := stationFor(w, req)
+	if !ok {
+		return
+	}
+
+	fileName := fileParam(req)
+	if fileName == "" {
+		b2Client, err := b2ClientFromEnv()
+		if err != nil {
+			http.Error(w, "Failed to create B2 client", http.StatusInternalServerError)
+			log.Printf("Failed to create B2 client: %v", err)
+			return
+		}
+
+		files, err := st.candidates(b2Client)
+		if err != nil {
+			b2Error(w, "Failed to list files", err)
+			log.Printf("Failed to list files: %v", err)
+			return
+		}
+		if fileName, err = st.selector.selectFile(files); err != nil {
+			b2Error(w, "No files available", err)
+			log.Printf("Failed to select file for listen page: %v", err)
+			return
+		}
+	}
+	if err := validateKey(fileName); err != nil {
+		http.Error(w, "Invalid file parameter", http.StatusBadRequest)
+		return
+	}
+	if !isAllowed(fileName) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	query := url.Values{"file": {fileName}}
+	next := url.Values{}
+	if st.name != defaultStationName {
+		query.Set("station", st.name)
+		next.Set("station", st.name)
+	}
+
+	metadata, _ := cachedMetadata(fileName)
+	data := listenData{
+		Title:     displayTitle(fileName, metadata),
+		StreamURL: "/stream?" + query.Encode(),
+		ArtURL:    "/art?" + url.Values{"file": {fileName}}.Encode(),
+		NextURL:   "/listen",
+	}
+	if len(next) > 0 {
+		data.NextURL += "?" + next.Encode()
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := listenTemplate.Execute(w, data); err != nil {
+		log.Printf("Failed to render listen page: %v", err)
+	}
+}
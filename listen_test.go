@@ -0,0 +1,78 @@
+package main
+
+import (
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var audioSrc = regexp.MustCompile(`<audio [^>]*src="([^"]+)"`)
+
+// The /stream URL the page's player loads
+func listenStreamURL(t *testing.T, body string) *url.URL {
+	t.Helper()
+	match := audioSrc.FindStringSubmatch(body)
+	if match == nil {
+		t.Fatalf("no audio player in %s", body)
+	}
+	streamURL, err := url.Parse(html.UnescapeString(match[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if streamURL.Path != "/stream" {
+		t.Fatalf("player loads %s, want /stream", streamURL)
+	}
+	return streamURL
+}
+
+func TestListenPageStreamsSelectedTrack(t *testing.T) {
+	t.Chdir(t.TempDir())
+	stub := newS3Stub(t, map[string][]byte{"jazz/01 - Blue Train.mp3": []byte("audio")})
+	stub.useEnv(t)
+	useListing(t, []string{"jazz/01 - Blue Train.mp3"})
+	useStation(t, modeRandom)
+
+	rec := httptest.NewRecorder()
+	listen(rec, httptest.NewRequest(http.MethodGet, "/listen", nil))
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("status %d type %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(rec.Body.String(), "<h1>Blue Train</h1>") {
+		t.Fatalf("page doesn't show the track title: %s", rec.Body)
+	}
+
+	// The player's URL is one /stream serves
+	streamURL := listenStreamURL(t, rec.Body.String())
+	if file := streamURL.Query().Get("file"); file != "jazz/01 - Blue Train.mp3" {
+		t.Fatalf("player streams %q", file)
+	}
+	rec = httptest.NewRecorder()
+	newStreamHandler(t).stream(rec, httptest.NewRequest(http.MethodGet, streamURL.String(), nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "audio" {
+		t.Fatalf("following the player's URL: status %d body %q", rec.Code, rec.Body)
+	}
+}
+
+func TestListenPageForGivenFile(t *testing.T) {
+	useListing(t, []string{"rock/a&b.mp3"})
+	useStation(t, modeRandom)
+
+	rec := httptest.NewRecorder()
+	listen(rec, httptest.NewRequest(http.MethodGet, "/listen?file="+url.QueryEscape("rock/a&b.mp3"), nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if file := listenStreamURL(t, rec.Body.String()).Query().Get("file"); file != "rock/a&b.mp3" {
+		t.Fatalf("player streams %q, want the escaped key back", file)
+	}
+
+	rec = httptest.NewRecorder()
+	listen(rec, httptest.NewRequest(http.MethodGet, "/listen?file=../secret.mp3", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status %d, want 400 for an invalid key", rec.Code)
+	}
+}
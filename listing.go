@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultListingTTL = time.Minute
+
+	// Forced refreshes closer together than this reuse the last listing, so
+	// a client can't turn every request into a bucket listing
+	minForcedRefreshInterval = 5 * time.Second
+)
+
+type listingCache struct {
+	// Set once the first listing succeeds, used as the readiness signal
+	ready atomic.Bool
+
+	mu        sync.Mutex
+	ttl       time.Duration
+	objects   []objectInfo // keys normalized, see normalizeKey
+	files     []string
+	fetchedAt time.Time
+
+	// Bucket key for each normalized key that differs from it
+	bucketKeys map[string]string
+
+	// Listed key for each case-folded key, when CACHE_KEY_CASE folds case
+	foldedKeys map[string]string
+
+	// Listing in progress, shared by every request that finds the cache cold
+	pending *listingCall
+}
+
+type listingCall struct {
+	done chan struct{}
+	err  error
+}
+
+var listing = &listingCache{ttl: defaultListingTTL}
+
+func (c *listingCache) get(b2Client B2) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.refresh(b2Client); err != nil {
+		return nil, err
+	}
+	return c.files, nil
+}
+
+// Listing with object details (size, ETag, modification time)
+func (c *listingCache) getObjects(b2Client B2) ([]objectInfo, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.refresh(b2Client); err != nil {
+		return nil, err
+	}
+	return c.objects, nil
+}
+
+// Whether a request asked to bypass the cached listing, via
+// "Cache-Control: no-cache" or ?refresh=true
+func wantsFreshListing(req *http.Request) bool {
+	if req.URL.Query().Get("refresh") == "true" {
+		return true
+	}
+	for _, directive := range strings.Split(req.Header.Get("Cache-Control"), ",") {
+		if strings.EqualFold(strings.TrimSpace(directive), "no-cache") {
+			return true
+		}
+	}
+	return false
+}
+
+// Expire the cached listing so the next read re-lists the bucket
+func (c *listingCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.fetchedAt) >= minForcedRefreshInterval {
+		c.fetchedAt = time.Time{}
+	}
+}
+
+// Invalidate the listing when the request asks for a fresh one
+func (c *listingCache) refreshFor(req *http.Request) {
+	if wantsFreshListing(req) {
+		log.Printf("Forcing listing refresh for %s", req.URL.Path)
+		c.invalidate()
+	}
+}
+
+// Whether the last listing included a key, without refreshing it
+func (c *listingCache) contains(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, name := range c.files {
+		if name == key {
+			return true
+		}
+	}
+	return false
+}
+
+// The key a normalized name is stored under in the bucket
+func (c *listingCache) bucketKey(name string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if key, ok := c.bucketKeys[name]; ok {
+		return key
+	}
+	return name
+}
+
+// The listed key a requested name matches under the case policy, or the
+// name itself
+func (c *listingCache) resolveCase(name string) string {
+	if cacheKeyCase != keyCaseFold {
+		return name
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if key, ok := c.foldedKeys[foldKey(name)]; ok && !slices.Contains(c.files, name) {
+		return key
+	}
+	return name
+}
+
+// The last listing's entry for a key, without refreshing it
+func (c *listingCache) lookup(key string) (objectInfo, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, object := range c.objects {
+		if object.Key == key {
+			return object, true
+		}
+	}
+	return objectInfo{}, false
+}
+
+// Modification time of each listed key, from the last listing
+func (c *listingCache) modTimes() map[string]time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	modTimes := make(map[string]time.Time, len(c.objects))
+	for _, object := range c.objects {
+		modTimes[object.Key] = object.LastModified
+	}
+	return modTimes
+}
+
+// Re-list the bucket once the TTL has passed. Callers must hold mu, which is
+// released while listing; concurrent callers wait for the same listing
+// rather than each paging through the bucket.
+func (c *listingCache) refresh(b2Client B2) error {
+	if c.files != nil && time.Since(c.fetchedAt) < c.ttl {
+		return nil
+	}
+
+	if call := c.pending; call != nil {
+		c.mu.Unlock()
+		<-call.done
+		c.mu.Lock()
+		return call.err
+	}
+
+	call := &listingCall{done: make(chan struct{})}
+	c.pending = call
+	c.mu.Unlock()
+
+	objects, err := b2Client.listObjects()
+
+	c.mu.Lock()
+	c.pending = nil
+	call.err = err
+	close(call.done)
+	if err != nil {
+		return err
+	}
+
+	files := make([]string, 0, len(objects))
+	bucketKeys := make(map[string]string)
+	var foldedKeys map[string]string
+	if cacheKeyCase == keyCaseFold {
+		foldedKeys = make(map[string]string)
+	}
+	for i, object := range objects {
+		if normalized := normalizeKey(object.Key); normalized != object.Key {
+			bucketKeys[normalized] = object.Key
+			objects[i].Key = normalized
+		}
+		files = append(files, objects[i].Key)
+		if folded := foldKey(objects[i].Key); foldedKeys != nil && foldedKeys[folded] == "" {
+			foldedKeys[folded] = objects[i].Key
+		}
+	}
+
+	log.Printf("Refreshed file listing: %d files", len(files))
+	c.objects = objects
+	c.files = files
+	c.bucketKeys = bucketKeys
+	c.foldedKeys = foldedKeys
+	c.fetchedAt = time.Now()
+	c.ready.Store(true)
+	return nil
+}
+
+// Random wait before the first B2 calls, up to STARTUP_JITTER
+func startupJitter() time.Duration {
+	return jitter(envDuration("STARTUP_JITTER", 0))
+}
+
+// Fill the listing in the background at startup so that /readyz flips
+// without waiting for a listener. Starts after startDelay and retries with
+// jittered backoff, so instances that failed together don't retry together.
+func (c *listingCache) warm(startDelay time.Duration) {
+	time.Sleep(startDelay)
+
+	delay := time.Second
+	for {
+		b2Client, err := b2ClientFromEnv()
+		if err == nil {
+			_, err = c.get(b2Client)
+		}
+		if err == nil {
+			return
+		}
+
+		wait := delay + jitter(delay/2)
+		log.Printf("Initial listing failed, retrying in %s: %v", wait.Round(time.Millisecond), err)
+		time.Sleep(wait)
+		delay = min(delay*2, time.Minute)
+	}
+}
+
+func readyz(w http.ResponseWriter, req *http.Request) {
+	if !listing.ready.Load() {
+		http.Error(w, "Waiting for initial bucket listing", http.StatusServiceUnavailable)
+		return
+	}
+
+	fmt.Fprintln(w, "ok")
+}
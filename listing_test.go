@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReadyzFlipsAfterFirstListing(t *testing.T) {
+	listing.ready.Store(false)
+	useListing(t, nil)
+	t.Cleanup(func() { listing.ready.Store(false) })
+
+	client := newFakeB2(t, map[string][]byte{"a.mp3": nil})
+	client.listErr = errors.New("bucket unreachable")
+
+	rec := httptest.NewRecorder()
+	readyz(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status %d before any listing, want 503", rec.Code)
+	}
+
+	if _, err := listing.get(client); err == nil {
+		t.Fatal("expected the failing listing to return an error")
+	}
+	rec = httptest.NewRecorder()
+	readyz(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status %d after a failed listing, want 503", rec.Code)
+	}
+
+	client.listErr = nil
+	if _, err := listing.get(client); err != nil {
+		t.Fatal(err)
+	}
+	rec = httptest.NewRecorder()
+	readyz(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d after a successful listing, want 200", rec.Code)
+	}
+}
+
+func TestListingCachedWithinTTL(t *testing.T) {
+	useListing(t, nil)
+	client := newFakeB2(t, map[string][]byte{"a.mp3": nil, "b.mp3": nil})
+
+	for range 3 {
+		files, err := listing.get(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 2 {
+			t.Fatalf("listed %d files, want 2", len(files))
+		}
+	}
+	if client.listCalls != 1 {
+		t.Fatalf("listed the bucket %d times, want 1", client.listCalls)
+	}
+}
+
+// Lister whose listings block until release is closed
+type slowLister struct {
+	*fakeB2
+	started chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (s *slowLister) listObjects() ([]objectInfo, error) {
+	s.once.Do(func() { close(s.started) })
+	<-s.release
+	return s.fakeB2.listObjects()
+}
+
+func TestColdListingIsShared(t *testing.T) {
+	useListing(t, nil)
+	client := &slowLister{
+		fakeB2:  newFakeB2(t, map[string][]byte{"a.mp3": nil, "b.mp3": nil}),
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+
+	const requests = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, requests)
+	for range requests {
+		wg.Go(func() {
+			files, err := listing.get(client)
+			if err == nil && len(files) != 2 {
+				err = fmt.Errorf("listed %d files, want 2", len(files))
+			}
+			errs <- err
+		})
+	}
+
+	// Let the rest pile up behind the first listing before it finishes
+	<-client.started
+	time.Sleep(20 * time.Millisecond)
+	close(client.release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if client.listCalls != 1 {
+		t.Fatalf("listed the bucket %d times for %d cold requests, want 1", client.listCalls, requests)
+	}
+}
+
+func TestFailedListingIsRetried(t *testing.T) {
+	useListing(t, nil)
+	client := newFakeB2(t, map[string][]byte{"a.mp3": nil})
+	client.listErr = errors.New("bucket unreachable")
+
+	if _, err := listing.get(client); err == nil {
+		t.Fatal("expected the listing error")
+	}
+	client.listErr = nil
+	if files, err := listing.get(client); err != nil || len(files) != 1 {
+		t.Fatalf("got %v (%v), want the next request to list again", files, err)
+	}
+}
+
+func (s *s3Stub) listCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var count int
+	for _, request := range s.requests {
+		if request == "GET /bucket" || request == "GET /bucket/" {
+			count++
+		}
+	}
+	return count
+}
+
+func TestRefreshParamForcesListing(t *testing.T) {
+	stub := newS3Stub(t, map[string][]byte{"old.mp3": {1}})
+	stub.useEnv(t)
+	useListing(t, []string{"old.mp3"})
+	listing.mu.Lock()
+	listing.fetchedAt = time.Now().Add(-time.Minute / 2)
+	listing.mu.Unlock()
+
+	stub.mu.Lock()
+	stub.objects["new.mp3"] = []byte{2}
+	stub.mu.Unlock()
+
+	searchFor := func(target string, header http.Header) []string {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		rec := httptest.NewRecorder()
+		search(rec, req)
+
+		var response searchResponse
+		if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+			t.Fatalf("status %d: %s", rec.Code, rec.Body)
+		}
+		return response.Results
+	}
+
+	if results := searchFor("/search?q=mp3", nil); len(results) != 1 || stub.listCount() != 0 {
+		t.Fatalf("results %q after %d listings, want the cached listing", results, stub.listCount())
+	}
+	if results := searchFor("/search?q=mp3&refresh=true", nil); len(results) != 2 || stub.listCount() != 1 {
+		t.Fatalf("results %q after %d listings, want a fresh listing with the upload", results, stub.listCount())
+	}
+
+	// A second forced refresh right away reuses the fresh listing
+	searchFor("/search?q=mp3", http.Header{"Cache-Control": {"no-cache"}})
+	if stub.listCount() != 1 {
+		t.Fatalf("listed %d times, want forced refreshes rate limited", stub.listCount())
+	}
+}
+
+func TestWantsFreshListing(t *testing.T) {
+	tests := []struct {
+		target       string
+		cacheControl string
+		want         bool
+	}{
+		{"/tracks", "", false},
+		{"/tracks?refresh=true", "", true},
+		{"/tracks?refresh=false", "", false},
+		{"/tracks", "no-cache", true},
+		{"/tracks", "max-age=0, No-Cache", true},
+		{"/tracks", "max-age=0", false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+		if tt.cacheControl != "" {
+			req.Header.Set("Cache-Control", tt.cacheControl)
+		}
+		if got := wantsFreshListing(req); got != tt.want {
+			t.Errorf("%s %q: got %t, want %t", tt.target, tt.cacheControl, got, tt.want)
+		}
+	}
+}
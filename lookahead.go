@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"log"
+	"path/filepath"
+	"sync"
+)
+
+const defaultRadioPrefetchDepth = 1
+
+// How many upcoming tracks a /radio connection keeps in the cache, counting
+// the next one, set from RADIO_PREFETCH_DEPTH
+var radioPrefetchDepth = defaultRadioPrefetchDepth
+
+// Tracks a radio connection has cached ahead of the one playing. They stay
+// pinned until they play or leave the queue, so downloads further ahead can't
+// evict them first.
+type radioLookahead struct {
+	// Settings as the connection found them, which fill works from
+	enabled bool
+	depth   int
+	budget  int64
+
+	mu      sync.Mutex
+	pinned  map[string]func() // track name to release
+	closed  bool
+	filling sync.WaitGroup
+}
+
+// Call from the handler, so the settings are read while it runs
+func newRadioLookahead() *radioLookahead {
+	return &radioLookahead{
+		enabled: cacheEnabled,
+		depth:   radioPrefetchDepth,
+		budget:  currentCacheMaxBytes() / 2,
+		pinned:  make(map[string]func()),
+	}
+}
+
+// Cache the tracks the selector will hand out after next, up to the prefetch
+// depth. With a cache limit, lookahead stops once it would take more than
+// half the cache, leaving room for the track playing and other listeners.
+func (l *radioLookahead) fill(ctx context.Context, st *station, b2Client B2, ext string, playing string, next radioTrack) {
+	if !l.enabled || next.fallback || next.err != nil {
+		return
+	}
+
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return
+	}
+	l.filling.Add(1)
+	l.mu.Unlock()
+	defer l.filling.Done()
+
+	// The playing track stays pinned until the stream holds it open itself
+	keep := map[string]bool{playing: true, next.name: true}
+	l.pin(next.name, next.path)
+	defer func() { l.unpinExcept(keep) }()
+
+	if l.depth <= 1 {
+		return
+	}
+
+	files, err := st.candidates(b2Client)
+	if err != nil {
+		log.Printf("Failed to list files for radio lookahead: %v", err)
+		return
+	}
+	if ext != "" {
+		files = filterByExtension(files, ext)
+	}
+	upcoming, err := st.selector.peek(files, l.depth-1)
+	if err != nil {
+		return
+	}
+
+	budget := l.budget
+	var ahead int64
+	if object, ok := listing.lookup(next.name); ok {
+		ahead = object.Size
+	}
+
+	for _, name := range upcoming {
+		if ctx.Err() != nil {
+			return
+		}
+		if object, ok := listing.lookup(name); ok && budget > 0 {
+			if ahead+object.Size > budget {
+				log.Printf("Radio lookahead stopped before %s to stay within the cache limit", name)
+				return
+			}
+			ahead += object.Size
+		}
+
+		keep[name] = true
+		if l.isPinned(name) {
+			continue
+		}
+		path, err := b2Client.downloadFile(name)
+		if err != nil {
+			log.Printf("Failed to prefetch %s for radio lookahead: %v", name, err)
+			continue
+		}
+		l.pin(name, path)
+	}
+}
+
+func (l *radioLookahead) isPinned(name string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.pinned[name]
+	return ok
+}
+
+func (l *radioLookahead) pin(name, path string) {
+	if path == "" {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed || l.pinned[name] != nil {
+		return
+	}
+	l.pinned[name] = servingFiles.acquire(filepath.Clean(path))
+}
+
+func (l *radioLookahead) unpinExcept(keep map[string]bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for name, release := range l.pinned {
+		if !keep[name] {
+			release()
+			delete(l.pinned, name)
+		}
+	}
+}
+
+// Release every pin when the connection ends, once a fill in progress has
+// stopped pinning
+func (l *radioLookahead) close() {
+	l.mu.Lock()
+	l.closed = true
+	l.mu.Unlock()
+	l.filling.Wait()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for name, release := range l.pinned {
+		release()
+		delete(l.pinned, name)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func usePrefetchDepth(t *testing.T, depth int) {
+	previous := radioPrefetchDepth
+	t.Cleanup(func() { radioPrefetchDepth = previous })
+	radioPrefetchDepth = depth
+}
+
+func lookaheadBucket(t *testing.T, size int) *fakeB2 {
+	files := map[string][]byte{}
+	for _, name := range []string{"a.mp3", "b.mp3", "c.mp3", "d.mp3", "e.mp3", "f.mp3"} {
+		files[name] = bytes.Repeat([]byte(name[:1]), size)
+	}
+	client := newFakeB2(t, files)
+	useSizedListing(t, client)
+	return client
+}
+
+func TestLookaheadCachesUpcomingTracks(t *testing.T) {
+	usePrefetchDepth(t, 3)
+	client := lookaheadBucket(t, 10)
+	st := useStation(t, modeSequential)
+
+	playing := nextRadioTrack(context.Background(), st, client, "")
+	next := nextRadioTrack(context.Background(), st, client, "")
+	ahead := newRadioLookahead()
+	ahead.fill(context.Background(), st, client, "", playing.name, next)
+
+	// The two tracks after next are cached ahead and pinned, without
+	// consuming them from the selector
+	if !slices.Equal(client.downloads, []string{"a.mp3", "b.mp3", "c.mp3", "d.mp3"}) {
+		t.Fatalf("downloads %q, want c.mp3 and d.mp3 cached ahead", client.downloads)
+	}
+	for _, name := range []string{"b.mp3", "c.mp3", "d.mp3"} {
+		if !servingFiles.inUse(filepath.Join(client.dir, name)) {
+			t.Errorf("%s isn't pinned", name)
+		}
+	}
+	if track := nextRadioTrack(context.Background(), st, client, ""); track.name != "c.mp3" {
+		t.Fatalf("next pick %s, want the first track cached ahead", track.name)
+	}
+
+	ahead.close()
+	for _, name := range []string{"b.mp3", "c.mp3", "d.mp3"} {
+		if servingFiles.inUse(filepath.Join(client.dir, name)) {
+			t.Errorf("%s still pinned after the connection ended", name)
+		}
+	}
+}
+
+func TestLookaheadKeepsPlayingTrackAndCacheRoom(t *testing.T) {
+	usePrefetchDepth(t, 5)
+	client := lookaheadBucket(t, 100)
+	st := useStation(t, modeSequential)
+
+	previous := cacheMaxBytes
+	t.Cleanup(func() { cacheMaxBytes = previous })
+	cacheMaxBytes = 500
+
+	playing := nextRadioTrack(context.Background(), st, client, "")
+	next := nextRadioTrack(context.Background(), st, client, "")
+	ahead := newRadioLookahead()
+	defer ahead.close()
+	ahead.fill(context.Background(), st, client, "", playing.name, next)
+
+	// Half the cache fits next plus one more track, whatever the depth
+	if !slices.Equal(client.downloads, []string{"a.mp3", "b.mp3", "c.mp3"}) {
+		t.Fatalf("downloads %q, want lookahead to stop at half the cache", client.downloads)
+	}
+	if ahead.isPinned(playing.name) {
+		t.Fatal("the playing track is the stream's to hold, not the lookahead's")
+	}
+}
+
+func TestLookaheadDepthOne(t *testing.T) {
+	usePrefetchDepth(t, 1)
+	client := lookaheadBucket(t, 10)
+	st := useStation(t, modeSequential)
+
+	playing := nextRadioTrack(context.Background(), st, client, "")
+	next := nextRadioTrack(context.Background(), st, client, "")
+	ahead := newRadioLookahead()
+	defer ahead.close()
+	ahead.fill(context.Background(), st, client, "", playing.name, next)
+
+	if len(client.downloads) != 2 || !ahead.isPinned(next.name) {
+		t.Fatalf("downloads %q, want only the next track prefetched", client.downloads)
+	}
+}
+
+// Downloads of held block until release is closed
+type heldDownloadB2 struct {
+	*fakeB2
+	held    string
+	started chan struct{}
+	release chan struct{}
+}
+
+func (h *heldDownloadB2) downloadFile(fileName string) (string, error) {
+	if fileName == h.held {
+		close(h.started)
+		<-h.release
+	}
+	return h.fakeB2.downloadFile(fileName)
+}
+
+func TestLookaheadCloseWaitsForFill(t *testing.T) {
+	usePrefetchDepth(t, 3)
+	fake := lookaheadBucket(t, 10)
+	client := &heldDownloadB2{fakeB2: fake, held: "d.mp3", started: make(chan struct{}), release: make(chan struct{})}
+	st := useStation(t, modeSequential)
+
+	playing := nextRadioTrack(context.Background(), st, client, "")
+	next := nextRadioTrack(context.Background(), st, client, "")
+	ahead := newRadioLookahead()
+	go ahead.fill(context.Background(), st, client, "", playing.name, next)
+	<-client.started
+
+	closed := make(chan struct{})
+	go func() {
+		ahead.close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		t.Fatal("close returned while fill was still downloading")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(client.release)
+	<-closed
+	for _, name := range []string{"b.mp3", "c.mp3", "d.mp3"} {
+		if servingFiles.inUse(filepath.Join(fake.dir, name)) {
+			t.Errorf("%s still pinned after the connection ended", name)
+		}
+	}
+}
+
+func TestLookaheadKeepsSettingsOfItsConnection(t *testing.T) {
+	usePrefetchDepth(t, 3)
+	client := lookaheadBucket(t, 10)
+	st := useStation(t, modeSequential)
+
+	playing := nextRadioTrack(context.Background(), st, client, "")
+	next := nextRadioTrack(context.Background(), st, client, "")
+	ahead := newRadioLookahead()
+	defer ahead.close()
+
+	// A reload after the connection started doesn't reach its lookahead
+	radioPrefetchDepth = 1
+	ahead.fill(context.Background(), st, client, "", playing.name, next)
+	if len(client.downloads) != 4 {
+		t.Fatalf("downloads %q, want two tracks cached ahead at the depth the connection started with", client.downloads)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"log"
+	"strconv"
+)
+
+const (
+	loudnessOff        = "off"
+	loudnessLoudnorm   = "loudnorm"
+	loudnessReplayGain = "replaygain"
+
+	defaultLoudnessTarget = -16.0
+
+	// ReplayGain 2 gains bring a track to -18 LUFS
+	replayGainReference = -18.0
+)
+
+// How crossfaded /radio evens out volume between tracks, set from
+// RADIO_LOUDNESS. "loudnorm" measures each track as ffmpeg decodes it;
+// "replaygain" applies the gain stored in the track's tags and leaves
+// untagged tracks alone. Both need crossfading, since that's the only
+// place audio is re-encoded.
+var radioLoudness = loudnessOff
+
+// Integrated loudness normalized tracks are brought to, in LUFS, set from
+// RADIO_LOUDNESS_TARGET
+var loudnessTarget = defaultLoudnessTarget
+
+// ffmpeg filters bringing a track to the loudness target, ending in a comma
+// so the crossfade's resampling can follow, or "" when it is left as is.
+// loudnorm holds back a few seconds of audio to measure ahead, which costs
+// CPU rather than delay since tracks are decoded from the cache faster than
+// they play.
+func loudnessFilter(track radioTrack) string {
+	target := strconv.FormatFloat(loudnessTarget, 'f', 1, 64)
+
+	switch radioLoudness {
+	case loudnessLoudnorm:
+		return "loudnorm=I=" + target + ":TP=-1.5:LRA=11,"
+	case loudnessReplayGain:
+		metadata, err := loadMetadata(track.name, track.path)
+		if err != nil || metadata.ReplayGain.TrackGain == nil {
+			return ""
+		}
+		gain := *metadata.ReplayGain.TrackGain + loudnessTarget - replayGainReference
+		return "volume=" + strconv.FormatFloat(gain, 'f', 2, 64) + "dB,"
+	}
+	return ""
+}
+
+// Normalization rides on the crossfade's ffmpeg pass, so it is off without
+// one
+func checkLoudness() {
+	if radioLoudness != loudnessOff && !crossfadeEnabled() {
+		log.Printf("RADIO_LOUDNESS needs RADIO_CROSSFADE, radio volume won't be normalized")
+		radioLoudness = loudnessOff
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Stand-in for ffmpeg that prints the filter graph it was given
+const fakeFilterFFmpeg = `#!/bin/sh
+while [ $# -gt 0 ]; do
+	case "$1" in
+	-filter_complex|-af) printf '[%s]' "$2"; shift ;;
+	esac
+	shift
+done
+`
+
+func useLoudness(t *testing.T, mode string, target float64) {
+	useCrossfade(t, 3*time.Second)
+	script := filepath.Join(t.TempDir(), "ffmpeg")
+	if err := os.WriteFile(script, []byte(fakeFilterFFmpeg), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	ffmpegPath = script
+
+	previousMode, previousTarget := radioLoudness, loudnessTarget
+	t.Cleanup(func() { radioLoudness, loudnessTarget = previousMode, previousTarget })
+	radioLoudness, loudnessTarget = mode, target
+}
+
+func TestLoudnormFiltersCrossfadedRadio(t *testing.T) {
+	useLoudness(t, loudnessLoudnorm, -14)
+	useRadioBucket(t)
+
+	w := listenToRadio(t, 1)
+	got := w.Body.String()
+	if strings.Count(got, "loudnorm=I=-14.0:TP=-1.5:LRA=11,aresample") != 2 {
+		t.Fatalf("filter graph %q, want both inputs normalized to -14 LUFS", got)
+	}
+}
+
+func TestReplayGainFilter(t *testing.T) {
+	t.Chdir(t.TempDir())
+	useLoudness(t, loudnessReplayGain, -16)
+
+	tagged := writeTemp(t, "tagged.mp3", append(id3Tag(4,
+		id3Frame4("TXXX", id3UserText("replaygain_track_gain", "-6.48 dB")),
+	), 0xff, 0xfb, 0x90, 0x00))
+	// -6.48 dB brings the track to -18 LUFS, so -16 needs 2 dB more
+	if got := loudnessFilter(radioTrack{name: "tagged.mp3", path: tagged}); got != "volume=-4.48dB," {
+		t.Fatalf("got %q", got)
+	}
+
+	untagged := writeTemp(t, "untagged.mp3", []byte{0xff, 0xfb, 0x90, 0x00})
+	if got := loudnessFilter(radioTrack{name: "untagged.mp3", path: untagged}); got != "" {
+		t.Fatalf("got %q for a track without ReplayGain, want it left alone", got)
+	}
+}
+
+func TestLoudnessNeedsCrossfade(t *testing.T) {
+	useLoudness(t, loudnessLoudnorm, -16)
+	radioCrossfade = 0
+
+	checkLoudness()
+	if radioLoudness != loudnessOff {
+		t.Fatalf("loudness %s without crossfade, want off", radioLoudness)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// When each station last played each track, for lru mode. Saved to
+// PLAY_STATE_FILE so a restart picks the cycle up where it left off.
+type playTimes struct {
+	mu        sync.Mutex
+	stateFile string
+	stations  map[string]map[string]time.Time
+}
+
+var lastPlayed = &playTimes{stations: make(map[string]map[string]time.Time)}
+
+func newPlayTimes(stateFile string) *playTimes {
+	p := &playTimes{stateFile: stateFile, stations: make(map[string]map[string]time.Time)}
+	if stateFile == "" {
+		return p
+	}
+
+	data, err := os.ReadFile(stateFile)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Failed to read play state: %v", err)
+		}
+		return p
+	}
+	if err := json.Unmarshal(data, &p.stations); err != nil || p.stations == nil {
+		log.Printf("Failed to parse play state: %v", err)
+		p.stations = make(map[string]map[string]time.Time)
+	}
+	return p
+}
+
+// The candidates the station played longest ago, tracks it never played
+// counting as oldest of all
+func (p *playTimes) oldest(station string, fileNames []string) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	played := p.stations[station]
+	var oldest []string
+	var oldestAt time.Time
+	for _, name := range fileNames {
+		at := played[name]
+		switch {
+		case len(oldest) == 0 || at.Before(oldestAt):
+			oldest, oldestAt = []string{name}, at
+		case at.Equal(oldestAt):
+			oldest = append(oldest, name)
+		}
+	}
+	return oldest
+}
+
+func (p *playTimes) record(station, fileName string, at time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.stations[station] == nil {
+		p.stations[station] = make(map[string]time.Time)
+	}
+	p.stations[station][fileName] = at
+	p.save()
+}
+
+// Forget the station's plays, so the cycle starts over
+func (p *playTimes) reset(station string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.stations[station]; ok {
+		delete(p.stations, station)
+		p.save()
+	}
+}
+
+// Persist the play times. Callers must hold mu.
+func (p *playTimes) save() {
+	if p.stateFile == "" {
+		return
+	}
+
+	data, err := json.Marshal(p.stations)
+	if err != nil {
+		log.Printf("Failed to encode play state: %v", err)
+		return
+	}
+
+	tmpFile := p.stateFile + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0644); err != nil {
+		log.Printf("Failed to write play state: %v", err)
+		return
+	}
+	if err := os.Rename(tmpFile, p.stateFile); err != nil {
+		log.Printf("Failed to write play state: %v", err)
+	}
+}
+
+// Play the track the station played longest ago, choosing at random among
+// ties, so the whole library cycles before any track repeats
+func (s *trackSelector) nextLeastRecent(fileNames []string) (string, error) {
+	oldest := lastPlayed.oldest(s.station, fileNames)
+	if len(oldest) == 0 {
+		return "", errNoFiles
+	}
+
+	next := oldest[s.rng.Intn(len(oldest))]
+	lastPlayed.record(s.station, next, s.now())
+	return next, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func useLastPlayed(t *testing.T, stateFile string) {
+	previous := lastPlayed
+	t.Cleanup(func() { lastPlayed = previous })
+	lastPlayed = newPlayTimes(stateFile)
+}
+
+func lruSelector(t *testing.T, station string) *trackSelector {
+	t.Helper()
+	sel, err := newTrackSelector(selectorConfig{station: station, mode: modeLRU, seed: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	sel.now = func() time.Time {
+		clock = clock.Add(time.Minute)
+		return clock
+	}
+	return sel
+}
+
+func TestLRUPlaysEveryTrackBeforeRepeating(t *testing.T) {
+	useLastPlayed(t, "")
+	sel := lruSelector(t, "default")
+	files := []string{"a.mp3", "b.mp3", "c.mp3", "d.mp3", "e.mp3"}
+
+	var order []string
+	for cycle := range 3 {
+		seen := map[string]bool{}
+		for range len(files) {
+			name, err := sel.selectFile(files)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if seen[name] {
+				t.Fatalf("cycle %d repeated %s before playing every track", cycle, name)
+			}
+			seen[name] = true
+			if cycle == 0 {
+				order = append(order, name)
+			}
+		}
+	}
+
+	// After the first cycle the order is fixed by the play times
+	for i, want := range order {
+		if name, _ := sel.selectFile(files); name != want {
+			t.Fatalf("pick %d: got %s, want %s", i, name, want)
+		}
+	}
+}
+
+func TestLRUPlayTimesPersist(t *testing.T) {
+	state := filepath.Join(t.TempDir(), "plays.json")
+	useLastPlayed(t, state)
+	sel := lruSelector(t, "default")
+	files := []string{"a.mp3", "b.mp3", "c.mp3"}
+
+	first, _ := sel.selectFile(files)
+	second, _ := sel.selectFile(files)
+
+	// A restart reads the plays back and carries on with the third track
+	lastPlayed = newPlayTimes(state)
+	oldest := lastPlayed.oldest("default", files)
+	if len(oldest) != 1 || oldest[0] == first || oldest[0] == second {
+		t.Fatalf("oldest %q after playing %s and %s", oldest, first, second)
+	}
+	if other := lastPlayed.oldest("late-night", files); len(other) != len(files) {
+		t.Fatalf("another station's oldest %q, want every track", other)
+	}
+}
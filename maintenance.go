@@ -0,0 +1,117 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaintenanceMessage    = "The station is down for maintenance"
+	defaultMaintenanceRetryAfter = 5 * time.Minute
+)
+
+type maintenanceState struct {
+	Enabled    bool      `json:"enabled"`
+	Message    string    `json:"message"`
+	RetryAfter int       `json:"retry_after_seconds"`
+	Since      time.Time `json:"since,omitzero"`
+}
+
+// Whether streaming endpoints are taken offline, starting from MAINTENANCE,
+// MAINTENANCE_MESSAGE and MAINTENANCE_RETRY_AFTER and toggled through
+// /admin/maintenance
+type maintenanceMode struct {
+	mu    sync.Mutex
+	state maintenanceState
+}
+
+var maintenance = &maintenanceMode{state: maintenanceState{
+	Message:    defaultMaintenanceMessage,
+	RetryAfter: int(defaultMaintenanceRetryAfter.Seconds()),
+}}
+
+func (m *maintenanceMode) get() maintenanceState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state
+}
+
+// Switch maintenance on or off. An empty message or a zero retryAfter keeps
+// the current one.
+func (m *maintenanceMode) set(enabled bool, message string, retryAfter time.Duration) maintenanceState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if enabled && !m.state.Enabled {
+		m.state.Since = time.Now()
+	}
+	if !enabled {
+		m.state.Since = time.Time{}
+	}
+	m.state.Enabled = enabled
+	if message != "" {
+		m.state.Message = message
+	}
+	if retryAfter > 0 {
+		m.state.RetryAfter = int(retryAfter.Seconds())
+	}
+	return m.state
+}
+
+// Answer new requests to a streaming endpoint with 503 while in maintenance.
+// Streams already playing are left to finish.
+func unlessMaintenance(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		state := maintenance.get()
+		if !state.Enabled {
+			next(w, req)
+			return
+		}
+
+		w.Header().Set("Retry-After", strconv.Itoa(state.RetryAfter))
+		w.Header().Set("Cache-Control", "no-store")
+		http.Error(w, state.Message, http.StatusServiceUnavailable)
+	}
+}
+
+// GET reports the maintenance state. POST with ?enabled=true|false toggles
+// it, optionally with a new ?message= and ?retry_after= duration.
+func maintenanceHandler(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		writeJSON(w, maintenance.get())
+		return
+	case http.MethodPost:
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := req.URL.Query()
+	enabled, err := strconv.ParseBool(query.Get("enabled"))
+	if err != nil {
+		http.Error(w, "Invalid enabled parameter", http.StatusBadRequest)
+		return
+	}
+
+	var retryAfter time.Duration
+	if value := query.Get("retry_after"); value != "" {
+		retryAfter, err = time.ParseDuration(value)
+		if err != nil || retryAfter < time.Second {
+			http.Error(w, "Invalid retry_after parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	state := maintenance.set(enabled, query.Get("message"), retryAfter)
+	if state.Enabled {
+		log.Printf("Maintenance mode on: %s", state.Message)
+	} else {
+		log.Printf("Maintenance mode off")
+	}
+	writeJSON(w, state)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func useMaintenance(t *testing.T) {
+	previous := maintenance
+	t.Cleanup(func() { maintenance = previous })
+	maintenance = &maintenanceMode{state: previous.get()}
+}
+
+func setMaintenance(t *testing.T, query string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	maintenanceHandler(rec, httptest.NewRequest(http.MethodPost, "/admin/maintenance?"+query, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("%s: status %d: %s", query, rec.Code, rec.Body)
+	}
+}
+
+func TestMaintenanceTogglesStreaming(t *testing.T) {
+	t.Chdir(t.TempDir())
+	useStation(t, modeRandom)
+	useMaintenance(t)
+	stub := newS3Stub(t, map[string][]byte{"a.mp3": []byte("audio")})
+	stub.useEnv(t)
+	useListing(t, []string{"a.mp3"})
+	handler := unlessMaintenance(newStreamHandler(t).stream)
+
+	setMaintenance(t, "enabled=true&message=Migrating+buckets&retry_after=90s")
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/stream?file=a.mp3", nil))
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "90" {
+		t.Fatalf("status %d Retry-After %q, want 503 after 90", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if !strings.Contains(rec.Body.String(), "Migrating buckets") || stub.getCount("a.mp3") != 0 {
+		t.Fatalf("body %q, want the message without fetching the track", rec.Body)
+	}
+
+	rec = httptest.NewRecorder()
+	healthz(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Maintenance") != "true" {
+		t.Fatalf("healthz status %d, want live and reporting maintenance", rec.Code)
+	}
+
+	setMaintenance(t, "enabled=false")
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/stream?file=a.mp3", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "audio" {
+		t.Fatalf("status %d body %q, want the track once maintenance is off", rec.Code, rec.Body)
+	}
+}
+
+func TestMaintenanceInvalidParams(t *testing.T) {
+	useMaintenance(t)
+	for _, query := range []string{"", "enabled=maybe", "enabled=true&retry_after=soon", "enabled=true&retry_after=10ms"} {
+		rec := httptest.NewRecorder()
+		maintenanceHandler(rec, httptest.NewRequest(http.MethodPost, "/admin/maintenance?"+query, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%q: status %d, want 400", query, rec.Code)
+		}
+	}
+	if maintenance.get().Enabled {
+		t.Fatal("an invalid request switched maintenance on")
+	}
+}
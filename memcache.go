@@ -0,0 +1,161 @@
+package main
+
+import (
+	"container/list"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+const defaultMemoryCacheMaxFile = 1 << 20
+
+type memoryEntry struct {
+	key     string
+	data    []byte
+	modTime time.Time
+}
+
+// In-memory LRU tier for small, frequently played files (jingles) in front of
+// the disk cache, bounded by total bytes.
+type memoryCache struct {
+	mu       sync.Mutex
+	maxBytes int64 // 0 disables the tier
+	maxFile  int64
+	size     int64
+	order    *list.List // most recently used at the front
+	entries  map[string]*list.Element
+}
+
+var memCache = newMemoryCache(0, defaultMemoryCacheMaxFile)
+
+func newMemoryCache(maxBytes, maxFile int64) *memoryCache {
+	return &memoryCache{
+		maxBytes: maxBytes,
+		maxFile:  maxFile,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+func (c *memoryCache) admits(size int64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.fits(size)
+}
+
+// Callers must hold mu
+func (c *memoryCache) fits(size int64) bool {
+	return c.maxBytes > 0 && size <= c.maxFile && size <= c.maxBytes
+}
+
+func (c *memoryCache) get(key string) (*memoryEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	c.order.MoveToFront(element)
+	return element.Value.(*memoryEntry), true
+}
+
+func (c *memoryCache) add(key string, data []byte, modTime time.Time) {
+	size := int64(len(data))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.fits(size) {
+		return
+	}
+
+	if element, ok := c.entries[key]; ok {
+		c.size -= int64(len(element.Value.(*memoryEntry).data))
+		c.order.Remove(element)
+		delete(c.entries, key)
+	}
+
+	// Evict least recently used entries until the new one fits
+	for c.size+size > c.maxBytes {
+		oldest := c.order.Back()
+		entry := c.order.Remove(oldest).(*memoryEntry)
+		delete(c.entries, entry.key)
+		c.size -= int64(len(entry.data))
+	}
+
+	c.entries[key] = c.order.PushFront(&memoryEntry{key: key, data: data, modTime: modTime})
+	c.size += size
+}
+
+// Promote a file from the disk cache into memory if it's small enough
+func (c *memoryCache) load(key, filePath string) {
+	file, err := openCached(filePath)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil || !c.admits(info.Size()) {
+		return
+	}
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		log.Printf("Failed to load %s into memory cache: %v", filePath, err)
+		return
+	}
+
+	c.add(key, data, info.ModTime())
+}
+
+func (c *memoryCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		c.size -= int64(len(element.Value.(*memoryEntry).data))
+		c.order.Remove(element)
+		delete(c.entries, key)
+	}
+}
+
+// Change the limits, evicting least recently used entries that no longer fit
+func (c *memoryCache) setLimits(maxBytes, maxFile int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.maxBytes, c.maxFile = maxBytes, maxFile
+	for c.size > c.maxBytes {
+		oldest := c.order.Back()
+		entry := c.order.Remove(oldest).(*memoryEntry)
+		delete(c.entries, entry.key)
+		c.size -= int64(len(entry.data))
+	}
+}
+
+// Drop every entry whose key matches
+func (c *memoryCache) removeMatching(match func(key string) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, element := range c.entries {
+		if match(key) {
+			c.size -= int64(len(element.Value.(*memoryEntry).data))
+			c.order.Remove(element)
+			delete(c.entries, key)
+		}
+	}
+}
+
+func (c *memoryCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.order.Init()
+	c.entries = make(map[string]*list.Element)
+	c.size = 0
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMemoryCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newMemoryCache(10, 10)
+
+	c.add("a", []byte("aaaa"), time.Now())
+	c.add("b", []byte("bbbb"), time.Now())
+	c.get("a") // b is now the least recently used
+	c.add("c", []byte("cccc"), time.Now())
+
+	if _, ok := c.get("b"); ok {
+		t.Fatal("b should have been evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := c.get(key); !ok {
+			t.Fatalf("%s should still be cached", key)
+		}
+	}
+	if c.size != 8 {
+		t.Fatalf("size %d, want 8", c.size)
+	}
+}
+
+func TestMemoryCacheReplacesEntry(t *testing.T) {
+	c := newMemoryCache(10, 10)
+
+	c.add("a", []byte("aaaa"), time.Now())
+	c.add("a", []byte("aa"), time.Now())
+
+	entry, ok := c.get("a")
+	if !ok || string(entry.data) != "aa" {
+		t.Fatal("the new data should replace the old")
+	}
+	if c.size != 2 {
+		t.Fatalf("size %d, want 2", c.size)
+	}
+}
+
+func TestMemoryCacheTierSelection(t *testing.T) {
+	dir := t.TempDir()
+	small := filepath.Join(dir, "jingle.mp3")
+	large := filepath.Join(dir, "album.flac")
+	os.WriteFile(small, bytes.Repeat([]byte{1}, 100), 0o644)
+	os.WriteFile(large, bytes.Repeat([]byte{1}, 2000), 0o644)
+
+	c := newMemoryCache(4096, 1000)
+	c.load("jingle.mp3", small)
+	c.load("album.flac", large)
+
+	if _, ok := c.get("jingle.mp3"); !ok {
+		t.Fatal("a file under the size cap should be promoted to memory")
+	}
+	if _, ok := c.get("album.flac"); ok {
+		t.Fatal("a file over the size cap should stay on disk only")
+	}
+}
+
+func TestMemoryCacheDisabled(t *testing.T) {
+	c := newMemoryCache(0, defaultMemoryCacheMaxFile)
+
+	c.add("a", []byte("a"), time.Now())
+	if _, ok := c.get("a"); ok {
+		t.Fatal("a zero budget should disable the tier")
+	}
+}
+
+func TestStreamFromMemoryTier(t *testing.T) {
+	setB2Env(t)
+	useStation(t, modeRandom)
+	previous := memCache
+	t.Cleanup(func() { memCache = previous })
+	memCache = newMemoryCache(1024, 1024)
+	memCache.add("jingle.mp3", []byte("jingle"), time.Now())
+
+	rec := httptest.NewRecorder()
+	newStreamHandler(t).stream(rec, httptest.NewRequest(http.MethodGet, "/stream?file=jingle.mp3", nil))
+
+	if rec.Code != http.StatusOK || rec.Body.String() != "jingle" {
+		t.Fatalf("status %d body %q, want the cached bytes", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Sidecar metadata lives beside the cache under a hidden directory so cache
+// scans and eviction skip it
+var metadataDir = filepath.Join(cacheDir, ".meta")
+
+type replayGain struct {
+	TrackGain *float64 `json:"track_gain"`
+	TrackPeak *float64 `json:"track_peak"`
+	AlbumGain *float64 `json:"album_gain"`
+	AlbumPeak *float64 `json:"album_peak"`
+}
+
+type trackMetadata struct {
+	File         string     `json:"file"`
+	DisplayTitle string     `json:"display_title,omitempty"`
+	Title        string     `json:"title,omitempty"`
+	Artist       string     `json:"artist,omitempty"`
+	Album        string     `json:"album,omitempty"`
+	ReplayGain   replayGain `json:"replay_gain"`
+	Duration     float64    `json:"duration,omitempty"` // seconds
+	VBR          bool       `json:"vbr,omitempty"`
+	Chapters     []chapter  `json:"chapters"`
+}
+
+func metadataPath(fileName string) string {
+	return filepath.Join(metadataDir, localName(fileName)+".json")
+}
+
+// Parse a ReplayGain value such as "-6.48 dB" or "0.988553"
+func parseGainValue(value string) *float64 {
+	fields := strings.Fields(value)
+	if len(fields) == 0 {
+		return nil
+	}
+
+	parsed, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return nil
+	}
+	return &parsed
+}
+
+func replayGainFromTags(tags audioTags) replayGain {
+	gain := replayGain{
+		TrackGain: parseGainValue(tags["REPLAYGAIN_TRACK_GAIN"]),
+		TrackPeak: parseGainValue(tags["REPLAYGAIN_TRACK_PEAK"]),
+		AlbumGain: parseGainValue(tags["REPLAYGAIN_ALBUM_GAIN"]),
+		AlbumPeak: parseGainValue(tags["REPLAYGAIN_ALBUM_PEAK"]),
+	}
+
+	// Opus stores R128 gains as Q7.8 integers relative to -23 LUFS, which is
+	// 5 dB below the ReplayGain reference level
+	r128 := func(value string) *float64 {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			return nil
+		}
+		db := float64(parsed)/256 + 5
+		return &db
+	}
+	if gain.TrackGain == nil {
+		gain.TrackGain = r128(tags["R128_TRACK_GAIN"])
+	}
+	if gain.AlbumGain == nil {
+		gain.AlbumGain = r128(tags["R128_ALBUM_GAIN"])
+	}
+
+	return gain
+}
+
+// Read the sidecar for a cached file, regenerating it from the file's tags
+// when it's missing or older than the cached audio
+func loadMetadata(fileName, filePath string) (*trackMetadata, error) {
+	fileInfo, err := statCached(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	sidecar := metadataPath(fileName)
+	if info, err := os.Stat(sidecar); err == nil && !info.ModTime().Before(fileInfo.ModTime()) {
+		if metadata, err := readMetadata(sidecar); err == nil {
+			return metadata, nil
+		}
+	}
+
+	metadata := &trackMetadata{File: fileName}
+	tags, err := readTags(filePath)
+	if err != nil && !errors.Is(err, errNoTags) {
+		log.Printf("Failed to read tags from %s: %v", filePath, err)
+	}
+	if tags != nil {
+		metadata.Title = tags["TITLE"]
+		metadata.Artist = tags["ARTIST"]
+		metadata.Album = tags["ALBUM"]
+		metadata.ReplayGain = replayGainFromTags(tags)
+	}
+
+	metadata.Duration, metadata.VBR, err = readDuration(filePath)
+	if err != nil {
+		log.Printf("Failed to read duration of %s: %v", filePath, err)
+	}
+
+	metadata.Chapters, err = readChapters(filePath)
+	if err != nil {
+		log.Printf("Failed to read chapters from %s: %v", filePath, err)
+		metadata.Chapters = []chapter{}
+	}
+
+	if err := writeMetadata(sidecar, metadata); err != nil {
+		log.Printf("Failed to write metadata sidecar: %v", err)
+	}
+	return metadata, nil
+}
+
+func readMetadata(sidecar string) (*trackMetadata, error) {
+	data, err := os.ReadFile(sidecar)
+	if err != nil {
+		return nil, err
+	}
+
+	var metadata trackMetadata
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return nil, err
+	}
+	return &metadata, nil
+}
+
+func writeMetadata(sidecar string, metadata *trackMetadata) error {
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(sidecar), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(sidecar, data, 0644)
+}
+
+// Sidecar metadata if the file has been cached before, without touching B2
+func cachedMetadata(fileName string) (*trackMetadata, bool) {
+	metadata, err := readMetadata(metadataPath(fileName))
+	return metadata, err == nil
+}
+
+func meta(w http.ResponseWriter, req *http.Request) {
+	fileName := fileParam(req)
+	if fileName == "" {
+		http.Error(w, "Missing file parameter", http.StatusBadRequest)
+		return
+	}
+	if err := validateKey(fileName); err != nil {
+		http.Error(w, "Invalid file parameter", http.StatusBadRequest)
+		return
+	}
+	if !isAllowed(fileName) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	// Without the disk cache there is no file to read tags from
+	if !cacheEnabled {
+		writeJSON(w, trackMetadata{File: fileName, DisplayTitle: displayTitle(fileName, nil), Chapters: []chapter{}})
+		return
+	}
+
+	filePath := cachePath(fileName)
+	if _, err := statCached(filePath); err != nil {
+		b2Client, err := b2ClientFromEnv()
+		if err != nil {
+			http.Error(w, "Failed to create B2 client", http.StatusInternalServerError)
+			log.Printf("Failed to create B2 client: %v", err)
+			return
+		}
+
+		filePath, err = b2Client.downloadFile(fileName)
+		if err != nil {
+			b2Error(w, "Failed to download file", err)
+			log.Printf("Failed to download file: %v", err)
+			return
+		}
+	}
+
+	metadata, err := loadMetadata(fileName, filePath)
+	if err != nil {
+		http.Error(w, "Failed to read metadata", http.StatusInternalServerError)
+		log.Printf("Failed to read metadata for %s: %v", fileName, err)
+		return
+	}
+	metadata.DisplayTitle = displayTitle(fileName, metadata)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(metadata); err != nil {
+		log.Printf("Failed to encode metadata: %v", err)
+	}
+}
+
+// M3U playlist of the bucket. Durations and ReplayGain come from cached
+// sidecars; ReplayGain is passed through as #EXTINF attributes for players
+// that normalize volume.
+func playlistM3U(w http.ResponseWriter, req *http.Request) {
+	b2Client, err := b2ClientFromEnv()
+	if err != nil {
+		http.Error(w, "Failed to create B2 client", http.StatusInternalServerError)
+		log.Printf("Failed to create B2 client: %v", err)
+		return
+	}
+
+	listing.refreshFor(req)
+	files, err := listing.get(b2Client)
+	if err != nil {
+		b2Error(w, "Failed to list files", err)
+		log.Printf("Failed to list files: %v", err)
+		return
+	}
+	files = filterAllowed(filterAudio(files))
+
+	w.Header().Set("Content-Type", "audio/x-mpegurl")
+	fmt.Fprintln(w, "#EXTM3U")
+
+	for _, name := range files {
+		var attributes string
+		duration := -1
+
+		metadata, ok := cachedMetadata(name)
+		title := displayTitle(name, metadata)
+		if ok {
+			if metadata.Duration > 0 {
+				duration = int(math.Round(metadata.Duration))
+			}
+
+			gain := metadata.ReplayGain
+			if gain.TrackGain != nil {
+				attributes += fmt.Sprintf(` replaygain_track_gain="%.2f dB"`, *gain.TrackGain)
+			}
+			if gain.TrackPeak != nil {
+				attributes += fmt.Sprintf(` replaygain_track_peak="%.6f"`, *gain.TrackPeak)
+			}
+			if gain.AlbumGain != nil {
+				attributes += fmt.Sprintf(` replaygain_album_gain="%.2f dB"`, *gain.AlbumGain)
+			}
+		}
+
+		fmt.Fprintf(w, "#EXTINF:%d%s,%s\n", duration, attributes, title)
+		fmt.Fprintf(w, "/stream?file=%s\n", url.QueryEscape(name))
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+type serverMetrics struct {
+	streamsCompleted atomic.Int64
+	streamBytes      atomic.Int64
+	streamNanos      atomic.Int64
+	rangeRequests    atomic.Int64
+	cacheHits        atomic.Int64
+	cacheMisses      atomic.Int64
+
+	// B2 HTTP requests, timed until the response headers arrive
+	b2Requests    atomic.Int64
+	b2Errors      atomic.Int64
+	b2Nanos       atomic.Int64
+	b2LastLatency atomic.Int64
+
+	// Radio tracks that failed to download and were picked again, by reason,
+	// and selections that gave up after RADIO_MAX_RESELECTIONS
+	reselectNotFound      atomic.Int64
+	reselectDownloadError atomic.Int64
+	reselectQuarantined   atomic.Int64
+	reselectExhausted     atomic.Int64
+}
+
+var metrics serverMetrics
+
+// Whether to log every completed stream, set from STREAM_LOG
+var logStreams = true
+
+type streamRecord struct {
+	file     string
+	station  string
+	client   string // IP address
+	bytes    int64
+	duration time.Duration
+	ranged   bool
+	cacheHit bool
+}
+
+func recordStream(record streamRecord) {
+	metrics.streamsCompleted.Add(1)
+	metrics.streamBytes.Add(record.bytes)
+	metrics.streamNanos.Add(int64(record.duration))
+	if record.ranged {
+		metrics.rangeRequests.Add(1)
+	}
+	if record.cacheHit {
+		metrics.cacheHits.Add(1)
+	} else {
+		metrics.cacheMisses.Add(1)
+	}
+
+	if accessLog != nil {
+		accessLog.record(record)
+	}
+
+	if !logStreams {
+		return
+	}
+
+	cacheStatus := "miss"
+	if record.cacheHit {
+		cacheStatus = "hit"
+	}
+	log.Printf("Stream complete: file=%q bytes=%d duration=%s range=%t cache=%s",
+		record.file, record.bytes, record.duration.Round(time.Millisecond), record.ranged, cacheStatus)
+}
+
+func metricsHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	writeMetric(w, "radio_streams_completed_total", "counter", metrics.streamsCompleted.Load())
+	writeMetric(w, "radio_stream_bytes_total", "counter", metrics.streamBytes.Load())
+	fmt.Fprintf(w, "# TYPE radio_stream_duration_seconds_total counter\nradio_stream_duration_seconds_total %.3f\n",
+		time.Duration(metrics.streamNanos.Load()).Seconds())
+	writeMetric(w, "radio_range_requests_total", "counter", metrics.rangeRequests.Load())
+	writeMetric(w, "radio_cache_hits_total", "counter", metrics.cacheHits.Load())
+	writeMetric(w, "radio_cache_misses_total", "counter", metrics.cacheMisses.Load())
+	writeMetric(w, "radio_b2_requests_total", "counter", metrics.b2Requests.Load())
+	writeMetric(w, "radio_b2_request_errors_total", "counter", metrics.b2Errors.Load())
+	fmt.Fprintf(w, "# TYPE radio_b2_request_duration_seconds_total counter\nradio_b2_request_duration_seconds_total %.3f\n",
+		time.Duration(metrics.b2Nanos.Load()).Seconds())
+	fmt.Fprintf(w, "# TYPE radio_reselections_total counter\n")
+	fmt.Fprintf(w, "radio_reselections_total{reason=\"not_found\"} %d\n", metrics.reselectNotFound.Load())
+	fmt.Fprintf(w, "radio_reselections_total{reason=\"download_error\"} %d\n", metrics.reselectDownloadError.Load())
+	fmt.Fprintf(w, "radio_reselections_total{reason=\"quarantined\"} %d\n", metrics.reselectQuarantined.Load())
+	writeMetric(w, "radio_reselections_exhausted_total", "counter", metrics.reselectExhausted.Load())
+	writeMetric(w, "radio_active_streams", "gauge", streams.active.Load())
+	if goroutines != nil {
+		writeMetric(w, "radio_goroutines", "gauge", goroutines.last.Load())
+	}
+}
+
+// Times every request the S3 SDK sends to B2, retries included
+type timedHTTPClient struct {
+	client aws.HTTPClient
+}
+
+func (c timedHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := c.client.Do(req)
+	elapsed := time.Since(start)
+
+	metrics.b2Requests.Add(1)
+	metrics.b2Nanos.Add(int64(elapsed))
+	metrics.b2LastLatency.Store(int64(elapsed))
+	if err != nil || resp.StatusCode >= http.StatusInternalServerError {
+		metrics.b2Errors.Add(1)
+	}
+	return resp, err
+}
+
+func writeMetric(w http.ResponseWriter, name, kind string, value int64) {
+	fmt.Fprintf(w, "# TYPE %s %s\n%s %d\n", name, kind, name, value)
+}
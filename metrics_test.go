@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCountingWriterMatchesServedBytes(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "track.mp3")
+	if err := os.WriteFile(filePath, bytes.Repeat([]byte{0xff}, 10000), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		rangeHeader string
+		wantStatus  int
+		wantBytes   int64
+	}{
+		{"full", "", http.StatusOK, 10000},
+		{"range", "bytes=100-1099", http.StatusPartialContent, 1000},
+		{"suffix", "bytes=-10", http.StatusPartialContent, 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/stream?file=track.mp3", nil)
+			if tt.rangeHeader != "" {
+				req.Header.Set("Range", tt.rangeHeader)
+			}
+			rec := httptest.NewRecorder()
+			cw := &countingResponseWriter{ResponseWriter: rec}
+			http.ServeFile(cw, req, filePath)
+
+			if cw.status != tt.wantStatus {
+				t.Fatalf("status %d, want %d", cw.status, tt.wantStatus)
+			}
+			if cw.bytes != tt.wantBytes || int64(rec.Body.Len()) != tt.wantBytes {
+				t.Fatalf("counted %d bytes, body has %d, want %d", cw.bytes, rec.Body.Len(), tt.wantBytes)
+			}
+		})
+	}
+}
+
+func TestRecordStreamUpdatesMetrics(t *testing.T) {
+	previous := logStreams
+	t.Cleanup(func() { logStreams = previous })
+	logStreams = false
+
+	completed := metrics.streamsCompleted.Load()
+	streamBytes := metrics.streamBytes.Load()
+	ranges := metrics.rangeRequests.Load()
+	hits := metrics.cacheHits.Load()
+	misses := metrics.cacheMisses.Load()
+
+	recordStream(streamRecord{file: "a.mp3", bytes: 1234, duration: time.Second, ranged: true, cacheHit: true})
+	recordStream(streamRecord{file: "b.mp3", bytes: 766, duration: time.Second})
+
+	if got := metrics.streamsCompleted.Load() - completed; got != 2 {
+		t.Fatalf("%d streams completed, want 2", got)
+	}
+	if got := metrics.streamBytes.Load() - streamBytes; got != 2000 {
+		t.Fatalf("%d stream bytes, want 2000", got)
+	}
+	if got := metrics.rangeRequests.Load() - ranges; got != 1 {
+		t.Fatalf("%d range requests, want 1", got)
+	}
+	if metrics.cacheHits.Load()-hits != 1 || metrics.cacheMisses.Load()-misses != 1 {
+		t.Fatal("expected one cache hit and one miss")
+	}
+}
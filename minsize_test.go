@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func useMinFileSize(t *testing.T, size int64, strict bool) {
+	previousSize, previousStrict := minFileSize, minFileSizeStrict
+	t.Cleanup(func() { minFileSize, minFileSizeStrict = previousSize, previousStrict })
+	minFileSize, minFileSizeStrict = size, strict
+}
+
+func mixedSizeBucket(t *testing.T) *fakeB2 {
+	client := newFakeB2(t, map[string][]byte{
+		"track1.mp3":     bytes.Repeat([]byte("a"), 200_000),
+		"track2.mp3":     bytes.Repeat([]byte("b"), 150_000),
+		"stub.mp3":       bytes.Repeat([]byte("c"), 2_000),
+		"exact.mp3":      bytes.Repeat([]byte("d"), 100_000),
+		"truncated.flac": []byte("fLaC"),
+	})
+	useSizedListing(t, client)
+	return client
+}
+
+func TestMinFileSizeFiltersSelection(t *testing.T) {
+	client := mixedSizeBucket(t)
+	useMinFileSize(t, 100_000, false)
+
+	candidates, err := selectionCandidates(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(candidates)
+	if !slices.Equal(candidates, []string{"exact.mp3", "track1.mp3", "track2.mp3"}) {
+		t.Fatalf("candidates %q, want the small files left out", candidates)
+	}
+
+	useMinFileSize(t, 0, false)
+	if candidates, _ := selectionCandidates(client); len(candidates) != 5 {
+		t.Fatalf("%d candidates with no minimum, want all 5", len(candidates))
+	}
+}
+
+func TestMinFileSizeDirectRequests(t *testing.T) {
+	t.Chdir(t.TempDir())
+	useStation(t, modeRandom)
+	stub := newS3Stub(t, map[string][]byte{"stub.mp3": []byte("tiny")})
+	stub.useEnv(t)
+	mixedSizeBucket(t)
+
+	// Only selection is filtered unless strict
+	useMinFileSize(t, 100_000, false)
+	rec := httptest.NewRecorder()
+	newStreamHandler(t).stream(rec, httptest.NewRequest(http.MethodGet, "/stream?file=stub.mp3", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d, want the small file served on request", rec.Code)
+	}
+
+	useMinFileSize(t, 100_000, true)
+	for target, handler := range map[string]http.HandlerFunc{
+		"/stream?file=stub.mp3":  newStreamHandler(t).stream,
+		"/preload?file=stub.mp3": preload,
+	} {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("%s: status %d, want 404 when strict", target, rec.Code)
+		}
+	}
+	if !rejectedForSize("stub.mp3") || rejectedForSize("track1.mp3") || rejectedForSize("unlisted.mp3") {
+		t.Fatal("rejectedForSize disagrees with the listing")
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+const (
+	cafeComposed   = "Café.mp3"  // é as one code point
+	cafeDecomposed = "Café.mp3" // e followed by a combining acute accent
+)
+
+func TestNormalizeKey(t *testing.T) {
+	tests := map[string]string{
+		"albums/" + cafeComposed:     "albums/" + cafeComposed,
+		"albums/" + cafeDecomposed:   "albums/" + cafeComposed,
+		"/albums/" + cafeComposed:    "albums/" + cafeComposed,
+		"albums//" + cafeDecomposed:  "albums/" + cafeComposed,
+		"//albums///" + cafeComposed: "albums/" + cafeComposed,
+		"plain.mp3":                  "plain.mp3",
+	}
+	for key, want := range tests {
+		if got := normalizeKey(key); got != want {
+			t.Errorf("%q: got %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestEquivalentKeysShareCacheEntry(t *testing.T) {
+	t.Chdir(t.TempDir())
+	// The bucket holds the decomposed spelling behind a doubled slash
+	bucketKey := "albums//" + cafeDecomposed
+	stub := newS3Stub(t, map[string][]byte{bucketKey: []byte("cafe")})
+	stub.useEnv(t)
+	useListing(t, nil)
+
+	client, err := b2ClientFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listing.get(client); err != nil {
+		t.Fatal(err)
+	}
+
+	want := cachePath("albums/" + cafeComposed)
+	for _, raw := range []string{
+		"/albums/" + cafeComposed,
+		"albums/" + cafeDecomposed,
+		"albums//" + cafeComposed,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/stream", nil)
+		req.URL.RawQuery = "file=" + raw
+		fileName := fileParam(req)
+
+		path, err := client.downloadFile(fileName)
+		if err != nil {
+			t.Fatalf("%q: %v", raw, err)
+		}
+		if path != want {
+			t.Fatalf("%q cached at %q, want %q", raw, path, want)
+		}
+	}
+
+	if data, _ := os.ReadFile(want); string(data) != "cafe" {
+		t.Fatalf("cached %q", data)
+	}
+	if gets := stub.getCount(bucketKey); gets != 1 {
+		t.Fatalf("%d GETs of the bucket key, want the later requests served from its cache entry", gets)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStreamRangesAreNotTransformed(t *testing.T) {
+	for _, proxy := range []bool{false, true} {
+		t.Run(map[bool]string{false: "cached", true: "proxied"}[proxy], func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			if proxy {
+				disableCache(t)
+			}
+			useStation(t, modeRandom)
+			files := map[string][]byte{"track.mp3": []byte("0123456789")}
+			stub := newS3Stub(t, files)
+			stub.useEnv(t)
+			useSizedListing(t, newFakeB2(t, files))
+
+			req := httptest.NewRequest(http.MethodGet, "/stream?file=track.mp3", nil)
+			req.Header.Set("Range", "bytes=2-5")
+			req.Header.Set("Accept-Encoding", "gzip")
+			rec := httptest.NewRecorder()
+			newStreamHandler(t).stream(rec, req)
+
+			if rec.Code != http.StatusPartialContent || rec.Body.String() != "2345" {
+				t.Fatalf("status %d body %q, want 206 with bytes 2-5", rec.Code, rec.Body)
+			}
+			if got := rec.Header().Get("Content-Range"); got != "bytes 2-5/10" {
+				t.Fatalf("Content-Range %q", got)
+			}
+			if !strings.Contains(rec.Header().Get("Cache-Control"), "no-transform") {
+				t.Fatalf("Cache-Control %q, want no-transform", rec.Header().Get("Cache-Control"))
+			}
+			if encoding := rec.Header().Get("Content-Encoding"); encoding != "" {
+				t.Fatalf("Content-Encoding %q, audio must go out as is", encoding)
+			}
+		})
+	}
+}
+
+func TestNoTransformKeepsCacheControl(t *testing.T) {
+	header := http.Header{}
+	noTransform(header)
+	if got := header.Get("Cache-Control"); got != "no-transform" {
+		t.Fatalf("got %q", got)
+	}
+
+	header.Set("Cache-Control", "no-store")
+	noTransform(header)
+	if got := header.Get("Cache-Control"); got != "no-store, no-transform" {
+		t.Fatalf("got %q, want no-store kept", got)
+	}
+}
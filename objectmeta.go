@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const objectMetadataWorkers = 8
+
+// User metadata key/value pairs that exclude an object from selection, set
+// from EXCLUDE_METADATA (e.g. "explicit=true" for a clean station)
+var excludedMetadata map[string]string
+
+func parseMetadataRules(value string) (map[string]string, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	rules := make(map[string]string)
+	for _, rule := range strings.Split(value, ",") {
+		key, want, ok := strings.Cut(strings.TrimSpace(rule), "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("expected key=value, got %q", rule)
+		}
+		// S3 reports user metadata keys in lower case
+		rules[strings.ToLower(key)] = want
+	}
+	return rules, nil
+}
+
+type objectMetadataEntry struct {
+	ETag     string            `json:"etag"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+// User metadata needs a HeadObject per key, so results are kept per key,
+// validated against the listing's ETag, and persisted across restarts
+type objectMetadataCache struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]objectMetadataEntry
+	loaded  bool
+}
+
+var objectMetadata = &objectMetadataCache{
+	path:    filepath.Join(metadataDir, "objects.json"),
+	entries: make(map[string]objectMetadataEntry),
+}
+
+func (c *objectMetadataCache) load() {
+	if c.loaded {
+		return
+	}
+	c.loaded = true
+	if !cacheEnabled {
+		return
+	}
+
+	data, err := os.ReadFile(c.path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Failed to read object metadata cache: %v", err)
+		}
+		return
+	}
+	if err := json.Unmarshal(data, &c.entries); err != nil {
+		log.Printf("Failed to parse object metadata cache: %v", err)
+	}
+}
+
+func (c *objectMetadataCache) save() {
+	if !cacheEnabled {
+		return
+	}
+
+	data, err := json.Marshal(c.entries)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(c.path), 0755)
+	}
+	if err == nil {
+		err = os.WriteFile(c.path, data, 0644)
+	}
+	if err != nil {
+		log.Printf("Failed to write object metadata cache: %v", err)
+	}
+}
+
+// Metadata for each object, issuing HeadObject only for keys that are new or
+// whose ETag changed since they were last seen
+func (c *objectMetadataCache) lookup(b2Client B2, objects []objectInfo) map[string]map[string]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.load()
+
+	var stale []objectInfo
+	for _, object := range objects {
+		if entry, ok := c.entries[object.Key]; !ok || entry.ETag != object.ETag {
+			stale = append(stale, object)
+		}
+	}
+
+	if len(stale) > 0 {
+		log.Printf("Fetching metadata for %d objects", len(stale))
+
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		jobs := make(chan objectInfo)
+
+		for range objectMetadataWorkers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for object := range jobs {
+					head, err := b2Client.headFile(object.Key)
+					if err != nil {
+						log.Printf("Failed to fetch metadata for %s: %v", object.Key, err)
+						continue
+					}
+
+					mu.Lock()
+					c.entries[object.Key] = objectMetadataEntry{ETag: object.ETag, Metadata: head.Metadata}
+					mu.Unlock()
+				}
+			}()
+		}
+
+		for _, object := range stale {
+			jobs <- object
+		}
+		close(jobs)
+		wg.Wait()
+
+		c.save()
+	}
+
+	metadata := make(map[string]map[string]string, len(objects))
+	for _, object := range objects {
+		metadata[object.Key] = c.entries[object.Key].Metadata
+	}
+	return metadata
+}
+
+func matchesMetadataRules(metadata map[string]string, rules map[string]string) bool {
+	for key, want := range rules {
+		if strings.EqualFold(metadata[key], want) {
+			return true
+		}
+	}
+	return false
+}
+
+// Drop objects whose metadata matches an exclusion rule
+func filterByMetadata(b2Client B2, objects []objectInfo, fileNames []string) []string {
+	rules := currentExcludedMetadata()
+	if len(rules) == 0 {
+		return fileNames
+	}
+
+	metadata := objectMetadata.lookup(b2Client, objects)
+
+	filtered := make([]string, 0, len(fileNames))
+	for _, name := range fileNames {
+		if !matchesMetadataRules(metadata[name], rules) {
+			filtered = append(filtered, name)
+		}
+	}
+	return filtered
+}
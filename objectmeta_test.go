@@ -0,0 +1,81 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func useObjectMetadata(t *testing.T, rules map[string]string) {
+	t.Chdir(t.TempDir())
+	previousRules, previousCache := excludedMetadata, objectMetadata
+	t.Cleanup(func() { excludedMetadata, objectMetadata = previousRules, previousCache })
+	excludedMetadata = rules
+	objectMetadata = &objectMetadataCache{path: previousCache.path, entries: map[string]objectMetadataEntry{}}
+}
+
+func TestCleanModeFiltersTaggedObjects(t *testing.T) {
+	useObjectMetadata(t, map[string]string{"explicit": "true"})
+	useListing(t, nil)
+	useQuarantine(t, defaultQuarantineThreshold, defaultQuarantineCooldown)
+
+	client := newFakeB2(t, map[string][]byte{
+		"clean.mp3":    []byte("clean"),
+		"explicit.mp3": []byte("explicit"),
+		"untagged.mp3": []byte("untagged"),
+	})
+	client.metadata = map[string]map[string]string{
+		"clean.mp3":    {"explicit": "false"},
+		"explicit.mp3": {"explicit": "TRUE"},
+	}
+
+	candidates, err := selectionCandidates(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(candidates, []string{"clean.mp3", "untagged.mp3"}) {
+		t.Fatalf("candidates %q, want the explicit track filtered out", candidates)
+	}
+
+	// Metadata is cached per ETag, so an unchanged listing needs no HeadObject
+	heads := client.heads
+	if _, err := selectionCandidates(client); err != nil {
+		t.Fatal(err)
+	}
+	if client.heads != heads {
+		t.Fatalf("issued %d more HeadObject calls for an unchanged listing", client.heads-heads)
+	}
+
+	// The cache survives a restart
+	objectMetadata = &objectMetadataCache{path: objectMetadata.path, entries: map[string]objectMetadataEntry{}}
+	if _, err := selectionCandidates(client); err != nil {
+		t.Fatal(err)
+	}
+	if client.heads != heads {
+		t.Fatal("persisted metadata wasn't reused after a restart")
+	}
+}
+
+func TestMetadataFilterDisabled(t *testing.T) {
+	useObjectMetadata(t, nil)
+	client := newFakeB2(t, map[string][]byte{"a.mp3": nil})
+
+	if files := filterByMetadata(client, []objectInfo{{Key: "a.mp3"}}, []string{"a.mp3"}); len(files) != 1 {
+		t.Fatal("no rules should mean no filtering")
+	}
+	if client.heads != 0 {
+		t.Fatal("no rules should mean no HeadObject calls")
+	}
+}
+
+func TestParseMetadataRules(t *testing.T) {
+	rules, err := parseMetadataRules("Explicit=true, mood=sad")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 || rules["explicit"] != "true" || rules["mood"] != "sad" {
+		t.Fatalf("rules %v", rules)
+	}
+	if _, err := parseMetadataRules("explicit"); err == nil {
+		t.Fatal("expected an error for a rule without a value")
+	}
+}
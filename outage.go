@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+const (
+	outageEnd     = "end"
+	outageSilence = "silence"
+
+	// Times a track that breaks off mid-stream is fetched again from where
+	// it stopped before the stream moves on to the next one
+	maxRadioResumes = 2
+)
+
+var (
+	// Wait before the first resume, growing with each one after
+	radioResumeBackoff = time.Second
+
+	// Length of each stretch of silence played while B2 is unreachable
+	radioOutageSilence = 5 * time.Second
+)
+
+// What a /radio connection plays when B2 fails mid-stream and no next track
+// can be fetched, set from RADIO_OUTAGE. FALLBACK_FILE takes precedence when
+// set. "end" closes the stream; "silence" plays short stretches of silence
+// between retries until B2 recovers, and needs an MP3 stream.
+var radioOutage = outageEnd
+
+// A failure reading a track's audio, as opposed to writing to the listener.
+// The stream can recover from these by moving on to another track.
+type trackReadError struct {
+	err error
+}
+
+func (e trackReadError) Error() string { return e.err.Error() }
+func (e trackReadError) Unwrap() error { return e.err }
+
+func isTrackReadError(err error) bool {
+	var readErr trackReadError
+	return errors.As(err, &readErr)
+}
+
+// Reads a track, and when it's proxied from B2 and the body breaks off, asks
+// B2 for the rest of it from where it stopped
+type resumingReader struct {
+	ctx      context.Context
+	b2Client B2
+	track    radioTrack
+	body     io.ReadCloser
+	etag     string
+	pos      int64
+	resumes  int
+	pending  error
+}
+
+func (r *resumingReader) Read(p []byte) (int, error) {
+	for {
+		if r.pending == nil {
+			var n int
+			n, r.pending = r.body.Read(p)
+			r.pos += int64(n)
+			if n > 0 || r.pending == nil {
+				// A read error is returned on the next call
+				return n, nil
+			}
+		}
+
+		err := r.pending
+		if err == io.EOF {
+			return 0, err
+		}
+		if !r.resume(err) {
+			return 0, trackReadError{err}
+		}
+		r.pending = nil
+	}
+}
+
+// Fetch the rest of the track after err broke off the body, reporting
+// whether reading can go on
+func (r *resumingReader) resume(err error) bool {
+	// A cached file failing to read won't get better
+	if r.track.path != "" {
+		return false
+	}
+
+	for r.resumes < maxRadioResumes {
+		r.resumes++
+		log.Printf("Lost %s after %d bytes, resuming (%d/%d): %v", r.track.name, r.pos, r.resumes, maxRadioResumes, err)
+
+		select {
+		case <-time.After(radioResumeBackoff * time.Duration(r.resumes)):
+		case <-r.ctx.Done():
+			return false
+		}
+
+		var result *rangeResult
+		result, err = r.b2Client.fetchRange(r.track.name, fmt.Sprintf("bytes=%d-", r.pos))
+		if err != nil {
+			continue
+		}
+		if r.etag != "" && result.etag != "" && result.etag != r.etag {
+			result.body.Close()
+			log.Printf("%s changed in B2 while playing, not resuming it", r.track.name)
+			return false
+		}
+
+		r.body.Close()
+		r.body = result.body
+		return true
+	}
+	quarantined.recordFailure(r.track.name)
+	return false
+}
+
+func (r *resumingReader) Close() error {
+	return r.body.Close()
+}
+
+// One silent MPEG-1 Layer III frame: 128 kbps, 44.1 kHz, 1152 samples
+var silentMP3Frame = append([]byte{0xFF, 0xFB, 0x90, 0x00}, make([]byte, 413)...)
+
+// Play a stretch of silence, then wait out its length so the retry that
+// follows doesn't spin while B2 is down
+func playSilence(cw *chunkedWriter, length time.Duration) error {
+	frameDuration := time.Second * 1152 / 44100
+	frames := int(length / frameDuration)
+	if err := cw.copyFrom(bytes.NewReader(bytes.Repeat(silentMP3Frame, frames))); err != nil {
+		return err
+	}
+
+	select {
+	case <-time.After(length):
+		return nil
+	case <-cw.ctx.Done():
+		return cw.ctx.Err()
+	}
+}
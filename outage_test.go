@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// B2 stand-in that can go down, and can break off the first full read of
+// a track partway through
+type flakyOrigin struct {
+	*httptest.Server
+	objects map[string][]byte
+	down    atomic.Bool
+
+	mu         sync.Mutex
+	breakAfter map[string]int
+	requests   []string
+}
+
+func newFlakyOrigin(t *testing.T, objects map[string][]byte) *flakyOrigin {
+	origin := &flakyOrigin{objects: objects, breakAfter: map[string]int{}}
+	origin.Server = httptest.NewServer(http.HandlerFunc(origin.serve))
+	t.Cleanup(origin.Close)
+	setB2Env(t)
+	t.Setenv("ENDPOINT", origin.URL)
+	return origin
+}
+
+func (o *flakyOrigin) serve(w http.ResponseWriter, req *http.Request) {
+	key := strings.TrimPrefix(req.URL.Path, "/bucket/")
+	o.mu.Lock()
+	o.requests = append(o.requests, strings.TrimSpace(key+" "+req.Header.Get("Range")))
+	cut, breaks := o.breakAfter[key]
+	if breaks && req.Header.Get("Range") == "" {
+		delete(o.breakAfter, key)
+	}
+	o.mu.Unlock()
+
+	if o.down.Load() {
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`<Error><Code>AccessDenied</Code><Message>Access Denied</Message></Error>`))
+		return
+	}
+	data, ok := o.objects[key]
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+
+	w.Header().Set("ETag", `"v1"`)
+	if breaks && req.Header.Get("Range") == "" {
+		// Promise the whole object, then drop the connection partway
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data[:cut])
+		w.(http.Flusher).Flush()
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+		return
+	}
+	http.ServeContent(w, req, key, time.Time{}, bytes.NewReader(data))
+}
+
+func (o *flakyOrigin) sawRequest(request string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return slices.Contains(o.requests, request)
+}
+
+// Proxied radio with short waits, so outages play out quickly
+func useOutageRadio(t *testing.T, outage string) {
+	disableCache(t)
+	useQuarantine(t, 0, 0)
+	useStation(t, modeSequential)
+	previousOutage, previousBackoff, previousSilence, previousJitter := radioOutage, radioResumeBackoff, radioOutageSilence, radioJitter
+	t.Cleanup(func() {
+		radioOutage, radioResumeBackoff, radioOutageSilence, radioJitter = previousOutage, previousBackoff, previousSilence, previousJitter
+	})
+	radioOutage, radioResumeBackoff, radioOutageSilence, radioJitter = outage, time.Millisecond, 50*time.Millisecond, 0
+}
+
+func TestRadioResumesBrokenTrack(t *testing.T) {
+	useOutageRadio(t, outageEnd)
+	origin := newFlakyOrigin(t, map[string][]byte{
+		"a.mp3": []byte("aaaaaaaa"),
+		"b.mp3": []byte("bbbbbbbb"),
+	})
+	origin.breakAfter["a.mp3"] = 4
+	useListing(t, []string{"a.mp3", "b.mp3"})
+
+	w := listenToRadio(t, 16)
+	if got := w.Body.String(); !strings.HasPrefix(got, "aaaaaaaabbbbbbbb") {
+		t.Fatalf("streamed %q, want a.mp3 whole and then b.mp3", got)
+	}
+	if !origin.sawRequest("a.mp3 bytes=4-") {
+		t.Fatalf("requests %q, want a.mp3 resumed from byte 4", origin.requests)
+	}
+}
+
+// Flips the origin back up once silence has gone out
+type recoveringListener struct {
+	*cancelAfterWriter
+	origin *flakyOrigin
+}
+
+func (w *recoveringListener) Write(p []byte) (int, error) {
+	if bytes.Contains(p, silentMP3Frame[:4]) {
+		w.origin.down.Store(false)
+	}
+	return w.cancelAfterWriter.Write(p)
+}
+
+var wholeTracks = regexp.MustCompile(`^(aaaa|bbbb|cccc|dddd){2}$`)
+
+func TestRadioPlaysSilenceThroughOutage(t *testing.T) {
+	useOutageRadio(t, outageSilence)
+	origin := newFlakyOrigin(t, map[string][]byte{
+		"a.mp3": []byte("aaaa"),
+		"b.mp3": []byte("bbbb"),
+		"c.mp3": []byte("cccc"),
+		"d.mp3": []byte("dddd"),
+	})
+	origin.down.Store(true)
+	useListing(t, []string{"a.mp3", "b.mp3", "c.mp3", "d.mp3"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w := &recoveringListener{
+		cancelAfterWriter: &cancelAfterWriter{ResponseRecorder: httptest.NewRecorder(), limit: len(silentMP3Frame) + 8, cancel: cancel},
+		origin:            origin,
+	}
+	done := make(chan struct{})
+	go func() {
+		radio(w, httptest.NewRequest(http.MethodGet, "/radio", nil).WithContext(ctx))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the stream never recovered")
+	}
+
+	body := w.Body.Bytes()
+	if !bytes.HasPrefix(body, silentMP3Frame) {
+		t.Fatalf("streamed %q, want silence while B2 was down", body[:min(len(body), 16)])
+	}
+	if tail := string(body[len(silentMP3Frame):]); !wholeTracks.MatchString(tail) {
+		t.Fatalf("streamed %q after the silence, want the tracks to resume", tail)
+	}
+}
+
+func TestRadioOutageEndsStream(t *testing.T) {
+	useOutageRadio(t, outageEnd)
+	origin := newFlakyOrigin(t, map[string][]byte{"a.mp3": []byte("aaaa"), "b.mp3": []byte("bbbb")})
+	origin.down.Store(true)
+	useListing(t, []string{"a.mp3", "b.mp3"})
+
+	// Cancelled once the stream ends, as the server does, so the prefetch it
+	// leaves behind stops before the listing and origin are torn down
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rec := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		radio(rec, httptest.NewRequest(http.MethodGet, "/radio", nil).WithContext(ctx))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the stream kept going with B2 down and no outage fallback")
+	}
+	if rec.Body.Len() != 0 {
+		t.Fatalf("streamed %q", rec.Body)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+const maxPlaylistLength = 100
+
+// Parse and check ?list= up front, so a bad entry fails the request before
+// any audio is sent rather than cutting the stream off partway
+func parsePlaylist(value string) ([]string, error) {
+	var files []string
+	for _, entry := range strings.Split(value, ",") {
+		if name := normalizeKey(strings.TrimSpace(entry)); name != "" {
+			files = append(files, name)
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("empty playlist")
+	}
+	if len(files) > maxPlaylistLength {
+		return nil, fmt.Errorf("playlist has %d tracks, at most %d are allowed", len(files), maxPlaylistLength)
+	}
+
+	// A continuous stream can't switch container formats between tracks
+	ext := filepath.Ext(files[0])
+	for _, name := range files {
+		if err := validateKey(name); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		if !listing.contains(name) || !isAllowed(name) || rejectedForSize(name) {
+			return nil, fmt.Errorf("%s: %w", name, errNotFound)
+		}
+		if !strings.EqualFold(filepath.Ext(name), ext) {
+			return nil, fmt.Errorf("%s: all tracks must share the %s format", name, ext)
+		}
+	}
+	return files, nil
+}
+
+// Fetch a playlist track ahead of playing it, like radio's prefetch
+func playlistTrack(b2Client B2, name string) radioTrack {
+	if !cacheEnabled {
+		return radioTrack{name: name}
+	}
+	path, err := b2Client.downloadFile(name)
+	return radioTrack{name: name, path: path, err: err}
+}
+
+// Continuous stream of the tracks in ?list=, in order, ending after the last
+// one or starting over with ?loop=true
+func playList(w http.ResponseWriter, req *http.Request) {
+	if egress.exceeded() {
+		http.Error(w, "Daily egress quota exceeded, try again tomorrow", http.StatusServiceUnavailable)
+		log.Printf("Rejected play request: daily egress quota exceeded")
+		return
+	}
+
+	st, ok := stationFor(w, req)
+	if !ok {
+		return
+	}
+
+	b2Client, err := b2ClientFromEnv()
+	if err != nil {
+		http.Error(w, "Failed to create B2 client", http.StatusInternalServerError)
+		log.Printf("Failed to create B2 client: %v", err)
+		return
+	}
+
+	if _, err := listing.get(b2Client); err != nil {
+		b2Error(w, "Failed to list files", err)
+		log.Printf("Failed to list files: %v", err)
+		return
+	}
+	files, err := parsePlaylist(req.URL.Query().Get("list"))
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, errNotFound) {
+			status = http.StatusNotFound
+		}
+		http.Error(w, fmt.Sprintf("Invalid playlist: %v", err), status)
+		return
+	}
+	loop := req.URL.Query().Get("loop") == "true"
+
+	current := playlistTrack(b2Client, files[0])
+	if current.err != nil {
+		b2Error(w, "Failed to fetch track", current.err)
+		log.Printf("Failed to start playlist: %v", current.err)
+		return
+	}
+
+	done := streams.begin()
+	defer done()
+	defer st.join()()
+
+	cw := newChunkedWriter(w, req, audioContentType(files[0]))
+	ctx := req.Context()
+
+	i := 0
+	for {
+		nextIndex := i + 1
+		if nextIndex == len(files) && loop {
+			nextIndex = 0
+		}
+
+		// Fetch the next track while this one plays so there's no gap
+		var next chan radioTrack
+		if nextIndex < len(files) {
+			next = make(chan radioTrack, 1)
+			go func(name string) {
+				if ctx.Err() != nil {
+					next <- radioTrack{err: ctx.Err()}
+					return
+				}
+				next <- playlistTrack(b2Client, name)
+			}(files[nextIndex])
+		}
+
+		log.Printf("Playlist on %s playing: %s", st.name, current.name)
+		st.recordPlay(current.name)
+		if err := playRadioTrack(cw, b2Client, current, streamRecord{station: st.name, client: clientIP(req)}); err != nil {
+			log.Printf("Playlist stream ended: %v", err)
+			return
+		}
+
+		if next == nil {
+			log.Printf("Playlist finished after %d tracks", len(files))
+			return
+		}
+		if streams.isDraining() {
+			log.Printf("Playlist stream ended after %s for shutdown", current.name)
+			return
+		}
+
+		current = <-next
+		if current.err != nil {
+			log.Printf("Playlist stream ended, failed to fetch %s: %v", files[nextIndex], current.err)
+			return
+		}
+		i = nextIndex
+	}
+}
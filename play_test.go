@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func usePlaylistBucket(t *testing.T) {
+	t.Chdir(t.TempDir())
+	stub := newS3Stub(t, map[string][]byte{
+		"one.mp3":   []byte("first track "),
+		"two.mp3":   []byte("second track"),
+		"three.ogg": []byte("other format"),
+	})
+	stub.useEnv(t)
+	useListing(t, []string{"one.mp3", "two.mp3", "three.ogg"})
+}
+
+func TestPlayStreamsPlaylistInOrder(t *testing.T) {
+	usePlaylistBucket(t)
+	st := useStation(t, modeRandom)
+
+	rec := httptest.NewRecorder()
+	playList(rec, httptest.NewRequest(http.MethodGet, "/play?list=two.mp3,one.mp3", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if rec.Body.String() != "second trackfirst track " {
+		t.Fatalf("streamed %q, want both tracks back to back", rec.Body)
+	}
+
+	status := st.status()
+	if status.NowPlaying != "one.mp3" || len(status.History) != 2 || status.History[0].File != "two.mp3" {
+		t.Fatalf("now playing %s with history %+v", status.NowPlaying, status.History)
+	}
+}
+
+// Cancels the request once enough has been streamed to prove it looped
+type cancelAfterWriter struct {
+	*httptest.ResponseRecorder
+	limit  int
+	cancel context.CancelFunc
+}
+
+func (w *cancelAfterWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseRecorder.Write(p)
+	if w.Body.Len() >= w.limit {
+		w.cancel()
+	}
+	return n, err
+}
+
+func TestPlayLoops(t *testing.T) {
+	usePlaylistBucket(t)
+	useStation(t, modeRandom)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w := &cancelAfterWriter{ResponseRecorder: httptest.NewRecorder(), limit: 36, cancel: cancel}
+	playList(w, httptest.NewRequest(http.MethodGet, "/play?list=one.mp3,two.mp3&loop=true", nil).WithContext(ctx))
+
+	if !strings.HasPrefix(w.Body.String(), "first track second trackfirst track ") {
+		t.Fatalf("streamed %q, want the playlist to start over", w.Body)
+	}
+}
+
+func TestPlayValidatesUpFront(t *testing.T) {
+	usePlaylistBucket(t)
+	useStation(t, modeRandom)
+
+	tests := []struct {
+		list   string
+		status int
+	}{
+		{"", http.StatusBadRequest},
+		{"one.mp3,missing.mp3", http.StatusNotFound},
+		{"one.mp3,three.ogg", http.StatusBadRequest},
+		{"one.mp3,../secret.mp3", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		playList(rec, httptest.NewRequest(http.MethodGet, "/play?list="+tt.list, nil))
+		if rec.Code != tt.status {
+			t.Errorf("%q: status %d, want %d", tt.list, rec.Code, tt.status)
+		}
+		if strings.Contains(rec.Body.String(), "first track") {
+			t.Errorf("%q: streamed audio before rejecting the playlist", tt.list)
+		}
+	}
+}
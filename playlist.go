@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+)
+
+type playlistEntry struct {
+	Name  string `json:"name"`
+	Title string `json:"title"`
+	URL   string `json:"url"`
+}
+
+// Serves /playlist with the B2 client built at startup
+type playlistHandler struct {
+	client B2
+}
+
+// The tracks a listener can pick as JSON, each with a ready-made /stream
+// link, for a UI to list the library. Titles come from cached tags where
+// there are any, like /playlist.m3u.
+func (h *playlistHandler) playlist(w http.ResponseWriter, req *http.Request) {
+	listing.refreshFor(req)
+	files, err := listing.get(h.client)
+	if err != nil {
+		// Whatever B2 answered, a UI can only report the library as
+		// unavailable
+		recentErrors.add(fmt.Sprintf("Failed to list files: %v", err))
+		http.Error(w, "Failed to list files", http.StatusInternalServerError)
+		setProblemType(w, err)
+		log.Printf("Failed to list files: %v", err)
+		return
+	}
+
+	entries := []playlistEntry{}
+	for _, name := range filterAllowed(filterVariants(filterAudio(files))) {
+		metadata, _ := cachedMetadata(name)
+		entries = append(entries, playlistEntry{
+			Name:  name,
+			Title: displayTitle(name, metadata),
+			URL:   "/stream?" + url.Values{"file": {name}}.Encode(),
+		})
+	}
+
+	writeJSON(w, entries)
+}
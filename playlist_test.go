@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func getPlaylist(t *testing.T, client B2) []playlistEntry {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	(&playlistHandler{client: client}).playlist(rec, httptest.NewRequest(http.MethodGet, "/playlist", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("status %d type %s: %s", rec.Code, rec.Header().Get("Content-Type"), rec.Body)
+	}
+	var entries []playlistEntry
+	if err := json.NewDecoder(rec.Body).Decode(&entries); err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func TestPlaylistLinksEveryTrack(t *testing.T) {
+	t.Chdir(t.TempDir())
+	useListing(t, []string{"jazz/Blue Train & Co.mp3", "live/été?.ogg", "album/cover.jpg"})
+
+	entries := getPlaylist(t, newFakeB2(t, nil))
+	want := []playlistEntry{
+		{Name: "jazz/Blue Train & Co.mp3", Title: "Blue Train & Co", URL: "/stream?file=jazz%2FBlue+Train+%26+Co.mp3"},
+		{Name: "live/été?.ogg", Title: "été?", URL: "/stream?file=live%2F%C3%A9t%C3%A9%3F.ogg"},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("got %+v, want %+v", entries, want)
+	}
+	for i := range want {
+		if entries[i] != want[i] {
+			t.Errorf("entry %d: got %+v, want %+v", i, entries[i], want[i])
+		}
+	}
+
+	// The links are ones /stream resolves back to the track
+	req := httptest.NewRequest(http.MethodGet, entries[1].URL, nil)
+	if name := fileParam(req); name != entries[1].Name {
+		t.Fatalf("%s names %q, want %q", entries[1].URL, name, entries[1].Name)
+	}
+}
+
+func TestPlaylistOfEmptyBucket(t *testing.T) {
+	useListing(t, nil)
+	stub := newS3Stub(t, map[string][]byte{})
+	stub.useEnv(t)
+	client, err := b2ClientFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	(&playlistHandler{client: client}).playlist(rec, httptest.NewRequest(http.MethodGet, "/playlist", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "[]\n" {
+		t.Fatalf("status %d body %q, want an empty array", rec.Code, rec.Body)
+	}
+}
+
+type throttledLister struct {
+	*fakeB2
+}
+
+func (throttledLister) listObjects() ([]objectInfo, error) {
+	return nil, fmt.Errorf("failed to list objects: %w", errThrottled)
+}
+
+func TestPlaylistListingFailureIs500(t *testing.T) {
+	handler := problemJSON((&playlistHandler{client: throttledLister{newFakeB2(t, nil)}}).playlist)
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/playlist", nil))
+	if rec.Code != http.StatusInternalServerError || rec.Header().Get("Content-Type") != "application/problem+json" {
+		t.Fatalf("status %d type %s, want a 500 JSON error", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	var body problem
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Status != http.StatusInternalServerError || body.Detail != "Failed to list files" {
+		t.Fatalf("got %+v", body)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+)
+
+// Download a file into the cache without streaming it, so the web player
+// can warm the track it expects to play next. Answers 204 either way; a file
+// that is already cached is left as is.
+func preload(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if egress.exceeded() {
+		http.Error(w, "Daily egress quota exceeded, try again tomorrow", http.StatusServiceUnavailable)
+		return
+	}
+
+	fileName := fileParam(req)
+	if fileName == "" {
+		http.Error(w, "Missing file parameter", http.StatusBadRequest)
+		return
+	}
+	if err := validateKey(fileName); err != nil {
+		http.Error(w, "Invalid file parameter", http.StatusBadRequest)
+		log.Printf("Rejected unsafe file parameter: %q", fileName)
+		return
+	}
+	if !isAllowed(fileName) || rejectedForSize(fileName) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	if !cacheEnabled {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if _, err := statCached(cachePath(fileName)); err == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// A file larger than the whole cache would only evict everything else
+	if object, ok := listing.lookup(fileName); ok {
+		if limit := currentCacheMaxBytes(); limit > 0 && object.Size > limit {
+			http.Error(w, "File is larger than the cache", http.StatusInsufficientStorage)
+			return
+		}
+	}
+
+	b2Client, err := b2ClientFromEnv()
+	if err != nil {
+		http.Error(w, "Failed to create B2 client", http.StatusInternalServerError)
+		log.Printf("Failed to create B2 client: %v", err)
+		return
+	}
+
+	if _, err := b2Client.downloadFile(fileName); err != nil {
+		if !errors.Is(err, errInsufficientStorage) {
+			quarantined.recordFailure(fileName)
+		}
+		b2Error(w, "Failed to preload file", err)
+		log.Printf("Failed to preload %s: %v", fileName, err)
+		return
+	}
+	quarantined.recordSuccess(fileName)
+
+	log.Printf("Preloaded file: %s", fileName)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPreloadCachesOnce(t *testing.T) {
+	t.Chdir(t.TempDir())
+	stub := newS3Stub(t, map[string][]byte{"next.mp3": []byte("audio")})
+	stub.useEnv(t)
+	useListing(t, []string{"next.mp3"})
+
+	for range 2 {
+		rec := httptest.NewRecorder()
+		preload(rec, httptest.NewRequest(http.MethodPost, "/preload?file=next.mp3", nil))
+		if rec.Code != http.StatusNoContent || rec.Body.Len() != 0 {
+			t.Fatalf("status %d body %q, want an empty 204", rec.Code, rec.Body)
+		}
+	}
+	if data, err := os.ReadFile(filepath.Join(cacheDir, "next.mp3")); err != nil || string(data) != "audio" {
+		t.Fatalf("cached %q (%v)", data, err)
+	}
+	if n := stub.getCount("next.mp3"); n != 1 {
+		t.Fatalf("downloaded %d times, want the second preload to be a no-op", n)
+	}
+}
+
+func TestPreloadRejects(t *testing.T) {
+	t.Chdir(t.TempDir())
+	stub := newS3Stub(t, map[string][]byte{"next.mp3": []byte("audio")})
+	stub.useEnv(t)
+	useListing(t, []string{"next.mp3", "other.mp3"})
+
+	useAllowlist(t, "next.mp3")
+	for target, want := range map[string]int{
+		"/preload":                 http.StatusBadRequest,
+		"/preload?file=../etc.mp3": http.StatusBadRequest,
+		"/preload?file=other.mp3":  http.StatusNotFound,
+	} {
+		rec := httptest.NewRecorder()
+		preload(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != want {
+			t.Errorf("%s: status %d, want %d", target, rec.Code, want)
+		}
+	}
+	if n := stub.getCount("other.mp3"); n != 0 {
+		t.Fatal("fetched a file outside the allowlist")
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const sessionHeader = "X-Radio-Session"
+
+// Local clip (a sponsor message, say) played once at the start of every
+// /radio session before the first track, set from PREROLL_FILE. It has to be
+// in the stream's format, so a clip that isn't is skipped.
+var prerollFile string
+
+// How long the pre-roll plays before a listener may skip it through
+// /radio/skip, set from PREROLL_SKIP_AFTER. 0 makes it unskippable.
+var prerollSkipAfter time.Duration
+
+// A /radio connection's pre-roll while it plays
+type prerollSession struct {
+	started time.Time
+	skipped atomic.Bool
+}
+
+type prerollSessions struct {
+	mu       sync.Mutex
+	sessions map[string]*prerollSession
+}
+
+var prerolls = &prerollSessions{sessions: make(map[string]*prerollSession)}
+
+// Register a pre-roll session, returning its ID and the func that ends it
+func (p *prerollSessions) begin() (string, *prerollSession, func()) {
+	var b [8]byte
+	rand.Read(b[:])
+	id := hex.EncodeToString(b[:])
+	session := &prerollSession{started: time.Now()}
+
+	p.mu.Lock()
+	p.sessions[id] = session
+	p.mu.Unlock()
+
+	return id, session, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		delete(p.sessions, id)
+	}
+}
+
+func (p *prerollSessions) get(id string) (*prerollSession, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	session, ok := p.sessions[id]
+	return session, ok
+}
+
+// Ends the pre-roll early once the listener skips it
+type skippableReader struct {
+	r       io.Reader
+	session *prerollSession
+}
+
+func (s skippableReader) Read(p []byte) (int, error) {
+	if s.session.skipped.Load() {
+		return 0, io.EOF
+	}
+	return s.r.Read(p)
+}
+
+// Play the pre-roll ahead of a session's first track. A clip that can't be
+// opened is logged and left out rather than keeping the listener from the
+// station.
+func playPreroll(cw *chunkedWriter, session *prerollSession) error {
+	file, err := os.Open(prerollFile)
+	if err != nil {
+		log.Printf("Failed to open PREROLL_FILE: %v", err)
+		return nil
+	}
+	defer file.Close()
+
+	before := cw.written
+	err = cw.copyFrom(skippableReader{r: file, session: session})
+	egress.addServed(cw.written - before)
+	return err
+}
+
+// Skip the pre-roll of the /radio session in ?session=, once it has played
+// for PREROLL_SKIP_AFTER
+func skipPreroll(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if prerollSkipAfter <= 0 {
+		http.Error(w, "The pre-roll can't be skipped", http.StatusForbidden)
+		return
+	}
+
+	session, ok := prerolls.get(req.URL.Query().Get("session"))
+	if !ok {
+		http.Error(w, "No pre-roll playing for this session", http.StatusNotFound)
+		return
+	}
+
+	if remaining := prerollSkipAfter - time.Since(session.started); remaining > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(remaining.Seconds())+1))
+		http.Error(w, "The pre-roll can't be skipped yet", http.StatusConflict)
+		return
+	}
+
+	session.skipped.Store(true)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func usePreroll(t *testing.T, name, content string, skipAfter time.Duration) {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	previousFile, previousSkip, previousJitter := prerollFile, prerollSkipAfter, radioJitter
+	t.Cleanup(func() { prerollFile, prerollSkipAfter, radioJitter = previousFile, previousSkip, previousJitter })
+	prerollFile, prerollSkipAfter, radioJitter = path, skipAfter, 0
+}
+
+func TestPrerollPlaysOncePerSession(t *testing.T) {
+	useRadioBucket(t)
+	usePreroll(t, "sponsor.mp3", "PPPP", 0)
+
+	for range 2 {
+		w := listenToRadio(t, len("PPPPaaaabbbb"))
+		body := w.Body.String()
+		tracks, ok := strings.CutPrefix(body, "PPPP")
+		if !ok || !wholeTracks.MatchString(tracks) {
+			t.Fatalf("stream %q, want the pre-roll once before the tracks", body)
+		}
+		if w.Header().Get(sessionHeader) == "" {
+			t.Fatal("no session ID to skip the pre-roll with")
+		}
+	}
+}
+
+func TestPrerollInAnotherFormatIsLeftOut(t *testing.T) {
+	useRadioBucket(t)
+	usePreroll(t, "sponsor.ogg", "PPPP", 0)
+
+	w := listenToRadio(t, len("aaaabbbb"))
+	if body := w.Body.String(); strings.Contains(body, "P") || w.Header().Get(sessionHeader) != "" {
+		t.Fatalf("stream %q, want the mismatched pre-roll left out", body)
+	}
+}
+
+func TestSkipPrerollAfterMinimum(t *testing.T) {
+	usePreroll(t, "sponsor.mp3", "PPPP", time.Minute)
+	id, session, end := prerolls.begin()
+	defer end()
+
+	skip := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		skipPreroll(rec, httptest.NewRequest(http.MethodPost, "/radio/skip?session="+id, nil))
+		return rec
+	}
+	if rec := skip(); rec.Code != http.StatusConflict || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("status %d, want 409 with Retry-After before the minimum", rec.Code)
+	}
+
+	session.started = time.Now().Add(-time.Minute)
+	if rec := skip(); rec.Code != http.StatusNoContent {
+		t.Fatalf("status %d, want 204 once skippable", rec.Code)
+	}
+	if n, err := (skippableReader{r: strings.NewReader("PPPP"), session: session}).Read(make([]byte, 4)); n != 0 || err == nil {
+		t.Fatalf("read %d bytes after the skip", n)
+	}
+
+	end()
+	if rec := skip(); rec.Code != http.StatusNotFound {
+		t.Fatalf("status %d, want 404 once the pre-roll ended", rec.Code)
+	}
+}
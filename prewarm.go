@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const defaultPrewarmWorkers = 4
+
+// Number of concurrent downloads a prewarm runs, set from PREWARM_WORKERS
+var prewarmWorkers = defaultPrewarmWorkers
+
+type prewarmFailure struct {
+	File  string `json:"file"`
+	Error string `json:"error"`
+}
+
+type prewarmSummary struct {
+	Prefix    string           `json:"prefix"`
+	Requested int              `json:"requested"`
+	Succeeded int              `json:"succeeded"`
+	Failed    []prewarmFailure `json:"failed"`
+}
+
+// Download every key under a prefix into the cache ahead of an event
+func prewarm(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	prefix := req.URL.Query().Get("prefix")
+	if prefix == "" {
+		http.Error(w, "Missing prefix parameter", http.StatusBadRequest)
+		return
+	}
+
+	if !cacheEnabled {
+		writeJSON(w, prewarmSummary{Prefix: prefix, Failed: []prewarmFailure{}})
+		return
+	}
+
+	b2Client, err := b2ClientFromEnv()
+	if err != nil {
+		http.Error(w, "Failed to create B2 client", http.StatusInternalServerError)
+		log.Printf("Failed to create B2 client: %v", err)
+		return
+	}
+
+	files, err := listing.get(b2Client)
+	if err != nil {
+		b2Error(w, "Failed to list files", err)
+		log.Printf("Failed to list files: %v", err)
+		return
+	}
+
+	var keys []string
+	for _, name := range files {
+		if strings.HasPrefix(name, prefix) {
+			keys = append(keys, name)
+		}
+	}
+
+	log.Printf("Prewarming %d files under %s", len(keys), prefix)
+
+	summary := prewarmSummary{Prefix: prefix, Requested: len(keys), Failed: []prewarmFailure{}}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	jobs := make(chan string)
+
+	for range max(prewarmWorkers, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range jobs {
+				_, err := b2Client.downloadFile(key)
+
+				mu.Lock()
+				if err != nil {
+					summary.Failed = append(summary.Failed, prewarmFailure{File: key, Error: err.Error()})
+				} else {
+					summary.Succeeded++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, key := range keys {
+		jobs <- key
+	}
+	close(jobs)
+	wg.Wait()
+
+	log.Printf("Prewarm of %s complete: %d succeeded, %d failed", prefix, summary.Succeeded, len(summary.Failed))
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(summary); err != nil {
+		log.Printf("Failed to encode prewarm summary: %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPrewarmCachesPrefix(t *testing.T) {
+	t.Chdir(t.TempDir())
+	stub := newS3Stub(t, map[string][]byte{
+		"event/intro.mp3": []byte("intro"),
+		"event/set.mp3":   []byte("set"),
+		"other/song.mp3":  []byte("song"),
+	})
+	stub.useEnv(t)
+	useListing(t, []string{"event/intro.mp3", "event/set.mp3", "event/missing.mp3", "other/song.mp3"})
+
+	previous := adminToken
+	t.Cleanup(func() { adminToken = previous })
+	adminToken = "secret"
+
+	req := httptest.NewRequest(http.MethodPost, "/prewarm?prefix=event/", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	requireAdmin(prewarm)(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var summary prewarmSummary
+	if err := json.NewDecoder(rec.Body).Decode(&summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.Requested != 3 || summary.Succeeded != 2 || len(summary.Failed) != 1 || summary.Failed[0].File != "event/missing.mp3" {
+		t.Fatalf("unexpected summary %+v", summary)
+	}
+
+	for _, name := range []string{"event/intro.mp3", "event/set.mp3"} {
+		if _, err := os.Stat(filepath.Join(cacheDir, name)); err != nil {
+			t.Fatalf("%s wasn't cached: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(cacheDir, "other/song.mp3")); err == nil {
+		t.Fatal("a key outside the prefix was cached")
+	}
+}
+
+func TestPrewarmRequiresAdmin(t *testing.T) {
+	previous := adminToken
+	t.Cleanup(func() { adminToken = previous })
+
+	tests := []struct {
+		name   string
+		token  string
+		header string
+		want   int
+	}{
+		{"disabled", "", "Bearer anything", http.StatusForbidden},
+		{"missing", "secret", "", http.StatusUnauthorized},
+		{"wrong", "secret", "Bearer guess", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			adminToken = tt.token
+			req := httptest.NewRequest(http.MethodPost, "/prewarm?prefix=a/", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			rec := httptest.NewRecorder()
+			requireAdmin(prewarm)(rec, req)
+			if rec.Code != tt.want {
+				t.Fatalf("status %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// RFC 7807 error body of the JSON API endpoints
+type problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+}
+
+type problemType struct {
+	err   error
+	slug  string
+	title string
+}
+
+// Problem types for the typed B2 errors. Other errors are "about:blank"
+// with the status text as their title, as RFC 7807 has it.
+var problemTypes = []problemType{
+	{errNotFound, "not-found", "Object not found"},
+	{errNoFiles, "no-files", "No files found"},
+	{errThrottled, "throttled", "Request throttled by B2"},
+	{errBucketUnreachable, "bucket-unreachable", "Bucket unreachable"},
+	{errRangeUnsatisfiable, "range-not-satisfiable", "Range not satisfiable"},
+	{errUnauthorized, "unauthorized", "Credentials rejected by B2"},
+	{errInsufficientStorage, "insufficient-storage", "Not enough cache space"},
+}
+
+const problemTypePrefix = "urn:radio-paje:problem:"
+
+// Turns the plain-text errors http.Error writes into problem+json, so
+// handlers report errors the same way whether or not they are wrapped
+type problemWriter struct {
+	http.ResponseWriter
+	req     *http.Request
+	problem *problem
+	detail  bytes.Buffer
+}
+
+func (p *problemWriter) WriteHeader(status int) {
+	if p.problem == nil && status >= 400 && strings.HasPrefix(p.Header().Get("Content-Type"), "text/plain") {
+		p.problem = &problem{Type: "about:blank", Title: http.StatusText(status), Status: status, Instance: p.req.URL.Path}
+		return
+	}
+	p.ResponseWriter.WriteHeader(status)
+}
+
+func (p *problemWriter) Write(b []byte) (int, error) {
+	if p.problem != nil {
+		return p.detail.Write(b)
+	}
+	return p.ResponseWriter.Write(b)
+}
+
+func (p *problemWriter) Unwrap() http.ResponseWriter {
+	return p.ResponseWriter
+}
+
+// Write the buffered error, if the handler wrote one
+func (p *problemWriter) finish() {
+	if p.problem == nil {
+		return
+	}
+	p.problem.Detail = strings.TrimSpace(p.detail.String())
+
+	header := p.Header()
+	header.Set("Content-Type", "application/problem+json")
+	header.Del("X-Content-Type-Options")
+	p.ResponseWriter.WriteHeader(p.problem.Status)
+	if err := json.NewEncoder(p.ResponseWriter).Encode(p.problem); err != nil {
+		log.Printf("Failed to encode response: %v", err)
+	}
+}
+
+// Give the error response being written the problem type of a B2 error
+func setProblemType(w http.ResponseWriter, err error) {
+	for {
+		if p, ok := w.(*problemWriter); ok {
+			if p.problem == nil {
+				return
+			}
+			for _, t := range problemTypes {
+				if errors.Is(err, t.err) {
+					p.problem.Type = problemTypePrefix + t.slug
+					p.problem.Title = t.title
+					return
+				}
+			}
+			return
+		}
+		unwrapper, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return
+		}
+		w = unwrapper.Unwrap()
+	}
+}
+
+// Report the handler's errors as application/problem+json
+func problemJSON(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		p := &problemWriter{ResponseWriter: w, req: req}
+		next(p, req)
+		p.finish()
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func getProblem(t *testing.T, handler http.HandlerFunc, target string) problem {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	problemJSON(handler)(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "application/problem+json" {
+		t.Fatalf("%s: Content-Type %s: %s", target, ct, rec.Body)
+	}
+	var p problem
+	if err := json.NewDecoder(rec.Body).Decode(&p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Status != rec.Code {
+		t.Fatalf("%s: problem status %d, response status %d", target, p.Status, rec.Code)
+	}
+	return p
+}
+
+func TestNotFoundProblem(t *testing.T) {
+	p := getProblem(t, func(w http.ResponseWriter, req *http.Request) {
+		b2Error(w, "Failed to fetch file", classifyB2Error(&types.NoSuchKey{}))
+	}, "/meta?file=missing.mp3")
+
+	want := problem{
+		Type:     problemTypePrefix + "not-found",
+		Title:    "Object not found",
+		Status:   http.StatusNotFound,
+		Detail:   "Failed to fetch file",
+		Instance: "/meta",
+	}
+	if p != want {
+		t.Fatalf("got %+v, want %+v", p, want)
+	}
+}
+
+func TestServerErrorProblem(t *testing.T) {
+	p := getProblem(t, func(w http.ResponseWriter, req *http.Request) {
+		b2Error(w, "Failed to list files", errors.New("connection reset by peer"))
+	}, "/search?q=jazz")
+
+	want := problem{
+		Type:     "about:blank",
+		Title:    "Internal Server Error",
+		Status:   http.StatusInternalServerError,
+		Detail:   "Failed to list files",
+		Instance: "/search",
+	}
+	if p != want {
+		t.Fatalf("got %+v, want %+v", p, want)
+	}
+}
+
+func TestProblemFromEndpointValidation(t *testing.T) {
+	useStation(t, modeRandom)
+	p := getProblem(t, recentHandler, "/recent?limit=many")
+	if p.Type != "about:blank" || p.Status != http.StatusBadRequest || p.Title != "Bad Request" || p.Detail == "" {
+		t.Fatalf("got %+v", p)
+	}
+
+	// Successful responses pass through untouched
+	rec := httptest.NewRecorder()
+	problemJSON(recentHandler)(rec, httptest.NewRequest(http.MethodGet, "/recent", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("status %d type %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Serve a file straight from B2 without touching the disk, passing a single
+// Range through (small sequential ranges go through a read-ahead buffer).
+// Used when the disk cache is disabled or STREAM_MODE is direct.
+func proxyServe(req *http.Request, b2Client B2, fileName string) func(w http.ResponseWriter) {
+	return func(w http.ResponseWriter) {
+		rangeHeader, ok := checkRange(w, req, fileName)
+		if !ok {
+			return
+		}
+		if strings.Contains(rangeHeader, ",") {
+			// Multiple ranges aren't proxied, serve the whole file
+			rangeHeader = ""
+		}
+		if serveReadAhead(w, req, b2Client, fileName, rangeHeader) {
+			return
+		}
+
+		result, err := b2Client.fetchRange(fileName, rangeHeader)
+		if errors.Is(err, errRangeUnsatisfiable) {
+			// The listing didn't know the size, and B2 turned the range down
+			http.Error(w, "Range not satisfiable", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		if err != nil {
+			quarantined.recordFailure(fileName)
+			b2Error(w, "Failed to fetch file", err)
+			log.Printf("Failed to proxy %s: %v", fileName, err)
+			return
+		}
+		defer result.body.Close()
+		quarantined.recordSuccess(fileName)
+
+		if result.size < 0 && rangeHeader == "" {
+			// Nothing to set Content-Length from, so send it chunked
+			if req.Method == http.MethodHead {
+				w.Header().Set("Content-Type", audioContentType(fileName))
+				return
+			}
+			if _, err := streamChunked(w, req, result.body, audioContentType(fileName)); err != nil {
+				log.Printf("Proxy stream of %s ended: %v", fileName, err)
+			}
+			return
+		}
+
+		w.Header().Set("Content-Type", audioContentType(fileName))
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("Content-Length", strconv.FormatInt(result.span.end-result.span.start, 10))
+		if result.etag != "" {
+			w.Header().Set("ETag", result.etag)
+		}
+		if rangeHeader != "" {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", result.span.start, result.span.end-1, result.size))
+			w.WriteHeader(http.StatusPartialContent)
+		} else {
+			w.WriteHeader(http.StatusOK)
+		}
+
+		if req.Method == http.MethodHead {
+			return
+		}
+		fw := newFlushingWriter(w, rangeHeader == "")
+		_, err = io.CopyBuffer(fw, result.body, make([]byte, streamBufferBytes))
+		if err == nil {
+			err = fw.Flush()
+		}
+		if err != nil {
+			log.Printf("Proxy stream of %s ended: %v", fileName, err)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func disableCache(t *testing.T) {
+	previous := cacheEnabled
+	t.Cleanup(func() { cacheEnabled = previous })
+	cacheEnabled = false
+}
+
+func useStreamMode(t *testing.T, mode string) {
+	previous := streamMode
+	t.Cleanup(func() { streamMode = previous })
+	streamMode = mode
+}
+
+func TestProxyModeWritesNothingToDisk(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	disableCache(t)
+	useStation(t, modeRandom)
+	stub := newS3Stub(t, map[string][]byte{
+		"album/track.mp3": id3Tag(4, apicFrame(frontCoverPicture, "image/png", pngImage)),
+		"album/cover.jpg": []byte("\xff\xd8\xffjpeg"),
+	})
+	stub.useEnv(t)
+	useSizedListing(t, newFakeB2(t, map[string][]byte{"album/track.mp3": stub.objects["album/track.mp3"]}))
+
+	rec := httptest.NewRecorder()
+	newStreamHandler(t).stream(rec, httptest.NewRequest(http.MethodGet, "/stream?file=album/track.mp3", nil))
+	if rec.Code != http.StatusOK || rec.Body.Len() != len(stub.objects["album/track.mp3"]) {
+		t.Fatalf("status %d with %d bytes, want the whole object", rec.Code, rec.Body.Len())
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/stream?file=album/track.mp3", nil)
+	req.Header.Set("Range", "bytes=0-2")
+	rec = httptest.NewRecorder()
+	newStreamHandler(t).stream(rec, req)
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "ID3" {
+		t.Fatalf("status %d body %q, want the proxied range", rec.Code, rec.Body)
+	}
+
+	for _, handler := range []struct {
+		name   string
+		serve  http.HandlerFunc
+		target string
+	}{
+		{"meta", meta, "/meta?file=album/track.mp3"},
+		{"art", art, "/art?file=album/track.mp3"},
+		{"chapters", chaptersHandler, "/chapters?file=album/track.mp3"},
+		{"prewarm", prewarm, "/prewarm?prefix=album/"},
+		{"purge", purgeCache, "/cache/purge?all=true"},
+		{"healthz", healthz, "/healthz?verbose=true"},
+	} {
+		method := http.MethodGet
+		if handler.name == "prewarm" || handler.name == "purge" {
+			method = http.MethodPost
+		}
+		rec := httptest.NewRecorder()
+		handler.serve(rec, httptest.NewRequest(method, handler.target, nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s: status %d: %s", handler.name, rec.Code, rec.Body)
+		}
+	}
+
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && path != dir {
+			t.Errorf("proxy mode wrote %s", path)
+		}
+		return nil
+	})
+}
+
+func TestDirectModeProxiesRanges(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	useStreamMode(t, streamModeDirect)
+	useStation(t, modeRandom)
+	stub := newS3Stub(t, map[string][]byte{"a.mp3": []byte("0123456789")})
+	stub.useEnv(t)
+	useSizedListing(t, newFakeB2(t, map[string][]byte{"a.mp3": stub.objects["a.mp3"]}))
+
+	req := httptest.NewRequest(http.MethodGet, "/stream?file=a.mp3", nil)
+	req.Header.Set("Range", "bytes=2-5")
+	rec := httptest.NewRecorder()
+	newStreamHandler(t).stream(rec, req)
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "2345" {
+		t.Fatalf("status %d body %q, want the range from B2", rec.Code, rec.Body)
+	}
+	for header, want := range map[string]string{
+		"Content-Range":  "bytes 2-5/10",
+		"Content-Length": "4",
+		"Accept-Ranges":  "bytes",
+	} {
+		if got := rec.Header().Get(header); got != want {
+			t.Errorf("%s %q, want %q", header, got, want)
+		}
+	}
+
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && path != dir {
+			t.Errorf("direct mode wrote %s", path)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func purge(t *testing.T, query string) (*httptest.ResponseRecorder, purgeSummary) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	purgeCache(rec, httptest.NewRequest(http.MethodPost, "/cache/purge?"+query, nil))
+
+	var summary purgeSummary
+	if rec.Code == http.StatusOK {
+		if err := json.NewDecoder(rec.Body).Decode(&summary); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rec, summary
+}
+
+func TestPurgeSingleFile(t *testing.T) {
+	t.Chdir(t.TempDir())
+	previous := memCache
+	t.Cleanup(func() { memCache = previous })
+	memCache = newMemoryCache(1<<20, 1<<20)
+
+	stale := writeCached(t, "jazz/stale.mp3", 5, 0)
+	other := writeCached(t, "other.mp3", 3, 0)
+	memCache.add("jazz/stale.mp3", make([]byte, 5), time.Now())
+
+	rec, summary := purge(t, "file=jazz/stale.mp3")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if summary.Purged != 1 || summary.BytesFreed != 5 {
+		t.Fatalf("summary %+v, want one file and 5 bytes", summary)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Fatal("the purged file is still on disk")
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Fatal("an unrelated file was purged")
+	}
+	if _, ok := memCache.get("jazz/stale.mp3"); ok {
+		t.Fatal("the purged file is still in the memory cache")
+	}
+
+	if rec, _ := purge(t, "file=jazz/stale.mp3"); rec.Code != http.StatusNotFound {
+		t.Fatalf("status %d for an uncached file, want 404", rec.Code)
+	}
+}
+
+func TestPurgeAllSkipsFilesBeingServed(t *testing.T) {
+	t.Chdir(t.TempDir())
+	writeCached(t, "a.mp3", 4, 0)
+	writeCached(t, "jazz/b.mp3", 2, 0)
+	playing := writeCached(t, "playing.mp3", 3, 0)
+
+	release := servingFiles.acquire(playing)
+	defer release()
+
+	rec, summary := purge(t, "all=true")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if summary.Purged != 2 || summary.BytesFreed != 6 {
+		t.Fatalf("summary %+v, want two files and 6 bytes", summary)
+	}
+	if len(summary.Skipped) != 1 || summary.Skipped[0] != filepath.Clean(playing) {
+		t.Fatalf("skipped %q, want the file being served", summary.Skipped)
+	}
+	if _, err := os.Stat(playing); err != nil {
+		t.Fatal("a file being served was purged")
+	}
+}
+
+func TestPurgeRejectsUnsafeKeys(t *testing.T) {
+	t.Chdir(t.TempDir())
+	for _, query := range []string{"file=../etc/passwd", "file=a/../../b", ""} {
+		if rec, _ := purge(t, query); rec.Code != http.StatusBadRequest {
+			t.Errorf("%q: status %d, want 400", query, rec.Code)
+		}
+	}
+
+	// A leading slash is normalized away, leaving a key inside the cache
+	if rec, _ := purge(t, "file=/etc/passwd"); rec.Code != http.StatusNotFound {
+		t.Errorf("status %d for /etc/passwd, want 404 for cache/etc/passwd", rec.Code)
+	}
+
+	rec := httptest.NewRecorder()
+	purgeCache(rec, httptest.NewRequest(http.MethodGet, "/cache/purge?all=true", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("GET status %d, want 405", rec.Code)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultQuarantineThreshold = 3
+	defaultQuarantineCooldown  = 30 * time.Minute
+)
+
+// Files that keep failing to download (corrupt, bad permissions) are left
+// out of selection for a cooldown rather than picked and erroring again
+type quarantine struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  map[string]int
+	until     map[string]time.Time
+}
+
+type quarantineEntry struct {
+	File     string    `json:"file"`
+	Failures int       `json:"failures"`
+	Until    time.Time `json:"until"`
+}
+
+var quarantined = newQuarantine(defaultQuarantineThreshold, defaultQuarantineCooldown)
+
+func newQuarantine(threshold int, cooldown time.Duration) *quarantine {
+	return &quarantine{
+		threshold: threshold,
+		cooldown:  cooldown,
+		failures:  make(map[string]int),
+		until:     make(map[string]time.Time),
+	}
+}
+
+// Count a failed download, reporting whether it put the file in quarantine
+func (q *quarantine) recordFailure(fileName string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.failures[fileName]++
+	if q.threshold > 0 && q.failures[fileName] >= q.threshold {
+		q.until[fileName] = time.Now().Add(q.cooldown)
+		log.Printf("Quarantined %s for %s after %d consecutive failures", fileName, q.cooldown, q.failures[fileName])
+		return true
+	}
+	return false
+}
+
+func (q *quarantine) recordSuccess(fileName string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delete(q.failures, fileName)
+	delete(q.until, fileName)
+}
+
+// Drop quarantined files from a candidate list. Once a cooldown expires the
+// file gets one more try; another failure quarantines it again.
+func (q *quarantine) filter(fileNames []string) []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.until) == 0 {
+		return fileNames
+	}
+
+	now := time.Now()
+	for name, until := range q.until {
+		if now.After(until) {
+			delete(q.until, name)
+			q.failures[name] = q.threshold - 1
+		}
+	}
+
+	filtered := make([]string, 0, len(fileNames))
+	for _, name := range fileNames {
+		if _, ok := q.until[name]; !ok {
+			filtered = append(filtered, name)
+		}
+	}
+
+	// Better to retry a failing file than to go silent
+	if len(filtered) == 0 {
+		return fileNames
+	}
+	return filtered
+}
+
+func (q *quarantine) entries() []quarantineEntry {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	entries := []quarantineEntry{}
+	for name, until := range q.until {
+		entries = append(entries, quarantineEntry{File: name, Failures: q.failures[name], Until: until})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].File < entries[j].File })
+	return entries
+}
+
+type statsResponse struct {
+	Quarantined []quarantineEntry `json:"quarantined"`
+	Stations    []stationStatus   `json:"stations"`
+	Endpoints   []endpointStatus  `json:"endpoints,omitempty"`
+}
+
+// With ?station= only that station is reported
+func stats(w http.ResponseWriter, req *http.Request) {
+	list := stations.all()
+	if req.URL.Query().Has("station") {
+		st, ok := stationFor(w, req)
+		if !ok {
+			return
+		}
+		list = []*station{st}
+	}
+
+	statuses := make([]stationStatus, 0, len(list))
+	for _, st := range list {
+		statuses = append(statuses, st.status())
+	}
+
+	response := statsResponse{
+		Quarantined: quarantined.entries(),
+		Stations:    statuses,
+	}
+	if len(failoverEndpoints) > 0 {
+		response.Endpoints = endpointStates.status(configuredEndpoints())
+	}
+	writeJSON(w, response)
+}
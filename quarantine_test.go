@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+func useQuarantine(t *testing.T, threshold int, cooldown time.Duration) {
+	previous := quarantined
+	t.Cleanup(func() { quarantined = previous })
+	quarantined = newQuarantine(threshold, cooldown)
+}
+
+func TestRepeatedlyFailingFileIsExcluded(t *testing.T) {
+	useQuarantine(t, 3, time.Hour)
+	useListing(t, []string{"broken.mp3", "good.mp3"})
+	st := useStation(t, modeSequential)
+
+	// broken.mp3 is listed but can't be downloaded
+	client := newFakeB2(t, map[string][]byte{"good.mp3": []byte("ok")})
+
+	for range 3 {
+		quarantined.recordFailure("broken.mp3")
+	}
+	candidates, err := selectionCandidates(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(candidates, []string{"good.mp3"}) {
+		t.Fatalf("candidates %q, want broken.mp3 quarantined", candidates)
+	}
+
+	for range 5 {
+		if track := nextRadioTrack(context.Background(), st, client, ""); track.name != "good.mp3" || track.err != nil {
+			t.Fatalf("picked %s (%v), want only good.mp3", track.name, track.err)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	stats(rec, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	var response statsResponse
+	if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Quarantined) != 1 || response.Quarantined[0].File != "broken.mp3" || response.Quarantined[0].Failures != 3 {
+		t.Fatalf("/stats reports %+v", response.Quarantined)
+	}
+}
+
+func TestDownloadFailuresQuarantine(t *testing.T) {
+	useQuarantine(t, 2, time.Hour)
+	useListing(t, []string{"broken.mp3"})
+	st := useStation(t, modeSequential)
+	client := newFakeB2(t, map[string][]byte{})
+
+	for range 2 {
+		if track := nextRadioTrack(context.Background(), st, client, ""); track.err == nil {
+			t.Fatal("expected the download to fail")
+		}
+	}
+	if entries := quarantined.entries(); len(entries) != 1 || entries[0].File != "broken.mp3" {
+		t.Fatalf("quarantine %+v, want broken.mp3", entries)
+	}
+}
+
+func TestQuarantineSuccessResets(t *testing.T) {
+	q := newQuarantine(2, time.Hour)
+
+	q.recordFailure("a.mp3")
+	q.recordSuccess("a.mp3")
+	q.recordFailure("a.mp3")
+
+	if filtered := q.filter([]string{"a.mp3", "b.mp3"}); len(filtered) != 2 {
+		t.Fatal("failures shouldn't count across a success")
+	}
+}
+
+func TestQuarantineCooldownExpires(t *testing.T) {
+	q := newQuarantine(1, time.Hour)
+	q.recordFailure("a.mp3")
+	q.until["a.mp3"] = time.Now().Add(-time.Second)
+
+	if filtered := q.filter([]string{"a.mp3", "b.mp3"}); len(filtered) != 2 {
+		t.Fatal("the file should get another try after the cooldown")
+	}
+
+	q.recordFailure("a.mp3")
+	if filtered := q.filter([]string{"a.mp3", "b.mp3"}); len(filtered) != 1 {
+		t.Fatal("one more failure should quarantine it again")
+	}
+}
+
+func TestQuarantineNeverEmptiesSelection(t *testing.T) {
+	q := newQuarantine(1, time.Hour)
+	q.recordFailure("a.mp3")
+
+	if filtered := q.filter([]string{"a.mp3"}); len(filtered) != 1 {
+		t.Fatal("with every file quarantined, selection should fall back to all of them")
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// Reject unknown or malformed query parameters with a 400, set from
+// STRICT_QUERY. Off by default, when handlers ignore what they don't read.
+var strictQuery = false
+
+// Validates one query parameter's value
+type paramCheck func(value string) error
+
+func anyValue(string) error { return nil }
+
+func boolValue(value string) error {
+	if value != "true" && value != "false" {
+		return errors.New("must be true or false")
+	}
+	return nil
+}
+
+func positiveInt(value string) error {
+	if n, err := strconv.Atoi(value); err != nil || n <= 0 {
+		return errors.New("must be a positive integer")
+	}
+	return nil
+}
+
+func nonNegativeInt(value string) error {
+	if n, err := strconv.Atoi(value); err != nil || n < 0 {
+		return errors.New("must be a non-negative integer")
+	}
+	return nil
+}
+
+func knownStation(value string) error {
+	if _, ok := stations.get(value); !ok {
+		return errors.New("unknown station")
+	}
+	return nil
+}
+
+// Parameters each endpoint accepts
+var (
+	streamParams = map[string]paramCheck{
+		"file":           anyValue,
+		redirectHopParam: nonNegativeInt,
+		"station":        knownStation,
+		"refresh":        boolValue,
+		"version":        validateVersion,
+		"quality":        validateQuality,
+		"t":              anyValue, // cache buster added by the web player
+	}
+	radioParams = map[string]paramCheck{
+		"station": knownStation,
+	}
+	playParams = map[string]paramCheck{
+		"list":    anyValue,
+		"loop":    boolValue,
+		"station": knownStation,
+	}
+	listenParams = map[string]paramCheck{
+		"file":    anyValue,
+		"station": knownStation,
+	}
+	browseParams = map[string]paramCheck{
+		"prefix": anyValue,
+	}
+	preloadParams = map[string]paramCheck{
+		"file": anyValue,
+		"t":    anyValue,
+	}
+	recentParams = map[string]paramCheck{
+		"limit":   positiveInt,
+		"station": knownStation,
+	}
+	scheduleParams = map[string]paramCheck{
+		"recent":   nonNegativeInt,
+		"upcoming": nonNegativeInt,
+		"station":  knownStation,
+	}
+	queueParams = map[string]paramCheck{
+		"n":       positiveInt,
+		"station": knownStation,
+		"refresh": boolValue,
+	}
+)
+
+// The first problem with the request's query against the allowed params
+func checkQuery(req *http.Request, allowed map[string]paramCheck) error {
+	query := req.URL.Query()
+
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		check, ok := allowed[name]
+		if !ok {
+			return fmt.Errorf("unknown query parameter %q", name)
+		}
+		if len(query[name]) > 1 {
+			return fmt.Errorf("query parameter %q given more than once", name)
+		}
+		if err := check(query.Get(name)); err != nil {
+			return fmt.Errorf("invalid %s parameter: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func strictParams(allowed map[string]paramCheck, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if strictQuery {
+			if err := checkQuery(req, allowed); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		next(w, req)
+	}
+}
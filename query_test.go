@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func useStrictQuery(t *testing.T, strict bool) {
+	previous := strictQuery
+	t.Cleanup(func() { strictQuery = previous })
+	strictQuery = strict
+}
+
+func TestCheckQuery(t *testing.T) {
+	useStation(t, modeRandom)
+
+	tests := []struct {
+		name    string
+		allowed map[string]paramCheck
+		query   string
+		valid   bool
+	}{
+		{"no params", streamParams, "", true},
+		{"file", streamParams, "file=a.mp3", true},
+		{"every stream param", streamParams, "file=a.mp3&station=default&refresh=true&version=4_z1&t=123&" + redirectHopParam + "=1", true},
+		{"unknown param", streamParams, "file=a.mp3&format=flac", false},
+		{"repeated param", streamParams, "file=a.mp3&file=b.mp3", false},
+		{"unknown station", streamParams, "station=nowhere", false},
+		{"bad refresh", streamParams, "refresh=yes", false},
+		{"bad version", streamParams, "version=../x", false},
+		{"negative hop", streamParams, redirectHopParam + "=-1", false},
+		{"radio station", radioParams, "station=default", true},
+		{"radio file", radioParams, "file=a.mp3", false},
+		{"playlist", playParams, "list=a.mp3,b.mp3&loop=false", true},
+		{"bad loop", playParams, "list=a.mp3&loop=1", false},
+		{"listen", listenParams, "file=a.mp3&station=default", true},
+		{"queue length", queueParams, "n=5", true},
+		{"zero queue length", queueParams, "n=0", false},
+		{"numeric queue length", queueParams, "n=five", false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/?"+tt.query, nil)
+		if err := checkQuery(req, tt.allowed); (err == nil) != tt.valid {
+			t.Errorf("%s: got %v, want valid %t", tt.name, err, tt.valid)
+		}
+	}
+}
+
+func TestStrictParamsToggle(t *testing.T) {
+	useStation(t, modeRandom)
+	served := false
+	handler := strictParams(radioParams, func(w http.ResponseWriter, req *http.Request) { served = true })
+
+	useStrictQuery(t, false)
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/radio?bogus=1", nil))
+	if !served {
+		t.Fatal("unknown params should be ignored when strict parsing is off")
+	}
+
+	served = false
+	useStrictQuery(t, true)
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/radio?bogus=1", nil))
+	if served || rec.Code != http.StatusBadRequest {
+		t.Fatalf("status %d served %t, want 400 without reaching the handler", rec.Code, served)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+const (
+	defaultQueueLength = 5
+	maxQueueLength     = 20
+)
+
+// Upcoming selections, in the order the selector will hand them out
+func queue(w http.ResponseWriter, req *http.Request) {
+	n := defaultQueueLength
+	if value := req.URL.Query().Get("n"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "Invalid n parameter", http.StatusBadRequest)
+			return
+		}
+		n = min(parsed, maxQueueLength)
+	}
+
+	st, ok := stationFor(w, req)
+	if !ok {
+		return
+	}
+
+	b2Client, err := b2ClientFromEnv()
+	if err != nil {
+		http.Error(w, "Failed to create B2 client", http.StatusInternalServerError)
+		log.Printf("Failed to create B2 client: %v", err)
+		return
+	}
+
+	listing.refreshFor(req)
+	files, err := st.candidates(b2Client)
+	if err != nil {
+		b2Error(w, "Failed to list files", err)
+		log.Printf("Failed to list files: %v", err)
+		return
+	}
+
+	upcoming, err := st.selector.peek(files, n)
+	if err != nil {
+		upcoming = []string{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(upcoming); err != nil {
+		log.Printf("Failed to encode queue: %v", err)
+	}
+}
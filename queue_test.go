@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestQueueMatchesServedTracks(t *testing.T) {
+	setB2Env(t)
+	files := []string{"a.mp3", "b.mp3", "c.mp3", "d.mp3", "e.mp3", "f.mp3"}
+	useListing(t, files)
+	st := useStation(t, modeRandom)
+
+	rec := httptest.NewRecorder()
+	queue(rec, httptest.NewRequest(http.MethodGet, "/queue?n=4", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var upcoming []string
+	if err := json.NewDecoder(rec.Body).Decode(&upcoming); err != nil {
+		t.Fatal(err)
+	}
+	if len(upcoming) != 4 {
+		t.Fatalf("queue has %d entries, want 4", len(upcoming))
+	}
+
+	var served []string
+	for range 4 {
+		name, err := st.selector.selectFile(files)
+		if err != nil {
+			t.Fatal(err)
+		}
+		served = append(served, name)
+	}
+	if !slices.Equal(served, upcoming) {
+		t.Fatalf("served %q, but the queue promised %q", served, upcoming)
+	}
+}
+
+func TestPeekDoesNotConsume(t *testing.T) {
+	sel, _ := newTrackSelector(selectorConfig{mode: modeSequential, seed: 1})
+	files := []string{"a.mp3", "b.mp3", "c.mp3"}
+
+	first, _ := sel.peek(files, 2)
+	second, _ := sel.peek(files, 3)
+	if !slices.Equal(first, []string{"a.mp3", "b.mp3"}) || !slices.Equal(second, []string{"a.mp3", "b.mp3", "c.mp3"}) {
+		t.Fatalf("peeks %q then %q", first, second)
+	}
+	if next, _ := sel.selectFile(files); next != "a.mp3" {
+		t.Fatalf("next pick %s, want a.mp3", next)
+	}
+}
+
+func TestQueueDropsDeletedTracks(t *testing.T) {
+	sel, _ := newTrackSelector(selectorConfig{mode: modeSequential, seed: 1})
+	sel.peek([]string{"a.mp3", "b.mp3", "c.mp3"}, 3)
+
+	next, _ := sel.selectFile([]string{"b.mp3", "c.mp3"})
+	if next != "b.mp3" {
+		t.Fatalf("next pick %s, want b.mp3 once a.mp3 is deleted", next)
+	}
+}
+
+func TestQueueInvalidLength(t *testing.T) {
+	rec := httptest.NewRecorder()
+	queue(rec, httptest.NewRequest(http.MethodGet, "/queue?n=0", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status %d, want 400", rec.Code)
+	}
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultRadioJitter = 2 * time.Second
+
+// Upper bound of the random delay before each connection prefetches its next
+// track, so streams started together don't hit B2 in lockstep
+var radioJitter = defaultRadioJitter
+
+var audioContentTypes = map[string]string{
+	".mp3":  "audio/mpeg",
+	".ogg":  "audio/ogg",
+	".opus": "audio/ogg",
+	".flac": "audio/flac",
+	".m4a":  "audio/mp4",
+	".aac":  "audio/aac",
+	".wav":  "audio/wav",
+}
+
+func audioContentType(fileName string) string {
+	ext := strings.ToLower(filepath.Ext(fileName))
+	if contentType, ok := audioContentTypes[ext]; ok {
+		return contentType
+	}
+	if contentType := mime.TypeByExtension(ext); contentType != "" {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+func jitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
+// Keep only files sharing an extension, since a continuous stream can't
+// switch container formats between tracks
+func filterByExtension(fileNames []string, ext string) []string {
+	var filtered []string
+	for _, name := range fileNames {
+		if strings.EqualFold(filepath.Ext(name), ext) {
+			filtered = append(filtered, name)
+		}
+	}
+	return filtered
+}
+
+type radioTrack struct {
+	name     string
+	path     string
+	fallback bool
+	err      error
+}
+
+const defaultRadioReselections = 3
+
+// Attempts at picking a track whose download fails before a radio stream
+// gives up, set from RADIO_MAX_RESELECTIONS
+var maxRadioReselections = defaultRadioReselections
+
+var errReselectionsExhausted = errors.New("no track could be downloaded")
+
+// The next track to play, or the fallback clip when none can be selected.
+// Once the listener has gone there is nothing to play, fallback included.
+func nextRadioTrack(ctx context.Context, st *station, b2Client B2, ext string) radioTrack {
+	track := selectRadioTrack(ctx, st, b2Client, ext)
+	if track.err != nil && ctx.Err() == nil {
+		return fallbackRadioTrack(track.err)
+	}
+	return track
+}
+
+func selectRadioTrack(ctx context.Context, st *station, b2Client B2, ext string) radioTrack {
+	var lastErr error
+	for range maxRadioReselections {
+		if ctx.Err() != nil {
+			return radioTrack{err: ctx.Err()}
+		}
+		files, err := st.candidates(b2Client)
+		if err != nil {
+			return radioTrack{err: err}
+		}
+		if ext != "" {
+			files = filterByExtension(files, ext)
+		}
+
+		name, err := st.selector.selectFile(files)
+		if err != nil {
+			return radioTrack{err: err}
+		}
+
+		// In proxy mode the track is fetched from B2 as it plays
+		if !cacheEnabled {
+			return radioTrack{name: name}
+		}
+
+		path, err := b2Client.downloadFile(name)
+		if err == nil {
+			quarantined.recordSuccess(name)
+			return radioTrack{name: name, path: path}
+		}
+		lastErr = err
+
+		switch {
+		case quarantined.recordFailure(name):
+			metrics.reselectQuarantined.Add(1)
+			log.Printf("Quarantined %s after its download failed, reselecting: %v", name, err)
+		case isNotFound(err):
+			metrics.reselectNotFound.Add(1)
+			log.Printf("Listed track %s is still missing after retries, reselecting", name)
+		default:
+			metrics.reselectDownloadError.Add(1)
+			log.Printf("Failed to download %s, reselecting: %v", name, err)
+		}
+	}
+
+	metrics.reselectExhausted.Add(1)
+	return radioTrack{err: fmt.Errorf("%w after %d attempts: %w", errReselectionsExhausted, maxRadioReselections, lastErr)}
+}
+
+// record carries the connection's station and client, filled in with the
+// track's stats once it has played
+func playRadioTrack(cw *chunkedWriter, b2Client B2, track radioTrack, record streamRecord) error {
+	src, err := openRadioTrack(cw.ctx, b2Client, track)
+	if err != nil {
+		return trackReadError{err}
+	}
+	defer src.Close()
+
+	return streamRadioTrack(cw, src, track, record)
+}
+
+// Copy a track's audio to the stream, recording it once it has played
+func streamRadioTrack(cw *chunkedWriter, src io.Reader, track radioTrack, record streamRecord) error {
+	start := time.Now()
+	before := cw.written
+	err := cw.copyFrom(src)
+
+	bytesWritten := cw.written - before
+	egress.addServed(bytesWritten)
+	record.file = track.name
+	record.bytes = bytesWritten
+	record.duration = time.Since(start)
+	recordStream(record)
+	return err
+}
+
+// The cached file, or in proxy mode the object body straight from B2
+func openRadioTrack(ctx context.Context, b2Client B2, track radioTrack) (io.ReadCloser, error) {
+	if track.path == "" {
+		result, err := b2Client.fetchRange(track.name, "")
+		if err != nil {
+			quarantined.recordFailure(track.name)
+			return nil, err
+		}
+		quarantined.recordSuccess(track.name)
+		return &resumingReader{ctx: ctx, b2Client: b2Client, track: track, body: result.body, etag: result.etag}, nil
+	}
+
+	release := servingFiles.acquire(track.path)
+	file, err := openCached(track.path)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return &resumingReader{ctx: ctx, track: track, body: releaseOnClose{file, release}}, nil
+}
+
+type releaseOnClose struct {
+	io.ReadCloser
+	release func()
+}
+
+func (r releaseOnClose) Close() error {
+	defer r.release()
+	return r.ReadCloser.Close()
+}
+
+// Continuous stream playing selected tracks back to back
+func radio(w http.ResponseWriter, req *http.Request) {
+	if egress.exceeded() {
+		http.Error(w, "Daily egress quota exceeded, try again tomorrow", http.StatusServiceUnavailable)
+		log.Printf("Rejected radio request: daily egress quota exceeded")
+		return
+	}
+
+	st, ok := stationFor(w, req)
+	if !ok {
+		return
+	}
+
+	b2Client, err := b2ClientFromEnv()
+	if err != nil {
+		http.Error(w, "Failed to create B2 client", http.StatusInternalServerError)
+		log.Printf("Failed to create B2 client: %v", err)
+		return
+	}
+
+	current := nextRadioTrack(req.Context(), st, b2Client, "")
+	if current.err != nil {
+		http.Error(w, "No tracks available", http.StatusServiceUnavailable)
+		log.Printf("Failed to start radio: %v", current.err)
+		return
+	}
+
+	done := streams.begin()
+	defer done()
+	defer st.join()()
+
+	// Behave like an Icecast mountpoint for players asking for ICY metadata
+	wantsICY := req.Header.Get("Icy-MetaData") == "1"
+	if wantsICY {
+		w.Header().Set("icy-metaint", strconv.Itoa(icyMetaInt))
+		w.Header().Set("icy-name", st.title)
+		if st.description != "" {
+			w.Header().Set("icy-description", st.description)
+		}
+	}
+
+	// The fallback clip doesn't pin the format, so a recovered bucket isn't
+	// filtered down to the clip's extension. Crossfaded radio is re-encoded,
+	// so it can mix formats freely.
+	crossfade := crossfadeEnabled()
+	ext := ""
+	if !current.fallback && !crossfade {
+		ext = filepath.Ext(current.name)
+	}
+	contentType := audioContentType(current.name)
+	if crossfade {
+		contentType = crossfadeContentType
+	}
+
+	// The pre-roll plays once per connection, before the first track. Its ID
+	// goes out with the headers so the listener can skip it.
+	var preroll *prerollSession
+	endPreroll := func() {}
+	if prerollFile != "" {
+		if audioContentType(prerollFile) == contentType {
+			var id string
+			id, preroll, endPreroll = prerolls.begin()
+			defer endPreroll()
+			w.Header().Set(sessionHeader, id)
+		} else {
+			log.Printf("Skipping pre-roll, %s doesn't match the %s stream", prerollFile, contentType)
+		}
+	}
+	cw := newChunkedWriter(w, req, contentType)
+
+	var icy *icyWriter
+	if wantsICY {
+		icy = newICYWriter(w)
+		cw.out = icy
+	}
+	ctx := req.Context()
+
+	if preroll != nil {
+		log.Printf("Radio %s playing pre-roll: %s", st.name, prerollFile)
+		err := playPreroll(cw, preroll)
+		endPreroll()
+		if err != nil {
+			log.Printf("Radio stream ended during pre-roll: %v", err)
+			return
+		}
+	}
+
+	ahead := newRadioLookahead()
+	defer ahead.close()
+
+	// Fetch the track after playing in the background, after a random offset.
+	// The handler waits for the fetch before returning, so that it never
+	// outlives the connection.
+	var prefetching sync.WaitGroup
+	defer prefetching.Wait()
+	prefetch := func(playing, ext string) chan radioTrack {
+		next := make(chan radioTrack, 1)
+		prefetching.Add(1)
+		go func() {
+			defer prefetching.Done()
+			select {
+			case <-time.After(jitter(radioJitter)):
+			case <-ctx.Done():
+				next <- radioTrack{err: ctx.Err()}
+				return
+			}
+			track := nextRadioTrack(ctx, st, b2Client, ext)
+			next <- track
+			ahead.fill(ctx, st, b2Client, ext, playing, track)
+		}()
+		return next
+	}
+
+	next := prefetch(current.name, ext)
+	playing := current.name
+	advance := func() radioTrack {
+		track := <-next
+		if track.err != nil {
+			// Try again on the next call, in case B2 comes back
+			next = prefetch(playing, ext)
+			return track
+		}
+		playing = track.name
+		if ext == "" && !track.fallback && !crossfade {
+			ext = filepath.Ext(track.name)
+		}
+		next = prefetch(track.name, ext)
+		return track
+	}
+
+	// Whether current's opening was already played in the previous crossfade
+	mixedHead := false
+	// Tracks in a row that broke off before the end
+	lost := 0
+
+	for {
+		log.Printf("Radio %s playing: %s", st.name, current.name)
+		st.recordPlay(current.name)
+		if icy != nil {
+			metadata, _ := cachedMetadata(current.name)
+			icy.setTitle(displayTitle(current.name, metadata))
+		}
+		record := streamRecord{station: st.name, client: clientIP(req)}
+
+		var upcoming radioTrack
+		var err error
+		if crossfade {
+			// The next track's opening is mixed into this one's ending, so it
+			// is needed before this one starts; the one after it is fetched
+			// while they play
+			upcoming = advance()
+			err = playCrossfaded(ctx, cw, current, upcoming, mixedHead, record)
+			mixedHead = upcoming.err == nil
+		} else {
+			err = playRadioTrack(cw, b2Client, current, record)
+		}
+		if err != nil && (!isTrackReadError(err) || crossfade) {
+			log.Printf("Radio stream ended: %v", err)
+			return
+		}
+		if err != nil {
+			log.Printf("Radio %s lost %s, moving on: %v", st.name, current.name, err)
+			lost++
+		} else {
+			lost = 0
+		}
+
+		// On shutdown, end cleanly at the track boundary instead of mid-song
+		if streams.isDraining() {
+			log.Printf("Radio stream ended after %s for shutdown", current.name)
+			return
+		}
+
+		if !crossfade {
+			upcoming = advance()
+		}
+		current = upcoming
+		// Tracks failing one after another mean B2 is down rather than one
+		// file being bad
+		if lost >= maxRadioReselections {
+			current = fallbackRadioTrack(err)
+			lost = 0
+		}
+		for current.err != nil && radioOutage == outageSilence && !crossfade && contentType == "audio/mpeg" {
+			log.Printf("Radio %s playing silence, failed to fetch next track: %v", st.name, current.err)
+			if err := playSilence(cw, radioOutageSilence); err != nil {
+				log.Printf("Radio stream ended: %v", err)
+				return
+			}
+			current = advance()
+		}
+		if current.err != nil {
+			log.Printf("Radio stream ended, failed to fetch next track: %v", current.err)
+			return
+		}
+	}
+}
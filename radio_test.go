@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestJitterStaggersConcurrentStreams(t *testing.T) {
+	const streams = 200
+	const max = time.Second
+
+	// Every stream starts at once and delays its prefetch by its own jitter
+	delays := make([]time.Duration, streams)
+	var wg sync.WaitGroup
+	for i := range delays {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			delays[i] = jitter(max)
+		}()
+	}
+	wg.Wait()
+
+	for _, delay := range delays {
+		if delay < 0 || delay >= max {
+			t.Fatalf("delay %s outside [0, %s)", delay, max)
+		}
+	}
+
+	// Bucket the prefetches into tenths of the window: in lockstep they would
+	// all land in one, staggered they spread across nearly all of them
+	buckets := map[time.Duration]int{}
+	for _, delay := range delays {
+		buckets[delay/(max/10)]++
+	}
+	if len(buckets) < 8 {
+		t.Fatalf("prefetches landed in %d of 10 windows, want them spread out", len(buckets))
+	}
+	for bucket, count := range buckets {
+		if count > streams/4 {
+			t.Fatalf("%d of %d prefetches landed in window %d", count, streams, bucket)
+		}
+	}
+}
+
+func TestJitterDisabled(t *testing.T) {
+	if delay := jitter(0); delay != 0 {
+		t.Fatalf("delay %s, want 0", delay)
+	}
+}
+
+func TestNextRadioTrackKeepsExtension(t *testing.T) {
+	client := newFakeB2(t, map[string][]byte{
+		"a.mp3": []byte("a"),
+		"b.ogg": []byte("b"),
+		"c.MP3": []byte("c"),
+	})
+	useListing(t, []string{"a.mp3", "b.ogg", "c.MP3"})
+	st := useStation(t, modeRandom)
+
+	for range 20 {
+		track := nextRadioTrack(context.Background(), st, client, ".mp3")
+		if track.err != nil {
+			t.Fatal(track.err)
+		}
+		if !slices.Contains([]string{"a.mp3", "c.MP3"}, track.name) {
+			t.Fatalf("picked %s for an mp3 stream", track.name)
+		}
+		if track.path == "" {
+			t.Fatal("track wasn't downloaded")
+		}
+	}
+}
+
+func TestNextRadioTrackSkipsLeftListeners(t *testing.T) {
+	useFallback(t)
+	client := newFakeB2(t, map[string][]byte{"a.mp3": []byte("a")})
+	useListing(t, []string{"a.mp3"})
+	st := useStation(t, modeRandom)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	track := nextRadioTrack(ctx, st, client, "")
+	if track.err == nil || track.fallback {
+		t.Fatalf("got %+v, want neither a track nor the fallback clip", track)
+	}
+	if len(client.downloads) != 0 {
+		t.Fatalf("downloaded %q for a listener that has left", client.downloads)
+	}
+}
+
+func TestAudioContentType(t *testing.T) {
+	tests := map[string]string{
+		"a.mp3":     "audio/mpeg",
+		"b.OGG":     "audio/ogg",
+		"c.flac":    "audio/flac",
+		"d.unknown": "application/octet-stream",
+	}
+	for name, want := range tests {
+		if got := audioContentType(name); got != want {
+			t.Errorf("%s: got %s, want %s", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,695 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	streamModeCache  = "cache"
+	streamModeHybrid = "hybrid"
+	streamModeDirect = "direct"
+)
+
+// Every STREAM_MODE value
+var streamModes = []string{streamModeCache, streamModeHybrid, streamModeDirect}
+
+// How /stream delivers a file, set from STREAM_MODE. In hybrid mode the
+// requested range is proxied from B2 while the rest of the file is backfilled
+// into the cache in the background; in direct mode it is proxied and never
+// written to disk.
+var streamMode = streamModeCache
+
+// Partially downloaded files live in a hidden directory of their shard
+// until complete, so completing one is a rename on the same disk. Each gets
+// its own name after this one: a discarded file can still be in use while
+// the next one for the same key fills in.
+func partialPath(fileName string) string {
+	return filepath.Join(shardFor(fileName), ".partial", localName(fileName))
+}
+
+const (
+	defaultRangeCacheBytes    = 32 << 20
+	defaultRangeCacheMaxRange = 2 << 20
+)
+
+// Recently proxied byte ranges, so a client replaying the same section of a
+// large file doesn't refetch it from B2 while the backfill catches up. Keys
+// include the object's ETag: once the object is replaced the listing reports
+// a new ETag and the old ranges are never hit again.
+var servedRanges = newMemoryCache(defaultRangeCacheBytes, defaultRangeCacheMaxRange)
+
+func rangeCacheKey(fileName, etag string, r byteRange) string {
+	return fmt.Sprintf("%s\x00%s\x00%d-%d", fileName, etag, r.start, r.end)
+}
+
+func forgetRanges(fileName string) {
+	servedRanges.removeMatching(func(key string) bool {
+		return strings.HasPrefix(key, fileName+"\x00")
+	})
+}
+
+func serveCachedRange(w http.ResponseWriter, fileName string, data []byte, r byteRange, size int64) {
+	w.Header().Set("Content-Type", audioContentType(fileName))
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", r.start, r.end-1, size))
+	w.WriteHeader(http.StatusPartialContent)
+	w.Write(data)
+}
+
+// Half-open byte interval [start, end)
+type byteRange struct {
+	start, end int64
+}
+
+// A cache file that is filled in out of order, with bookkeeping of which
+// byte ranges are present
+type sparseFile struct {
+	mu          sync.Mutex
+	key         string
+	file        *os.File
+	size        int64  // 0 until the first response from B2 reports it
+	etag        string // of the first response; later ones must match
+	have        []byteRange
+	backfilling bool
+
+	// Ranges requests are proxying into the file right now. The backfill
+	// leaves them to those requests and waits on released for anything
+	// they didn't finish.
+	writing  []byteRange
+	released *sync.Cond
+
+	// Requests and the backfill using the file, guarded by partials.mu. The
+	// file is only moved into the cache or removed, and closed, by finish
+	// once the last of them releases it.
+	users  int
+	finish func()
+}
+
+func (f *sparseFile) contentSize() int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.size
+}
+
+func (f *sparseFile) setSize(size int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.size = size
+}
+
+func (f *sparseFile) currentETag() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.etag
+}
+
+// Whether a response from B2 is of the same object version as the bytes
+// already in the file. The first response sets the version.
+func (f *sparseFile) sameObject(etag string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.etag == "" {
+		f.etag = etag
+	}
+	return etag == "" || etag == f.etag
+}
+
+func (f *sparseFile) covers(r byteRange) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, have := range f.have {
+		if have.start <= r.start && r.end <= have.end {
+			return true
+		}
+	}
+	return false
+}
+
+// Record a range as present, merging it with overlapping or adjacent ranges
+func (f *sparseFile) add(r byteRange) {
+	if r.end <= r.start {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	ranges := append(f.have, r)
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].start < ranges[j].start })
+
+	merged := ranges[:1]
+	for _, next := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if next.start <= last.end {
+			last.end = max(last.end, next.end)
+		} else {
+			merged = append(merged, next)
+		}
+	}
+	f.have = merged
+}
+
+// Ranges of the file neither present nor being written
+func (f *sparseFile) gaps() []byteRange {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	covered := append(slices.Clone(f.have), f.writing...)
+	sort.Slice(covered, func(i, j int) bool { return covered[i].start < covered[j].start })
+
+	var missing []byteRange
+	var offset int64
+	for _, r := range covered {
+		if r.start > offset {
+			missing = append(missing, byteRange{offset, r.start})
+		}
+		offset = max(offset, r.end)
+	}
+	if offset < f.size {
+		missing = append(missing, byteRange{offset, f.size})
+	}
+	return missing
+}
+
+// Mark r as being written by a request. The returned func ends that, after
+// the request has added what it wrote.
+func (f *sparseFile) startWriting(r byteRange) func() {
+	f.mu.Lock()
+	f.writing = append(f.writing, r)
+	f.mu.Unlock()
+
+	return func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if i := slices.Index(f.writing, r); i >= 0 {
+			f.writing = slices.Delete(f.writing, i, i+1)
+		}
+		f.released.Broadcast()
+	}
+}
+
+// Wait until no request is writing into the file
+func (f *sparseFile) waitForWriters() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for len(f.writing) > 0 {
+		f.released.Wait()
+	}
+}
+
+type partialFiles struct {
+	mu      sync.Mutex
+	entries map[string]*sparseFile
+}
+
+var partials = &partialFiles{entries: make(map[string]*sparseFile)}
+
+// The partial file for fileName, which the caller must release
+func (p *partialFiles) open(fileName string) (*sparseFile, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if entry, ok := p.entries[fileName]; ok {
+		entry.users++
+		return entry, nil
+	}
+
+	path := partialPath(fileName)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &sparseFile{key: fileName, file: file, users: 1}
+	entry.released = sync.NewCond(&entry.mu)
+	p.entries[fileName] = entry
+	return entry, nil
+}
+
+// Take another reference to an entry already held
+func (p *partialFiles) retain(entry *sparseFile) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	entry.users++
+}
+
+func (p *partialFiles) release(entry *sparseFile) {
+	p.mu.Lock()
+	entry.users--
+	finish := entry.finish
+	last := entry.users == 0 && finish != nil
+	p.mu.Unlock()
+
+	if last {
+		finish()
+	}
+}
+
+// Whether entry is still the partial file new requests get. Once completed
+// or discarded it is only kept open for those still using it.
+func (p *partialFiles) current(entry *sparseFile) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.entries[entry.key] == entry
+}
+
+// Retire entry, running finish once its last user releases it. The first
+// of complete and discard decides what happens to the file.
+func (p *partialFiles) retire(entry *sparseFile, finish func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.entries[entry.key] == entry {
+		delete(p.entries, entry.key)
+	}
+	if entry.finish == nil {
+		entry.finish = finish
+	}
+}
+
+// Move a fully backfilled file into the regular cache
+func (p *partialFiles) complete(entry *sparseFile) {
+	p.retire(entry, func() {
+		filePath := cachePath(entry.key)
+		err := os.MkdirAll(filepath.Dir(filePath), 0755)
+		if err == nil {
+			err = os.Rename(entry.file.Name(), filePath)
+		}
+		entry.file.Close()
+
+		if err != nil {
+			log.Printf("Failed to move backfilled file into cache: %v", err)
+			os.Remove(entry.file.Name())
+			return
+		}
+
+		log.Printf("Backfill complete, cached file to: %s", filePath)
+		storeETag(entry.key, entry.etag)
+		enforceCacheLimit(filePath)
+	})
+}
+
+func (p *partialFiles) discard(entry *sparseFile) {
+	p.retire(entry, func() {
+		entry.file.Close()
+		os.Remove(entry.file.Name())
+	})
+}
+
+// Parse a single-range Range header against a known size. Multiple ranges
+// and malformed headers report false, and are served as the full file.
+func parseByteRange(header string, size int64) (byteRange, bool) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return byteRange{}, false
+	}
+
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return byteRange{}, false
+	}
+
+	if first == "" {
+		// Suffix range: the final n bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return byteRange{}, false
+		}
+		return byteRange{max(size-n, 0), size}, true
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return byteRange{}, false
+	}
+
+	end := size
+	if last != "" {
+		lastByte, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || lastByte < start {
+			return byteRange{}, false
+		}
+		end = min(lastByte+1, size)
+	}
+	return byteRange{start, end}, true
+}
+
+const (
+	rangeValid = iota
+	rangeMalformed
+	rangeUnsatisfiable
+)
+
+// With INVALID_RANGE=reject, syntactically invalid Range headers get 400
+// rather than being ignored as RFC 9110 allows
+var rejectInvalidRange bool
+
+// Check a Range header before passing it on to B2. size is the object's
+// length, or -1 when unknown, which skips the bounds check.
+func classifyRange(header string, size int64) int {
+	unit, spec, ok := strings.Cut(header, "=")
+	if !ok || !strings.EqualFold(strings.TrimSpace(unit), "bytes") {
+		return rangeMalformed
+	}
+
+	satisfiable := false
+	for _, part := range strings.Split(spec, ",") {
+		first, last, ok := strings.Cut(strings.TrimSpace(part), "-")
+		if !ok || (first == "" && last == "") {
+			return rangeMalformed
+		}
+
+		if first == "" {
+			n, err := strconv.ParseUint(last, 10, 63)
+			if err != nil {
+				return rangeMalformed
+			}
+			// A zero-length suffix selects nothing
+			satisfiable = satisfiable || (n > 0 && size != 0)
+			continue
+		}
+
+		start, err := strconv.ParseUint(first, 10, 63)
+		if err != nil {
+			return rangeMalformed
+		}
+		if last != "" {
+			end, err := strconv.ParseUint(last, 10, 63)
+			if err != nil || end < start {
+				return rangeMalformed
+			}
+		}
+		satisfiable = satisfiable || size < 0 || int64(start) < size
+	}
+
+	if !satisfiable {
+		return rangeUnsatisfiable
+	}
+	return rangeValid
+}
+
+// Resolve a request's Range header for fetching fileName: the header to
+// pass on, which is empty for the full file, or false once a 416 or 400
+// has been written
+func checkRange(w http.ResponseWriter, req *http.Request, fileName string) (string, bool) {
+	header := req.Header.Get("Range")
+	if header == "" {
+		return "", true
+	}
+
+	size := int64(-1)
+	if object, ok := listing.lookup(fileName); ok {
+		size = object.Size
+	}
+
+	switch classifyRange(header, size) {
+	case rangeUnsatisfiable:
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		http.Error(w, "Range not satisfiable", http.StatusRequestedRangeNotSatisfiable)
+		return "", false
+	case rangeMalformed:
+		if rejectInvalidRange {
+			http.Error(w, "Invalid Range header", http.StatusBadRequest)
+			return "", false
+		}
+		log.Printf("Ignoring malformed Range header %q, serving the full file", header)
+		return "", true
+	}
+	return header, true
+}
+
+// Parse the "bytes start-end/size" Content-Range of a B2 response
+func parseContentRange(header string) (byteRange, int64, error) {
+	var first, last, size int64
+	if _, err := fmt.Sscanf(header, "bytes %d-%d/%d", &first, &last, &size); err != nil {
+		return byteRange{}, 0, fmt.Errorf("invalid content range %q: %w", header, err)
+	}
+	return byteRange{first, last + 1}, size, nil
+}
+
+// Serve a file in hybrid mode. Full cache hits are served from disk; ranges
+// already present in the partial file are served from it; anything else is
+// fetched from B2 and written through to the partial file.
+func hybridServe(req *http.Request, b2Client B2, fileName string) (func(w http.ResponseWriter), bool) {
+	// A copy of another size than B2's is stale or was cut short
+	if filePath, ok := cachedCopy(b2Client, fileName, ""); ok {
+		return func(w http.ResponseWriter) {
+			defer servingFiles.acquire(filePath)()
+			serveCached(w, req, filePath)
+		}, true
+	}
+
+	return func(w http.ResponseWriter) {
+		if err := serveSparse(w, req, b2Client, fileName); err != nil {
+			log.Printf("Hybrid stream of %s failed: %v", fileName, err)
+		}
+	}, false
+}
+
+func serveSparse(w http.ResponseWriter, req *http.Request, b2Client B2, fileName string) error {
+	entry, err := partials.open(fileName)
+	if err != nil {
+		http.Error(w, "Failed to open cache file", http.StatusInternalServerError)
+		return err
+	}
+	defer partials.release(entry)
+
+	rangeHeader, ok := checkRange(w, req, fileName)
+	if !ok {
+		return nil
+	}
+
+	// Only ranges of objects in the listing are cached, since the listed
+	// ETag is what tells a cached range is still current
+	object, listed := listing.lookup(fileName)
+	listed = listed && object.ETag != ""
+	if listed {
+		if wanted, ok := parseByteRange(rangeHeader, object.Size); ok {
+			if cached, hit := servedRanges.get(rangeCacheKey(fileName, object.ETag, wanted)); hit {
+				log.Printf("Serving %s bytes %d-%d from range cache", fileName, wanted.start, wanted.end-1)
+				serveCachedRange(w, fileName, cached.data, wanted, object.Size)
+				return nil
+			}
+		}
+	}
+
+	fetchHeader := rangeHeader
+	if strings.Contains(rangeHeader, ",") {
+		// Multiple ranges aren't proxied, serve the whole file
+		fetchHeader = ""
+	}
+
+	if size := entry.contentSize(); size > 0 {
+		wanted, ok := parseByteRange(rangeHeader, size)
+		if !ok {
+			wanted = byteRange{0, size}
+		}
+
+		if entry.covers(wanted) && etagCheckDue(fileName) && !etagMatches(b2Client, fileName, entry.currentETag()) {
+			log.Printf("%s changed in B2, discarding its partial cache file", fileName)
+			partials.discard(entry)
+			return serveSparse(w, req, b2Client, fileName)
+		}
+		if entry.covers(wanted) {
+			// Our reference keeps the file open while we serve, even if the
+			// backfill completes meanwhile
+			log.Printf("Serving %s bytes %d-%d from partial cache", fileName, wanted.start, wanted.end-1)
+			http.ServeContent(w, req, fileName, time.Time{}, io.NewSectionReader(entry.file, 0, size))
+			startBackfill(b2Client, entry)
+			return nil
+		}
+
+		fetchHeader = ""
+		if ok {
+			fetchHeader = fmt.Sprintf("bytes=%d-%d", wanted.start, wanted.end-1)
+		}
+	}
+
+	result, err := b2Client.fetchRange(fileName, fetchHeader)
+	if err != nil {
+		b2Error(w, "Failed to fetch file", err)
+		return err
+	}
+	defer result.body.Close()
+
+	if result.size < 0 {
+		// Without a length the body can't be placed in the partial file,
+		// so pass it through uncached and chunked, as proxyServe does. A
+		// file nothing has sized yet is left for good rather than kept.
+		if entry.contentSize() <= 0 {
+			partials.discard(entry)
+		}
+		if req.Method == http.MethodHead {
+			w.Header().Set("Content-Type", audioContentType(fileName))
+			return nil
+		}
+		_, err := streamChunked(w, req, result.body, audioContentType(fileName))
+		return err
+	}
+
+	// The object was replaced while the partial file was filling in, so its
+	// bytes are a mix of versions. Start over and pass this response through.
+	changed := !entry.sameObject(result.etag)
+	if changed {
+		log.Printf("%s changed in B2, discarding its partial cache file", fileName)
+		partials.discard(entry)
+	} else if result.size > 0 {
+		entry.setSize(result.size)
+	}
+
+	w.Header().Set("Content-Type", audioContentType(fileName))
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Length", strconv.FormatInt(result.span.end-result.span.start, 10))
+	if fetchHeader != "" {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", result.span.start, result.span.end-1, result.size))
+		w.WriteHeader(http.StatusPartialContent)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if changed {
+		fw := newFlushingWriter(w, fetchHeader == "")
+		_, err := io.Copy(fw, result.body)
+		if flushErr := fw.Flush(); err == nil {
+			err = flushErr
+		}
+		return err
+	}
+
+	// Backfill alongside the proxied range so the whole file ends up cached,
+	// once the range is marked as ours so the backfill doesn't fetch it too
+	span := result.span
+	doneWriting := entry.startWriting(span)
+	startBackfill(b2Client, entry)
+
+	cacheable := fetchHeader != "" && listed && result.etag == object.ETag && servedRanges.admits(span.end-span.start)
+
+	var body io.Reader = result.body
+	var buf bytes.Buffer
+	if cacheable {
+		body = io.TeeReader(result.body, &buf)
+	}
+
+	fw := newFlushingWriter(w, fetchHeader == "")
+	written, err := copyThrough(fw, entry, body, span.start)
+	if flushErr := fw.Flush(); err == nil {
+		err = flushErr
+	}
+	entry.add(byteRange{span.start, span.start + written})
+	doneWriting()
+	if err == nil && cacheable && written == span.end-span.start {
+		servedRanges.add(rangeCacheKey(fileName, object.ETag, span), buf.Bytes(), time.Time{})
+	}
+	return err
+}
+
+// Copy from B2 to the client while writing the same bytes into the partial
+// file at their offset
+func copyThrough(w io.Writer, entry *sparseFile, body io.Reader, offset int64) (int64, error) {
+	buf := make([]byte, streamBufferBytes)
+	var written int64
+
+	for {
+		n, readErr := body.Read(buf)
+		if n > 0 {
+			if _, err := entry.file.WriteAt(buf[:n], offset+written); err != nil {
+				return written, err
+			}
+			if _, err := w.Write(buf[:n]); err != nil {
+				return written, err
+			}
+			written += int64(n)
+		}
+
+		if readErr == io.EOF {
+			return written, nil
+		}
+		if readErr != nil {
+			return written, readErr
+		}
+	}
+}
+
+// Backfills still running. Their last steps read the cache settings, so
+// tests wait for them before putting those back.
+var backfills sync.WaitGroup
+
+func startBackfill(b2Client B2, entry *sparseFile) {
+	entry.mu.Lock()
+	// Until a response reports the size every byte looks present, and the
+	// file would be completed empty
+	if entry.backfilling || entry.size <= 0 {
+		entry.mu.Unlock()
+		return
+	}
+	entry.backfilling = true
+	entry.mu.Unlock()
+
+	partials.retain(entry)
+	backfills.Add(1)
+	go func() {
+		defer backfills.Done()
+		backfill(b2Client, entry)
+	}()
+}
+
+// Fetch every missing range until the partial file is complete, or until a
+// request discards it
+func backfill(b2Client B2, entry *sparseFile) {
+	defer partials.release(entry)
+
+	for partials.current(entry) {
+		gaps := entry.gaps()
+		if len(gaps) == 0 {
+			// Requests still writing may stop short and leave gaps behind
+			entry.waitForWriters()
+			if gaps = entry.gaps(); len(gaps) == 0 {
+				partials.complete(entry)
+				return
+			}
+		}
+
+		gap := gaps[0]
+		result, err := b2Client.fetchRange(entry.key, fmt.Sprintf("bytes=%d-%d", gap.start, gap.end-1))
+		if err != nil {
+			log.Printf("Backfill of %s failed: %v", entry.key, err)
+			partials.discard(entry)
+			return
+		}
+
+		if !entry.sameObject(result.etag) {
+			result.body.Close()
+			log.Printf("%s changed in B2 during backfill, discarding its partial cache file", entry.key)
+			partials.discard(entry)
+			return
+		}
+
+		written, err := copyThrough(io.Discard, entry, result.body, result.span.start)
+		result.body.Close()
+		entry.add(byteRange{result.span.start, result.span.start + written})
+		if err != nil && !errors.Is(err, io.EOF) {
+			log.Printf("Backfill of %s failed: %v", entry.key, err)
+			partials.discard(entry)
+			return
+		}
+	}
+}
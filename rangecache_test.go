@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestSparseFileMergesOverlappingRanges(t *testing.T) {
+	entry := &sparseFile{size: 100}
+
+	entry.add(byteRange{10, 30})
+	entry.add(byteRange{20, 40})
+	entry.add(byteRange{40, 50})
+
+	if !slices.Equal(entry.have, []byteRange{{10, 50}}) {
+		t.Fatalf("ranges %v, want one merged [10, 50)", entry.have)
+	}
+	if !entry.covers(byteRange{15, 45}) {
+		t.Fatal("a range inside the merged span should be covered")
+	}
+	if !slices.Equal(entry.gaps(), []byteRange{{0, 10}, {50, 100}}) {
+		t.Fatalf("gaps %v", entry.gaps())
+	}
+}
+
+func TestSparseFileDisjointRanges(t *testing.T) {
+	entry := &sparseFile{size: 100}
+
+	entry.add(byteRange{60, 80})
+	entry.add(byteRange{0, 20})
+
+	if !slices.Equal(entry.have, []byteRange{{0, 20}, {60, 80}}) {
+		t.Fatalf("ranges %v, want two disjoint ranges", entry.have)
+	}
+	if entry.covers(byteRange{10, 70}) {
+		t.Fatal("a range spanning a gap shouldn't be covered")
+	}
+	if !slices.Equal(entry.gaps(), []byteRange{{20, 60}, {80, 100}}) {
+		t.Fatalf("gaps %v", entry.gaps())
+	}
+}
+
+func TestParseByteRange(t *testing.T) {
+	tests := []struct {
+		header string
+		want   byteRange
+		ok     bool
+	}{
+		{"bytes=0-99", byteRange{0, 100}, true},
+		{"bytes=900-", byteRange{900, 1000}, true},
+		{"bytes=-100", byteRange{900, 1000}, true},
+		{"bytes=990-2000", byteRange{990, 1000}, true},
+		{"bytes=1000-", byteRange{}, false},
+		{"bytes=0-1,5-6", byteRange{}, false},
+		{"bytes=5-1", byteRange{}, false},
+		{"items=0-1", byteRange{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseByteRange(tt.header, 1000)
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("%s: got %v %t, want %v %t", tt.header, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func waitForFile(t *testing.T, path string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := os.Stat(path); err == nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s never appeared", path)
+}
+
+func TestHybridServesRangesAndBackfills(t *testing.T) {
+	t.Chdir(t.TempDir())
+	t.Cleanup(backfills.Wait)
+	data := bytes.Repeat([]byte("0123456789"), 10000)
+	client := newFakeB2(t, map[string][]byte{"track.mp3": data})
+
+	tests := []struct {
+		name        string
+		rangeHeader string
+		want        []byte
+	}{
+		{"disjoint tail", "bytes=90000-90999", data[90000:91000]},
+		{"disjoint head", "bytes=0-999", data[:1000]},
+		{"overlapping", "bytes=500-1499", data[500:1500]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/stream?file=track.mp3", nil)
+			req.Header.Set("Range", tt.rangeHeader)
+			rec := httptest.NewRecorder()
+
+			serve, _ := hybridServe(req, client, "track.mp3")
+			serve(rec)
+
+			if rec.Code != http.StatusPartialContent {
+				t.Fatalf("status %d, want 206", rec.Code)
+			}
+			if !bytes.Equal(rec.Body.Bytes(), tt.want) {
+				t.Fatalf("got %d bytes that don't match the requested range", rec.Body.Len())
+			}
+		})
+	}
+
+	waitForFile(t, cachePath("track.mp3"))
+	cached, err := os.ReadFile(cachePath("track.mp3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(cached, data) {
+		t.Fatal("the backfilled file doesn't match the object")
+	}
+
+	// Once complete, the file is served from the regular cache
+	req := httptest.NewRequest(http.MethodGet, "/stream?file=track.mp3", nil)
+	req.Header.Set("Range", "bytes=10-19")
+	rec := httptest.NewRecorder()
+	serve, hit := hybridServe(req, client, "track.mp3")
+	serve(rec)
+	if !hit || rec.Body.String() != "0123456789" {
+		t.Fatalf("hit %t body %q, want a cache hit", hit, rec.Body)
+	}
+}
+
+// A fake B2 whose response to one range holds its body back until released,
+// like a proxied range a listener is still receiving
+type heldRangeB2 struct {
+	*fakeB2
+	held    string
+	release chan struct{}
+}
+
+type heldBody struct {
+	io.ReadCloser
+	release chan struct{}
+}
+
+func (b heldBody) Read(p []byte) (int, error) {
+	<-b.release
+	return b.ReadCloser.Read(p)
+}
+
+func (b *heldRangeB2) fetchRange(fileName, rangeHeader string) (*rangeResult, error) {
+	result, err := b.fakeB2.fetchRange(fileName, rangeHeader)
+	if err == nil && rangeHeader == b.held {
+		result.body = heldBody{ReadCloser: result.body, release: b.release}
+	}
+	return result, err
+}
+
+func TestBackfillSkipsRangeBeingProxied(t *testing.T) {
+	t.Chdir(t.TempDir())
+	t.Cleanup(backfills.Wait)
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	client := &heldRangeB2{fakeB2: newFakeB2(t, map[string][]byte{"track.mp3": data}), held: "bytes=1000-1999", release: make(chan struct{})}
+
+	req := httptest.NewRequest(http.MethodGet, "/stream?file=track.mp3", nil)
+	req.Header.Set("Range", client.held)
+	rec := httptest.NewRecorder()
+	served := make(chan struct{})
+	go func() {
+		serve, _ := hybridServe(req, client, "track.mp3")
+		serve(rec)
+		close(served)
+	}()
+
+	// The backfill fetches around the range while it is still being proxied
+	deadline := time.Now().Add(5 * time.Second)
+	for client.fetchCount("bytes=2000-9999") == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	close(client.release)
+	<-served
+	if !bytes.Equal(rec.Body.Bytes(), data[1000:2000]) {
+		t.Fatalf("got %d bytes that don't match the requested range", rec.Body.Len())
+	}
+
+	waitForFile(t, cachePath("track.mp3"))
+	if cached, _ := os.ReadFile(cachePath("track.mp3")); !bytes.Equal(cached, data) {
+		t.Fatal("the backfilled file doesn't match the object")
+	}
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	sort.Strings(client.fetches)
+	if want := []string{"bytes=0-999", "bytes=1000-1999", "bytes=2000-9999"}; !slices.Equal(client.fetches, want) {
+		t.Fatalf("fetched %q, want each byte once", client.fetches)
+	}
+}
+
+func TestDiscardWaitsForRequestsUsingFile(t *testing.T) {
+	t.Chdir(t.TempDir())
+	t.Cleanup(backfills.Wait)
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	client := &heldRangeB2{fakeB2: newFakeB2(t, map[string][]byte{"track.mp3": data}), held: "bytes=1000-1999", release: make(chan struct{})}
+
+	req := httptest.NewRequest(http.MethodGet, "/stream?file=track.mp3", nil)
+	req.Header.Set("Range", client.held)
+	rec := httptest.NewRecorder()
+	served := make(chan struct{})
+	go func() {
+		serve, _ := hybridServe(req, client, "track.mp3")
+		serve(rec)
+		close(served)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for client.fetchCount("bytes=2000-9999") == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Another request finds the object changed while this one is writing
+	entry, err := partials.open("track.mp3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	partials.discard(entry)
+	partials.release(entry)
+	close(client.release)
+	<-served
+	if !bytes.Equal(rec.Body.Bytes(), data[1000:2000]) {
+		t.Fatalf("got %d bytes, want the whole range despite the discard", rec.Body.Len())
+	}
+
+	// Once the backfill has let go too, the file is removed and not cached
+	partialDir := filepath.Dir(partialPath("track.mp3"))
+	for time.Now().Before(deadline) {
+		if left, _ := os.ReadDir(partialDir); len(left) == 0 {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if left, _ := os.ReadDir(partialDir); len(left) != 0 {
+		t.Fatalf("%d partial files left behind", len(left))
+	}
+	if _, err := os.Stat(cachePath("track.mp3")); err == nil {
+		t.Fatal("a discarded partial file was moved into the cache")
+	}
+}
+
+func TestRepeatedRangeHitsRangeCache(t *testing.T) {
+	t.Chdir(t.TempDir())
+	t.Cleanup(backfills.Wait)
+	previous := servedRanges
+	t.Cleanup(func() { servedRanges = previous })
+	servedRanges = newMemoryCache(1<<20, 1<<20)
+
+	data := bytes.Repeat([]byte("abcdefghij"), 10000)
+	client := newFakeB2(t, map[string][]byte{"long.mp3": data})
+	useListing(t, nil)
+	if _, err := listing.get(client); err != nil {
+		t.Fatal(err)
+	}
+
+	request := func() *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/stream?file=long.mp3", nil)
+		req.Header.Set("Range", "bytes=1000-1999")
+		rec := httptest.NewRecorder()
+		if err := serveSparse(rec, req, client, "long.mp3"); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Code != http.StatusPartialContent || !bytes.Equal(rec.Body.Bytes(), data[1000:2000]) {
+			t.Fatalf("status %d with %d bytes, want the requested range", rec.Code, rec.Body.Len())
+		}
+		return rec
+	}
+
+	request()
+	rec := request()
+	if fetches := client.fetchCount("bytes=1000-1999"); fetches != 1 {
+		t.Fatalf("fetched the range %d times, want the repeat served from the range cache", fetches)
+	}
+	if got := rec.Header().Get("Content-Range"); got != "bytes 1000-1999/100000" {
+		t.Fatalf("Content-Range %s", got)
+	}
+
+	// A replaced object gets a new ETag in the listing, so the cached range
+	// no longer matches
+	wanted := byteRange{1000, 2000}
+	if _, hit := servedRanges.get(rangeCacheKey("long.mp3", fakeETag(data), wanted)); !hit {
+		t.Fatal("the range isn't cached under the listed ETag")
+	}
+	if _, hit := servedRanges.get(rangeCacheKey("long.mp3", `"replaced"`, wanted)); hit {
+		t.Fatal("a different ETag shouldn't find the cached range")
+	}
+
+	// Let the backfill finish before the temp dir goes away
+	waitForFile(t, cachePath("long.mp3"))
+}
+
+func TestHybridPassesUnsizedBodyThrough(t *testing.T) {
+	t.Chdir(t.TempDir())
+	useStreamMode(t, streamModeHybrid)
+	useStation(t, modeRandom)
+	data := bytes.Repeat([]byte("abcdefghij"), 10000)
+	stub := newS3Stub(t, map[string][]byte{"long.mp3": data})
+	stub.unsized = map[string]bool{"long.mp3": true}
+	stub.useEnv(t)
+	useSizedListing(t, newFakeB2(t, stub.objects))
+
+	// A copy cut short by an earlier bug is of another size than B2's
+	truncated := writeCached(t, "long.mp3", 65536, time.Minute)
+
+	for range 2 {
+		resp := getLive(t, newStreamHandler(t).stream, "/stream?file=long.mp3")
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK || !isChunked(resp) || !bytes.Equal(body, data) {
+			t.Fatalf("status %d Content-Length %d with %d bytes, want the whole object chunked", resp.StatusCode, resp.ContentLength, len(body))
+		}
+	}
+	if stub.getCount("long.mp3") != 2 {
+		t.Fatalf("%d GETs, want each request passed through and nothing backfilled", stub.getCount("long.mp3"))
+	}
+	if info, err := os.Stat(truncated); err != nil || info.Size() != 65536 {
+		t.Fatal("an unsized response replaced the cached copy")
+	}
+}
+
+func TestClassifyRange(t *testing.T) {
+	tests := []struct {
+		header string
+		size   int64
+		want   int
+	}{
+		{"bytes=0-99", 1000, rangeValid},
+		{"bytes=990-2000", 1000, rangeValid},
+		{"bytes=-100", 1000, rangeValid},
+		{"bytes=0-1, 5-6", 1000, rangeValid},
+		{"bytes=2000-3000, 10-20", 1000, rangeValid},
+		{"bytes=5000-", -1, rangeValid},
+		{"bytes=1000-", 1000, rangeUnsatisfiable},
+		{"bytes=1000-1999, 5000-", 1000, rangeUnsatisfiable},
+		{"bytes=-0", 1000, rangeUnsatisfiable},
+		{"bytes=-10", 0, rangeUnsatisfiable},
+		{"bytes=5-1", 1000, rangeMalformed},
+		{"bytes=abc-", 1000, rangeMalformed},
+		{"bytes=-", 1000, rangeMalformed},
+		{"bytes=0-1,", 1000, rangeMalformed},
+		{"bytes=10", 1000, rangeMalformed},
+		{"items=0-1", 1000, rangeMalformed},
+		{"0-99", 1000, rangeMalformed},
+	}
+	for _, tt := range tests {
+		if got := classifyRange(tt.header, tt.size); got != tt.want {
+			t.Errorf("%q of %d bytes: got %d, want %d", tt.header, tt.size, got, tt.want)
+		}
+	}
+}
+
+func useInvalidRange(t *testing.T, reject bool) {
+	previous := rejectInvalidRange
+	t.Cleanup(func() { rejectInvalidRange = previous })
+	rejectInvalidRange = reject
+}
+
+func proxyWithRange(client B2, rangeHeader string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/stream?file=track.mp3", nil)
+	req.Header.Set("Range", rangeHeader)
+	rec := httptest.NewRecorder()
+	proxyServe(req, client, "track.mp3")(rec)
+	return rec
+}
+
+func TestOutOfBoundsRangeAnswered416(t *testing.T) {
+	disableCache(t)
+	client := newFakeB2(t, map[string][]byte{"track.mp3": bytes.Repeat([]byte("a"), 1000)})
+	useSizedListing(t, client)
+
+	rec := proxyWithRange(client, "bytes=1000-")
+	if rec.Code != http.StatusRequestedRangeNotSatisfiable || rec.Header().Get("Content-Range") != "bytes */1000" {
+		t.Fatalf("status %d Content-Range %q, want 416 with bytes */1000", rec.Code, rec.Header().Get("Content-Range"))
+	}
+	if len(client.fetches) != 0 {
+		t.Fatal("passed an unsatisfiable range on to B2")
+	}
+}
+
+func TestMalformedRangeServesFullFile(t *testing.T) {
+	disableCache(t)
+	data := bytes.Repeat([]byte("a"), 1000)
+	client := newFakeB2(t, map[string][]byte{"track.mp3": data})
+	useSizedListing(t, client)
+
+	useInvalidRange(t, false)
+	for _, header := range []string{"bytes=5-1", "bytes=abc-", "items=0-10"} {
+		rec := proxyWithRange(client, header)
+		if rec.Code != http.StatusOK || rec.Body.Len() != len(data) {
+			t.Errorf("%q: status %d with %d bytes, want the full file", header, rec.Code, rec.Body.Len())
+		}
+	}
+	if client.fetchCount("") != 3 {
+		t.Fatalf("fetches %q, want the malformed headers dropped", client.fetches)
+	}
+
+	useInvalidRange(t, true)
+	if rec := proxyWithRange(client, "bytes=5-1"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("status %d, want 400 with INVALID_RANGE=reject", rec.Code)
+	}
+}
+
+func TestRangeRejectedByB2(t *testing.T) {
+	disableCache(t)
+	useListing(t, nil)
+	stub := newS3Stub(t, map[string][]byte{"track.mp3": []byte("short")})
+	stub.useEnv(t)
+	client, err := b2ClientFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Unlisted, so only B2 knows the range is out of bounds
+	rec := proxyWithRange(client, "bytes=100-")
+	if rec.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Fatalf("status %d, want B2's 416 passed on", rec.Code)
+	}
+}
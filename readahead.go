@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultReadAheadBytes = 1 << 20
+	maxReadAheadEntries   = 256
+	readAheadIdle         = 30 * time.Second
+)
+
+// How much is read from B2 when a client's small range requests walk through
+// a file in order, set from READ_AHEAD_BYTES. 0 proxies every range as is.
+var readAheadBytes int64 = defaultReadAheadBytes
+
+// A client's position in a file plus the bytes read ahead of it. Players
+// that buffer with many small sequential ranges are then served from memory
+// instead of costing a GetObject each.
+type readAhead struct {
+	etag     string
+	cursor   int64 // end of the client's last range
+	buffer   byteRange
+	data     []byte
+	lastUsed time.Time
+}
+
+type readAheadBuffers struct {
+	mu      sync.Mutex
+	entries map[string]*readAhead // keyed by client and file
+}
+
+var readAheads = &readAheadBuffers{entries: make(map[string]*readAhead)}
+
+func readAheadKey(client, fileName string) string {
+	return client + "\x00" + fileName
+}
+
+func (b *readAheadBuffers) get(key, etag string) *readAhead {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	entry, ok := b.entries[key]
+	if !ok || entry.etag != etag {
+		entry = &readAhead{etag: etag, lastUsed: time.Now()}
+		b.entries[key] = entry
+		b.prune()
+	}
+	entry.lastUsed = time.Now()
+	return entry
+}
+
+// Drop idle entries, then the least recently used ones past the cap.
+// Callers must hold mu.
+func (b *readAheadBuffers) prune() {
+	for key, entry := range b.entries {
+		if time.Since(entry.lastUsed) > readAheadIdle {
+			delete(b.entries, key)
+		}
+	}
+	for len(b.entries) > maxReadAheadEntries {
+		var oldestKey string
+		var oldest time.Time
+		for key, entry := range b.entries {
+			if oldestKey == "" || entry.lastUsed.Before(oldest) {
+				oldestKey, oldest = key, entry.lastUsed
+			}
+		}
+		delete(b.entries, oldestKey)
+	}
+}
+
+func (b *readAheadBuffers) update(key string, entry *readAhead, cursor int64, buffer byteRange, data []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	entry.cursor = cursor
+	if data != nil {
+		entry.buffer, entry.data = buffer, data
+	}
+}
+
+// Serve a small range of a listed object through the client's read-ahead
+// buffer, reporting false when the request isn't one to coalesce
+func serveReadAhead(w http.ResponseWriter, req *http.Request, b2Client B2, fileName, rangeHeader string) bool {
+	if readAheadBytes <= 0 || rangeHeader == "" {
+		return false
+	}
+
+	object, ok := listing.lookup(fileName)
+	if !ok || object.ETag == "" {
+		return false
+	}
+	wanted, ok := parseByteRange(rangeHeader, object.Size)
+	if !ok || wanted.end-wanted.start >= readAheadBytes {
+		return false
+	}
+
+	key := readAheadKey(clientIP(req), fileName)
+	entry := readAheads.get(key, object.ETag)
+
+	readAheads.mu.Lock()
+	buffer, data, cursor := entry.buffer, entry.data, entry.cursor
+	readAheads.mu.Unlock()
+
+	if buffer.start <= wanted.start && wanted.end <= buffer.end {
+		serveCachedRange(w, fileName, data[wanted.start-buffer.start:wanted.end-buffer.start], wanted, object.Size)
+		readAheads.update(key, entry, wanted.end, byteRange{}, nil)
+		return true
+	}
+
+	// Only read ahead once the client is reading sequentially; a seek
+	// fetches just its range and moves the cursor
+	fetch := wanted
+	if wanted.start == cursor {
+		fetch.end = min(wanted.start+readAheadBytes, object.Size)
+	}
+
+	result, err := b2Client.fetchRange(fileName, fmt.Sprintf("bytes=%d-%d", fetch.start, fetch.end-1))
+	if err != nil {
+		quarantined.recordFailure(fileName)
+		b2Error(w, "Failed to fetch file", err)
+		log.Printf("Failed to proxy %s: %v", fileName, err)
+		return true
+	}
+	defer result.body.Close()
+	quarantined.recordSuccess(fileName)
+
+	fetched, err := io.ReadAll(result.body)
+	if err != nil || int64(len(fetched)) < wanted.end-fetch.start {
+		http.Error(w, "Failed to fetch file", http.StatusInternalServerError)
+		log.Printf("Failed to read %s from B2: %v", fileName, err)
+		return true
+	}
+
+	if fetch != wanted {
+		readAheads.update(key, entry, wanted.end, byteRange{fetch.start, fetch.start + int64(len(fetched))}, fetched)
+	} else {
+		readAheads.update(key, entry, wanted.end, byteRange{}, nil)
+	}
+	serveCachedRange(w, fileName, fetched[:wanted.end-wanted.start], wanted, object.Size)
+	return true
+}
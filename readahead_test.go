@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Like useListing, with the sizes and ETags read-ahead needs
+func useSizedListing(t *testing.T, client *fakeB2) {
+	objects, _ := client.listObjects()
+	var files []string
+	for _, object := range objects {
+		files = append(files, object.Key)
+	}
+
+	listing.mu.Lock()
+	listing.objects, listing.files, listing.fetchedAt = objects, files, time.Now()
+	listing.mu.Unlock()
+
+	t.Cleanup(func() {
+		listing.mu.Lock()
+		listing.objects, listing.files, listing.fetchedAt = nil, nil, time.Time{}
+		listing.mu.Unlock()
+	})
+}
+
+func useReadAhead(t *testing.T, size int64) {
+	previous := readAheadBytes
+	t.Cleanup(func() {
+		readAheadBytes = previous
+		readAheads.mu.Lock()
+		readAheads.entries = make(map[string]*readAhead)
+		readAheads.mu.Unlock()
+	})
+	readAheadBytes = size
+}
+
+func proxyRange(client *fakeB2, fileName string, start, end int64) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/stream?file="+fileName, nil)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end-1))
+	rec := httptest.NewRecorder()
+	proxyServe(req, client, fileName)(rec)
+	return rec
+}
+
+func TestSequentialSmallRangesAreCoalesced(t *testing.T) {
+	useReadAhead(t, 64<<10)
+	data := bytes.Repeat([]byte("0123456789abcdef"), 16<<10) // 256 KiB
+	client := newFakeB2(t, map[string][]byte{"track.mp3": data})
+	useSizedListing(t, client)
+
+	const chunk = 4 << 10
+	requests := 0
+	for start := int64(0); start < int64(len(data)); start += chunk {
+		rec := proxyRange(client, "track.mp3", start, start+chunk)
+		if rec.Code != http.StatusPartialContent || !bytes.Equal(rec.Body.Bytes(), data[start:start+chunk]) {
+			t.Fatalf("range at %d: status %d with %d bytes", start, rec.Code, rec.Body.Len())
+		}
+		requests++
+	}
+
+	if fetches := len(client.fetches); fetches*8 > requests {
+		t.Fatalf("%d small ranges cost %d GetObject calls, want far fewer", requests, fetches)
+	}
+}
+
+func TestSeekFetchesOnlyTheRange(t *testing.T) {
+	useReadAhead(t, 64<<10)
+	data := bytes.Repeat([]byte("x"), 256<<10)
+	client := newFakeB2(t, map[string][]byte{"track.mp3": data})
+	useSizedListing(t, client)
+
+	proxyRange(client, "track.mp3", 100<<10, 101<<10)
+	if client.fetchCount(fmt.Sprintf("bytes=%d-%d", 100<<10, 101<<10-1)) != 1 {
+		t.Fatalf("fetches %q, want a seek to read just its range", client.fetches)
+	}
+}
+
+func TestReadAheadDisabled(t *testing.T) {
+	useReadAhead(t, 0)
+	data := bytes.Repeat([]byte("x"), 8<<10)
+	client := newFakeB2(t, map[string][]byte{"track.mp3": data})
+	useSizedListing(t, client)
+
+	for start := int64(0); start < 8<<10; start += 1 << 10 {
+		proxyRange(client, "track.mp3", start, start+1<<10)
+	}
+	if len(client.fetches) != 8 {
+		t.Fatalf("%d fetches, want every range proxied", len(client.fetches))
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func getRecent(t *testing.T, target string) []play {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	recentHandler(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("%s: status %d: %s", target, rec.Code, rec.Body)
+	}
+	var plays []play
+	if err := json.NewDecoder(rec.Body).Decode(&plays); err != nil {
+		t.Fatal(err)
+	}
+	return plays
+}
+
+func TestRecentNewestFirst(t *testing.T) {
+	st := useStation(t, modeRandom)
+	for _, name := range []string{"a.mp3", "b.mp3", "c.mp3"} {
+		st.recordPlay(name)
+	}
+
+	plays := getRecent(t, "/recent?limit=2")
+	if len(plays) != 2 || plays[0].File != "c.mp3" || plays[1].File != "b.mp3" {
+		t.Fatalf("got %+v, want c.mp3 then b.mp3", plays)
+	}
+	if plays[0].At.Before(plays[1].At) {
+		t.Fatal("timestamps out of order")
+	}
+	if plays := getRecent(t, "/recent"); len(plays) != 3 {
+		t.Fatalf("got %d plays, want all 3 under the default limit", len(plays))
+	}
+}
+
+func TestRecentIsCapped(t *testing.T) {
+	st := useStation(t, modeRandom)
+	for i := range stationHistorySize + 10 {
+		st.recordPlay(fmt.Sprintf("%03d.mp3", i))
+	}
+
+	plays := getRecent(t, "/recent?limit=1000")
+	if len(plays) != stationHistorySize {
+		t.Fatalf("got %d plays, want the history capped at %d", len(plays), stationHistorySize)
+	}
+	if newest, oldest := plays[0].File, plays[len(plays)-1].File; newest != fmt.Sprintf("%03d.mp3", stationHistorySize+9) || oldest != "010.mp3" {
+		t.Fatalf("history runs %s to %s, want the oldest plays dropped", newest, oldest)
+	}
+}
+
+func TestRecentInvalidLimit(t *testing.T) {
+	useStation(t, modeRandom)
+	for _, limit := range []string{"0", "-1", "many"} {
+		rec := httptest.NewRecorder()
+		recentHandler(rec, httptest.NewRequest(http.MethodGet, "/recent?limit="+limit, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("limit %s: status %d, want 400", limit, rec.Code)
+		}
+	}
+}
+
+func TestStreamRecordsPlaysFromStart(t *testing.T) {
+	t.Chdir(t.TempDir())
+	stub := newS3Stub(t, map[string][]byte{"a.mp3": []byte("audio"), "b.mp3": []byte("audio"), "c.mp3": []byte("audio")})
+	stub.useEnv(t)
+	useSizedListing(t, newFakeB2(t, stub.objects))
+	useStation(t, modeRandom)
+
+	for file, rangeHeader := range map[string]string{
+		"a.mp3": "",
+		"b.mp3": "bytes=0-",
+		"c.mp3": "bytes=2-",
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/stream?file="+file, nil)
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		rec := httptest.NewRecorder()
+		newStreamHandler(t).stream(rec, req)
+		if rec.Code >= http.StatusBadRequest {
+			t.Fatalf("%s: status %d", file, rec.Code)
+		}
+	}
+
+	played := map[string]bool{}
+	for _, p := range getRecent(t, "/recent") {
+		played[p.File] = true
+	}
+	if !played["a.mp3"] || !played["b.mp3"] || played["c.mp3"] || len(played) != 2 {
+		t.Fatalf("recorded %v, want plays started without a Range or from byte 0 only", played)
+	}
+}
+
+func TestStartsPlay(t *testing.T) {
+	for header, want := range map[string]bool{
+		"":             true,
+		"bytes=0-":     true,
+		"bytes=0-1023": true,
+		" bytes= 0-":   true,
+		"bytes=1024-":  false,
+		"bytes=-500":   false,
+		"items=0-":     false,
+	} {
+		if got := startsPlay(header); got != want {
+			t.Errorf("%q: got %t, want %t", header, got, want)
+		}
+	}
+}
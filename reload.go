@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/joho/godotenv"
+)
+
+// Config file re-read by /admin/reload, set from CONFIG_FILE
+var configFile = ".env"
+
+// Guards the settings /admin/reload can swap while requests read them
+var liveMu sync.RWMutex
+
+func currentCacheMaxBytes() int64 {
+	liveMu.RLock()
+	defer liveMu.RUnlock()
+	return cacheMaxBytes
+}
+
+func currentExcludedMetadata() map[string]string {
+	liveMu.RLock()
+	defer liveMu.RUnlock()
+	return excludedMetadata
+}
+
+// Settings that can change without a restart
+type reloadableConfig struct {
+	rotation           []prefixWeight
+	excludedMetadata   map[string]string
+	cacheMaxBytes      int64
+	memoryCacheBytes   int64
+	memoryCacheMaxFile int64
+}
+
+// Parse the reloadable settings from the config file. Keys missing from the
+// file keep the value the process was started with.
+func loadReloadableConfig(path string) (reloadableConfig, error) {
+	values, err := godotenv.Read(path)
+	if err != nil {
+		return reloadableConfig{}, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	get := func(name string) string {
+		if value, ok := values[name]; ok {
+			return value
+		}
+		return os.Getenv(name)
+	}
+	getInt := func(name string, fallback int64) (int64, error) {
+		value := get(name)
+		if value == "" {
+			return fallback, nil
+		}
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid %s: %w", name, err)
+		}
+		return parsed, nil
+	}
+
+	var cfg reloadableConfig
+
+	rotationWeights := get("ROTATION_WEIGHTS")
+	if path := get("ROTATION_WEIGHTS_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return reloadableConfig{}, fmt.Errorf("failed to read ROTATION_WEIGHTS_FILE: %w", err)
+		}
+		rotationWeights = string(data)
+	}
+	if cfg.rotation, err = parseRotationWeights(rotationWeights); err != nil {
+		return reloadableConfig{}, fmt.Errorf("invalid rotation weights: %w", err)
+	}
+	for _, st := range stations.all() {
+		if st.selector.mode == modeRotation && len(cfg.rotation) == 0 {
+			return reloadableConfig{}, fmt.Errorf("station %s uses rotation mode but no weights are set", st.name)
+		}
+	}
+
+	if cfg.excludedMetadata, err = parseMetadataRules(get("EXCLUDE_METADATA")); err != nil {
+		return reloadableConfig{}, fmt.Errorf("invalid EXCLUDE_METADATA: %w", err)
+	}
+
+	if cfg.cacheMaxBytes, err = getInt("CACHE_MAX_BYTES", 0); err != nil {
+		return reloadableConfig{}, err
+	}
+	if cfg.memoryCacheBytes, err = getInt("MEMORY_CACHE_BYTES", 0); err != nil {
+		return reloadableConfig{}, err
+	}
+	if cfg.memoryCacheMaxFile, err = getInt("MEMORY_CACHE_MAX_FILE", defaultMemoryCacheMaxFile); err != nil {
+		return reloadableConfig{}, err
+	}
+	if cfg.cacheMaxBytes < 0 || cfg.memoryCacheBytes < 0 || cfg.memoryCacheMaxFile < 0 {
+		return reloadableConfig{}, fmt.Errorf("cache limits must not be negative")
+	}
+
+	return cfg, nil
+}
+
+func (cfg reloadableConfig) apply() {
+	liveMu.Lock()
+	cacheMaxBytes = cfg.cacheMaxBytes
+	excludedMetadata = cfg.excludedMetadata
+	liveMu.Unlock()
+
+	for _, st := range stations.all() {
+		st.selector.setRotation(cfg.rotation)
+	}
+	memCache.setLimits(cfg.memoryCacheBytes, cfg.memoryCacheMaxFile)
+
+	// A smaller limit takes effect now rather than on the next download
+	enforceCacheLimit("")
+}
+
+// Re-read the config file and swap in its settings. Streams in progress are
+// unaffected; invalid config is rejected and the running config kept.
+func reloadConfig(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cfg, err := loadReloadableConfig(configFile)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Config rejected: %v", err), http.StatusBadRequest)
+		log.Printf("Rejected config reload, keeping current config: %v", err)
+		return
+	}
+
+	cfg.apply()
+	log.Printf("Reloaded config from %s", configFile)
+	writeJSON(w, map[string]string{"status": "reloaded"})
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Point /admin/reload at a temp config file and restore every setting it
+// can change
+func useConfigFile(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "radio.env")
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	previousFile, previousMax, previousRules, previousMem := configFile, cacheMaxBytes, excludedMetadata, memCache
+	t.Cleanup(func() {
+		configFile, cacheMaxBytes, excludedMetadata, memCache = previousFile, previousMax, previousRules, previousMem
+	})
+	configFile = path
+	memCache = newMemoryCache(1<<20, 1<<20)
+	return path
+}
+
+func reload(t *testing.T) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	reloadConfig(rec, httptest.NewRequest(http.MethodPost, "/admin/reload", nil))
+	return rec
+}
+
+func useRotationStation(t *testing.T, rotation []prefixWeight) *station {
+	t.Helper()
+	previous := stations
+	t.Cleanup(func() { stations = previous })
+
+	stations = &stationRegistry{stations: map[string]*station{}}
+	if err := stations.add(defaultStationName, "", selectorConfig{mode: modeRotation, seed: 1, rotation: rotation}); err != nil {
+		t.Fatal(err)
+	}
+	st, _ := stations.get(defaultStationName)
+	return st
+}
+
+func TestReloadSwapsLiveSettings(t *testing.T) {
+	t.Chdir(t.TempDir())
+	st := useRotationStation(t, []prefixWeight{{"ambient/", 1}})
+	path := useConfigFile(t, "ROTATION_WEIGHTS=ambient/=70,jazz/=30\nEXCLUDE_METADATA=explicit=true\nCACHE_MAX_BYTES=5000\nMEMORY_CACHE_BYTES=10\n")
+	memCache.add("big", make([]byte, 100), time.Now())
+
+	if rec := reload(t); rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+
+	if want := []prefixWeight{{"ambient/", 70}, {"jazz/", 30}}; !reflect.DeepEqual(st.selector.rotation, want) {
+		t.Fatalf("rotation %v, want %v", st.selector.rotation, want)
+	}
+	if currentCacheMaxBytes() != 5000 {
+		t.Fatalf("cache limit %d, want 5000", currentCacheMaxBytes())
+	}
+	if rules := currentExcludedMetadata(); rules["explicit"] != "true" {
+		t.Fatalf("exclusions %v", rules)
+	}
+	if _, ok := memCache.get("big"); ok {
+		t.Fatal("an entry over the new memory limit wasn't evicted")
+	}
+
+	// The file is re-read each time, the environment isn't
+	os.WriteFile(path, []byte("ROTATION_WEIGHTS=jazz/=1\n"), 0644)
+	if rec := reload(t); rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if want := []prefixWeight{{"jazz/", 1}}; !reflect.DeepEqual(st.selector.rotation, want) {
+		t.Fatalf("rotation %v, want %v", st.selector.rotation, want)
+	}
+}
+
+func TestReloadRejectsInvalidConfig(t *testing.T) {
+	t.Chdir(t.TempDir())
+	st := useRotationStation(t, []prefixWeight{{"ambient/", 1}})
+
+	for _, contents := range []string{
+		"ROTATION_WEIGHTS=ambient/=lots\nCACHE_MAX_BYTES=5000\n",
+		"CACHE_MAX_BYTES=-1\n",
+		"CACHE_MAX_BYTES=5000\nEXCLUDE_METADATA=novalue\n",
+		// Rotation mode can't be left without weights
+		"ROTATION_WEIGHTS=\n",
+	} {
+		useConfigFile(t, contents)
+		cacheMaxBytes = 123
+
+		if rec := reload(t); rec.Code != http.StatusBadRequest {
+			t.Errorf("%q: status %d, want 400", contents, rec.Code)
+		}
+		if currentCacheMaxBytes() != 123 || !reflect.DeepEqual(st.selector.rotation, []prefixWeight{{"ambient/", 1}}) {
+			t.Errorf("%q: a rejected reload changed the running config", contents)
+		}
+	}
+
+	configFile = filepath.Join(t.TempDir(), "missing.env")
+	if rec := reload(t); rec.Code != http.StatusBadRequest {
+		t.Fatalf("status %d for a missing file, want 400", rec.Code)
+	}
+}
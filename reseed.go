@@ -0,0 +1,54 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+)
+
+type reseedResult struct {
+	Station string `json:"station"`
+	selectorState
+}
+
+// Reset the selection state of ?station=, or of every station, so the whole
+// library is eligible again. ?seed=N also reseeds the RNG with N, and
+// ?seed=random with a fresh random seed.
+func reseed(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var seed *int64
+	switch value := req.URL.Query().Get("seed"); value {
+	case "":
+	case "random":
+		random := randomSeed()
+		seed = &random
+	default:
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid seed parameter", http.StatusBadRequest)
+			return
+		}
+		seed = &parsed
+	}
+
+	targets := stations.all()
+	if req.URL.Query().Get("station") != "" {
+		st, ok := stationFor(w, req)
+		if !ok {
+			return
+		}
+		targets = []*station{st}
+	}
+
+	results := make([]reseedResult, 0, len(targets))
+	for _, st := range targets {
+		results = append(results, reseedResult{Station: st.name, selectorState: st.selector.reset(seed)})
+		log.Printf("Reset selection state of station %s", st.name)
+	}
+	writeJSON(w, results)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReseedMakesPlayedTracksEligible(t *testing.T) {
+	useListing(t, []string{"a.mp3", "b.mp3", "c.mp3"})
+	st := useStation(t, modeSequential)
+	files := []string{"a.mp3", "b.mp3", "c.mp3"}
+
+	for _, want := range []string{"a.mp3", "b.mp3"} {
+		if got, _ := st.selector.selectFile(files); got != want {
+			t.Fatalf("picked %s, want %s", got, want)
+		}
+	}
+	if _, err := st.selector.peek(files, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	reseed(rec, httptest.NewRequest(http.MethodPost, "/reseed?station="+defaultStationName, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var results []reseedResult
+	if err := json.NewDecoder(rec.Body).Decode(&results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Station != defaultStationName || results[0].Upcoming != 0 || results[0].Position != "" || results[0].Reseeded {
+		t.Fatalf("got %+v", results)
+	}
+
+	// The queued c.mp3 and a.mp3 are gone, and the play starts over
+	if got, _ := st.selector.selectFile(files); got != "a.mp3" {
+		t.Fatalf("picked %s after reseeding, want a.mp3 again", got)
+	}
+}
+
+func TestReseedWithSeedRepeatsSequence(t *testing.T) {
+	st := useStation(t, modeRandom)
+	files := []string{"a.mp3", "b.mp3", "c.mp3", "d.mp3", "e.mp3"}
+	fresh, err := newTrackSelector(selectorConfig{mode: modeRandom, seed: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	reseed(rec, httptest.NewRequest(http.MethodPost, "/reseed?seed=7", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	for range 10 {
+		got, _ := st.selector.selectFile(files)
+		want, _ := fresh.selectFile(files)
+		if got != want {
+			t.Fatalf("picked %s, want %s as with a fresh selector seeded 7", got, want)
+		}
+	}
+}
+
+func TestReseedRejects(t *testing.T) {
+	useStation(t, modeRandom)
+	for target, want := range map[string]int{
+		"/reseed?seed=abc":     http.StatusBadRequest,
+		"/reseed?station=nope": http.StatusNotFound,
+	} {
+		rec := httptest.NewRecorder()
+		reseed(rec, httptest.NewRequest(http.MethodPost, target, nil))
+		if rec.Code != want {
+			t.Errorf("%s: status %d, want %d", target, rec.Code, want)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	reseed(rec, httptest.NewRequest(http.MethodGet, "/reseed", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("GET: status %d, want 405", rec.Code)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Lists its files but fails every download, as B2 does for keys deleted
+// since the listing
+type missingB2 struct {
+	*fakeB2
+}
+
+func (m missingB2) downloadFile(fileName string) (string, error) {
+	return "", fmt.Errorf("failed to get object: %w", errNotFound)
+}
+
+func useReselections(t *testing.T, limit int) {
+	previous := maxRadioReselections
+	t.Cleanup(func() { maxRadioReselections = previous })
+	maxRadioReselections = limit
+}
+
+func TestExhaustedReselectionsAreCappedAndCounted(t *testing.T) {
+	useReselections(t, 4)
+	useQuarantine(t, 0, 0)
+	useListing(t, []string{"a.mp3", "b.mp3"})
+	st := useStation(t, modeRandom)
+
+	tests := []struct {
+		name    string
+		client  B2
+		counter func() int64
+	}{
+		{"download error", newFakeB2(t, nil), metrics.reselectDownloadError.Load},
+		{"not found", missingB2{newFakeB2(t, nil)}, metrics.reselectNotFound.Load},
+	}
+	for _, tt := range tests {
+		before, exhausted := tt.counter(), metrics.reselectExhausted.Load()
+		track := selectRadioTrack(context.Background(), st, tt.client, "")
+		if !errors.Is(track.err, errReselectionsExhausted) || !strings.Contains(track.err.Error(), "after 4 attempts") {
+			t.Fatalf("%s: got %v, want the capped error", tt.name, track.err)
+		}
+		if got := tt.counter() - before; got != 4 {
+			t.Errorf("%s: counted %d reselections, want 4", tt.name, got)
+		}
+		if got := metrics.reselectExhausted.Load() - exhausted; got != 1 {
+			t.Errorf("%s: counted %d exhausted selections, want 1", tt.name, got)
+		}
+	}
+}
+
+func TestQuarantinedReselectionsAreCounted(t *testing.T) {
+	useReselections(t, 2)
+	useQuarantine(t, 1, time.Hour)
+	useListing(t, []string{"a.mp3", "b.mp3"})
+	st := useStation(t, modeSequential)
+
+	before := metrics.reselectQuarantined.Load()
+	if track := selectRadioTrack(context.Background(), st, newFakeB2(t, nil), ""); !errors.Is(track.err, errReselectionsExhausted) {
+		t.Fatalf("got %v, want the capped error", track.err)
+	}
+	if got := metrics.reselectQuarantined.Load() - before; got != 2 {
+		t.Fatalf("counted %d quarantined reselections, want 2", got)
+	}
+
+	rec := httptest.NewRecorder()
+	metricsHandler(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if want := fmt.Sprintf(`radio_reselections_total{reason="quarantined"} %d`, metrics.reselectQuarantined.Load()); !strings.Contains(rec.Body.String(), want) {
+		t.Fatalf("metrics lack %q", want)
+	}
+}
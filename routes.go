@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+const (
+	trailingSlashRedirect = "redirect"
+	trailingSlashStrip    = "strip"
+	trailingSlashOff      = "off"
+)
+
+// What to do with a trailing slash on an endpoint path like /stream/, set
+// from TRAILING_SLASH. "redirect" sends the client to the canonical path,
+// "strip" serves it as if the slash weren't there, and "off" leaves it to
+// the static file server, which answers 404.
+var trailingSlash = trailingSlashRedirect
+
+// Route endpoint paths with a trailing slash to the endpoint rather than the
+// static files. Paths that only exist with the slash, like /hls/, and real
+// static directories are left alone.
+func normalizeSlashes(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		path := req.URL.Path
+		if trailingSlash == trailingSlashOff || path == "/" || !strings.HasSuffix(path, "/") {
+			mux.ServeHTTP(w, req)
+			return
+		}
+		if _, pattern := mux.Handler(req); pattern != "/" {
+			// Already an endpoint of its own
+			mux.ServeHTTP(w, req)
+			return
+		}
+
+		trimmed := req.Clone(req.Context())
+		trimmed.URL.Path = strings.TrimRight(path, "/")
+		trimmed.URL.RawPath = ""
+		trimmed.RequestURI = trimmed.URL.RequestURI()
+		if _, pattern := mux.Handler(trimmed); pattern == "/" {
+			mux.ServeHTTP(w, req)
+			return
+		}
+
+		if trailingSlash == trailingSlashStrip {
+			mux.ServeHTTP(w, trimmed)
+			return
+		}
+		// 308 so that POSTs to admin endpoints keep their method and body
+		http.Redirect(w, req, trimmed.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
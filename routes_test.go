@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func useTrailingSlash(t *testing.T, mode string) {
+	previous := trailingSlash
+	t.Cleanup(func() { trailingSlash = previous })
+	trailingSlash = mode
+}
+
+// A mux laid out like main's: static files at /, endpoints beside them
+func testRoutes(t *testing.T) http.Handler {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "index.html"), []byte("<h1>Radio</h1>"), 0o644)
+	os.Mkdir(filepath.Join(dir, "albums"), 0o755)
+	os.WriteFile(filepath.Join(dir, "albums", "index.html"), []byte("albums"), 0o644)
+
+	endpoint := func(name string) http.HandlerFunc {
+		return func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte(name + " " + req.URL.RawQuery))
+		}
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", staticHandler(dir))
+	mux.HandleFunc("/stream", endpoint("stream"))
+	mux.HandleFunc("/hls/", endpoint("hls"))
+	return normalizeSlashes(mux)
+}
+
+func TestTrailingSlashRedirects(t *testing.T) {
+	useTrailingSlash(t, trailingSlashRedirect)
+	routes := testRoutes(t)
+
+	for target, want := range map[string]string{
+		"/stream/?file=a.mp3": "/stream?file=a.mp3",
+		"/stream//":           "/stream",
+	} {
+		rec := httptest.NewRecorder()
+		routes.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, target, nil))
+		if rec.Code != http.StatusPermanentRedirect || rec.Header().Get("Location") != want {
+			t.Errorf("%s: status %d to %q, want 308 to %q", target, rec.Code, rec.Header().Get("Location"), want)
+		}
+	}
+}
+
+func TestTrailingSlashStripped(t *testing.T) {
+	useTrailingSlash(t, trailingSlashStrip)
+	rec := httptest.NewRecorder()
+	testRoutes(t).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stream/?file=a.mp3", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "stream file=a.mp3" {
+		t.Fatalf("status %d body %q, want the endpoint served in place", rec.Code, rec.Body)
+	}
+}
+
+func TestTrailingSlashOff(t *testing.T) {
+	useTrailingSlash(t, trailingSlashOff)
+	rec := httptest.NewRecorder()
+	testRoutes(t).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stream/", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("status %d, want the static server's 404", rec.Code)
+	}
+}
+
+func TestSlashedPathsLeftAlone(t *testing.T) {
+	useTrailingSlash(t, trailingSlashRedirect)
+	routes := testRoutes(t)
+
+	for target, want := range map[string]string{
+		"/":           "<h1>Radio</h1>",
+		"/albums/":    "albums",
+		"/hls/a.m3u8": "hls ",
+	} {
+		rec := httptest.NewRecorder()
+		routes.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != http.StatusOK || rec.Body.String() != want {
+			t.Errorf("%s: status %d body %q, want %q", target, rec.Code, rec.Body, want)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	routes.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/missing/", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("unknown path: status %d, want 404 rather than a redirect", rec.Code)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+)
+
+const defaultScheduleRecent = 10
+
+// A station's timeline: what played, what's on and what the selector will
+// play next, for a UI to render from one request
+type schedule struct {
+	Station  string   `json:"station"`
+	Recent   []play   `json:"recent"` // newest first, without the current track
+	Current  *play    `json:"current"`
+	Upcoming []string `json:"upcoming"`
+}
+
+// Snapshot the schedule under the station's lock, so a play recorded
+// meanwhile can't leave recent, current and upcoming out of step. Upcoming
+// comes from the selector's queue, the same picks /queue reports.
+func (s *station) schedule(files []string, recentLimit, upcomingLength int) schedule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sched := schedule{Station: s.name, Recent: []play{}, Upcoming: []string{}}
+	history := s.history
+	if len(history) > 0 && history[len(history)-1].File == s.nowPlaying {
+		current := history[len(history)-1]
+		sched.Current = &current
+		history = history[:len(history)-1]
+	}
+	for i := len(history) - 1; i >= 0 && len(sched.Recent) < recentLimit; i-- {
+		sched.Recent = append(sched.Recent, history[i])
+	}
+
+	if upcoming, err := s.selector.peek(files, upcomingLength); err == nil {
+		sched.Upcoming = append(sched.Upcoming, upcoming...)
+	}
+	return sched
+}
+
+// Recent, current and upcoming tracks of ?station= in one document. It reads
+// the cached listing rather than refreshing it, so polling it is cheap.
+func scheduleHandler(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	recentLimit := defaultScheduleRecent
+	if value := query.Get("recent"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			http.Error(w, "Invalid recent parameter", http.StatusBadRequest)
+			return
+		}
+		recentLimit = min(parsed, stationHistorySize)
+	}
+	upcomingLength := defaultQueueLength
+	if value := query.Get("upcoming"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			http.Error(w, "Invalid upcoming parameter", http.StatusBadRequest)
+			return
+		}
+		upcomingLength = min(parsed, maxQueueLength)
+	}
+
+	st, ok := stationFor(w, req)
+	if !ok {
+		return
+	}
+
+	b2Client, err := b2ClientFromEnv()
+	if err != nil {
+		http.Error(w, "Failed to create B2 client", http.StatusInternalServerError)
+		log.Printf("Failed to create B2 client: %v", err)
+		return
+	}
+
+	files, err := st.candidates(b2Client)
+	if err != nil {
+		b2Error(w, "Failed to list files", err)
+		log.Printf("Failed to list files: %v", err)
+		return
+	}
+
+	writeJSON(w, st.schedule(files, recentLimit, upcomingLength))
+}
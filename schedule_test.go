@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func getSchedule(t *testing.T, target string) schedule {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	scheduleHandler(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("%s: status %d: %s", target, rec.Code, rec.Body)
+	}
+	var sched schedule
+	if err := json.NewDecoder(rec.Body).Decode(&sched); err != nil {
+		t.Fatal(err)
+	}
+	return sched
+}
+
+func TestScheduleSectionsLineUp(t *testing.T) {
+	setB2Env(t)
+	files := []string{"a.mp3", "b.mp3", "c.mp3", "d.mp3", "e.mp3", "f.mp3"}
+	useListing(t, files)
+	st := useStation(t, modeSequential)
+
+	// Three tracks play, the last of them still on
+	for range 3 {
+		name, err := st.selector.selectFile(files)
+		if err != nil {
+			t.Fatal(err)
+		}
+		st.recordPlay(name)
+	}
+
+	sched := getSchedule(t, "/schedule?recent=5&upcoming=2")
+	if sched.Station != defaultStationName || sched.Current == nil || sched.Current.File != "c.mp3" {
+		t.Fatalf("got %+v, want c.mp3 playing on the default station", sched)
+	}
+	var recent []string
+	for _, p := range sched.Recent {
+		recent = append(recent, p.File)
+	}
+	if !slices.Equal(recent, []string{"b.mp3", "a.mp3"}) {
+		t.Fatalf("recent %q, want the earlier plays newest first without the current one", recent)
+	}
+	if !slices.Equal(sched.Upcoming, []string{"d.mp3", "e.mp3"}) {
+		t.Fatalf("upcoming %q, want the next two picks", sched.Upcoming)
+	}
+
+	// The schedule only peeks: the next pick is what it promised
+	if next, _ := st.selector.selectFile(files); next != sched.Upcoming[0] {
+		t.Fatalf("picked %s, but the schedule promised %s", next, sched.Upcoming[0])
+	}
+}
+
+func TestScheduleBeforeAnyPlay(t *testing.T) {
+	setB2Env(t)
+	useListing(t, []string{"a.mp3", "b.mp3"})
+	useStation(t, modeSequential)
+
+	sched := getSchedule(t, "/schedule?upcoming=2")
+	if sched.Current != nil || len(sched.Recent) != 0 || !slices.Equal(sched.Upcoming, []string{"a.mp3", "b.mp3"}) {
+		t.Fatalf("got %+v, want nothing played and the listing upcoming", sched)
+	}
+}
+
+func TestScheduleInvalidParams(t *testing.T) {
+	useStation(t, modeSequential)
+	for _, query := range []string{"recent=-1", "upcoming=many"} {
+		rec := httptest.NewRecorder()
+		scheduleHandler(rec, httptest.NewRequest(http.MethodGet, "/schedule?"+query, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", query, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultSearchLimit = 50
+	maxSearchLimit     = 500
+
+	// Go's regexp engine runs in linear time, so capping the pattern length
+	// is enough to keep a hostile query cheap
+	maxSearchPatternLength = 256
+)
+
+type searchResponse struct {
+	Query     string   `json:"query"`
+	Results   []string `json:"results"`
+	Truncated bool     `json:"truncated"`
+}
+
+func search(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query().Get("q")
+	if query == "" {
+		http.Error(w, "Missing q parameter", http.StatusBadRequest)
+		return
+	}
+	if len(query) > maxSearchPatternLength {
+		http.Error(w, "Query too long", http.StatusBadRequest)
+		return
+	}
+
+	limit := defaultSearchLimit
+	if value := req.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "Invalid limit parameter", http.StatusBadRequest)
+			return
+		}
+		limit = min(parsed, maxSearchLimit)
+	}
+
+	var match func(string) bool
+	if req.URL.Query().Get("regex") == "true" {
+		pattern, err := regexp.Compile("(?i)" + query)
+		if err != nil {
+			http.Error(w, "Invalid regular expression", http.StatusBadRequest)
+			return
+		}
+		match = pattern.MatchString
+	} else {
+		needle := strings.ToLower(query)
+		match = func(name string) bool {
+			return strings.Contains(strings.ToLower(name), needle)
+		}
+	}
+
+	b2Client, err := b2ClientFromEnv()
+	if err != nil {
+		http.Error(w, "Failed to create B2 client", http.StatusInternalServerError)
+		log.Printf("Failed to create B2 client: %v", err)
+		return
+	}
+
+	listing.refreshFor(req)
+	files, err := listing.get(b2Client)
+	if err != nil {
+		b2Error(w, "Failed to list files", err)
+		log.Printf("Failed to list files: %v", err)
+		return
+	}
+
+	response := searchResponse{Query: query, Results: []string{}}
+	for _, name := range files {
+		if !isAudio(name) || !match(name) {
+			continue
+		}
+		if len(response.Results) == limit {
+			response.Truncated = true
+			break
+		}
+		response.Results = append(response.Results, name)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Failed to encode search results: %v", err)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"testing"
+)
+
+func TestSearch(t *testing.T) {
+	setB2Env(t)
+	useListing(t, []string{"Jazz/Blue Train.mp3", "jazz/So What.mp3", "rock/Paranoid.mp3", "rock/Blue Sky.ogg"})
+
+	tests := []struct {
+		name       string
+		query      url.Values
+		wantStatus int
+		want       []string
+	}{
+		{"substring", url.Values{"q": {"blue"}}, http.StatusOK, []string{"Jazz/Blue Train.mp3", "rock/Blue Sky.ogg"}},
+		{"substring case-insensitive", url.Values{"q": {"JAZZ/"}}, http.StatusOK, []string{"Jazz/Blue Train.mp3", "jazz/So What.mp3"}},
+		{"substring no match", url.Values{"q": {"polka"}}, http.StatusOK, []string{}},
+		{"regex", url.Values{"q": {`^rock/.*\.mp3$`}, "regex": {"true"}}, http.StatusOK, []string{"rock/Paranoid.mp3"}},
+		{"regex not used without flag", url.Values{"q": {`^rock/.*\.mp3$`}}, http.StatusOK, []string{}},
+		{"limit", url.Values{"q": {"."}, "limit": {"1"}}, http.StatusOK, []string{"Jazz/Blue Train.mp3"}},
+		{"invalid regex", url.Values{"q": {"(unclosed"}, "regex": {"true"}}, http.StatusBadRequest, nil},
+		{"missing query", url.Values{}, http.StatusBadRequest, nil},
+		{"invalid limit", url.Values{"q": {"a"}, "limit": {"zero"}}, http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			search(rec, httptest.NewRequest(http.MethodGet, "/search?"+tt.query.Encode(), nil))
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var response searchResponse
+			if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(response.Results, tt.want) {
+				t.Fatalf("results %q, want %q", response.Results, tt.want)
+			}
+		})
+	}
+}
+
+func TestSearchTruncated(t *testing.T) {
+	setB2Env(t)
+	useListing(t, []string{"a.mp3", "b.mp3", "c.mp3"})
+
+	rec := httptest.NewRecorder()
+	search(rec, httptest.NewRequest(http.MethodGet, "/search?q=mp3&limit=2", nil))
+
+	var response searchResponse
+	if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if !response.Truncated || len(response.Results) != 2 {
+		t.Fatalf("got %d results, truncated %t; want 2, truncated", len(response.Results), response.Truncated)
+	}
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	cryptorand "crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	modeRandom     = "random"
+	modeSequential = "sequential"
+	modeRecency    = "recency"
+	modeRotation   = "rotation"
+	modeLRU        = "lru"
+)
+
+const (
+	defaultRecencyHalfLife = 7 * 24 * time.Hour
+	defaultRecencyBoost    = 4
+	defaultNoRepeat        = 3
+)
+
+type selectorConfig struct {
+	station string
+	mode    string
+	prefix  string // sequential mode plays keys under this prefix
+
+	// A fixed seed (from RANDOM_SEED) makes the "random" order reproducible
+	// for a stable listing, which is handy for demos and tests
+	seed int64
+
+	// Recency mode weights a track 1 + boost*2^(-age/halfLife), so a fresh
+	// upload starts at 1+boost times the baseline and decays towards it
+	recencyHalfLife time.Duration
+	recencyBoost    float64
+
+	// Rotation mode first picks a prefix with probability proportional to
+	// its weight, then a track under it
+	rotation []prefixWeight
+
+	// Tracks picked within this long are passed over while others remain
+	cooldown time.Duration
+
+	// The last noRepeat picks are passed over, or all but one of the
+	// candidates when there are fewer
+	noRepeat int
+}
+
+type prefixWeight struct {
+	prefix string
+	weight float64
+}
+
+type trackSelector struct {
+	mu      sync.Mutex
+	station string // whose play times lru mode goes by
+	mode    string
+	prefix  string
+
+	recencyHalfLife time.Duration
+	recencyBoost    float64
+
+	rotation []prefixWeight
+
+	cooldown   time.Duration
+	lastPicked map[string]time.Time
+
+	noRepeat    int
+	recentPicks []string // newest last, at most noRepeat
+
+	// Last key picked in sequential mode, used as the play position so that
+	// uploads or deletions in the listing don't shift the order
+	lastFile string
+
+	// Picks made ahead of time by peek, handed out before making new ones
+	upcoming []string
+
+	rng *rand.Rand
+	now func() time.Time
+}
+
+// Seed from the system's secure source so unseeded stations differ per run
+func randomSeed() int64 {
+	var b [8]byte
+	if _, err := cryptorand.Read(b[:]); err != nil {
+		return time.Now().UnixNano()
+	}
+	return int64(binary.LittleEndian.Uint64(b[:]))
+}
+
+func newTrackSelector(cfg selectorConfig) (*trackSelector, error) {
+	switch cfg.mode {
+	case "":
+		cfg.mode = modeRandom
+	case modeRandom, modeSequential, modeRecency, modeLRU:
+	case modeRotation:
+		if len(cfg.rotation) == 0 {
+			return nil, errors.New("rotation mode needs at least one weighted prefix")
+		}
+	default:
+		return nil, fmt.Errorf("unknown selection mode: %s", cfg.mode)
+	}
+
+	if cfg.recencyHalfLife <= 0 {
+		cfg.recencyHalfLife = defaultRecencyHalfLife
+	}
+
+	return &trackSelector{
+		station:         cfg.station,
+		mode:            cfg.mode,
+		prefix:          cfg.prefix,
+		recencyHalfLife: cfg.recencyHalfLife,
+		recencyBoost:    cfg.recencyBoost,
+		rotation:        cfg.rotation,
+		cooldown:        cfg.cooldown,
+		lastPicked:      make(map[string]time.Time),
+		noRepeat:        cfg.noRepeat,
+		rng:             rand.New(rand.NewSource(cfg.seed)),
+		now:             time.Now,
+	}, nil
+}
+
+func (s *trackSelector) selectFile(fileNames []string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Queued picks that are no longer candidates (deleted, or filtered out by
+	// the caller) are dropped
+	s.pruneUpcoming(fileNames)
+	if len(s.upcoming) > 0 {
+		next := s.upcoming[0]
+		s.upcoming = s.upcoming[1:]
+		return next, nil
+	}
+
+	return s.pick(fileNames)
+}
+
+// Return the next n selections without consuming them
+func (s *trackSelector) peek(fileNames []string, n int) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pruneUpcoming(fileNames)
+	for len(s.upcoming) < n {
+		next, err := s.pick(fileNames)
+		if err != nil {
+			return nil, err
+		}
+		s.upcoming = append(s.upcoming, next)
+	}
+
+	return append([]string(nil), s.upcoming[:n]...), nil
+}
+
+// Selector state reported by /reseed
+type selectorState struct {
+	Mode     string `json:"mode"`
+	Position string `json:"position"`
+	Upcoming int    `json:"upcoming"`
+	Reseeded bool   `json:"reseeded"`
+}
+
+// Forget the play position, recent and queued picks, so every
+// candidate is eligible again, and reseed the RNG when seed is set
+func (s *trackSelector) reset(seed *int64) selectorState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastFile = ""
+	s.upcoming = nil
+	s.recentPicks = nil
+	clear(s.lastPicked)
+	if s.mode == modeLRU {
+		lastPlayed.reset(s.station)
+	}
+	if seed != nil {
+		s.rng = rand.New(rand.NewSource(*seed))
+	}
+	return selectorState{Mode: s.mode, Position: s.lastFile, Upcoming: len(s.upcoming), Reseeded: seed != nil}
+}
+
+func (s *trackSelector) pruneUpcoming(fileNames []string) {
+	if len(s.upcoming) == 0 {
+		return
+	}
+
+	listed := make(map[string]bool, len(fileNames))
+	for _, name := range fileNames {
+		listed[name] = true
+	}
+
+	kept := s.upcoming[:0]
+	for _, name := range s.upcoming {
+		if listed[name] {
+			kept = append(kept, name)
+		}
+	}
+	s.upcoming = kept
+}
+
+func (s *trackSelector) pick(fileNames []string) (string, error) {
+	if len(fileNames) == 0 {
+		return "", errNoFiles
+	}
+	if s.mode == modeSequential {
+		return s.pickFrom(fileNames)
+	}
+
+	// Rotation passes over recent picks within the prefix it draws, so that
+	// the prefix weights still hold
+	candidates := fileNames
+	if s.mode != modeRotation {
+		candidates = s.notRecent(fileNames)
+	}
+	if s.cooldown > 0 {
+		candidates = s.cooledDown(candidates)
+	}
+	next, err := s.pickFrom(candidates)
+	if err != nil {
+		return "", err
+	}
+
+	if s.cooldown > 0 {
+		s.lastPicked[next] = s.now()
+	}
+	if s.noRepeat > 0 {
+		s.recentPicks = append(s.recentPicks, next)
+		if len(s.recentPicks) > s.noRepeat {
+			s.recentPicks = s.recentPicks[len(s.recentPicks)-s.noRepeat:]
+		}
+	}
+	return next, nil
+}
+
+// Candidates other than the latest picks. A library no larger than
+// noRepeat only passes over as many picks as leaves one track, so a
+// two-track library alternates rather than repeating.
+func (s *trackSelector) notRecent(fileNames []string) []string {
+	skip := min(len(s.recentPicks), len(fileNames)-1)
+	if skip <= 0 {
+		return fileNames
+	}
+
+	recent := make(map[string]bool, skip)
+	for _, name := range s.recentPicks[len(s.recentPicks)-skip:] {
+		recent[name] = true
+	}
+	var eligible []string
+	for _, name := range fileNames {
+		if !recent[name] {
+			eligible = append(eligible, name)
+		}
+	}
+	if len(eligible) == 0 {
+		// Recent picks the listing no longer has left nothing over
+		return fileNames
+	}
+	return eligible
+}
+
+// Candidates not picked within the cooldown. When every one of them was,
+// the library is too small for it, so the track picked longest ago is the
+// only candidate.
+func (s *trackSelector) cooledDown(fileNames []string) []string {
+	now := s.now()
+	var eligible []string
+	oldest, oldestAt := "", now
+	for _, name := range fileNames {
+		pickedAt, ok := s.lastPicked[name]
+		if !ok || now.Sub(pickedAt) >= s.cooldown {
+			eligible = append(eligible, name)
+			continue
+		}
+		if pickedAt.Before(oldestAt) || oldest == "" {
+			oldest, oldestAt = name, pickedAt
+		}
+	}
+
+	// Entries past the cooldown no longer matter
+	for name, pickedAt := range s.lastPicked {
+		if now.Sub(pickedAt) >= s.cooldown {
+			delete(s.lastPicked, name)
+		}
+	}
+
+	if len(eligible) == 0 {
+		return []string{oldest}
+	}
+	return eligible
+}
+
+func (s *trackSelector) pickFrom(fileNames []string) (string, error) {
+	switch s.mode {
+	case modeSequential:
+		return s.nextSequential(fileNames)
+	case modeRecency:
+		return s.weightedPick(fileNames, s.recencyWeight(listing.modTimes()))
+	case modeRotation:
+		return s.nextRotation(fileNames)
+	case modeLRU:
+		return s.nextLeastRecent(fileNames)
+	}
+
+	return fileNames[s.rng.Intn(len(fileNames))], nil
+}
+
+// Pick with probability proportional to weight
+func (s *trackSelector) weightedPick(fileNames []string, weight func(string) float64) (string, error) {
+	weights := make([]float64, len(fileNames))
+	var total float64
+	for i, name := range fileNames {
+		weights[i] = max(weight(name), 0)
+		total += weights[i]
+	}
+	if total == 0 {
+		return fileNames[s.rng.Intn(len(fileNames))], nil
+	}
+
+	target := s.rng.Float64() * total
+	for i, w := range weights {
+		if target < w {
+			return fileNames[i], nil
+		}
+		target -= w
+	}
+	return fileNames[len(fileNames)-1], nil
+}
+
+func (s *trackSelector) recencyWeight(modTimes map[string]time.Time) func(string) float64 {
+	now := s.now()
+	return func(name string) float64 {
+		modified, ok := modTimes[name]
+		if !ok {
+			return 1
+		}
+
+		age := max(now.Sub(modified), 0)
+		return 1 + s.recencyBoost*math.Exp2(-float64(age)/float64(s.recencyHalfLife))
+	}
+}
+
+func (s *trackSelector) nextSequential(fileNames []string) (string, error) {
+	var candidates []string
+	for _, name := range fileNames {
+		if strings.HasPrefix(name, s.prefix) {
+			candidates = append(candidates, name)
+		}
+	}
+	if len(candidates) == 0 {
+		return "", errNoFiles
+	}
+	sort.Strings(candidates)
+
+	// Pick the first key after the current position, wrapping at the end
+	next := candidates[0]
+	for _, name := range candidates {
+		if name > s.lastFile {
+			next = name
+			break
+		}
+	}
+
+	s.lastFile = next
+	return next, nil
+}
+
+func (s *trackSelector) nextRotation(fileNames []string) (string, error) {
+	// Prefixes without any candidates drop out and the rest share their weight
+	tracks := make([][]string, len(s.rotation))
+	var total float64
+	for i, rotation := range s.rotation {
+		for _, name := range fileNames {
+			if strings.HasPrefix(name, rotation.prefix) {
+				tracks[i] = append(tracks[i], name)
+			}
+		}
+		if len(tracks[i]) > 0 {
+			total += rotation.weight
+		}
+	}
+	if total == 0 {
+		return "", fmt.Errorf("%w under the rotation prefixes", errNoFiles)
+	}
+
+	chosen := tracks[len(tracks)-1]
+	target := s.rng.Float64() * total
+	for i, rotation := range s.rotation {
+		if len(tracks[i]) == 0 {
+			continue
+		}
+		chosen = tracks[i]
+		if target < rotation.weight {
+			break
+		}
+		target -= rotation.weight
+	}
+
+	// Don't play the same track twice in a row when the prefix has others
+	chosen = s.notRecent(chosen)
+	next := chosen[s.rng.Intn(len(chosen))]
+	if next == s.lastFile && len(chosen) > 1 {
+		next = chosen[(slices.Index(chosen, next)+1+s.rng.Intn(len(chosen)-1))%len(chosen)]
+	}
+
+	s.lastFile = next
+	return next, nil
+}
+
+func (s *trackSelector) setRotation(rotation []prefixWeight) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rotation = rotation
+}
+
+// Parse ROTATION_WEIGHTS, prefix=weight pairs separated by commas or newlines
+func parseRotationWeights(value string) ([]prefixWeight, error) {
+	var weights []prefixWeight
+	for _, entry := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == '\n' }) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+
+		prefix, weightText, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid rotation entry %q, expected prefix=weight", entry)
+		}
+		weight, err := strconv.ParseFloat(strings.TrimSpace(weightText), 64)
+		if err != nil || weight <= 0 || math.IsInf(weight, 0) {
+			return nil, fmt.Errorf("invalid weight in rotation entry %q", entry)
+		}
+		weights = append(weights, prefixWeight{prefix: strings.TrimSpace(prefix), weight: weight})
+	}
+	return weights, nil
+}
+
+// Files smaller than minFileSize are almost always artifacts rather than
+// tracks, so they're never selected. Set from MIN_FILE_SIZE; with
+// MIN_FILE_SIZE_STRICT, requests naming one get 404 as well.
+var (
+	minFileSize       int64
+	minFileSizeStrict bool
+)
+
+// Whether a request for a file should be refused for its size, going by the
+// last listing. Files missing from it are let through.
+func rejectedForSize(fileName string) bool {
+	if !minFileSizeStrict || minFileSize <= 0 {
+		return false
+	}
+	object, ok := listing.lookup(fileName)
+	return ok && object.Size < minFileSize
+}
+
+// Listing filtered down to files eligible for selection
+func selectionCandidates(b2Client B2) ([]string, error) {
+	objects, err := listing.getObjects(b2Client)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]string, 0, len(objects))
+	for _, object := range objects {
+		if object.Size >= minFileSize {
+			files = append(files, object.Key)
+		}
+	}
+
+	files = filterAudio(files)
+	files = filterVariants(files)
+	files = filterAllowed(files)
+	files = filterByMetadata(b2Client, objects, files)
+	return quarantined.filter(files), nil
+}
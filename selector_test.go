@@ -0,0 +1,320 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSequentialOrderAndWraparound(t *testing.T) {
+	sel, err := newTrackSelector(selectorConfig{mode: modeSequential, prefix: "album/", seed: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := []string{"album/02.mp3", "other/01.mp3", "album/01.mp3", "album/03.mp3"}
+	want := []string{"album/01.mp3", "album/02.mp3", "album/03.mp3", "album/01.mp3", "album/02.mp3"}
+	for i, expected := range want {
+		got, err := sel.selectFile(files)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != expected {
+			t.Fatalf("pick %d: got %s, want %s", i, got, expected)
+		}
+	}
+}
+
+func TestSequentialKeepsPositionWhenListingChanges(t *testing.T) {
+	sel, err := newTrackSelector(selectorConfig{mode: modeSequential, seed: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, _ := sel.selectFile([]string{"a.mp3", "c.mp3"}); got != "a.mp3" {
+		t.Fatalf("got %s, want a.mp3", got)
+	}
+	// An upload sorting before the position doesn't replay the first track
+	if got, _ := sel.selectFile([]string{"0.mp3", "a.mp3", "b.mp3", "c.mp3"}); got != "b.mp3" {
+		t.Fatalf("got %s, want b.mp3", got)
+	}
+}
+
+func TestSequentialWithoutMatches(t *testing.T) {
+	sel, err := newTrackSelector(selectorConfig{mode: modeSequential, prefix: "missing/", seed: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sel.selectFile([]string{"a.mp3"}); err == nil {
+		t.Fatal("expected an error when no key has the prefix")
+	}
+}
+
+func TestUnknownSelectionMode(t *testing.T) {
+	if _, err := newTrackSelector(selectorConfig{mode: "shuffle", seed: 1}); err == nil {
+		t.Fatal("expected an error for an unknown mode")
+	}
+}
+
+func TestSameSeedSameSequence(t *testing.T) {
+	files := []string{"a.mp3", "b.mp3", "c.mp3", "d.mp3", "e.mp3", "f.mp3", "g.mp3", "h.mp3"}
+
+	sequence := func(seed int64) []string {
+		sel, err := newTrackSelector(selectorConfig{mode: modeRandom, seed: seed})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var picks []string
+		for range 50 {
+			name, err := sel.selectFile(files)
+			if err != nil {
+				t.Fatal(err)
+			}
+			picks = append(picks, name)
+		}
+		return picks
+	}
+
+	first, second := sequence(42), sequence(42)
+	if !slices.Equal(first, second) {
+		t.Fatalf("same seed gave different sequences:\n%q\n%q", first, second)
+	}
+	if slices.Equal(first, sequence(43)) {
+		t.Fatal("a different seed gave the same sequence")
+	}
+}
+
+func TestRecencyFavorsNewerFiles(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	useListing(t, []string{"new.mp3", "week.mp3", "old.mp3"})
+	listing.mu.Lock()
+	listing.objects[0].LastModified = now
+	listing.objects[1].LastModified = now.Add(-7 * 24 * time.Hour)
+	listing.objects[2].LastModified = now.Add(-365 * 24 * time.Hour)
+	listing.mu.Unlock()
+
+	sel, err := newTrackSelector(selectorConfig{mode: modeRecency, seed: 1, recencyHalfLife: 7 * 24 * time.Hour, recencyBoost: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sel.now = func() time.Time { return now }
+
+	// Weights are 5, 3 and ~1, so new.mp3 should play about five times as
+	// often as old.mp3
+	counts := make(map[string]int)
+	for range 9000 {
+		name, err := sel.selectFile([]string{"new.mp3", "week.mp3", "old.mp3"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[name]++
+	}
+	if !(counts["new.mp3"] > counts["week.mp3"] && counts["week.mp3"] > counts["old.mp3"]) {
+		t.Fatalf("counts %v, want newer files chosen more often", counts)
+	}
+	if ratio := float64(counts["new.mp3"]) / float64(counts["old.mp3"]); ratio < 4 || ratio > 6 {
+		t.Fatalf("new/old ratio %.2f, want about 5", ratio)
+	}
+}
+
+func TestRotationMatchesWeights(t *testing.T) {
+	weights, err := parseRotationWeights("ambient/=70, jazz/=30\n# comment\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sel, err := newTrackSelector(selectorConfig{mode: modeRotation, seed: 1, rotation: weights})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := []string{"ambient/a.mp3", "ambient/b.mp3", "ambient/c.mp3", "jazz/d.mp3", "jazz/e.mp3", "rock/f.mp3"}
+	const picks = 10000
+	counts := make(map[string]int)
+	var previous string
+	for range picks {
+		name, err := sel.selectFile(files)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name == previous {
+			t.Fatalf("%s played twice in a row", name)
+		}
+		previous = name
+		genre, _, _ := strings.Cut(name, "/")
+		counts[genre]++
+	}
+
+	if counts["rock"] != 0 {
+		t.Fatalf("picked %d tracks outside the rotation", counts["rock"])
+	}
+	if share := float64(counts["ambient"]) / picks; share < 0.67 || share > 0.73 {
+		t.Fatalf("ambient share %.3f, want about 0.70", share)
+	}
+}
+
+func TestRotationSkipsEmptyPrefixes(t *testing.T) {
+	sel, err := newTrackSelector(selectorConfig{mode: modeRotation, seed: 1, rotation: []prefixWeight{{"missing/", 90}, {"jazz/", 10}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 20 {
+		if name, err := sel.selectFile([]string{"jazz/a.mp3", "jazz/b.mp3"}); err != nil || !strings.HasPrefix(name, "jazz/") {
+			t.Fatalf("picked %s (%v), want the weight of an empty prefix shared", name, err)
+		}
+	}
+}
+
+func TestParseRotationWeights(t *testing.T) {
+	for _, value := range []string{"ambient/", "ambient/=zero", "ambient/=-1", "ambient/=0"} {
+		if _, err := parseRotationWeights(value); err == nil {
+			t.Errorf("%q: expected an error", value)
+		}
+	}
+	if _, err := newTrackSelector(selectorConfig{mode: modeRotation}); err == nil {
+		t.Fatal("rotation without weights should be rejected")
+	}
+}
+
+func TestCooldownExcludesRecentPicks(t *testing.T) {
+	clock := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	sel, err := newTrackSelector(selectorConfig{mode: modeRandom, seed: 1, cooldown: 30 * time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sel.now = func() time.Time { return clock }
+	files := []string{"a.mp3", "b.mp3", "c.mp3", "d.mp3"}
+
+	// Four picks a minute apart play every track once
+	seen := map[string]bool{}
+	for range len(files) {
+		name, err := sel.selectFile(files)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[name] {
+			t.Fatalf("%s replayed within the cooldown", name)
+		}
+		seen[name] = true
+		clock = clock.Add(time.Minute)
+	}
+
+	// Every track is cooling down, so the one played longest ago comes next
+	var first string
+	for name := range seen {
+		if at := sel.lastPicked[name]; first == "" || at.Before(sel.lastPicked[first]) {
+			first = name
+		}
+	}
+	if name, _ := sel.selectFile(files); name != first {
+		t.Fatalf("picked %s, want %s as the least recently played", name, first)
+	}
+
+	// Past the cooldown everything is eligible again and old entries go
+	clock = clock.Add(time.Hour)
+	if _, err := sel.selectFile(files); err != nil {
+		t.Fatal(err)
+	}
+	if len(sel.lastPicked) != 1 {
+		t.Fatalf("%d tracks remembered, want only the latest pick", len(sel.lastPicked))
+	}
+}
+
+func TestCooldownOffRepeatsFreely(t *testing.T) {
+	sel, err := newTrackSelector(selectorConfig{mode: modeRandom, seed: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 10 {
+		if name, _ := sel.selectFile([]string{"a.mp3"}); name != "a.mp3" {
+			t.Fatalf("picked %s", name)
+		}
+	}
+	if len(sel.lastPicked) != 0 {
+		t.Fatal("recorded picks with no cooldown")
+	}
+}
+
+func TestNoRepeatPassesOverLatestPicks(t *testing.T) {
+	sel, err := newTrackSelector(selectorConfig{mode: modeRandom, seed: 1, noRepeat: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := []string{"a.mp3", "b.mp3", "c.mp3", "d.mp3", "e.mp3"}
+
+	var history []string
+	for range 2000 {
+		name, err := sel.selectFile(files)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if slices.Contains(history[max(0, len(history)-3):], name) {
+			t.Fatalf("%s picked again within 3 picks: %q", name, history[len(history)-3:])
+		}
+		history = append(history, name)
+	}
+
+	sel.reset(nil)
+	if len(sel.recentPicks) != 0 {
+		t.Fatal("reseeding kept the recent picks")
+	}
+}
+
+func TestNoRepeatInSmallLibraries(t *testing.T) {
+	sel, err := newTrackSelector(selectorConfig{mode: modeRandom, seed: 1, noRepeat: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two tracks alternate, and one still plays
+	previous := ""
+	for range 100 {
+		name, err := sel.selectFile([]string{"a.mp3", "b.mp3"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name == previous {
+			t.Fatalf("%s played twice in a row", name)
+		}
+		previous = name
+	}
+	for range 3 {
+		if name, err := sel.selectFile([]string{"only.mp3"}); err != nil || name != "only.mp3" {
+			t.Fatalf("picked %s (%v) from a single track", name, err)
+		}
+	}
+}
+
+func TestNoRepeatKeepsRotationWeights(t *testing.T) {
+	sel, err := newTrackSelector(selectorConfig{
+		mode:     modeRotation,
+		seed:     1,
+		noRepeat: 3,
+		rotation: []prefixWeight{{"ambient/", 50}, {"jazz/", 50}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// One jazz track among several ambient ones would mostly be passed
+	// over if recent picks were left out before the prefix is drawn
+	files := []string{"ambient/a.mp3", "ambient/b.mp3", "ambient/c.mp3", "ambient/d.mp3", "jazz/e.mp3"}
+	const picks = 10000
+	jazz := 0
+	var history []string
+	for range picks {
+		name, err := sel.selectFile(files)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name == "jazz/e.mp3" {
+			jazz++
+		} else if slices.Contains(history[max(0, len(history)-3):], name) {
+			t.Fatalf("%s picked again within 3 picks: %q", name, history[len(history)-3:])
+		}
+		history = append(history, name)
+	}
+	if share := float64(jazz) / picks; share < 0.47 || share > 0.53 {
+		t.Fatalf("jazz share %.3f, want about 0.50", share)
+	}
+}
@@ -1,17 +1,31 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
@@ -20,26 +34,134 @@ import (
 )
 
 type B2Client struct {
-	bucketName string
-	s3Client   *s3.Client
+	bucketName    string
+	s3Client      *s3.Client
+	listingShards []string
+	timeouts      downloadTimeouts
+	keyPrefix     string
 }
 
 type B2 interface {
 	listFiles() ([]string, error)
+	listObjects() ([]objectInfo, error)
+	listPrefix(prefix, delimiter string) ([]objectInfo, []string, error)
+	headFile(fileName string) (*objectHead, error)
+	headBucket() error
+	probeListing() error
 	selectRandomFile(fileNames []string) (string, error)
 	downloadFile(fileName string) (string, error)
+	downloadVersion(fileName, versionID string) (string, error)
+	fetchVersion(fileName, versionID string) (string, error)
+	fetchRange(fileName, rangeHeader string) (*rangeResult, error)
 }
 
-func NewB2Client(endpoint, region, keyId, applicationKey, bucketName string) (B2, error) {
+type objectInfo struct {
+	Key          string
+	Size         int64
+	ETag         string
+	LastModified time.Time
+}
+
+type objectHead struct {
+	Size         int64             `json:"size"`
+	ETag         string            `json:"etag"`
+	LastModified time.Time         `json:"last_modified"`
+	Metadata     map[string]string `json:"metadata"`
+}
+
+// Body of a (possibly partial) object read, with the span it covers and the
+// full object size
+type rangeResult struct {
+	body io.ReadCloser
+	span byteRange
+	size int64 // -1 when the response didn't say
+	etag string
+}
+
+// S3 client settings that vary between S3-compatible backends
+type b2Options struct {
+	usePathStyle bool
+
+	// Only send and validate checksums when an operation requires them, for
+	// stores that reject the SDK's default flexible checksums
+	checksumWhenRequired bool
+
+	// HTTP transport tuning; zero values keep the SDK defaults. There is no
+	// overall client timeout since streaming a large object can take minutes.
+	dialTimeout           time.Duration
+	keepAlive             time.Duration
+	tlsHandshakeTimeout   time.Duration
+	responseHeaderTimeout time.Duration
+	idleConnTimeout       time.Duration
+	maxIdleConnsPerHost   int
+
+	// Prefixes listed in parallel; empty lists the bucket sequentially
+	listingShards []string
+
+	// Deadline for downloading an object into the cache, scaled by its size
+	downloadTimeouts downloadTimeouts
+
+	// Bucket prefix prepended to every public key
+	keyPrefix string
+
+	// Built once at startup and shared by every client so connections opened
+	// by one request (or the warmup) are reused by the next
+	sharedHTTPClient *awshttp.BuildableClient
+}
+
+// Defaults suit B2, which requires path-style addressing
+var clientOptions = b2Options{usePathStyle: true}
+
+func (opts b2Options) apply(o *s3.Options) {
+	o.UsePathStyle = opts.usePathStyle
+	if opts.checksumWhenRequired {
+		o.RequestChecksumCalculation = aws.RequestChecksumCalculationWhenRequired
+		o.ResponseChecksumValidation = aws.ResponseChecksumValidationWhenRequired
+	}
+}
+
+func (opts b2Options) httpClient() *awshttp.BuildableClient {
+	return awshttp.NewBuildableClient().
+		WithDialerOptions(func(d *net.Dialer) {
+			if opts.dialTimeout > 0 {
+				d.Timeout = opts.dialTimeout
+			}
+			if opts.keepAlive > 0 {
+				d.KeepAlive = opts.keepAlive
+			}
+		}).
+		WithTransportOptions(func(t *http.Transport) {
+			if opts.tlsHandshakeTimeout > 0 {
+				t.TLSHandshakeTimeout = opts.tlsHandshakeTimeout
+			}
+			if opts.responseHeaderTimeout > 0 {
+				t.ResponseHeaderTimeout = opts.responseHeaderTimeout
+			}
+			if opts.idleConnTimeout > 0 {
+				t.IdleConnTimeout = opts.idleConnTimeout
+			}
+			if opts.maxIdleConnsPerHost > 0 {
+				t.MaxIdleConnsPerHost = opts.maxIdleConnsPerHost
+			}
+		})
+}
+
+func NewB2Client(endpoint, region, keyId, applicationKey, bucketName string, opts b2Options) (B2, error) {
 	ctx := context.Background()
 
 	// Create custom credentials provider
 	credProvider := credentials.NewStaticCredentialsProvider(keyId, applicationKey, "")
 
+	httpClient := opts.sharedHTTPClient
+	if httpClient == nil {
+		httpClient = opts.httpClient()
+	}
+
 	// Load config with custom endpoint and credentials
 	sdkConfig, err := config.LoadDefaultConfig(ctx,
 		config.WithRegion(region),
 		config.WithCredentialsProvider(credProvider),
+		config.WithHTTPClient(httpClient),
 	)
 	if err != nil {
 		log.Printf("Couldn't load configuration: %v", err)
@@ -49,90 +171,392 @@ func NewB2Client(endpoint, region, keyId, applicationKey, bucketName string) (B2
 	// Create S3 client with B2 endpoint
 	s3Client := s3.NewFromConfig(sdkConfig, func(o *s3.Options) {
 		o.BaseEndpoint = aws.String(endpoint)
-		o.UsePathStyle = true // B2 requires path-style addressing
+		opts.apply(o)
+		// Wrapped here rather than in the config, which needs the buildable
+		// client to add AWS_CA_BUNDLE certificates
+		o.HTTPClient = timedHTTPClient{o.HTTPClient}
 	})
 
 	return &B2Client{
-		bucketName: bucketName,
-		s3Client:   s3Client,
+		bucketName:    bucketName,
+		s3Client:      s3Client,
+		listingShards: opts.listingShards,
+		timeouts:      opts.downloadTimeouts,
+		keyPrefix:     opts.keyPrefix,
 	}, nil
 }
 
-func (b *B2Client) listFiles() ([]string, error) {
+// List the keys under a prefix. With a delimiter, keys below the next
+// delimiter are rolled up into the returned common prefixes.
+func (b *B2Client) listPrefix(prefix, delimiter string) ([]objectInfo, []string, error) {
 	input := &s3.ListObjectsV2Input{
 		Bucket: aws.String(b.bucketName),
 	}
+	if prefix := b.keyPrefix + prefix; prefix != "" {
+		input.Prefix = aws.String(prefix)
+	}
+	if delimiter != "" {
+		input.Delimiter = aws.String(delimiter)
+	}
+
+	// Each page holds at most 1000 keys, so follow the continuation token
+	// until the listing is complete
+	var objects []objectInfo
+	var prefixes []string
+	for {
+		result, err := b.s3Client.ListObjectsV2(b2Context, input)
+		if err != nil {
+			return nil, nil, classifyB2Error(err)
+		}
+
+		for _, object := range result.Contents {
+			objects = append(objects, objectInfo{
+				Key:          b.publicKey(aws.ToString(object.Key)),
+				Size:         aws.ToInt64(object.Size),
+				ETag:         aws.ToString(object.ETag),
+				LastModified: aws.ToTime(object.LastModified),
+			})
+		}
+		for _, common := range result.CommonPrefixes {
+			prefixes = append(prefixes, b.publicKey(aws.ToString(common.Prefix)))
+		}
+
+		if !aws.ToBool(result.IsTruncated) || aws.ToString(result.NextContinuationToken) == "" {
+			return objects, prefixes, nil
+		}
+		input.ContinuationToken = result.NextContinuationToken
+	}
+}
+
+func (b *B2Client) listObjects() ([]objectInfo, error) {
+	if len(b.listingShards) == 0 {
+		objects, _, err := b.listPrefix("", "")
+		return objects, err
+	}
+	return b.listSharded()
+}
 
-	result, err := b.s3Client.ListObjectsV2(context.TODO(), input)
+// List configured prefixes in parallel. A delimited listing of the bucket
+// root supplies the top-level keys and any top-level folders the configured
+// shards don't cover, so the merged result is always complete.
+func (b *B2Client) listSharded() ([]objectInfo, error) {
+	rootObjects, topLevel, err := b.listPrefix("", "/")
+	if err != nil {
+		return nil, err
+	}
+
+	shards := append([]string(nil), b.listingShards...)
+	for _, folder := range topLevel {
+		covered := false
+		for _, shard := range b.listingShards {
+			if strings.HasPrefix(folder, shard) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			shards = append(shards, folder)
+		}
+	}
+
+	type shardResult struct {
+		objects []objectInfo
+		err     error
+	}
+	results := make([]shardResult, len(shards))
+
+	var wg sync.WaitGroup
+	for i, shard := range shards {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			objects, _, err := b.listPrefix(shard, "")
+			results[i] = shardResult{objects: objects, err: err}
+		}()
+	}
+	wg.Wait()
+
+	// Shards may overlap (a configured prefix nested in another), so dedupe
+	seen := make(map[string]bool)
+	var objects []objectInfo
+	for _, object := range rootObjects {
+		seen[object.Key] = true
+		objects = append(objects, object)
+	}
+	for i, result := range results {
+		if result.err != nil {
+			return nil, fmt.Errorf("failed to list shard %s: %w", shards[i], result.err)
+		}
+		for _, object := range result.objects {
+			if !seen[object.Key] {
+				seen[object.Key] = true
+				objects = append(objects, object)
+			}
+		}
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+func (b *B2Client) listFiles() ([]string, error) {
+	objects, err := b.listObjects()
 	if err != nil {
 		return nil, err
 	}
 
 	var fileNames []string
-	for _, object := range result.Contents {
-		fileNames = append(fileNames, *object.Key)
+	for _, object := range objects {
+		if isAudio(object.Key) {
+			fileNames = append(fileNames, object.Key)
+		}
 	}
 
 	return fileNames, nil
 }
 
+func (b *B2Client) headFile(fileName string) (*objectHead, error) {
+	output, err := b.s3Client.HeadObject(b2Context, &s3.HeadObjectInput{
+		Bucket: aws.String(b.bucketName),
+		Key:    aws.String(b.objectKey(fileName)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to head object: %w", classifyB2Error(err))
+	}
+
+	return &objectHead{
+		Size:         aws.ToInt64(output.ContentLength),
+		ETag:         aws.ToString(output.ETag),
+		LastModified: aws.ToTime(output.LastModified),
+		Metadata:     output.Metadata,
+	}, nil
+}
+
 func (b *B2Client) selectRandomFile(fileNames []string) (string, error) {
 	if len(fileNames) == 0 {
-		return "", errors.New("no files found")
+		return "", errNoFiles
 	}
 
 	randomIndex := rand.Intn(len(fileNames))
 	return fileNames[randomIndex], nil
 }
 
+const (
+	consistencyRetries    = 2
+	consistencyRetryDelay = 500 * time.Millisecond
+)
+
+func isNotFound(err error) bool {
+	return errors.Is(classifyB2Error(err), errNotFound)
+}
+
+// A key that is in the listing but 404s is usually a fresh upload that isn't
+// readable yet, so give it a moment before reporting it missing
+func (b *B2Client) getObject(ctx context.Context, input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	key := aws.ToString(input.Key)
+
+	for attempt := 1; ; attempt++ {
+		output, err := b.s3Client.GetObject(ctx, input)
+		err = classifyB2Error(err)
+		if err == nil || !isNotFound(err) || attempt > consistencyRetries || !listing.contains(normalizeKey(b.publicKey(key))) {
+			return output, err
+		}
+
+		log.Printf("Listed key %s not readable yet (attempt %d), retrying in %s", key, attempt, consistencyRetryDelay)
+		time.Sleep(consistencyRetryDelay)
+	}
+}
+
+func cachePath(fileName string) string {
+	return fmt.Sprintf("%s/%s", shardFor(fileName), localName(fileName))
+}
+
 func (b *B2Client) downloadFile(fileName string) (string, error) {
+	return b.downloadVersion(fileName, "")
+}
+
+// Download a specific version of an object, or the latest when versionID is
+// empty. Pinned versions are cached under versionedKey.
+func (b *B2Client) downloadVersion(fileName, versionID string) (string, error) {
+	return b.download(fileName, versionID, true)
+}
+
+// Like downloadVersion, for callers that already found no usable cached copy
+// and so shouldn't check it with B2 again
+func (b *B2Client) fetchVersion(fileName, versionID string) (string, error) {
+	return b.download(fileName, versionID, false)
+}
+
+func (b *B2Client) download(fileName, versionID string, checkCache bool) (string, error) {
+	if !cacheEnabled {
+		return "", errCacheDisabled
+	}
+	fileName = normalizeKey(fileName)
+	if err := validateKey(fileName); err != nil {
+		return "", err
+	}
+	if err := validateVersion(versionID); err != nil {
+		return "", err
+	}
+
+	if checkCache {
+		if filePath, ok := cachedCopy(b, fileName, versionID); ok {
+			return filePath, nil
+		}
+	}
+
+	// Concurrent requests for one file share a single download
+	cacheKey := versionedKey(fileName, versionID)
+	dl, started := downloads.start(cacheKey)
+	if !started {
+		log.Printf("Waiting for download already in progress: %s", cacheKey)
+		return dl.wait()
+	}
+	filePath, err := b.fetchToCache(fileName, versionID, cachePath(cacheKey), dl)
+	downloads.finish(cacheKey, dl, filePath, err)
+	return filePath, err
+}
+
+// Fetch an object into the cache at filePath, reporting progress to dl
+func (b *B2Client) fetchToCache(fileName, versionID, filePath string, dl *download) (string, error) {
 	input := &s3.GetObjectInput{
 		Bucket: aws.String(b.bucketName),
-		Key:    aws.String(fileName),
+		Key:    aws.String(b.objectKey(fileName)),
+	}
+	if versionID != "" {
+		input.VersionId = aws.String(versionID)
 	}
 
 	log.Printf("Downloading file: %s from bucket: %s", fileName, b.bucketName)
 
-	output, err := b.s3Client.GetObject(context.TODO(), input)
+	ctx, cancel := b.downloadContext(fileName, versionID)
+	defer cancel()
+	output, err := b.getObject(ctx, input)
 	if err != nil {
 		return "", fmt.Errorf("failed to get object: %w", err)
 	}
 	defer output.Body.Close()
 
-	filePath := fmt.Sprintf("cache/%s", fileName)
-
 	// Create directory structure if needed
-	dir := "cache"
-	if strings.Contains(fileName, "/") {
-		parts := strings.Split(fileName, "/")
-		dir = fmt.Sprintf("cache/%s", strings.Join(parts[:len(parts)-1], "/"))
+	err = os.MkdirAll(filepath.Dir(filePath), 0755)
+	if err != nil {
+		return "", fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	if err := ensureDiskSpace(filePath, aws.ToInt64(output.ContentLength)); err != nil {
+		return "", err
 	}
 
-	err = os.MkdirAll(dir, 0755)
+	size := int64(-1)
+	if output.ContentLength != nil {
+		size = *output.ContentLength
+	}
+	written, err := writeCacheEntry(filePath, output.Body, size, dl)
+	egress.addDownloaded(written)
 	if err != nil {
-		return "", fmt.Errorf("failed to create cache directory: %w", err)
+		return "", err
+	}
+	storeETag(versionedKey(fileName, versionID), aws.ToString(output.ETag))
+
+	log.Printf("Successfully cached file to: %s", filePath)
+	enforceCacheLimit(filePath)
+	return filePath, nil
+}
+
+// List a single key, as a cheap check that listing works end to end
+func (b *B2Client) probeListing() error {
+	input := &s3.ListObjectsV2Input{
+		Bucket:  aws.String(b.bucketName),
+		MaxKeys: aws.Int32(1),
+	}
+	if b.keyPrefix != "" {
+		input.Prefix = aws.String(b.keyPrefix)
+	}
+	_, err := b.s3Client.ListObjectsV2(b2Context, input)
+	if err != nil {
+		return fmt.Errorf("failed to list objects: %w", classifyB2Error(err))
 	}
+	return nil
+}
 
-	file, err := os.Create(filePath)
+func (b *B2Client) headBucket() error {
+	_, err := b.s3Client.HeadBucket(b2Context, &s3.HeadBucketInput{
+		Bucket: aws.String(b.bucketName),
+	})
 	if err != nil {
-		return "", fmt.Errorf("failed to create file: %w", err)
+		return fmt.Errorf("failed to head bucket: %w", classifyB2Error(err))
 	}
-	defer file.Close()
+	return nil
+}
 
-	_, err = io.Copy(file, output.Body)
+// Read an object, or a byte range of it when rangeHeader is set
+func (b *B2Client) fetchRange(fileName, rangeHeader string) (*rangeResult, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(b.bucketName),
+		Key:    aws.String(b.objectKey(normalizeKey(fileName))),
+	}
+	if rangeHeader != "" {
+		input.Range = aws.String(rangeHeader)
+	}
+
+	output, err := b.getObject(b2Context, input)
 	if err != nil {
-		return "", fmt.Errorf("failed to copy file content: %w", err)
+		return nil, fmt.Errorf("failed to get object: %w", err)
 	}
 
-	log.Printf("Successfully cached file to: %s", filePath)
-	return filePath, nil
+	result := &rangeResult{body: output.Body, etag: aws.ToString(output.ETag)}
+	if output.ContentRange != nil {
+		result.span, result.size, err = parseContentRange(*output.ContentRange)
+		if err != nil {
+			output.Body.Close()
+			return nil, err
+		}
+	} else if output.ContentLength != nil {
+		result.size = *output.ContentLength
+		result.span = byteRange{0, result.size}
+	} else {
+		// A chunked response, as gateways in front of B2 may send
+		result.size = -1
+	}
+
+	return result, nil
 }
 
-func stream(w http.ResponseWriter, req *http.Request) {
-	if err := godotenv.Load(); err != nil {
-		log.Printf("Warning: Error loading .env file: %v", err)
+// The file query parameter, normalized (see normalizeKey) and decoded with
+// url.QueryUnescape semantics so "+" and "%20" both mean a space and "%2B" is
+// a literal plus. Clients that send a key containing "+" without escaping it
+// would otherwise ask for a key with a space, so when only the literal
+// reading is in the listing, use it.
+func fileParam(req *http.Request) string {
+	fileName := normalizeKey(req.URL.Query().Get("file"))
+
+	for _, pair := range strings.Split(req.URL.RawQuery, "&") {
+		raw, ok := strings.CutPrefix(pair, "file=")
+		if !ok || !strings.Contains(raw, "+") {
+			continue
+		}
+		literal, err := url.PathUnescape(raw)
+		literal = normalizeKey(literal)
+		if err == nil && !listing.contains(fileName) && listing.contains(literal) {
+			return literal
+		}
+		break
 	}
+	return listing.resolveCase(fileName)
+}
+
+const (
+	redirectHopParam = "hop"
+	maxRedirectHops  = 3
+)
 
+// Status used when redirecting to a selected track, set from REDIRECT_STATUS.
+// 307 preserves the method, which some proxies and players handle better.
+var redirectStatus = http.StatusFound
+
+var errMissingEnv = errors.New("missing required environment variables")
+
+// Build a client from the credentials and endpoints in the environment
+func newB2ClientFromEnv() (B2, error) {
 	keyId := os.Getenv("KEY_ID")
 	applicationKey := os.Getenv("APPLICATION_KEY")
 	bucketName := os.Getenv("BUCKET_NAME")
@@ -141,9 +565,7 @@ func stream(w http.ResponseWriter, req *http.Request) {
 
 	// Validate required environment variables
 	if keyId == "" || applicationKey == "" || bucketName == "" || endpoint == "" {
-		http.Error(w, "Missing required environment variables", http.StatusInternalServerError)
-		log.Printf("Missing environment variables")
-		return
+		return nil, errMissingEnv
 	}
 
 	// Default region if not specified
@@ -153,51 +575,201 @@ func stream(w http.ResponseWriter, req *http.Request) {
 
 	log.Printf("Connecting to B2 - Endpoint: %s, Region: %s, Bucket: %s", endpoint, region, bucketName)
 
-	b2Client, err := NewB2Client(endpoint, region, keyId, applicationKey, bucketName)
-	if err != nil {
-		http.Error(w, "Failed to create B2 client", http.StatusInternalServerError)
-		log.Printf("Failed to create B2 client: %v", err)
+	primary, err := NewB2Client(endpoint, region, keyId, applicationKey, bucketName, clientOptions)
+	if err != nil || len(failoverEndpoints) == 0 {
+		return primary, err
+	}
+
+	clients := []endpointClient{{endpoint: endpoint, client: primary}}
+	for _, secondary := range failoverEndpoints {
+		client, err := NewB2Client(secondary.url, secondary.region, keyId, applicationKey, bucketName, clientOptions)
+		if err != nil {
+			log.Printf("Failed to create client for failover endpoint %s: %v", secondary.url, err)
+			continue
+		}
+		clients = append(clients, endpointClient{endpoint: secondary.url, client: client})
+	}
+	return &failoverClient{clients: clients}, nil
+}
+
+// Serves /stream with the B2 client built at startup
+type streamHandler struct {
+	client B2
+}
+
+func (h *streamHandler) stream(w http.ResponseWriter, req *http.Request) {
+	if egress.exceeded() {
+		http.Error(w, "Daily egress quota exceeded, try again tomorrow", http.StatusServiceUnavailable)
+		log.Printf("Rejected stream request: daily egress quota exceeded")
 		return
 	}
 
-	fileName := req.URL.Query().Get("file")
+	b2Client := h.client
+	st, ok := stationFor(w, req)
+	if !ok {
+		return
+	}
+
+	fileName := fileParam(req)
 
 	// If no file specified, select random file and redirect
 	if fileName == "" {
-		listResult, err := b2Client.listFiles()
+		// The redirect target always names a file, so a client arriving here
+		// with a hop count is losing the parameter and bouncing
+		hops, _ := strconv.Atoi(req.URL.Query().Get(redirectHopParam))
+		if hops >= maxRedirectHops {
+			http.Error(w, "Too many redirects", http.StatusLoopDetected)
+			log.Printf("Redirect loop detected after %d hops", hops)
+			return
+		}
+
+		listing.refreshFor(req)
+		_, listSpan := startSpan(req.Context(), "listFiles")
+		listSpan.set("bucket", os.Getenv("BUCKET_NAME"))
+		listResult, err := st.candidates(b2Client)
+		listSpan.set("files", len(listResult))
+		listSpan.fail(err)
+		listSpan.finish()
+		if err != nil && serveFallback(w, req, err) {
+			return
+		}
 		if err != nil {
-			http.Error(w, "Failed to list files", http.StatusInternalServerError)
+			b2Error(w, "Failed to list files", err)
 			log.Printf("Failed to list files: %v", err)
 			return
 		}
 
-		randomFile, err := b2Client.selectRandomFile(listResult)
+		// There is no transcoding, so pick among formats the client can play
+		listResult = preferAccepted(req, listResult)
+
+		_, selectSpan := startSpan(req.Context(), "selectRandomFile")
+		randomFile, err := st.selector.selectFile(listResult)
+		selectSpan.set("file", randomFile)
+		selectSpan.set("station", st.name)
+		selectSpan.fail(err)
+		selectSpan.finish()
+		if err != nil && serveFallback(w, req, err) {
+			return
+		}
 		if err != nil {
 			http.Error(w, "No files available", http.StatusNotFound)
 			log.Printf("Failed to select random file: %v", err)
 			return
 		}
 
-		log.Printf("Selected random file: %s", randomFile)
+		log.Printf("Selected file for station %s (%s mode): %s", st.name, st.selector.mode, randomFile)
 
-		// Properly URL encode the filename
-		encodedFile := strings.Replace(randomFile, " ", "%20", -1)
-		encodedFile = strings.Replace(encodedFile, "#", "%23", -1)
-		encodedFile = strings.Replace(encodedFile, "?", "%3F", -1)
+		// url.Values escapes everything a key may hold (&, +, #, ?, %,
+		// non-ASCII) so Query().Get("file") reads back the exact key
+		query := url.Values{
+			"file":           {randomFile},
+			redirectHopParam: {strconv.Itoa(hops + 1)},
+		}
+		if st.name != defaultStationName {
+			query.Set("station", st.name)
+		}
+		if quality := req.URL.Query().Get("quality"); quality != "" {
+			query.Set("quality", quality)
+		}
+		target := "/stream?" + query.Encode()
+		http.Redirect(w, req, target, redirectStatus)
+		return
+	}
 
-		http.Redirect(w, req, fmt.Sprintf("/stream?file=%s", encodedFile), http.StatusFound)
+	if err := validateKey(fileName); err != nil {
+		http.Error(w, "Invalid file parameter", http.StatusBadRequest)
+		log.Printf("Rejected unsafe file parameter: %q", fileName)
+		return
+	}
+	if !isAllowed(fileName) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		log.Printf("Rejected file outside the allowlist: %s", fileName)
+		return
+	}
+	if rejectedForSize(fileName) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		log.Printf("Rejected file below MIN_FILE_SIZE: %s", fileName)
 		return
 	}
 
 	log.Printf("Fetching file: %s", fileName)
+	start := time.Now()
 
-	// Download the file
-	filePath, err := b2Client.downloadFile(fileName)
-	if err != nil {
-		http.Error(w, "Failed to download file", http.StatusInternalServerError)
-		log.Printf("Failed to download file: %v", err)
+	// A pinned ?version= is fetched and cached apart from the latest version
+	version := req.URL.Query().Get("version")
+	if err := validateVersion(version); err != nil {
+		http.Error(w, "Invalid version parameter", http.StatusBadRequest)
 		return
 	}
+	if version != "" && !cacheEnabled {
+		http.Error(w, "Versioned requests need the disk cache", http.StatusNotImplemented)
+		return
+	}
+	// Pinned versions are of the named key, so only latest ones get variants
+	if version == "" {
+		if chosen := variantFor(w, req, fileName); chosen != fileName {
+			log.Printf("Serving variant %s of %s", chosen, fileName)
+			fileName = chosen
+		}
+	}
+	cacheKey := versionedKey(fileName, version)
+
+	cacheHit := false
+	var serve func(w http.ResponseWriter)
+
+	// Pinned versions never change, so only the latest copy is validated
+	if entry, ok := memCache.get(cacheKey); ok && (version != "" || validateCached(b2Client, fileName)) {
+		// Small hot files are served straight from memory
+		cacheHit = true
+		serve = func(w http.ResponseWriter) {
+			http.ServeContent(w, req, fileName, entry.modTime, bytes.NewReader(entry.data))
+		}
+	} else if !cacheEnabled || (streamMode == streamModeDirect && version == "") {
+		serve = proxyServe(req, b2Client, fileName)
+	} else if streamMode == streamModeHybrid && version == "" {
+		serve, cacheHit = hybridServe(req, b2Client, fileName)
+	} else if filePath, ok := cachedCopy(b2Client, fileName, version); ok {
+		cacheHit = true
+		memCache.load(cacheKey, filePath)
+		serve = func(w http.ResponseWriter) {
+			defer servingFiles.acquire(filePath)()
+			serveCached(w, req, filePath)
+		}
+	} else if dl := downloads.get(cacheKey); dl != nil && concurrentDownload == concurrentTail && req.Header.Get("Range") == "" {
+		// Another request is fetching the file, so follow its download
+		serve = func(w http.ResponseWriter) {
+			dl.serveTail(w, req, fileName)
+		}
+	} else {
+		// Not cached, or stale, so fetch it from B2 without checking again
+		_, downloadSpan := startSpan(req.Context(), "downloadFile")
+		downloadSpan.set("file", fileName)
+		downloadSpan.set("bucket", os.Getenv("BUCKET_NAME"))
+		filePath, err := b2Client.fetchVersion(fileName, version)
+		downloadSpan.fail(err)
+		downloadSpan.finish()
+		switch {
+		case errors.Is(err, errInsufficientStorage) && version == "":
+			// Still no room after eviction, so stream this one uncached
+			log.Printf("Streaming %s from B2 without caching: %v", fileName, err)
+			serve = proxyServe(req, b2Client, fileName)
+		case err != nil:
+			if !errors.Is(err, errInsufficientStorage) {
+				quarantined.recordFailure(fileName)
+			}
+			b2Error(w, "Failed to download file", err)
+			log.Printf("Failed to download file: %v", err)
+			return
+		default:
+			quarantined.recordSuccess(fileName)
+
+			memCache.load(cacheKey, filePath)
+			serve = func(w http.ResponseWriter) {
+				defer servingFiles.acquire(filePath)()
+				serveCached(w, req, filePath)
+			}
+		}
+	}
 
 	// Log range header for debugging
 	rangeHeader := req.Header.Get("Range")
@@ -206,15 +778,428 @@ func stream(w http.ResponseWriter, req *http.Request) {
 	}
 
 	// Serve the file (supports range requests automatically)
-	http.ServeFile(w, req, filePath)
+	done := streams.begin()
+	defer done()
+
+	noTransform(w.Header())
+
+	_, serveSpan := startSpan(req.Context(), "serve")
+	cw := &countingResponseWriter{ResponseWriter: w}
+	serve(cw)
+	egress.addServed(cw.bytes)
+	serveSpan.set("file", fileName)
+	serveSpan.set("bytes", cw.bytes)
+	serveSpan.set("cache_hit", cacheHit)
+	serveSpan.set("http.response.status_code", cw.status)
+	serveSpan.finish()
+
+	if cw.status < http.StatusBadRequest {
+		if startsPlay(rangeHeader) {
+			st.recordPlay(fileName)
+		}
+		recordStream(streamRecord{
+			file:     fileName,
+			station:  st.name,
+			client:   clientIP(req),
+			bytes:    cw.bytes,
+			duration: time.Since(start),
+			ranged:   rangeHeader != "",
+			cacheHit: cacheHit,
+		})
+	}
+}
+
+// Whether a request with this Range header starts playing a track. Players
+// like <audio> ask for "bytes=0-" from the start; later ranges continue a
+// play that was already recorded.
+func startsPlay(rangeHeader string) bool {
+	if rangeHeader == "" {
+		return true
+	}
+	spec, ok := strings.CutPrefix(strings.TrimSpace(rangeHeader), "bytes=")
+	if !ok {
+		return false
+	}
+	first, _, _ := strings.Cut(spec, ",")
+	start, _, ok := strings.Cut(strings.TrimSpace(first), "-")
+	return ok && start == "0"
+}
+
+const defaultWarmupDelay = time.Second
+
+// Prime the shared connection pool with a cheap call so the first listener
+// doesn't pay for the TLS handshake and connection setup
+func warmup(delay time.Duration) {
+	time.Sleep(delay)
+
+	b2Client, err := b2ClientFromEnv()
+	if err != nil {
+		log.Printf("Warmup skipped: %v", err)
+		return
+	}
+
+	start := time.Now()
+	if err := b2Client.headBucket(); err != nil {
+		log.Printf("Warmup failed: %v", err)
+		return
+	}
+	log.Printf("Warmup complete in %s", time.Since(start).Round(time.Millisecond))
+}
+
+func writeJSON(w http.ResponseWriter, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Printf("Failed to encode response: %v", err)
+	}
+}
+
+func staticHandler(staticDir string) http.Handler {
+	absDir, err := filepath.Abs(staticDir)
+	if err != nil {
+		log.Printf("Failed to resolve static directory %s: %v", staticDir, err)
+		absDir = staticDir
+	}
+
+	info, err := os.Stat(absDir)
+	if err != nil || !info.IsDir() {
+		log.Printf("Static directory not found: %s", absDir)
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			http.Error(w, fmt.Sprintf("Static directory %s not found, set STATIC_DIR to the web assets path", absDir), http.StatusInternalServerError)
+		})
+	}
+
+	log.Printf("Serving static files from: %s", absDir)
+	return http.FileServer(http.Dir(absDir))
 }
 
 func main() {
-	http.Handle("/", http.FileServer(http.Dir("./static")))
-	http.HandleFunc("/stream", stream)
+	configFile = envString("CONFIG_FILE", configFile)
+	if err := godotenv.Load(configFile); err != nil {
+		log.Printf("Warning: Error loading .env file: %v", err)
+	}
+
+	seed := randomSeed()
+	if os.Getenv("RANDOM_SEED") != "" {
+		seed = envInt64("RANDOM_SEED", 0)
+		log.Printf("Using fixed selection seed: %d", seed)
+	}
+
+	rotationWeights := os.Getenv("ROTATION_WEIGHTS")
+	if path := os.Getenv("ROTATION_WEIGHTS_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Fatalf("Failed to read ROTATION_WEIGHTS_FILE: %v", err)
+		}
+		rotationWeights = string(data)
+	}
+	rotation, err := parseRotationWeights(rotationWeights)
+	if err != nil {
+		log.Fatalf("Invalid rotation weights: %v", err)
+	}
+
+	lastPlayed = newPlayTimes(envString("PLAY_STATE_FILE", "plays.json"))
+	selectorCfg := selectorConfig{
+		mode:            os.Getenv("SELECTION_MODE"),
+		prefix:          os.Getenv("SELECTION_PREFIX"),
+		seed:            seed,
+		recencyHalfLife: envDuration("RECENCY_HALF_LIFE", defaultRecencyHalfLife),
+		recencyBoost:    envFloat("RECENCY_BOOST", defaultRecencyBoost),
+		rotation:        rotation,
+		cooldown:        envDuration("SELECTION_COOLDOWN", 0),
+		noRepeat:        int(envInt64("SELECTION_NO_REPEAT", defaultNoRepeat)),
+	}
+	if err := stations.add(defaultStationName, "", selectorCfg); err != nil {
+		log.Fatal(err)
+	}
+
+	stationPrefixes, err := parseStations(os.Getenv("STATIONS"))
+	if err != nil {
+		log.Fatalf("Invalid STATIONS: %v", err)
+	}
+	for name, prefix := range stationPrefixes {
+		if err := stations.add(name, prefix, selectorCfg); err != nil {
+			log.Fatalf("Invalid STATIONS: %v", err)
+		}
+		log.Printf("Station %s plays keys under %q", name, prefix)
+	}
+
+	clientOptions = b2Options{
+		usePathStyle:         envBool("USE_PATH_STYLE", true),
+		checksumWhenRequired: envBool("CHECKSUM_WHEN_REQUIRED", false),
+
+		dialTimeout:           envDuration("S3_DIAL_TIMEOUT", 0),
+		keepAlive:             envDuration("S3_KEEP_ALIVE", 0),
+		tlsHandshakeTimeout:   envDuration("S3_TLS_HANDSHAKE_TIMEOUT", 0),
+		responseHeaderTimeout: envDuration("S3_RESPONSE_HEADER_TIMEOUT", 0),
+		idleConnTimeout:       envDuration("S3_IDLE_CONN_TIMEOUT", 0),
+		maxIdleConnsPerHost:   int(envInt64("S3_MAX_IDLE_CONNS_PER_HOST", 0)),
+
+		downloadTimeouts: downloadTimeouts{
+			base:  envDuration("S3_DOWNLOAD_TIMEOUT", 0),
+			perMB: envDuration("S3_DOWNLOAD_TIMEOUT_PER_MB", 0),
+		},
+
+		keyPrefix: parseKeyPrefix(os.Getenv("KEY_PREFIX")),
+	}
+	clientOptions.sharedHTTPClient = clientOptions.httpClient()
+
+	failoverEndpoints, err = parseFailoverEndpoints(os.Getenv("FAILOVER_ENDPOINTS"), envString("REGION", "us-east-5"))
+	if err != nil {
+		log.Fatalf("Invalid FAILOVER_ENDPOINTS: %v", err)
+	}
+	maxReauths = int(envInt64("B2_MAX_REAUTHS", defaultMaxReauths))
+	if value := os.Getenv("AUDIO_EXTENSIONS"); value != "" {
+		if audioExtensions, err = parseAudioExtensions(value); err != nil {
+			log.Fatalf("Invalid AUDIO_EXTENSIONS: %v", err)
+		}
+	}
+	endpointStates = newEndpointHealth(int(envInt64("FAILOVER_THRESHOLD", defaultFailoverThreshold)), envDuration("FAILOVER_COOLDOWN", defaultFailoverCooldown))
+	if shards := os.Getenv("LISTING_SHARDS"); shards != "" {
+		clientOptions.listingShards = strings.Split(shards, ",")
+	}
+	egress = newEgressMeter(envInt64("EGRESS_DAILY_BUDGET", 0), envString("EGRESS_STATE_FILE", "egress.json"))
+	logStreams = envBool("STREAM_LOG", true)
+	if sink := os.Getenv("ACCESS_LOG"); sink != "" {
+		accessLog, err = openAccessLog(sink, envInt64("ACCESS_LOG_MAX_BYTES", defaultAccessLogMaxBytes), os.Getenv("ACCESS_LOG_SALT"))
+		if err != nil {
+			log.Fatalf("Failed to open access log: %v", err)
+		}
+	}
+	listing.ttl = envDuration("LISTING_TTL", defaultListingTTL)
+	memCache = newMemoryCache(envInt64("MEMORY_CACHE_BYTES", 0), envInt64("MEMORY_CACHE_MAX_FILE", defaultMemoryCacheMaxFile))
+	servedRanges = newMemoryCache(envInt64("RANGE_CACHE_BYTES", defaultRangeCacheBytes), envInt64("RANGE_CACHE_MAX_RANGE", defaultRangeCacheMaxRange))
+	cacheEnabled = envBool("CACHE_ENABLED", true)
+	downloadHeadroom = envInt64("DOWNLOAD_MIN_FREE_BYTES", 0)
+	defaultPathEncoding := pathEncodingNone
+	if runtime.GOOS == "windows" {
+		defaultPathEncoding = pathEncodingSafe
+	}
+	cachePathEncoding = envString("CACHE_PATH_ENCODING", defaultPathEncoding)
+	if cachePathEncoding != pathEncodingNone && cachePathEncoding != pathEncodingSafe {
+		log.Fatalf("Invalid CACHE_PATH_ENCODING: %s", cachePathEncoding)
+	}
+	compressWAV = envBool("CACHE_COMPRESS_WAV", false)
+	concurrentDownload = envString("CONCURRENT_DOWNLOAD", concurrentWait)
+	if concurrentDownload != concurrentWait && concurrentDownload != concurrentTail {
+		log.Fatalf("Invalid CONCURRENT_DOWNLOAD: %s", concurrentDownload)
+	}
+	cacheMaxBytes = envInt64("CACHE_MAX_BYTES", 0)
+	cacheKeyCase = envString("CACHE_KEY_CASE", keyCaseExact)
+	if cacheKeyCase != keyCaseExact && cacheKeyCase != keyCaseFold {
+		log.Fatalf("Invalid CACHE_KEY_CASE: %s", cacheKeyCase)
+	}
+	cacheShards, err = parseCacheShards(os.Getenv("CACHE_SHARDS"))
+	if err != nil {
+		log.Fatalf("Invalid CACHE_SHARDS: %v", err)
+	}
+	etagValidateInterval = envDuration("ETAG_VALIDATE_INTERVAL", 0)
+	switch value := envString("INVALID_RANGE", "ignore"); value {
+	case "ignore":
+	case "reject":
+		rejectInvalidRange = true
+	default:
+		log.Fatalf("Invalid INVALID_RANGE: %s", value)
+	}
+	minFileSize = envInt64("MIN_FILE_SIZE", 0)
+	minFileSizeStrict = envBool("MIN_FILE_SIZE_STRICT", false)
+	minFreeBytes = envInt64("HEALTH_MIN_FREE_BYTES", defaultMinFreeBytes)
+	adminToken = os.Getenv("ADMIN_TOKEN")
+	originSecret = []byte(os.Getenv("ORIGIN_SIGNING_SECRET"))
+	if endpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); endpoint != "" {
+		tracer = newOTLPExporter(endpoint, envString("OTEL_SERVICE_NAME", defaultTraceServiceName))
+		log.Printf("Exporting traces to %s", endpoint)
+	}
+	signatureWindow = envDuration("ORIGIN_SIGNATURE_WINDOW", defaultSignatureWindow)
+	prewarmWorkers = int(envInt64("PREWARM_WORKERS", defaultPrewarmWorkers))
+	verifyWorkers = int(envInt64("VERIFY_WORKERS", defaultVerifyWorkers))
+	redirectStatus = int(envInt64("REDIRECT_STATUS", http.StatusFound))
+	switch redirectStatus {
+	case http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect:
+	default:
+		log.Fatalf("Unsupported REDIRECT_STATUS: %d", redirectStatus)
+	}
+	streamMode = envString("STREAM_MODE", streamModeCache)
+	if !slices.Contains(streamModes, streamMode) {
+		log.Fatalf("Unknown STREAM_MODE: %s", streamMode)
+	}
+	if !cacheEnabled {
+		log.Printf("Disk cache disabled, proxying every stream from B2")
+	}
+	excludedMetadata, err = parseMetadataRules(os.Getenv("EXCLUDE_METADATA"))
+	if err != nil {
+		log.Fatalf("Invalid EXCLUDE_METADATA: %v", err)
+	}
+	titleConfig.stripTrackNumbers = envBool("TITLE_STRIP_TRACK_NUMBERS", true)
+	titleConfig.replaceUnderscores = envBool("TITLE_REPLACE_UNDERSCORES", true)
+	titleConfig.rules, err = parseTitleRules(os.Getenv("TITLE_RULES"))
+	if err != nil {
+		log.Fatalf("Invalid TITLE_RULES: %v", err)
+	}
+	quarantined = newQuarantine(int(envInt64("QUARANTINE_THRESHOLD", defaultQuarantineThreshold)), envDuration("QUARANTINE_COOLDOWN", defaultQuarantineCooldown))
+	radioJitter = envDuration("RADIO_JITTER", defaultRadioJitter)
+	maxRadioReselections = int(envInt64("RADIO_MAX_RESELECTIONS", defaultRadioReselections))
+	if maxRadioReselections < 1 {
+		log.Fatalf("Invalid RADIO_MAX_RESELECTIONS: must be at least 1")
+	}
+	ffmpegPath = envString("FFMPEG_PATH", ffmpegPath)
+	radioCrossfade = envDuration("RADIO_CROSSFADE", 0)
+	checkCrossfade()
+	radioLoudness = envString("RADIO_LOUDNESS", loudnessOff)
+	if radioLoudness != loudnessOff && radioLoudness != loudnessLoudnorm && radioLoudness != loudnessReplayGain {
+		log.Fatalf("Invalid RADIO_LOUDNESS: %s", radioLoudness)
+	}
+	loudnessTarget = envFloat("RADIO_LOUDNESS_TARGET", defaultLoudnessTarget)
+	checkLoudness()
+	radioOutage = envString("RADIO_OUTAGE", outageEnd)
+	if radioOutage != outageEnd && radioOutage != outageSilence {
+		log.Fatalf("Invalid RADIO_OUTAGE: %s", radioOutage)
+	}
+	hlsSegmentSeconds = int(envInt64("HLS_SEGMENT_SECONDS", defaultHLSSegmentSeconds))
+	if hlsSegmentSeconds <= 0 {
+		log.Fatalf("Invalid HLS_SEGMENT_SECONDS: must be positive")
+	}
+	strictQuery = envBool("STRICT_QUERY", false)
+	streamsPerIP = newIPStreamLimiter(int(envInt64("MAX_STREAMS_PER_IP", 0)))
+	radioPrefetchDepth = int(envInt64("RADIO_PREFETCH_DEPTH", defaultRadioPrefetchDepth))
+	if radioPrefetchDepth < 1 {
+		log.Fatalf("Invalid RADIO_PREFETCH_DEPTH: must be at least 1")
+	}
+	readAheadBytes = envInt64("READ_AHEAD_BYTES", defaultReadAheadBytes)
+	streamFlushInterval = envDuration("STREAM_FLUSH_INTERVAL", defaultFlushInterval)
+	streamBufferBytes = int(envInt64("STREAM_BUFFER_BYTES", defaultStreamBufferBytes))
+	if streamBufferBytes <= 0 {
+		log.Fatalf("Invalid STREAM_BUFFER_BYTES: must be positive")
+	}
+
+	if path := os.Getenv("ALLOWLIST_FILE"); path != "" {
+		allowlist, err = loadAllowlist(path)
+		if err != nil {
+			log.Fatalf("Invalid ALLOWLIST_FILE: %v", err)
+		}
+		log.Printf("Serving %d allowlisted tracks from %s", len(allowlist), path)
+	}
+
+	prerollFile = os.Getenv("PREROLL_FILE")
+	if prerollFile != "" {
+		if _, err := os.Stat(prerollFile); err != nil {
+			log.Fatalf("Invalid PREROLL_FILE: %v", err)
+		}
+	}
+	prerollSkipAfter = envDuration("PREROLL_SKIP_AFTER", 0)
+
+	fallbackFile = os.Getenv("FALLBACK_FILE")
+	if fallbackFile != "" {
+		if _, err := os.Stat(fallbackFile); err != nil {
+			log.Fatalf("Invalid FALLBACK_FILE: %v", err)
+		}
+	}
+
+	maintenance.set(envBool("MAINTENANCE", false), os.Getenv("MAINTENANCE_MESSAGE"), envDuration("MAINTENANCE_RETRY_AFTER", defaultMaintenanceRetryAfter))
+
+	publicURL = os.Getenv("PUBLIC_URL")
+	staticDir := envString("STATIC_DIR", "./static")
+	trailingSlash = envString("TRAILING_SLASH", trailingSlashRedirect)
+	if trailingSlash != trailingSlashRedirect && trailingSlash != trailingSlashStrip && trailingSlash != trailingSlashOff {
+		log.Fatalf("Invalid TRAILING_SLASH: %s", trailingSlash)
+	}
 
-	log.Println("Server starting on :8090")
-	if err := http.ListenAndServe(":8090", nil); err != nil {
+	// Built once and shared by every request; without credentials there is
+	// nothing to serve, so don't start
+	b2Client, err := b2ClientFromEnv()
+	if errors.Is(err, errMissingEnv) {
+		log.Fatalf("Missing required environment variables: KEY_ID, APPLICATION_KEY, BUCKET_NAME and ENDPOINT must be set")
+	}
+	if err != nil {
+		log.Fatalf("Failed to create B2 client: %v", err)
+	}
+	streamEndpoint := &streamHandler{client: b2Client}
+	playlistEndpoint := &playlistHandler{client: b2Client}
+
+	http.Handle("/", staticHandler(staticDir))
+	http.HandleFunc("/stream", unlessMaintenance(strictParams(streamParams, streamEndpoint.stream)))
+	http.HandleFunc("/radio", unlessMaintenance(strictParams(radioParams, limitStreamsPerIP(radio))))
+	http.HandleFunc("/radio/skip", problemJSON(skipPreroll))
+	http.HandleFunc("/play", unlessMaintenance(strictParams(playParams, limitStreamsPerIP(playList))))
+	http.HandleFunc("/listen", unlessMaintenance(strictParams(listenParams, listen)))
+	http.HandleFunc("/hls/", unlessMaintenance(hlsHandler))
+	http.HandleFunc("/preload", problemJSON(unlessMaintenance(strictParams(preloadParams, preload))))
+	http.HandleFunc("/search", problemJSON(search))
+	http.HandleFunc("/browse", problemJSON(strictParams(browseParams, browse)))
+	http.HandleFunc("/queue", problemJSON(strictParams(queueParams, queue)))
+	http.HandleFunc("/recent", problemJSON(strictParams(recentParams, recentHandler)))
+	http.HandleFunc("/schedule", problemJSON(strictParams(scheduleParams, scheduleHandler)))
+	http.HandleFunc("/metrics", metricsHandler)
+	http.HandleFunc("/stats", problemJSON(stats))
+	http.HandleFunc("/downloads", problemJSON(downloadsHandler))
+	if envBool("STATUS_REQUIRE_ADMIN", false) {
+		http.HandleFunc("/status", requireAdmin(statusHandler))
+	} else {
+		http.HandleFunc("/status", statusHandler)
+	}
+	http.HandleFunc("/readyz", readyz)
+	http.HandleFunc("/healthz", healthz)
+	http.HandleFunc("/version", problemJSON(versionHandler))
+	http.HandleFunc("/buildinfo", problemJSON(requireAdmin(buildInfoHandler)))
+	http.HandleFunc("/meta", problemJSON(meta))
+	http.HandleFunc("/art", art)
+	http.HandleFunc("/chapters", problemJSON(chaptersHandler))
+	http.HandleFunc("/playlist", problemJSON(playlistEndpoint.playlist))
+	http.HandleFunc("/playlist.m3u", playlistM3U)
+	http.HandleFunc("/feed.opml", feedOPML)
+	http.HandleFunc("/prewarm", problemJSON(requireAdmin(prewarm)))
+	http.HandleFunc("/cache/purge", problemJSON(requireAdmin(purgeCache)))
+	http.HandleFunc("/admin/reload", problemJSON(requireAdmin(reloadConfig)))
+	http.HandleFunc("/reseed", problemJSON(requireAdmin(reseed)))
+	http.HandleFunc("/admin/verify", problemJSON(requireAdmin(verifyBucket)))
+	http.HandleFunc("/admin/maintenance", problemJSON(requireAdmin(maintenanceHandler)))
+
+	// Stagger the first B2 calls so a cluster restarting at once doesn't list
+	// the bucket in lockstep
+	startupDelay := startupJitter()
+	if startupDelay > 0 {
+		log.Printf("Delaying initial listing by %s", startupDelay.Round(time.Millisecond))
+	}
+	go listing.warm(startupDelay)
+	if interval := envDuration("GOROUTINE_CHECK_INTERVAL", defaultGoroutineCheckInterval); interval > 0 {
+		goroutines = newGoroutineMonitor(int(envInt64("GOROUTINES_PER_STREAM", defaultGoroutinesPerStream)), int(envInt64("GOROUTINE_SLACK", defaultGoroutineSlack)))
+		go goroutines.run(interval)
+	}
+	if envBool("WARMUP", false) {
+		go warmup(startupDelay + envDuration("WARMUP_DELAY", defaultWarmupDelay))
+	}
+
+	server := &http.Server{Addr: ":8090", Handler: traceRequests(requireOriginSignature(normalizeSlashes(http.DefaultServeMux)))}
+	enterPhase(phaseStarting, "server.starting", "addr", server.Addr, configSummary())
+
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
 		log.Fatal(err)
 	}
+	go func() {
+		log.Println("Server starting on :8090")
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+	enterPhase(phaseReady, "server.ready", "addr", listener.Addr().String())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+
+	drainTimeout := envDuration("DRAIN_TIMEOUT", defaultDrainTimeout)
+	log.Printf("Shutting down, waiting up to %s for streams to finish", drainTimeout)
+	enterPhase(phaseDraining, "server.shutdown.begin", "active_streams", streams.active.Load(), "drain_timeout", drainTimeout.String())
+
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+
+	go streams.drain(ctx)
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Shutdown timed out, closing remaining connections: %v", err)
+		cancelB2Calls()
+		server.Close()
+	}
+	log.Println("Server stopped")
+	enterPhase(phaseStopped, "server.shutdown.complete", "uptime", time.Since(startTime).Round(time.Second).String())
 }
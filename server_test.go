@@ -0,0 +1,596 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+)
+
+func TestStaticHandlerServesDirectory(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "index.html"), []byte("<h1>radio</h1>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	staticHandler(dir).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200", rec.Code)
+	}
+	if body, _ := io.ReadAll(rec.Body); string(body) != "<h1>radio</h1>" {
+		t.Fatalf("unexpected body %q", body)
+	}
+}
+
+func TestStaticHandlerMissingDirectory(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "missing")
+
+	rec := httptest.NewRecorder()
+	staticHandler(dir).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("status %d, want 500", rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), "STATIC_DIR") {
+		t.Fatalf("message doesn't mention STATIC_DIR: %q", rec.Body.String())
+	}
+}
+
+// Point b2ClientFromEnv at an endpoint nothing listens on, for handlers whose
+// test shouldn't reach B2
+func setB2Env(t *testing.T) {
+	useSharedB2(t)
+	t.Setenv("KEY_ID", "key")
+	t.Setenv("APPLICATION_KEY", "secret")
+	t.Setenv("BUCKET_NAME", "bucket")
+	t.Setenv("ENDPOINT", "http://127.0.0.1:1")
+}
+
+// The /stream handler as main builds it, on the client for this test's env
+func newStreamHandler(t *testing.T) *streamHandler {
+	t.Helper()
+	client, err := b2ClientFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &streamHandler{client: client}
+}
+
+// Start from an unbuilt shared client, so it connects with this test's env
+func useSharedB2(t *testing.T) {
+	previous := sharedB2
+	t.Cleanup(func() { sharedB2 = previous })
+	sharedB2 = &reauthClient{connect: newB2ClientFromEnv}
+}
+
+// Serve handlers a fresh listing of files, as if just fetched from B2
+func useListing(t *testing.T, files []string) {
+	var objects []objectInfo
+	for _, name := range files {
+		objects = append(objects, objectInfo{Key: name, ETag: `"` + name + `"`})
+	}
+
+	listing.mu.Lock()
+	listing.objects, listing.files, listing.fetchedAt = objects, files, time.Now()
+	listing.mu.Unlock()
+
+	t.Cleanup(func() {
+		listing.mu.Lock()
+		listing.objects, listing.files, listing.fetchedAt = nil, nil, time.Time{}
+		listing.mu.Unlock()
+	})
+}
+
+// In-memory B2 for handler tests. Methods a test doesn't set up fall through
+// to the nil embedded interface and panic, so unexpected B2 calls are loud.
+type fakeB2 struct {
+	B2
+
+	mu        sync.Mutex
+	files     map[string][]byte
+	metadata  map[string]map[string]string
+	listErr   error
+	listCalls int
+	heads     int
+	downloads []string
+	fetches   []string
+	dir       string
+}
+
+func newFakeB2(t *testing.T, files map[string][]byte) *fakeB2 {
+	return &fakeB2{files: files, dir: t.TempDir()}
+}
+
+func (f *fakeB2) listFiles() ([]string, error) {
+	objects, err := f.listObjects()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(objects))
+	for _, object := range objects {
+		names = append(names, object.Key)
+	}
+	return names, nil
+}
+
+func fakeETag(data []byte) string {
+	return fmt.Sprintf(`"%x"`, md5.Sum(data))
+}
+
+func (f *fakeB2) listObjects() ([]objectInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.listCalls++
+	if f.listErr != nil {
+		return nil, f.listErr
+	}
+	objects := make([]objectInfo, 0, len(f.files))
+	for name, data := range f.files {
+		objects = append(objects, objectInfo{Key: name, Size: int64(len(data)), ETag: fakeETag(data)})
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+func (f *fakeB2) headFile(fileName string) (*objectHead, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.heads++
+	data, ok := f.files[fileName]
+	if !ok {
+		return nil, fmt.Errorf("no such key: %s", fileName)
+	}
+	return &objectHead{Size: int64(len(data)), ETag: fakeETag(data), Metadata: f.metadata[fileName]}, nil
+}
+
+func (f *fakeB2) selectRandomFile(fileNames []string) (string, error) {
+	if len(fileNames) == 0 {
+		return "", errors.New("no files found")
+	}
+	return fileNames[rand.Intn(len(fileNames))], nil
+}
+
+func (f *fakeB2) downloadFile(fileName string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	data, ok := f.files[fileName]
+	if !ok {
+		return "", fmt.Errorf("no such key: %s", fileName)
+	}
+	f.downloads = append(f.downloads, fileName)
+	filePath := filepath.Join(f.dir, filepath.FromSlash(fileName))
+	if err := os.MkdirAll(filepath.Dir(filePath), 0o755); err != nil {
+		return "", err
+	}
+	return filePath, os.WriteFile(filePath, data, 0o644)
+}
+
+func (f *fakeB2) fetchCount(rangeHeader string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var count int
+	for _, fetched := range f.fetches {
+		if fetched == rangeHeader {
+			count++
+		}
+	}
+	return count
+}
+
+func (f *fakeB2) fetchRange(fileName, rangeHeader string) (*rangeResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	data, ok := f.files[fileName]
+	if !ok {
+		return nil, fmt.Errorf("no such key: %s", fileName)
+	}
+	f.fetches = append(f.fetches, rangeHeader)
+
+	size := int64(len(data))
+	span := byteRange{0, size}
+	if r, ok := parseByteRange(rangeHeader, size); ok {
+		span = r
+	}
+	return &rangeResult{body: io.NopCloser(bytes.NewReader(data[span.start:span.end])), span: span, size: size, etag: fakeETag(data)}, nil
+}
+
+func TestB2OptionsWiredIntoS3Options(t *testing.T) {
+	tests := []struct {
+		name string
+		opts b2Options
+	}{
+		{"defaults", b2Options{usePathStyle: true}},
+		{"virtual hosted", b2Options{usePathStyle: false}},
+		{"checksums when required", b2Options{usePathStyle: true, checksumWhenRequired: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := NewB2Client("http://127.0.0.1:1", "us-east-1", "key", "secret", "bucket", tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			o := client.(*B2Client).s3Client.Options()
+			if o.UsePathStyle != tt.opts.usePathStyle {
+				t.Fatalf("UsePathStyle %t, want %t", o.UsePathStyle, tt.opts.usePathStyle)
+			}
+			if aws.ToString(o.BaseEndpoint) != "http://127.0.0.1:1" {
+				t.Fatalf("BaseEndpoint %s", aws.ToString(o.BaseEndpoint))
+			}
+
+			wantCalculation := aws.RequestChecksumCalculationWhenSupported
+			wantValidation := aws.ResponseChecksumValidationWhenSupported
+			if tt.opts.checksumWhenRequired {
+				wantCalculation = aws.RequestChecksumCalculationWhenRequired
+				wantValidation = aws.ResponseChecksumValidationWhenRequired
+			}
+			if o.RequestChecksumCalculation != wantCalculation || o.ResponseChecksumValidation != wantValidation {
+				t.Fatalf("checksum settings %v/%v, want %v/%v",
+					o.RequestChecksumCalculation, o.ResponseChecksumValidation, wantCalculation, wantValidation)
+			}
+		})
+	}
+}
+
+// S3-compatible endpoint serving a fixed set of objects, for tests that go
+// through a real B2Client
+type s3Stub struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	objects  map[string][]byte
+	gets     map[string]int
+	requests []string
+
+	// GETs of these keys 404 this many times before succeeding, like a
+	// fresh upload that is listed but not readable yet
+	notReadable map[string]int
+
+	// Listing the bucket is denied, which the SDK doesn't retry
+	denyList bool
+
+	// GETs of these keys are denied
+	forbidden map[string]bool
+
+	// Older versions of objects, by key and version ID
+	versions map[string]map[string][]byte
+
+	// Listings are split into pages of this many keys, if set
+	pageSize int
+
+	// Whole GETs of these keys are sent chunked, without a Content-Length
+	unsized map[string]bool
+}
+
+func newS3Stub(t *testing.T, objects map[string][]byte) *s3Stub {
+	stub := &s3Stub{objects: objects, gets: map[string]int{}, notReadable: map[string]int{}}
+	stub.Server = httptest.NewServer(http.HandlerFunc(stub.serve))
+	t.Cleanup(stub.Close)
+	return stub
+}
+
+// Point b2ClientFromEnv at the stub
+func (s *s3Stub) useEnv(t *testing.T) {
+	setB2Env(t)
+	t.Setenv("ENDPOINT", s.URL)
+}
+
+func (s *s3Stub) getCount(key string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.gets[key]
+}
+
+func (s *s3Stub) requestCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.requests)
+}
+
+func (s *s3Stub) serve(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests = append(s.requests, req.Method+" "+req.URL.Path)
+	key := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, "/bucket"), "/")
+	if key == "" && s.denyList {
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `<Error><Code>AccessDenied</Code><Message>Access Denied</Message></Error>`)
+		return
+	}
+	if key == "" {
+		s.list(w, req)
+		return
+	}
+
+	data, ok := s.objects[key]
+	if version := req.URL.Query().Get("versionId"); version != "" {
+		data, ok = s.versions[key][version]
+	}
+	if s.forbidden[key] {
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `<Error><Code>AccessDenied</Code><Message>Access Denied</Message></Error>`)
+		return
+	}
+	if ok && req.Method == http.MethodGet && s.notReadable[key] > 0 {
+		s.notReadable[key]--
+		ok = false
+	}
+	if !ok {
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>`)
+		return
+	}
+	if req.Method == http.MethodGet {
+		s.gets[key]++
+	}
+	w.Header().Set("ETag", fmt.Sprintf(`"%x"`, len(data)))
+	if s.unsized[key] && req.Method == http.MethodGet && req.Header.Get("Range") == "" {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		w.Write(data)
+		return
+	}
+	http.ServeContent(w, req, key, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), bytes.NewReader(data))
+}
+
+func (s *s3Stub) list(w http.ResponseWriter, req *http.Request) {
+	prefix := req.URL.Query().Get("prefix")
+	delimiter := req.URL.Query().Get("delimiter")
+	keys := make([]string, 0, len(s.objects))
+	commonPrefixes := map[string]bool{}
+	for key := range s.objects {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				commonPrefixes[key[:len(prefix)+i+len(delimiter)]] = true
+				continue
+			}
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// Continuation tokens are the index of the page's first key
+	start, _ := strconv.Atoi(req.URL.Query().Get("continuation-token"))
+	end := len(keys)
+	if s.pageSize > 0 && start+s.pageSize < end {
+		end = start + s.pageSize
+	}
+	truncated := end < len(keys)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><Name>bucket</Name><IsTruncated>%t</IsTruncated>`, truncated)
+	if truncated {
+		fmt.Fprintf(&b, `<NextContinuationToken>%d</NextContinuationToken>`, end)
+	}
+	for _, key := range keys[start:end] {
+		fmt.Fprintf(&b, `<Contents><Key>%s</Key><Size>%d</Size><ETag>"%x"</ETag><LastModified>2024-01-01T00:00:00.000Z</LastModified></Contents>`,
+			html.EscapeString(key), len(s.objects[key]), len(s.objects[key]))
+	}
+	commons := make([]string, 0, len(commonPrefixes))
+	for common := range commonPrefixes {
+		commons = append(commons, common)
+	}
+	sort.Strings(commons)
+	for _, common := range commons {
+		if truncated {
+			break
+		}
+		fmt.Fprintf(&b, `<CommonPrefixes><Prefix>%s</Prefix></CommonPrefixes>`, html.EscapeString(common))
+	}
+	b.WriteString(`</ListBucketResult>`)
+
+	w.Header().Set("Content-Type", "application/xml")
+	fmt.Fprint(w, b.String())
+}
+
+func TestStreamUsesHandlerClient(t *testing.T) {
+	t.Chdir(t.TempDir())
+	useStation(t, modeRandom)
+	useListing(t, []string{"a.mp3"})
+	stub := newS3Stub(t, map[string][]byte{"a.mp3": []byte("audio")})
+	client, err := NewB2Client(stub.URL, "us-east-1", "key", "secret", "bucket", b2Options{usePathStyle: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Requests mustn't need the environment the client was built from
+	for _, name := range []string{"KEY_ID", "APPLICATION_KEY", "BUCKET_NAME", "ENDPOINT"} {
+		t.Setenv(name, "")
+	}
+
+	rec := httptest.NewRecorder()
+	(&streamHandler{client: client}).stream(rec, httptest.NewRequest(http.MethodGet, "/stream?file=a.mp3", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "audio" {
+		t.Fatalf("status %d body %q, want the file from the startup client", rec.Code, rec.Body)
+	}
+	if stub.getCount("a.mp3") != 1 {
+		t.Fatal("the file wasn't fetched through the handler's client")
+	}
+}
+
+func TestListFilesFollowsContinuationTokens(t *testing.T) {
+	stub := newS3Stub(t, map[string][]byte{
+		"a.mp3":      []byte("a"),
+		"b.mp3":      []byte("b"),
+		"c.mp3":      []byte("c"),
+		"jazz/d.mp3": []byte("d"),
+		"jazz/e.mp3": []byte("e"),
+	})
+	stub.pageSize = 2
+	stub.useEnv(t)
+	client, err := b2ClientFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := client.listFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	if want := []string{"a.mp3", "b.mp3", "c.mp3", "jazz/d.mp3", "jazz/e.mp3"}; !slices.Equal(files, want) {
+		t.Fatalf("listed %q, want every key across the pages", files)
+	}
+	if lists := stub.requestCount(); lists != 3 {
+		t.Fatalf("%d requests, want one per page", lists)
+	}
+}
+
+func TestCustomTransportApplied(t *testing.T) {
+	opts := b2Options{
+		usePathStyle:          true,
+		dialTimeout:           3 * time.Second,
+		keepAlive:             45 * time.Second,
+		tlsHandshakeTimeout:   4 * time.Second,
+		responseHeaderTimeout: 7 * time.Second,
+		idleConnTimeout:       2 * time.Minute,
+		maxIdleConnsPerHost:   32,
+	}
+	client, err := NewB2Client("http://127.0.0.1:1", "us-east-1", "key", "secret", "bucket", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	timed, ok := client.(*B2Client).s3Client.Options().HTTPClient.(timedHTTPClient)
+	if !ok {
+		t.Fatalf("S3 client uses %T, want B2 requests timed", client.(*B2Client).s3Client.Options().HTTPClient)
+	}
+	httpClient, ok := timed.client.(*awshttp.BuildableClient)
+	if !ok {
+		t.Fatalf("timed client wraps %T, want the configured BuildableClient", timed.client)
+	}
+	transport := httpClient.GetTransport()
+	if transport.TLSHandshakeTimeout != opts.tlsHandshakeTimeout ||
+		transport.ResponseHeaderTimeout != opts.responseHeaderTimeout ||
+		transport.IdleConnTimeout != opts.idleConnTimeout ||
+		transport.MaxIdleConnsPerHost != opts.maxIdleConnsPerHost {
+		t.Fatalf("transport settings not applied: %+v", transport)
+	}
+	dialer := httpClient.GetDialer()
+	if dialer.Timeout != opts.dialTimeout || dialer.KeepAlive != opts.keepAlive {
+		t.Fatalf("dialer timeout %s keep-alive %s, want %s and %s", dialer.Timeout, dialer.KeepAlive, opts.dialTimeout, opts.keepAlive)
+	}
+	if httpClient.GetTimeout() != 0 {
+		t.Fatalf("overall timeout %s, want none so long streams aren't cut off", httpClient.GetTimeout())
+	}
+}
+
+func TestDefaultTransportKeepsSDKDefaults(t *testing.T) {
+	defaults := awshttp.NewBuildableClient().GetTransport()
+	transport := b2Options{}.httpClient().GetTransport()
+
+	if transport.TLSHandshakeTimeout != defaults.TLSHandshakeTimeout || transport.IdleConnTimeout != defaults.IdleConnTimeout {
+		t.Fatal("zero options should keep the SDK's transport defaults")
+	}
+}
+
+func TestRedirectUsesConfiguredStatus(t *testing.T) {
+	setB2Env(t)
+	useListing(t, []string{"a.mp3"})
+	useStation(t, modeRandom)
+	previous := redirectStatus
+	t.Cleanup(func() { redirectStatus = previous })
+
+	for _, status := range []int{http.StatusFound, http.StatusTemporaryRedirect} {
+		redirectStatus = status
+		rec := httptest.NewRecorder()
+		newStreamHandler(t).stream(rec, httptest.NewRequest(http.MethodGet, "/stream", nil))
+
+		if rec.Code != status {
+			t.Fatalf("status %d, want %d", rec.Code, status)
+		}
+		if location := rec.Header().Get("Location"); location != "/stream?file=a.mp3&hop=1" {
+			t.Fatalf("Location %s", location)
+		}
+	}
+}
+
+func TestRedirectKeepsKeysIntact(t *testing.T) {
+	setB2Env(t)
+	useStation(t, modeRandom)
+
+	for _, key := range []string{
+		"jazz/Blue Train.mp3",
+		"rock/Simon & Garfunkel.mp3",
+		"live/C++ Talk (2024).mp3",
+		"mixes/#1 Hits.mp3",
+		"what?/100%.mp3",
+		"español/Año Niño – été.mp3",
+	} {
+		useListing(t, []string{key})
+		rec := httptest.NewRecorder()
+		newStreamHandler(t).stream(rec, httptest.NewRequest(http.MethodGet, "/stream", nil))
+		if rec.Code != http.StatusFound {
+			t.Fatalf("%q: status %d", key, rec.Code)
+		}
+
+		// Following the redirect reads back the exact key
+		location := rec.Header().Get("Location")
+		req := httptest.NewRequest(http.MethodGet, location, nil)
+		if got := req.URL.Query().Get("file"); got != key {
+			t.Errorf("%q: %s reads back as %q", key, location, got)
+		}
+		if hop := req.URL.Query().Get(redirectHopParam); hop != "1" {
+			t.Errorf("%q: %s has hop %q", key, location, hop)
+		}
+	}
+}
+
+func TestRedirectLoopGuard(t *testing.T) {
+	setB2Env(t)
+	useListing(t, []string{"a.mp3"})
+	useStation(t, modeRandom)
+
+	rec := httptest.NewRecorder()
+	newStreamHandler(t).stream(rec, httptest.NewRequest(http.MethodGet, "/stream?hop=2", nil))
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/stream?file=a.mp3&hop=3" {
+		t.Fatalf("status %d Location %s, want a redirect counting the hop", rec.Code, rec.Header().Get("Location"))
+	}
+
+	rec = httptest.NewRecorder()
+	newStreamHandler(t).stream(rec, httptest.NewRequest(http.MethodGet, "/stream?hop=3", nil))
+	if rec.Code != http.StatusLoopDetected {
+		t.Fatalf("status %d after %d hops, want 508", rec.Code, maxRedirectHops)
+	}
+}
+
+func TestWarmupIssuesOnePrimingCall(t *testing.T) {
+	stub := newS3Stub(t, map[string][]byte{"a.mp3": []byte("a")})
+	stub.useEnv(t)
+
+	warmup(0)
+
+	if len(stub.requests) != 1 || stub.requests[0] != "HEAD /bucket" {
+		t.Fatalf("warmup made requests %q, want a single HeadBucket", stub.requests)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func listedKeys(t *testing.T, endpoint string, opts b2Options) []string {
+	t.Helper()
+	client, err := NewB2Client(endpoint, "us-east-1", "key", "secret", "bucket", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects, err := client.listObjects()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	for _, object := range objects {
+		keys = append(keys, object.Key)
+	}
+	return keys
+}
+
+func TestShardedListingMatchesSequential(t *testing.T) {
+	stub := newS3Stub(t, map[string][]byte{
+		"top.mp3":                {1},
+		"jazz/a.mp3":             {2},
+		"jazz/bebop/b.mp3":       {3},
+		"rock/c.mp3":             {4},
+		"rock/live/d.mp3":        {5},
+		"uncovered/e.mp3":        {6},
+		"uncovered/deeper/f.mp3": {7},
+	})
+
+	sequential := listedKeys(t, stub.URL, b2Options{usePathStyle: true})
+	if len(sequential) != 7 {
+		t.Fatalf("sequential listing %q, want all 7 keys", sequential)
+	}
+
+	// Overlapping shards, and a top-level folder no shard covers
+	sharded := listedKeys(t, stub.URL, b2Options{usePathStyle: true, listingShards: []string{"jazz/", "jazz/bebop/", "rock/"}})
+	if !slices.Equal(sharded, sequential) {
+		t.Fatalf("sharded listing %q, want %q", sharded, sequential)
+	}
+}
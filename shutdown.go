@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultDrainTimeout = 30 * time.Second
+
+// Parent of every B2 call's context, cancelled when the drain timeout runs
+// out so listings and downloads still in flight don't hold up the exit.
+// Calls aren't tied to the request that made them: one download into the
+// cache serves every request waiting on it, and outlives any one of them.
+var b2Context, cancelB2Calls = context.WithCancel(context.Background())
+
+// Counts in-flight streaming responses so shutdown can wait for them
+type streamTracker struct {
+	active    atomic.Int64
+	draining  chan struct{}
+	drainOnce sync.Once
+}
+
+var streams = newStreamTracker()
+
+func newStreamTracker() *streamTracker {
+	return &streamTracker{draining: make(chan struct{})}
+}
+
+// Register a stream, returning the func that marks it finished
+func (t *streamTracker) begin() func() {
+	t.active.Add(1)
+	return func() {
+		t.active.Add(-1)
+	}
+}
+
+func (t *streamTracker) isDraining() bool {
+	select {
+	case <-t.draining:
+		return true
+	default:
+		return false
+	}
+}
+
+// Signal streams to wrap up, then log progress until they have all finished
+// or ctx expires. Continuous streams stop at their next track boundary.
+func (t *streamTracker) drain(ctx context.Context) {
+	t.drainOnce.Do(func() { close(t.draining) })
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		active := t.active.Load()
+		if active == 0 {
+			log.Printf("All streams drained")
+			return
+		}
+		log.Printf("Draining: %d streams still active", active)
+
+		select {
+		case <-ctx.Done():
+			log.Printf("Drain timeout reached with %d streams still active", t.active.Load())
+			return
+		case <-ticker.C:
+		}
+	}
+}
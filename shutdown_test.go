@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestShutdownWaitsForInFlightStream(t *testing.T) {
+	tracker := newStreamTracker()
+	started := make(chan struct{})
+
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		done := tracker.begin()
+		defer done()
+
+		w.Header().Set("Content-Length", "10")
+		w.WriteHeader(http.StatusOK)
+		http.NewResponseController(w).Flush()
+		close(started)
+
+		// Keep streaming a while after shutdown begins
+		for range 10 {
+			time.Sleep(20 * time.Millisecond)
+			w.Write([]byte("x"))
+		}
+	})}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+
+	body := make(chan []byte, 1)
+	go func() {
+		resp, err := http.Get("http://" + listener.Addr().String())
+		if err != nil {
+			t.Error(err)
+			body <- nil
+			return
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		body <- data
+	}()
+	<-started
+
+	if tracker.active.Load() != 1 {
+		t.Fatalf("%d active streams, want 1", tracker.active.Load())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	drained := make(chan struct{})
+	go func() {
+		tracker.drain(ctx)
+		close(drained)
+	}()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+
+	if data := <-body; string(data) != "xxxxxxxxxx" {
+		t.Fatalf("stream was cut short: got %q", data)
+	}
+	select {
+	case <-drained:
+	case <-time.After(3 * time.Second):
+		t.Fatal("drain didn't notice the stream finishing")
+	}
+	if tracker.active.Load() != 0 {
+		t.Fatalf("%d active streams after shutdown, want 0", tracker.active.Load())
+	}
+}
+
+func TestDrainSignalsStreams(t *testing.T) {
+	tracker := newStreamTracker()
+	if tracker.isDraining() {
+		t.Fatal("draining before shutdown")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	tracker.drain(ctx)
+	tracker.drain(ctx)
+
+	if !tracker.isDraining() {
+		t.Fatal("continuous streams weren't told to wrap up")
+	}
+}
+
+func TestDrainGivesUpAtTimeout(t *testing.T) {
+	tracker := newStreamTracker()
+	tracker.begin()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	finished := make(chan struct{})
+	go func() {
+		tracker.drain(ctx)
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(3 * time.Second):
+		t.Fatal("drain kept waiting past its deadline")
+	}
+}
+
+func TestCancelledB2CallsReturn(t *testing.T) {
+	previousContext, previousCancel := b2Context, cancelB2Calls
+	t.Cleanup(func() { b2Context, cancelB2Calls = previousContext, previousCancel })
+	b2Context, cancelB2Calls = context.WithCancel(context.Background())
+
+	// An endpoint that never answers, like B2 stalling mid-shutdown
+	release := make(chan struct{})
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+	}))
+	t.Cleanup(hanging.Close)
+	t.Cleanup(func() { close(release) })
+	client, err := NewB2Client(hanging.URL, "us-east-1", "key", "secret", "bucket", b2Options{usePathStyle: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.headFile("a.mp3")
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancelB2Calls()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("got %v, want the call cancelled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the B2 call kept going after cancellation")
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStartupJitterWithinBounds(t *testing.T) {
+	t.Setenv("STARTUP_JITTER", "2s")
+
+	seen := map[time.Duration]bool{}
+	for range 100 {
+		delay := startupJitter()
+		if delay < 0 || delay >= 2*time.Second {
+			t.Fatalf("delay %s outside [0, 2s)", delay)
+		}
+		seen[delay/(200*time.Millisecond)] = true
+	}
+	if len(seen) < 5 {
+		t.Fatalf("delays landed in %d of 10 windows, want them spread out", len(seen))
+	}
+
+	t.Setenv("STARTUP_JITTER", "")
+	if delay := startupJitter(); delay != 0 {
+		t.Fatalf("delay %s without STARTUP_JITTER, want none", delay)
+	}
+}
+
+func TestWarmWaitsForStartupDelay(t *testing.T) {
+	stub := newS3Stub(t, map[string][]byte{"a.mp3": []byte("a")})
+	stub.useEnv(t)
+	useListing(t, nil)
+	listing.mu.Lock()
+	listing.fetchedAt = time.Time{}
+	listing.mu.Unlock()
+
+	const delay = 200 * time.Millisecond
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		listing.warm(delay)
+		close(done)
+	}()
+
+	time.Sleep(delay / 2)
+	if count := stub.requestCount(); count != 0 {
+		t.Fatalf("%d B2 requests before the startup delay ran out", count)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the initial listing never finished")
+	}
+	if elapsed := time.Since(start); elapsed < delay {
+		t.Fatalf("listed after %s, want at least %s", elapsed, delay)
+	}
+	if !listing.contains("a.mp3") {
+		t.Fatal("the initial listing wasn't stored")
+	}
+}
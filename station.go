@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultStationName = "default"
+	stationHistorySize = 50
+)
+
+// A station is a view of the bucket (optionally narrowed to a key prefix)
+// with its own selector, now-playing, history and listener count, so that
+// stations sharing the process never influence each other's picks
+type station struct {
+	name     string
+	prefix   string
+	selector *trackSelector
+
+	// Shown to players and directories, set from STATION_TITLE_<NAME> and
+	// STATION_DESCRIPTION_<NAME>
+	title       string
+	description string
+
+	listeners atomic.Int64
+
+	mu         sync.Mutex
+	nowPlaying string
+	plays      int64
+	history    []play // oldest first, capped at stationHistorySize
+}
+
+type play struct {
+	File string    `json:"file"`
+	At   time.Time `json:"at"`
+}
+
+type stationRegistry struct {
+	stations map[string]*station
+}
+
+var stations = &stationRegistry{stations: map[string]*station{}}
+
+func (r *stationRegistry) add(name, prefix string, cfg selectorConfig) error {
+	if _, ok := r.stations[name]; ok {
+		return fmt.Errorf("duplicate station: %s", name)
+	}
+
+	cfg.station = name
+	selector, err := newTrackSelector(cfg)
+	if err != nil {
+		return err
+	}
+
+	suffix := stationEnvSuffix(name)
+	r.stations[name] = &station{
+		name:        name,
+		prefix:      prefix,
+		selector:    selector,
+		title:       envString("STATION_TITLE_"+suffix, "radio-paje "+name),
+		description: os.Getenv("STATION_DESCRIPTION_" + suffix),
+	}
+	return nil
+}
+
+func (r *stationRegistry) get(name string) (*station, bool) {
+	if name == "" {
+		name = defaultStationName
+	}
+	st, ok := r.stations[name]
+	return st, ok
+}
+
+func (r *stationRegistry) all() []*station {
+	list := make([]*station, 0, len(r.stations))
+	for _, st := range r.stations {
+		list = append(list, st)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+	return list
+}
+
+// Resolve the ?station= parameter, writing a 404 for unknown stations
+func stationFor(w http.ResponseWriter, req *http.Request) (*station, bool) {
+	name := req.URL.Query().Get("station")
+	st, ok := stations.get(name)
+	if !ok {
+		http.Error(w, "Unknown station", http.StatusNotFound)
+	}
+	return st, ok
+}
+
+// Parse STATIONS, a comma-separated list of name=prefix pairs
+func parseStations(value string) (map[string]string, error) {
+	parsed := map[string]string{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		name, prefix, ok := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid station %q, expected name=prefix", entry)
+		}
+		if _, dup := parsed[name]; dup {
+			return nil, fmt.Errorf("duplicate station: %s", name)
+		}
+		parsed[name] = strings.TrimSpace(prefix)
+	}
+	return parsed, nil
+}
+
+// Listing filtered down to files this station may select
+func (s *station) candidates(b2Client B2) ([]string, error) {
+	files, err := selectionCandidates(b2Client)
+	if err != nil || s.prefix == "" {
+		return files, err
+	}
+
+	var scoped []string
+	for _, name := range files {
+		if strings.HasPrefix(name, s.prefix) {
+			scoped = append(scoped, name)
+		}
+	}
+	return scoped, nil
+}
+
+func (s *station) recordPlay(file string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nowPlaying = file
+	s.plays++
+	s.history = append(s.history, play{File: file, At: time.Now()})
+	if len(s.history) > stationHistorySize {
+		s.history = s.history[len(s.history)-stationHistorySize:]
+	}
+}
+
+// Track the listener for the lifetime of a radio connection
+func (s *station) join() func() {
+	s.listeners.Add(1)
+	return func() { s.listeners.Add(-1) }
+}
+
+// Up to limit of the latest plays, newest first
+func (s *station) recent(limit int) []play {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := min(limit, len(s.history))
+	recent := make([]play, 0, n)
+	for i := len(s.history) - 1; i >= len(s.history)-n; i-- {
+		recent = append(recent, s.history[i])
+	}
+	return recent
+}
+
+const defaultRecentLimit = 20
+
+// Tracks the station played lately, newest first, from the same history
+// /stats reports
+func recentHandler(w http.ResponseWriter, req *http.Request) {
+	limit := defaultRecentLimit
+	if value := req.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "Invalid limit parameter", http.StatusBadRequest)
+			return
+		}
+		limit = min(parsed, stationHistorySize)
+	}
+
+	st, ok := stationFor(w, req)
+	if !ok {
+		return
+	}
+	writeJSON(w, st.recent(limit))
+}
+
+type stationStatus struct {
+	Name       string `json:"name"`
+	Prefix     string `json:"prefix,omitempty"`
+	NowPlaying string `json:"now_playing,omitempty"`
+	Listeners  int64  `json:"listeners"`
+	Plays      int64  `json:"plays"`
+	History    []play `json:"history"`
+}
+
+func (s *station) status() stationStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return stationStatus{
+		Name:       s.name,
+		Prefix:     s.prefix,
+		NowPlaying: s.nowPlaying,
+		Listeners:  s.listeners.Load(),
+		Plays:      s.plays,
+		History:    append([]play{}, s.history...),
+	}
+}
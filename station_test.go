@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+// Replace the stations with a single default station using mode
+func useStation(t *testing.T, mode string) *station {
+	t.Helper()
+	previous := stations
+	t.Cleanup(func() { stations = previous })
+
+	stations = &stationRegistry{stations: map[string]*station{}}
+	if err := stations.add(defaultStationName, "", selectorConfig{mode: mode, seed: randomSeed()}); err != nil {
+		t.Fatal(err)
+	}
+	st, _ := stations.get(defaultStationName)
+	return st
+}
+
+func TestStationsKeepSeparateHistories(t *testing.T) {
+	t.Chdir(t.TempDir())
+	stub := newS3Stub(t, map[string][]byte{
+		"jazz/a.mp3": []byte("a"),
+		"jazz/b.mp3": []byte("b"),
+		"rock/c.mp3": []byte("c"),
+	})
+	stub.useEnv(t)
+	useListing(t, []string{"jazz/a.mp3", "jazz/b.mp3", "rock/c.mp3"})
+	useStation(t, modeSequential)
+	for name, prefix := range map[string]string{"jazz": "jazz/", "rock": "rock/"} {
+		if err := stations.add(name, prefix, selectorConfig{mode: modeSequential, seed: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Pick a track on the station, then follow the redirect to stream it
+	play := func(station string) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		newStreamHandler(t).stream(rec, httptest.NewRequest(http.MethodGet, "/stream?station="+station, nil))
+		if rec.Code != redirectStatus {
+			t.Fatalf("status %d: %s", rec.Code, rec.Body)
+		}
+
+		location := rec.Header().Get("Location")
+		rec = httptest.NewRecorder()
+		newStreamHandler(t).stream(rec, httptest.NewRequest(http.MethodGet, location, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status %d streaming %s", rec.Code, location)
+		}
+	}
+	play("jazz")
+	play("jazz")
+	play("rock")
+
+	history := func(station string) []string {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		stats(rec, httptest.NewRequest(http.MethodGet, "/stats?station="+station, nil))
+		var response statsResponse
+		if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		if len(response.Stations) != 1 {
+			t.Fatalf("stations %+v, want only %s", response.Stations, station)
+		}
+		files := []string{}
+		for _, p := range response.Stations[0].History {
+			files = append(files, p.File)
+		}
+		return files
+	}
+
+	if jazz := history("jazz"); !slices.Equal(jazz, []string{"jazz/a.mp3", "jazz/b.mp3"}) {
+		t.Fatalf("jazz history %q", jazz)
+	}
+	if rock := history("rock"); !slices.Equal(rock, []string{"rock/c.mp3"}) {
+		t.Fatalf("rock history %q", rock)
+	}
+	if other := history(defaultStationName); len(other) != 0 {
+		t.Fatalf("default station history %q, want plays kept on their own stations", other)
+	}
+}
+
+func TestUnknownStation(t *testing.T) {
+	useStation(t, modeRandom)
+
+	rec := httptest.NewRecorder()
+	queue(rec, httptest.NewRequest(http.MethodGet, "/queue?station=missing", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("status %d, want 404", rec.Code)
+	}
+}
+
+func TestParseStations(t *testing.T) {
+	parsed, err := parseStations(" jazz=jazz/ , rock=rock/,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed) != 2 || parsed["jazz"] != "jazz/" || parsed["rock"] != "rock/" {
+		t.Fatalf("parsed %v", parsed)
+	}
+	for _, value := range []string{"jazz", "=jazz/", "a=x,a=y"} {
+		if _, err := parseStations(value); err == nil {
+			t.Errorf("%q: expected an error", value)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	recentErrorLimit     = 20
+	statusRefreshSeconds = 10
+)
+
+type recentError struct {
+	At      time.Time
+	Message string
+}
+
+// The last few errors reported to clients, newest first, for /status
+type errorLog struct {
+	mu      sync.Mutex
+	entries []recentError
+}
+
+var recentErrors = &errorLog{}
+
+func (l *errorLog) add(message string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.entries = append([]recentError{{At: time.Now(), Message: message}}, l.entries...)
+	if len(l.entries) > recentErrorLimit {
+		l.entries = l.entries[:recentErrorLimit]
+	}
+}
+
+func (l *errorLog) list() []recentError {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]recentError(nil), l.entries...)
+}
+
+//go:embed templates/status.html
+var statusPage string
+
+var statusTemplate = template.Must(template.New("status").Parse(statusPage))
+
+type statusData struct {
+	Refresh          int
+	Version          string
+	Uptime           string
+	Phase            string
+	ActiveStreams    int64
+	StreamsCompleted int64
+	CacheUsage       string
+	CacheHits        int64
+	CacheMisses      int64
+	B2Requests       int64
+	B2Errors         int64
+	B2LastLatency    time.Duration
+	B2AverageLatency time.Duration
+	Stations         []stationStatus
+	Errors           []recentError
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func cacheUsage() string {
+	if !cacheEnabled {
+		return "disabled"
+	}
+
+	_, total, err := listCachedFiles()
+	if err != nil {
+		return fmt.Sprintf("unknown (%v)", err)
+	}
+	if limit := currentCacheMaxBytes(); limit > 0 {
+		return fmt.Sprintf("%s of %s (%.0f%%)", formatBytes(total), formatBytes(limit), float64(total)*100/float64(limit))
+	}
+	return formatBytes(total) + ", no limit"
+}
+
+// Auto-refreshing summary for people without a Prometheus setup, built from
+// the same counters as /metrics
+func statusHandler(w http.ResponseWriter, req *http.Request) {
+	data := statusData{
+		Refresh:          statusRefreshSeconds,
+		Version:          currentVersion().Version,
+		Uptime:           time.Since(startTime).Round(time.Second).String(),
+		Phase:            currentPhase(),
+		ActiveStreams:    streams.active.Load(),
+		StreamsCompleted: metrics.streamsCompleted.Load(),
+		CacheUsage:       cacheUsage(),
+		CacheHits:        metrics.cacheHits.Load(),
+		CacheMisses:      metrics.cacheMisses.Load(),
+		B2Requests:       metrics.b2Requests.Load(),
+		B2Errors:         metrics.b2Errors.Load(),
+		B2LastLatency:    time.Duration(metrics.b2LastLatency.Load()).Round(time.Millisecond),
+		Errors:           recentErrors.list(),
+	}
+	if data.B2Requests > 0 {
+		data.B2AverageLatency = (time.Duration(metrics.b2Nanos.Load()) / time.Duration(data.B2Requests)).Round(time.Millisecond)
+	}
+	for _, st := range stations.all() {
+		data.Stations = append(data.Stations, st.status())
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := statusTemplate.Execute(w, data); err != nil {
+		log.Printf("Failed to render status page: %v", err)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStatusPageShowsLiveValues(t *testing.T) {
+	t.Chdir(t.TempDir())
+	stub := newS3Stub(t, map[string][]byte{"jazz/a.mp3": []byte("audio")})
+	stub.useEnv(t)
+	st := useStation(t, modeRandom)
+	previous := recentErrors
+	t.Cleanup(func() { recentErrors = previous })
+	recentErrors = &errorLog{}
+
+	// One B2 request through the timed client, one error shown to a client,
+	// a track playing and a stream open
+	client, err := b2ClientFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.downloadFile("jazz/a.mp3"); err != nil {
+		t.Fatal(err)
+	}
+	b2Error(httptest.NewRecorder(), "Failed to fetch file", errors.New("connection reset by peer"))
+	st.recordPlay("jazz/a.mp3")
+	done := streams.begin()
+	defer done()
+
+	rec := httptest.NewRecorder()
+	statusHandler(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("status %d type %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+
+	page := rec.Body.String()
+	for _, want := range []string{
+		fmt.Sprintf(`content="%d"`, statusRefreshSeconds),
+		fmt.Sprintf("<th>Active streams</th><td>%d</td>", streams.active.Load()),
+		fmt.Sprintf("<th>B2 requests</th><td>%d (", metrics.b2Requests.Load()),
+		"<th>Cache</th><td>5 B, no limit</td>",
+		"<td>default</td><td>jazz/a.mp3</td>",
+		"Failed to fetch file: connection reset by peer",
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("page lacks %q", want)
+		}
+	}
+	if metrics.b2Requests.Load() == 0 {
+		t.Fatal("the B2 download wasn't counted")
+	}
+}
+
+func TestRecentErrorsNewestFirstAndCapped(t *testing.T) {
+	errs := &errorLog{}
+	for i := range recentErrorLimit + 5 {
+		errs.add(fmt.Sprintf("error %d", i))
+	}
+
+	entries := errs.list()
+	if len(entries) != recentErrorLimit {
+		t.Fatalf("%d entries, want %d", len(entries), recentErrorLimit)
+	}
+	if entries[0].Message != fmt.Sprintf("error %d", recentErrorLimit+4) {
+		t.Fatalf("first entry %q, want the newest", entries[0].Message)
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	for n, want := range map[int64]string{
+		512:     "512 B",
+		2048:    "2.0 KiB",
+		5 << 20: "5.0 MiB",
+		3 << 30: "3.0 GiB",
+	} {
+		if got := formatBytes(n); got != want {
+			t.Errorf("%d: got %s, want %s", n, got, want)
+		}
+	}
+}
@@ -0,0 +1,523 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"unicode/utf16"
+)
+
+// Upper bound on how much of a file we read looking for tags, so a corrupt
+// size field can't make us allocate the whole file
+const maxTagBytes = 16 << 20
+
+var errNoTags = errors.New("no supported tags found")
+
+// Tag values keyed by upper-case name (TITLE, ARTIST, REPLAYGAIN_TRACK_GAIN)
+type audioTags map[string]string
+
+type id3Frame struct {
+	id      string
+	data    []byte
+	version byte // major version of the enclosing tag, needed for sub-frames
+}
+
+func readTags(filePath string) (audioTags, error) {
+	file, err := openCached(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	magic, err := r.Peek(4)
+	if err != nil {
+		return nil, errNoTags
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, []byte("ID3")):
+		frames, err := readID3Frames(r)
+		if err != nil {
+			return nil, err
+		}
+		return id3Tags(frames), nil
+	case bytes.Equal(magic, []byte("fLaC")):
+		blocks, err := readFLACBlocks(r)
+		if err != nil {
+			return nil, err
+		}
+		for _, block := range blocks {
+			if block.kind == flacVorbisComment {
+				return parseVorbisComments(block.data)
+			}
+		}
+		return nil, errNoTags
+	case bytes.Equal(magic, []byte("OggS")):
+		return readOggTags(r)
+	}
+
+	return nil, errNoTags
+}
+
+func synchsafe(b []byte) int {
+	return int(b[0])<<21 | int(b[1])<<14 | int(b[2])<<7 | int(b[3])
+}
+
+// Read the frames of an ID3v2.3/2.4 tag at the start of r
+func readID3Frames(r io.Reader) ([]id3Frame, error) {
+	header := make([]byte, 10)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if string(header[:3]) != "ID3" {
+		return nil, errNoTags
+	}
+
+	version := header[3]
+	if version != 3 && version != 4 {
+		return nil, errNoTags
+	}
+
+	size := synchsafe(header[6:10])
+	if size > maxTagBytes {
+		return nil, errors.New("ID3 tag too large")
+	}
+
+	tag := make([]byte, size)
+	if _, err := io.ReadFull(r, tag); err != nil {
+		return nil, err
+	}
+
+	// Skip the extended header if present
+	if header[5]&0x40 != 0 && len(tag) >= 4 {
+		extSize := int(binary.BigEndian.Uint32(tag[:4])) + 4
+		if version == 4 {
+			extSize = synchsafe(tag[:4])
+		}
+		if extSize > len(tag) {
+			return nil, errors.New("invalid ID3 extended header")
+		}
+		tag = tag[extSize:]
+	}
+
+	return parseID3Frames(tag, version), nil
+}
+
+func parseID3Frames(tag []byte, version byte) []id3Frame {
+	var frames []id3Frame
+	for len(tag) >= 10 && tag[0] != 0 {
+		id := string(tag[:4])
+		frameSize := int(binary.BigEndian.Uint32(tag[4:8]))
+		if version == 4 {
+			frameSize = synchsafe(tag[4:8])
+		}
+		if frameSize < 0 || 10+frameSize > len(tag) {
+			break
+		}
+
+		frames = append(frames, id3Frame{id: id, data: tag[10 : 10+frameSize], version: version})
+		tag = tag[10+frameSize:]
+	}
+	return frames
+}
+
+var id3TextFrames = map[string]string{
+	"TIT2": "TITLE",
+	"TPE1": "ARTIST",
+	"TALB": "ALBUM",
+	"TRCK": "TRACKNUMBER",
+}
+
+func id3Tags(frames []id3Frame) audioTags {
+	tags := audioTags{}
+	for _, frame := range frames {
+		if len(frame.data) < 1 {
+			continue
+		}
+
+		if name, ok := id3TextFrames[frame.id]; ok {
+			tags[name] = decodeID3Text(frame.data[0], frame.data[1:])
+			continue
+		}
+
+		// User-defined text: description then value, e.g. REPLAYGAIN_TRACK_GAIN
+		if frame.id == "TXXX" {
+			encoding := frame.data[0]
+			description, value := splitID3String(encoding, frame.data[1:])
+			tags[strings.ToUpper(decodeID3Text(encoding, description))] = decodeID3Text(encoding, value)
+		}
+	}
+	return tags
+}
+
+// Split a null-terminated string off the front of data, honouring the
+// two-byte terminator of UTF-16 encodings
+func splitID3String(encoding byte, data []byte) ([]byte, []byte) {
+	if encoding == 1 || encoding == 2 {
+		for i := 0; i+1 < len(data); i += 2 {
+			if data[i] == 0 && data[i+1] == 0 {
+				return data[:i], data[i+2:]
+			}
+		}
+		return data, nil
+	}
+
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		return data[:i], data[i+1:]
+	}
+	return data, nil
+}
+
+func decodeID3Text(encoding byte, data []byte) string {
+	switch encoding {
+	case 0:
+		// ISO-8859-1 maps directly onto the first 256 code points
+		runes := make([]rune, len(data))
+		for i, b := range data {
+			runes[i] = rune(b)
+		}
+		return strings.TrimRight(string(runes), "\x00")
+	case 1, 2:
+		bigEndian := encoding == 2
+		if len(data) >= 2 {
+			if data[0] == 0xFF && data[1] == 0xFE {
+				bigEndian, data = false, data[2:]
+			} else if data[0] == 0xFE && data[1] == 0xFF {
+				bigEndian, data = true, data[2:]
+			}
+		}
+		units := make([]uint16, len(data)/2)
+		for i := range units {
+			if bigEndian {
+				units[i] = binary.BigEndian.Uint16(data[2*i:])
+			} else {
+				units[i] = binary.LittleEndian.Uint16(data[2*i:])
+			}
+		}
+		return strings.TrimRight(string(utf16.Decode(units)), "\x00")
+	default:
+		return strings.TrimRight(string(data), "\x00")
+	}
+}
+
+const (
+	flacVorbisComment = 4
+	flacPicture       = 6
+)
+
+type flacBlock struct {
+	kind byte
+	data []byte
+}
+
+// Read the metadata blocks following the fLaC marker
+func readFLACBlocks(r io.Reader) ([]flacBlock, error) {
+	marker := make([]byte, 4)
+	if _, err := io.ReadFull(r, marker); err != nil {
+		return nil, err
+	}
+
+	var blocks []flacBlock
+	total := 0
+	for {
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil, err
+		}
+
+		last := header[0]&0x80 != 0
+		kind := header[0] & 0x7F
+		length := int(header[1])<<16 | int(header[2])<<8 | int(header[3])
+
+		total += length
+		if total > maxTagBytes {
+			return nil, errors.New("FLAC metadata too large")
+		}
+
+		data := make([]byte, length)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, flacBlock{kind: kind, data: data})
+
+		if last {
+			return blocks, nil
+		}
+	}
+}
+
+// Parse a Vorbis comment block (little-endian lengths, KEY=value entries)
+func parseVorbisComments(data []byte) (audioTags, error) {
+	errInvalid := errors.New("invalid vorbis comment block")
+
+	readLength := func() (int, bool) {
+		if len(data) < 4 {
+			return 0, false
+		}
+		n := int(binary.LittleEndian.Uint32(data[:4]))
+		data = data[4:]
+		return n, n <= len(data)
+	}
+
+	vendorLength, ok := readLength()
+	if !ok {
+		return nil, errInvalid
+	}
+	data = data[vendorLength:]
+
+	if len(data) < 4 {
+		return nil, errInvalid
+	}
+	count := int(binary.LittleEndian.Uint32(data[:4]))
+	data = data[4:]
+
+	tags := audioTags{}
+	for range count {
+		length, ok := readLength()
+		if !ok {
+			return nil, errInvalid
+		}
+		key, value, found := strings.Cut(string(data[:length]), "=")
+		if found {
+			tags[strings.ToUpper(key)] = value
+		}
+		data = data[length:]
+	}
+	return tags, nil
+}
+
+// Splits an Ogg bitstream into packets of its first logical stream
+type oggPacketReader struct {
+	r       io.Reader
+	serial  uint32
+	started bool
+	pending [][]byte // complete packets not yet returned
+	partial []byte
+	total   int
+}
+
+func (o *oggPacketReader) next() ([]byte, error) {
+	for len(o.pending) == 0 {
+		if err := o.readPage(); err != nil {
+			return nil, err
+		}
+	}
+
+	packet := o.pending[0]
+	o.pending = o.pending[1:]
+	return packet, nil
+}
+
+func (o *oggPacketReader) readPage() error {
+	header := make([]byte, 27)
+	if _, err := io.ReadFull(o.r, header); err != nil {
+		return err
+	}
+	if string(header[:4]) != "OggS" {
+		return errors.New("invalid ogg page")
+	}
+
+	serial := binary.LittleEndian.Uint32(header[14:18])
+	segmentTable := make([]byte, header[26])
+	if _, err := io.ReadFull(o.r, segmentTable); err != nil {
+		return err
+	}
+
+	pageSize := 0
+	for _, size := range segmentTable {
+		pageSize += int(size)
+	}
+	o.total += pageSize
+	if o.total > maxTagBytes {
+		return errors.New("ogg headers too large")
+	}
+
+	page := make([]byte, pageSize)
+	if _, err := io.ReadFull(o.r, page); err != nil {
+		return err
+	}
+
+	if !o.started {
+		o.serial, o.started = serial, true
+	}
+	if serial != o.serial {
+		return nil
+	}
+
+	// A segment shorter than 255 bytes ends the current packet
+	for _, size := range segmentTable {
+		o.partial = append(o.partial, page[:size]...)
+		page = page[size:]
+		if size < 255 {
+			o.pending = append(o.pending, o.partial)
+			o.partial = nil
+		}
+	}
+	return nil
+}
+
+// The comment header is the second packet of a Vorbis or Opus stream
+func readOggTags(r io.Reader) (audioTags, error) {
+	packets := &oggPacketReader{r: r}
+	if _, err := packets.next(); err != nil {
+		return nil, err
+	}
+
+	comments, err := packets.next()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(comments, []byte("\x03vorbis")):
+		return parseVorbisComments(comments[7:])
+	case bytes.HasPrefix(comments, []byte("OpusTags")):
+		return parseVorbisComments(comments[8:])
+	}
+
+	return nil, errNoTags
+}
+
+const frontCoverPicture = 3
+
+type picture struct {
+	kind     uint32
+	mimeType string
+	data     []byte
+}
+
+// Extract embedded cover art: APIC frames in ID3v2, PICTURE blocks in FLAC
+// and METADATA_BLOCK_PICTURE comments in Ogg. Front covers are preferred.
+func readPicture(filePath string) (*picture, error) {
+	file, err := openCached(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	magic, err := r.Peek(4)
+	if err != nil {
+		return nil, errNoTags
+	}
+
+	var pictures []*picture
+	switch {
+	case bytes.HasPrefix(magic, []byte("ID3")):
+		frames, err := readID3Frames(r)
+		if err != nil {
+			return nil, err
+		}
+		for _, frame := range frames {
+			if frame.id == "APIC" {
+				if pic, ok := parseAPIC(frame.data); ok {
+					pictures = append(pictures, pic)
+				}
+			}
+		}
+	case bytes.Equal(magic, []byte("fLaC")):
+		blocks, err := readFLACBlocks(r)
+		if err != nil {
+			return nil, err
+		}
+		for _, block := range blocks {
+			if block.kind == flacPicture {
+				if pic, ok := parseFLACPicture(block.data); ok {
+					pictures = append(pictures, pic)
+				}
+			}
+		}
+	case bytes.Equal(magic, []byte("OggS")):
+		tags, err := readOggTags(r)
+		if err != nil {
+			return nil, err
+		}
+		if encoded, ok := tags["METADATA_BLOCK_PICTURE"]; ok {
+			if data, err := base64.StdEncoding.DecodeString(encoded); err == nil {
+				if pic, ok := parseFLACPicture(data); ok {
+					pictures = append(pictures, pic)
+				}
+			}
+		}
+	}
+
+	if len(pictures) == 0 {
+		return nil, errNoTags
+	}
+	for _, pic := range pictures {
+		if pic.kind == frontCoverPicture {
+			return pic, nil
+		}
+	}
+	return pictures[0], nil
+}
+
+// APIC: encoding, MIME type, picture type, description, image data
+func parseAPIC(data []byte) (*picture, bool) {
+	if len(data) < 2 {
+		return nil, false
+	}
+
+	encoding := data[0]
+	mimeType, rest := splitID3String(0, data[1:])
+	if len(rest) < 1 {
+		return nil, false
+	}
+
+	kind := uint32(rest[0])
+	_, image := splitID3String(encoding, rest[1:])
+	if len(image) == 0 {
+		return nil, false
+	}
+
+	return &picture{kind: kind, mimeType: string(mimeType), data: image}, true
+}
+
+// FLAC PICTURE block: big-endian length-prefixed fields, see the FLAC spec
+func parseFLACPicture(data []byte) (*picture, bool) {
+	readUint32 := func() (uint32, bool) {
+		if len(data) < 4 {
+			return 0, false
+		}
+		n := binary.BigEndian.Uint32(data[:4])
+		data = data[4:]
+		return n, true
+	}
+	readBytes := func() ([]byte, bool) {
+		n, ok := readUint32()
+		if !ok || int(n) > len(data) {
+			return nil, false
+		}
+		b := data[:n]
+		data = data[n:]
+		return b, true
+	}
+
+	kind, ok := readUint32()
+	if !ok {
+		return nil, false
+	}
+	mimeType, ok := readBytes()
+	if !ok {
+		return nil, false
+	}
+	if _, ok := readBytes(); !ok { // description
+		return nil, false
+	}
+	if len(data) < 16 { // width, height, depth, colors
+		return nil, false
+	}
+	data = data[16:]
+
+	image, ok := readBytes()
+	if !ok || len(image) == 0 {
+		return nil, false
+	}
+
+	return &picture{kind: kind, mimeType: string(mimeType), data: image}, true
+}
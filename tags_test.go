@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func synchsafeBytes(n int) []byte {
+	return []byte{byte(n >> 21 & 0x7f), byte(n >> 14 & 0x7f), byte(n >> 7 & 0x7f), byte(n & 0x7f)}
+}
+
+func id3Frame3(id string, data []byte) []byte {
+	frame := []byte(id)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(data)))
+	return append(append(frame, 0, 0), data...)
+}
+
+func id3Frame4(id string, data []byte) []byte {
+	frame := append([]byte(id), synchsafeBytes(len(data))...)
+	return append(append(frame, 0, 0), data...)
+}
+
+// An ID3v2 tag holding frames already encoded for version
+func id3Tag(version byte, frames ...[]byte) []byte {
+	body := bytes.Join(frames, nil)
+	tag := append([]byte{'I', 'D', '3', version, 0, 0}, synchsafeBytes(len(body))...)
+	return append(tag, body...)
+}
+
+func id3Text(value string) []byte {
+	return append([]byte{3}, value...)
+}
+
+func id3UserText(description, value string) []byte {
+	return append(append(append([]byte{3}, description...), 0), value...)
+}
+
+func vorbisComment(entries ...string) []byte {
+	data := binary.LittleEndian.AppendUint32(nil, 4)
+	data = append(data, "test"...)
+	data = binary.LittleEndian.AppendUint32(data, uint32(len(entries)))
+	for _, entry := range entries {
+		data = binary.LittleEndian.AppendUint32(data, uint32(len(entry)))
+		data = append(data, entry...)
+	}
+	return data
+}
+
+func flacStream(blocks ...flacBlock) []byte {
+	data := []byte("fLaC")
+	for i, block := range blocks {
+		kind := block.kind
+		if i == len(blocks)-1 {
+			kind |= 0x80
+		}
+		length := len(block.data)
+		data = append(data, kind, byte(length>>16), byte(length>>8), byte(length))
+		data = append(data, block.data...)
+	}
+	return data
+}
+
+// An Ogg page carrying whole packets of one logical stream
+func oggPage(serial uint32, packets ...[]byte) []byte {
+	var segments []byte
+	var body []byte
+	for _, packet := range packets {
+		n := len(packet)
+		for n >= 255 {
+			segments = append(segments, 255)
+			n -= 255
+		}
+		segments = append(segments, byte(n))
+		body = append(body, packet...)
+	}
+
+	page := []byte("OggS")
+	page = append(page, 0, 0)
+	page = append(page, make([]byte, 8)...)
+	page = binary.LittleEndian.AppendUint32(page, serial)
+	page = append(page, make([]byte, 8)...)
+	page = append(page, byte(len(segments)))
+	page = append(page, segments...)
+	return append(page, body...)
+}
+
+func writeTemp(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadTagsID3(t *testing.T) {
+	for _, version := range []byte{3, 4} {
+		frame := id3Frame3
+		if version == 4 {
+			frame = id3Frame4
+		}
+		data := id3Tag(version,
+			frame("TIT2", id3Text("Blue Train")),
+			frame("TPE1", id3Text("John Coltrane")),
+			frame("TXXX", id3UserText("replaygain_track_gain", "-6.48 dB")),
+			frame("TXXX", id3UserText("REPLAYGAIN_TRACK_PEAK", "0.988553")),
+		)
+		path := writeTemp(t, "track.mp3", append(data, 0xff, 0xfb, 0x90, 0x00))
+
+		tags, err := readTags(path)
+		if err != nil {
+			t.Fatalf("v2.%d: %v", version, err)
+		}
+		if tags["TITLE"] != "Blue Train" || tags["ARTIST"] != "John Coltrane" {
+			t.Fatalf("v2.%d: unexpected tags %v", version, tags)
+		}
+		if tags["REPLAYGAIN_TRACK_GAIN"] != "-6.48 dB" || tags["REPLAYGAIN_TRACK_PEAK"] != "0.988553" {
+			t.Fatalf("v2.%d: ReplayGain tags not read: %v", version, tags)
+		}
+	}
+}
+
+func TestReadTagsUTF16(t *testing.T) {
+	// UTF-16 with a little-endian byte order mark
+	title := []byte{1, 0xff, 0xfe, 'S', 0, 0xe3, 0, 'o', 0}
+	path := writeTemp(t, "track.mp3", id3Tag(3, id3Frame3("TIT2", title)))
+
+	tags, err := readTags(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tags["TITLE"] != "São" {
+		t.Fatalf("title %q, want São", tags["TITLE"])
+	}
+}
+
+func TestReadTagsFLAC(t *testing.T) {
+	data := flacStream(
+		flacBlock{kind: 0, data: make([]byte, 34)},
+		flacBlock{kind: flacVorbisComment, data: vorbisComment("title=So What", "REPLAYGAIN_ALBUM_GAIN=-7.1 dB")},
+	)
+	tags, err := readTags(writeTemp(t, "track.flac", data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tags["TITLE"] != "So What" || tags["REPLAYGAIN_ALBUM_GAIN"] != "-7.1 dB" {
+		t.Fatalf("unexpected tags %v", tags)
+	}
+}
+
+func TestReadTagsOpus(t *testing.T) {
+	head := append([]byte("OpusHead"), make([]byte, 11)...)
+	comments := append([]byte("OpusTags"), vorbisComment("TITLE=Paranoid", "R128_TRACK_GAIN=-1280")...)
+	data := append(oggPage(7, head), oggPage(7, comments)...)
+
+	tags, err := readTags(writeTemp(t, "track.opus", data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tags["TITLE"] != "Paranoid" {
+		t.Fatalf("unexpected tags %v", tags)
+	}
+
+	gain := replayGainFromTags(tags)
+	if gain.TrackGain == nil || *gain.TrackGain != 0 {
+		t.Fatalf("R128 gain of -1280 should be 0 dB ReplayGain, got %v", gain.TrackGain)
+	}
+}
+
+func TestReadTagsUntagged(t *testing.T) {
+	if _, err := readTags(writeTemp(t, "track.wav", []byte("RIFF\x00\x00\x00\x00WAVE"))); err != errNoTags {
+		t.Fatalf("got %v, want errNoTags", err)
+	}
+}
+
+func TestParseGainValue(t *testing.T) {
+	tests := []struct {
+		value string
+		want  *float64
+	}{
+		{"-6.48 dB", ptr(-6.48)},
+		{"+2.5 dB", ptr(2.5)},
+		{"0.988553", ptr(0.988553)},
+		{"", nil},
+		{"loud", nil},
+	}
+	for _, tt := range tests {
+		got := parseGainValue(tt.value)
+		if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+			t.Errorf("%q: got %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestLoadMetadataWithoutGain(t *testing.T) {
+	t.Chdir(t.TempDir())
+	path := writeTemp(t, "track.mp3", id3Tag(4, id3Frame4("TIT2", id3Text("Untitled"))))
+
+	metadata, err := loadMetadata("track.mp3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gain := metadata.ReplayGain
+	if gain.TrackGain != nil || gain.TrackPeak != nil || gain.AlbumGain != nil || gain.AlbumPeak != nil {
+		t.Fatalf("files without gain info should report null, got %+v", gain)
+	}
+	if cached, ok := cachedMetadata("track.mp3"); !ok || cached.Title != "Untitled" {
+		t.Fatal("the sidecar wasn't written")
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
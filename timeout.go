@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// How long a download into the cache may take: base plus perMB for every
+// MiB of the object, so a large FLAC gets proportionally longer than a short
+// MP3. Set from S3_DOWNLOAD_TIMEOUT and S3_DOWNLOAD_TIMEOUT_PER_MB; a zero
+// base leaves downloads without a deadline. Proxied streams are read at the
+// listener's pace and never get one.
+type downloadTimeouts struct {
+	base  time.Duration
+	perMB time.Duration
+}
+
+// Deadline for an object of size bytes. Objects of unknown size get the
+// base alone.
+func (t downloadTimeouts) forSize(size int64) time.Duration {
+	if size <= 0 {
+		return t.base
+	}
+	return t.base + time.Duration(float64(t.perMB)*float64(size)/(1<<20))
+}
+
+// Context for downloading fileName, with the deadline its size calls for.
+// The size comes from the listing, or a HeadObject for pinned versions and
+// keys the listing doesn't have yet.
+func (b *B2Client) downloadContext(fileName, versionID string) (context.Context, context.CancelFunc) {
+	if b.timeouts.base <= 0 {
+		return context.WithCancel(b2Context)
+	}
+
+	size := int64(-1)
+	if object, ok := listing.lookup(fileName); ok && versionID == "" {
+		size = object.Size
+	} else if b.timeouts.perMB > 0 {
+		input := &s3.HeadObjectInput{
+			Bucket: aws.String(b.bucketName),
+			Key:    aws.String(b.objectKey(fileName)),
+		}
+		if versionID != "" {
+			input.VersionId = aws.String(versionID)
+		}
+		head, err := b.s3Client.HeadObject(b2Context, input)
+		if err != nil {
+			// The download reports the error, if it persists
+			log.Printf("Failed to head %s for its download timeout: %v", fileName, err)
+		} else {
+			size = aws.ToInt64(head.ContentLength)
+		}
+	}
+
+	return context.WithTimeout(b2Context, b.timeouts.forSize(size))
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestLargerObjectsGetLongerDeadlines(t *testing.T) {
+	timeouts := downloadTimeouts{base: 10 * time.Second, perMB: time.Second}
+	if got := timeouts.forSize(50 << 20); got != time.Minute {
+		t.Fatalf("50 MiB: got %s, want 1m", got)
+	}
+	if got := timeouts.forSize(-1); got != 10*time.Second {
+		t.Fatalf("unknown size: got %s, want the base", got)
+	}
+
+	stub := newS3Stub(t, map[string][]byte{
+		"short.mp3": bytes.Repeat([]byte("a"), 1<<20),
+		"long.flac": bytes.Repeat([]byte("a"), 40<<20),
+	})
+	client, err := NewB2Client(stub.URL, "us-east-1", "key", "secret", "bucket", b2Options{
+		usePathStyle:     true,
+		downloadTimeouts: timeouts,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Neither key is listed, so both sizes come from a HeadObject
+	deadline := func(key string) time.Duration {
+		ctx, cancel := client.(*B2Client).downloadContext(key, "")
+		defer cancel()
+		at, ok := ctx.Deadline()
+		if !ok {
+			t.Fatalf("%s: no deadline", key)
+		}
+		return time.Until(at)
+	}
+	short, long := deadline("short.mp3"), deadline("long.flac")
+	if short > 12*time.Second || long < 49*time.Second {
+		t.Fatalf("short %s, long %s, want about 11s and 50s", short, long)
+	}
+}
+
+func TestNoBaseTimeoutLeavesNoDeadline(t *testing.T) {
+	client := &B2Client{timeouts: downloadTimeouts{perMB: time.Second}}
+	ctx, cancel := client.downloadContext("a.mp3", "")
+	defer cancel()
+	if _, ok := ctx.Deadline(); ok {
+		t.Fatal("got a deadline without a base timeout")
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+type titleRule struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// How a filename is turned into a display title when tags are missing
+type titleOptions struct {
+	stripTrackNumbers  bool
+	replaceUnderscores bool
+	rules              []titleRule
+}
+
+var titleConfig = titleOptions{stripTrackNumbers: true, replaceUnderscores: true}
+
+// A leading track number followed by a separator: "01 - ", "01. ", "1) ", "07 "
+var trackNumberPattern = regexp.MustCompile(`^\d{1,3}(?:\s*[-.)]\s*|\s+)`)
+
+// Parse TITLE_RULES: "pattern=>replacement" pairs separated by ";", applied
+// in order after the built-in cleanups
+func parseTitleRules(value string) ([]titleRule, error) {
+	var rules []titleRule
+	for _, spec := range strings.Split(value, ";") {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+
+		pattern, replacement, ok := strings.Cut(spec, "=>")
+		if !ok {
+			return nil, fmt.Errorf("expected pattern=>replacement, got %q", spec)
+		}
+
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, titleRule{pattern: compiled, replacement: replacement})
+	}
+	return rules, nil
+}
+
+// Turn "albums/01_-_Artist_-_Title_(Remastered).mp3" into
+// "Artist - Title (Remastered)"
+func titleFromFilename(fileName string, opts titleOptions) string {
+	title := path.Base(fileName)
+	title = strings.TrimSuffix(title, path.Ext(title))
+
+	if opts.replaceUnderscores {
+		title = strings.ReplaceAll(title, "_", " ")
+	}
+	if opts.stripTrackNumbers {
+		title = trackNumberPattern.ReplaceAllString(title, "")
+	}
+	for _, rule := range opts.rules {
+		title = rule.pattern.ReplaceAllString(title, rule.replacement)
+	}
+
+	title = strings.Join(strings.Fields(title), " ")
+	if title == "" {
+		return path.Base(fileName)
+	}
+	return title
+}
+
+// Best display title for a track: tags when we have them, else the filename
+func displayTitle(fileName string, metadata *trackMetadata) string {
+	if metadata != nil && metadata.Title != "" {
+		if metadata.Artist != "" {
+			return metadata.Artist + " - " + metadata.Title
+		}
+		return metadata.Title
+	}
+	return titleFromFilename(fileName, titleConfig)
+}
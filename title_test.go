@@ -0,0 +1,64 @@
+package main
+
+import "testing"
+
+func TestTitleFromFilename(t *testing.T) {
+	defaults := titleOptions{stripTrackNumbers: true, replaceUnderscores: true}
+	rules, err := parseTitleRules(`\s*\[[^]]*\]=>;(?i)\s*\(remastered\)=>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withRules := titleOptions{stripTrackNumbers: true, replaceUnderscores: true, rules: rules}
+
+	tests := []struct {
+		fileName string
+		opts     titleOptions
+		want     string
+	}{
+		{"albums/01_-_Artist_-_Title_(Remastered).mp3", defaults, "Artist - Title (Remastered)"},
+		{"01 - Blue Train.mp3", defaults, "Blue Train"},
+		{"02. So What.flac", defaults, "So What"},
+		{"3) Paranoid.ogg", defaults, "Paranoid"},
+		{"07 Intro.mp3", defaults, "Intro"},
+		{"1999.mp3", defaults, "1999"},
+		{"Artist_-_Song.mp3", titleOptions{}, "Artist_-_Song"},
+		{"01 - Song.mp3", titleOptions{replaceUnderscores: true}, "01 - Song"},
+		{"jazz/Song   with  spaces.mp3", defaults, "Song with spaces"},
+		{"Song [320kbps] (REMASTERED).mp3", withRules, "Song"},
+		{"01.mp3", defaults, "01"},
+		{"noextension", defaults, "noextension"},
+	}
+	for _, tt := range tests {
+		if got := titleFromFilename(tt.fileName, tt.opts); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.fileName, got, tt.want)
+		}
+	}
+}
+
+func TestDisplayTitlePrefersTags(t *testing.T) {
+	tests := []struct {
+		metadata *trackMetadata
+		want     string
+	}{
+		{&trackMetadata{Title: "Blue Train", Artist: "John Coltrane"}, "John Coltrane - Blue Train"},
+		{&trackMetadata{Title: "Blue Train"}, "Blue Train"},
+		{&trackMetadata{}, "Filename Title"},
+		{nil, "Filename Title"},
+	}
+	for _, tt := range tests {
+		if got := displayTitle("01_-_Filename_Title.mp3", tt.metadata); got != tt.want {
+			t.Errorf("%+v: got %q, want %q", tt.metadata, got, tt.want)
+		}
+	}
+}
+
+func TestParseTitleRules(t *testing.T) {
+	for _, value := range []string{"no arrow", "(unclosed=>x"} {
+		if _, err := parseTitleRules(value); err == nil {
+			t.Errorf("%q: expected an error", value)
+		}
+	}
+	if rules, err := parseTitleRules(""); err != nil || len(rules) != 0 {
+		t.Fatalf("empty rules: %v %v", rules, err)
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTraceServiceName = "radio-paje-go-web"
+	traceBatchSize          = 256
+	traceFlushInterval      = 5 * time.Second
+)
+
+// Where finished spans go, or nil when tracing is off. Set from
+// OTEL_EXPORTER_OTLP_ENDPOINT, which enables OTLP/HTTP export.
+var tracer spanExporter
+
+type spanExporter interface {
+	export(s *span)
+}
+
+type traceID [16]byte
+type spanID [8]byte
+
+// An OpenTelemetry span. A nil *span stands for tracing being off, and all
+// its methods do nothing, so call sites need no checks.
+type span struct {
+	traceID traceID
+	id      spanID
+	parent  spanID
+	name    string
+	kind    int
+	start   time.Time
+	end     time.Time
+
+	mu    sync.Mutex
+	attrs map[string]any
+	err   error
+}
+
+// OTLP span kinds
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+)
+
+type spanContextKey struct{}
+
+func spanFromContext(ctx context.Context) *span {
+	s, _ := ctx.Value(spanContextKey{}).(*span)
+	return s
+}
+
+func newSpan(name string, kind int, trace traceID, parent spanID) *span {
+	s := &span{traceID: trace, parent: parent, name: name, kind: kind, start: time.Now(), attrs: make(map[string]any)}
+	rand.Read(s.id[:])
+	return s
+}
+
+// Start a span as a child of the one in ctx
+func startSpan(ctx context.Context, name string) (context.Context, *span) {
+	if tracer == nil {
+		return ctx, nil
+	}
+
+	var trace traceID
+	var parent spanID
+	if p := spanFromContext(ctx); p != nil {
+		trace, parent = p.traceID, p.id
+	} else {
+		rand.Read(trace[:])
+	}
+	s := newSpan(name, spanKindInternal, trace, parent)
+	return context.WithValue(ctx, spanContextKey{}, s), s
+}
+
+func (s *span) set(key string, value any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attrs[key] = value
+	s.mu.Unlock()
+}
+
+// Mark the span failed when err is set
+func (s *span) fail(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.err = err
+	s.mu.Unlock()
+}
+
+func (s *span) finish() {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	tracer.export(s)
+}
+
+// Trace and parent span from a W3C traceparent header, such as
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+func parseTraceparent(header string) (traceID, spanID, bool) {
+	var trace traceID
+	var parent spanID
+
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return trace, parent, false
+	}
+	if n, err := hex.Decode(trace[:], []byte(parts[1])); err != nil || n != len(trace) || trace == (traceID{}) {
+		return trace, parent, false
+	}
+	if n, err := hex.Decode(parent[:], []byte(parts[2])); err != nil || n != len(parent) || parent == (spanID{}) {
+		return trace, parent, false
+	}
+	return trace, parent, true
+}
+
+// Wrap the server in a span per request, continuing the caller's trace when
+// it sends a traceparent header
+func traceRequests(next http.Handler) http.Handler {
+	if tracer == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		trace, parent, ok := parseTraceparent(req.Header.Get("Traceparent"))
+		if !ok {
+			rand.Read(trace[:])
+			parent = spanID{}
+		}
+
+		s := newSpan(req.Method+" "+req.URL.Path, spanKindServer, trace, parent)
+		s.set("http.request.method", req.Method)
+		s.set("url.path", req.URL.Path)
+		s.set("client.address", clientIP(req))
+
+		cw := &countingResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(cw, req.WithContext(context.WithValue(req.Context(), spanContextKey{}, s)))
+
+		s.set("http.response.status_code", cw.status)
+		s.set("http.response.body.size", cw.bytes)
+		if cw.status >= http.StatusInternalServerError {
+			s.fail(fmt.Errorf("HTTP %d", cw.status))
+		}
+		s.finish()
+	})
+}
+
+// Batches spans and posts them as OTLP/HTTP JSON to endpoint + /v1/traces
+type otlpExporter struct {
+	url     string
+	service string
+	client  *http.Client
+	spans   chan *span
+}
+
+func newOTLPExporter(endpoint, service string) *otlpExporter {
+	e := &otlpExporter{
+		url:     strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		service: service,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		spans:   make(chan *span, traceBatchSize*4),
+	}
+	go e.run()
+	return e
+}
+
+// Queue a finished span, dropping it if the exporter has fallen behind
+// rather than slowing requests down
+func (e *otlpExporter) export(s *span) {
+	select {
+	case e.spans <- s:
+	default:
+	}
+}
+
+func (e *otlpExporter) run() {
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+
+	var batch []*span
+	for {
+		select {
+		case s := <-e.spans:
+			if batch = append(batch, s); len(batch) < traceBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+		if len(batch) > 0 {
+			if err := e.send(batch); err != nil {
+				log.Printf("Failed to export %d spans: %v", len(batch), err)
+			}
+			batch = nil
+		}
+	}
+}
+
+func (e *otlpExporter) send(batch []*span) error {
+	body, err := json.Marshal(otlpRequest(e.service, batch))
+	if err != nil {
+		return err
+	}
+
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
+
+// OTLP's JSON encoding of attribute values
+func otlpValue(value any) map[string]any {
+	switch v := value.(type) {
+	case string:
+		return map[string]any{"stringValue": v}
+	case bool:
+		return map[string]any{"boolValue": v}
+	case int:
+		return map[string]any{"intValue": strconv.Itoa(v)}
+	case int64:
+		return map[string]any{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		return map[string]any{"doubleValue": v}
+	}
+	return map[string]any{"stringValue": fmt.Sprint(value)}
+}
+
+func otlpAttributes(attrs map[string]any) []map[string]any {
+	list := make([]map[string]any, 0, len(attrs))
+	for key, value := range attrs {
+		list = append(list, map[string]any{"key": key, "value": otlpValue(value)})
+	}
+	return list
+}
+
+func otlpRequest(service string, batch []*span) map[string]any {
+	spans := make([]map[string]any, 0, len(batch))
+	for _, s := range batch {
+		s.mu.Lock()
+		encoded := map[string]any{
+			"traceId":           hex.EncodeToString(s.traceID[:]),
+			"spanId":            hex.EncodeToString(s.id[:]),
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        otlpAttributes(s.attrs),
+		}
+		if s.parent != (spanID{}) {
+			encoded["parentSpanId"] = hex.EncodeToString(s.parent[:])
+		}
+		if s.err != nil {
+			encoded["status"] = map[string]any{"code": 2, "message": s.err.Error()}
+		}
+		s.mu.Unlock()
+		spans = append(spans, encoded)
+	}
+
+	return map[string]any{
+		"resourceSpans": []map[string]any{{
+			"resource": map[string]any{
+				"attributes": otlpAttributes(map[string]any{"service.name": service}),
+			},
+			"scopeSpans": []map[string]any{{
+				"scope": map[string]any{"name": defaultTraceServiceName},
+				"spans": spans,
+			}},
+		}},
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// Keeps finished spans in memory
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []*span
+}
+
+func (r *spanRecorder) export(s *span) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, s)
+}
+
+// The spans in the request's trace, by name. Spans from
+// goroutines an earlier test left running are in traces of their own.
+func (r *spanRecorder) byName() map[string]*span {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var root *span
+	for _, s := range r.spans {
+		if s.kind == spanKindServer {
+			root = s
+		}
+	}
+	spans := make(map[string]*span)
+	for _, s := range r.spans {
+		if root == nil || s.traceID == root.traceID {
+			spans[s.name] = s
+		}
+	}
+	return spans
+}
+
+func useSpanRecorder(t *testing.T) *spanRecorder {
+	previous := tracer
+	t.Cleanup(func() { tracer = previous })
+	recorder := &spanRecorder{}
+	tracer = recorder
+	return recorder
+}
+
+func TestStreamSpans(t *testing.T) {
+	t.Chdir(t.TempDir())
+	useStation(t, modeRandom)
+	stub := newS3Stub(t, map[string][]byte{"jazz/a.mp3": []byte("audio")})
+	stub.useEnv(t)
+	useListing(t, []string{"jazz/a.mp3"})
+	recorder := useSpanRecorder(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/stream?file=jazz/a.mp3", nil)
+	req.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	rec := httptest.NewRecorder()
+	traceRequests(http.HandlerFunc(newStreamHandler(t).stream)).ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d", rec.Code)
+	}
+
+	spans := recorder.byName()
+	server, download, serve := spans["GET /stream"], spans["downloadFile"], spans["serve"]
+	if server == nil || download == nil || serve == nil {
+		t.Fatalf("got spans %v", spans)
+	}
+	if hex.EncodeToString(server.traceID[:]) != "4bf92f3577b34da6a3ce929d0e0e4736" || hex.EncodeToString(server.parent[:]) != "00f067aa0ba902b7" {
+		t.Fatal("the incoming trace context wasn't continued")
+	}
+	for _, child := range []*span{download, serve} {
+		if child.traceID != server.traceID || child.parent != server.id {
+			t.Errorf("%s isn't a child of the request span", child.name)
+		}
+	}
+	if download.attrs["file"] != "jazz/a.mp3" || download.attrs["bucket"] != "bucket" {
+		t.Errorf("download attributes %v", download.attrs)
+	}
+	if serve.attrs["bytes"] != int64(5) || serve.attrs["cache_hit"] != false {
+		t.Errorf("serve attributes %v", serve.attrs)
+	}
+	if server.attrs["http.response.status_code"] != http.StatusOK || server.kind != spanKindServer {
+		t.Errorf("request span %v kind %d", server.attrs, server.kind)
+	}
+}
+
+func TestSelectionSpans(t *testing.T) {
+	useStation(t, modeRandom)
+	setB2Env(t)
+	useListing(t, []string{"a.mp3", "b.mp3"})
+	recorder := useSpanRecorder(t)
+
+	rec := httptest.NewRecorder()
+	traceRequests(http.HandlerFunc(newStreamHandler(t).stream)).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stream", nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("status %d, want a redirect", rec.Code)
+	}
+
+	spans := recorder.byName()
+	if list := spans["listFiles"]; list == nil || list.attrs["files"] != 2 {
+		t.Fatalf("listFiles span %v", list)
+	}
+	if pick := spans["selectRandomFile"]; pick == nil || pick.attrs["file"] == "" || pick.attrs["station"] != defaultStationName {
+		t.Fatalf("selectRandomFile span %v", pick)
+	}
+	if server := spans["GET /stream"]; server == nil || server.parent != (spanID{}) {
+		t.Fatal("a request without traceparent should start a new trace")
+	}
+}
+
+func TestTracingOff(t *testing.T) {
+	previous := tracer
+	t.Cleanup(func() { tracer = previous })
+	tracer = nil
+
+	if _, s := startSpan(context.Background(), "listFiles"); s != nil {
+		t.Fatal("started a span with tracing off")
+	}
+	var s *span
+	s.set("file", "a.mp3")
+	s.finish()
+}
+
+func TestOTLPExport(t *testing.T) {
+	received := make(chan map[string]any, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/v1/traces" {
+			t.Errorf("posted to %s", req.URL.Path)
+		}
+		body, _ := io.ReadAll(req.Body)
+		var payload map[string]any
+		json.Unmarshal(body, &payload)
+		received <- payload
+	}))
+	defer collector.Close()
+
+	exporter := &otlpExporter{url: collector.URL + "/v1/traces", service: "radio", client: collector.Client()}
+	s := newSpan("serve", spanKindInternal, traceID{1}, spanID{2})
+	s.set("bytes", int64(42))
+	if err := exporter.send([]*span{s}); err != nil {
+		t.Fatal(err)
+	}
+
+	payload := <-received
+	spans := payload["resourceSpans"].([]any)[0].(map[string]any)["scopeSpans"].([]any)[0].(map[string]any)["spans"].([]any)
+	encoded := spans[0].(map[string]any)
+	if encoded["name"] != "serve" || encoded["parentSpanId"] != "0200000000000000" {
+		t.Fatalf("encoded span %v", encoded)
+	}
+	attr := encoded["attributes"].([]any)[0].(map[string]any)
+	if attr["key"] != "bytes" || attr["value"].(map[string]any)["intValue"] != "42" {
+		t.Fatalf("attribute %v", attr)
+	}
+}
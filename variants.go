@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Lower-bitrate copies of a track sit beside it with the bitrate in kbps
+// before the extension: "song.128.mp3" is a variant of "song.mp3"
+var variantName = regexp.MustCompile(`^(.+)\.([0-9]{2,4})(\.[^./]+)$`)
+
+type variant struct {
+	key     string
+	bitrate int
+}
+
+// The track a variant key belongs to, and whether it is one
+func variantOf(key string) (string, bool) {
+	match := variantName.FindStringSubmatch(key)
+	if match == nil {
+		return "", false
+	}
+	return match[1] + match[3], true
+}
+
+// Listed variants of fileName, lowest bitrate first
+func (c *listingCache) variants(fileName string) []variant {
+	ext := path.Ext(fileName)
+	prefix := strings.TrimSuffix(fileName, ext) + "."
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var found []variant
+	for _, name := range c.files {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if match := variantName.FindStringSubmatch(name); match != nil && match[1]+match[3] == fileName {
+			bitrate, _ := strconv.Atoi(match[2])
+			found = append(found, variant{key: name, bitrate: bitrate})
+		}
+	}
+	slices.SortFunc(found, func(a, b variant) int { return a.bitrate - b.bitrate })
+	return found
+}
+
+// Leave variants out of selection when their track is listed, so a song
+// isn't picked once per bitrate
+func filterVariants(fileNames []string) []string {
+	listed := make(map[string]bool, len(fileNames))
+	for _, name := range fileNames {
+		listed[name] = true
+	}
+
+	kept := fileNames[:0:0]
+	for _, name := range fileNames {
+		if base, ok := variantOf(name); ok && listed[base] {
+			continue
+		}
+		kept = append(kept, name)
+	}
+	return kept
+}
+
+// Quality the client asked for: ?quality= (low, high or a bitrate in kbps),
+// else "low" when Save-Data or the network hints say the connection is slow
+func requestedQuality(req *http.Request) string {
+	if quality := req.URL.Query().Get("quality"); quality != "" {
+		return quality
+	}
+
+	if strings.EqualFold(strings.TrimSpace(req.Header.Get("Save-Data")), "on") {
+		return "low"
+	}
+	switch strings.TrimSpace(req.Header.Get("ECT")) {
+	case "slow-2g", "2g", "3g":
+		return "low"
+	}
+	if downlink, err := strconv.ParseFloat(strings.TrimSpace(req.Header.Get("Downlink")), 64); err == nil && downlink < 1 {
+		return "low"
+	}
+	return ""
+}
+
+// The key to serve for a request for fileName: its lowest variant for
+// "low", the highest variant at or under a numeric bitrate (else the
+// lowest), and fileName itself when there are no variants or the client
+// didn't ask for less
+func chooseVariant(quality string, variants []variant, fileName string) string {
+	if len(variants) == 0 {
+		return fileName
+	}
+
+	switch quality {
+	case "", "high":
+		return fileName
+	case "low":
+		return variants[0].key
+	}
+
+	limit, err := strconv.Atoi(quality)
+	if err != nil {
+		return fileName
+	}
+	chosen := variants[0].key
+	for _, v := range variants {
+		if v.bitrate <= limit {
+			chosen = v.key
+		}
+	}
+	return chosen
+}
+
+// Swap fileName for the variant matching the request's quality
+func variantFor(w http.ResponseWriter, req *http.Request, fileName string) string {
+	w.Header().Add("Vary", "Save-Data, ECT, Downlink")
+	quality := requestedQuality(req)
+	if quality == "" || quality == "high" {
+		return fileName
+	}
+	return chooseVariant(quality, listing.variants(fileName), fileName)
+}
+
+func validateQuality(value string) error {
+	if value == "low" || value == "high" {
+		return nil
+	}
+	return positiveInt(value)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+var variantFiles = []string{
+	"jazz/song.mp3",
+	"jazz/song.64.mp3",
+	"jazz/song.128.mp3",
+	"jazz/song.192.mp3",
+	"jazz/other.mp3",
+	"live/set.96.mp3",
+}
+
+func TestQualityPicksVariant(t *testing.T) {
+	useListing(t, variantFiles)
+
+	tests := []struct {
+		target string
+		header map[string]string
+		want   string
+	}{
+		{"/stream?file=jazz/song.mp3", nil, "jazz/song.mp3"},
+		{"/stream?file=jazz/song.mp3&quality=high", nil, "jazz/song.mp3"},
+		{"/stream?file=jazz/song.mp3&quality=low", nil, "jazz/song.64.mp3"},
+		{"/stream?file=jazz/song.mp3&quality=128", nil, "jazz/song.128.mp3"},
+		{"/stream?file=jazz/song.mp3&quality=150", nil, "jazz/song.128.mp3"},
+		{"/stream?file=jazz/song.mp3&quality=32", nil, "jazz/song.64.mp3"},
+		{"/stream?file=jazz/song.mp3", map[string]string{"Save-Data": "on"}, "jazz/song.64.mp3"},
+		{"/stream?file=jazz/song.mp3", map[string]string{"ECT": "3g"}, "jazz/song.64.mp3"},
+		{"/stream?file=jazz/song.mp3", map[string]string{"Downlink": "0.4"}, "jazz/song.64.mp3"},
+		{"/stream?file=jazz/song.mp3", map[string]string{"Downlink": "10"}, "jazz/song.mp3"},
+		{"/stream?file=jazz/song.mp3&quality=high", map[string]string{"Save-Data": "on"}, "jazz/song.mp3"},
+		{"/stream?file=jazz/other.mp3&quality=low", nil, "jazz/other.mp3"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+		for key, value := range tt.header {
+			req.Header.Set(key, value)
+		}
+		rec := httptest.NewRecorder()
+		if got := variantFor(rec, req, fileParam(req)); got != tt.want {
+			t.Errorf("%s %v: got %s, want %s", tt.target, tt.header, got, tt.want)
+		}
+		if rec.Header().Get("Vary") == "" {
+			t.Errorf("%s: no Vary header for the client hints", tt.target)
+		}
+	}
+}
+
+func TestVariantsLeftOutOfSelection(t *testing.T) {
+	got := filterVariants(variantFiles)
+	// A variant whose track isn't listed is a track of its own
+	want := []string{"jazz/song.mp3", "jazz/other.mp3", "live/set.96.mp3"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestStreamServesVariant(t *testing.T) {
+	t.Chdir(t.TempDir())
+	useStation(t, modeRandom)
+	stub := newS3Stub(t, map[string][]byte{
+		"jazz/song.mp3":    []byte("full quality"),
+		"jazz/song.64.mp3": []byte("low"),
+	})
+	stub.useEnv(t)
+	useListing(t, []string{"jazz/song.mp3", "jazz/song.64.mp3"})
+
+	rec := httptest.NewRecorder()
+	newStreamHandler(t).stream(rec, httptest.NewRequest(http.MethodGet, "/stream?file=jazz/song.mp3&quality=low", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "low" {
+		t.Fatalf("status %d body %q, want the 64 kbps variant", rec.Code, rec.Body)
+	}
+	if stub.getCount("jazz/song.mp3") != 0 {
+		t.Fatal("fetched the full-quality track")
+	}
+
+	// Picks keep the requested quality through the redirect
+	rec = httptest.NewRecorder()
+	newStreamHandler(t).stream(rec, httptest.NewRequest(http.MethodGet, "/stream?quality=low", nil))
+	if location := rec.Header().Get("Location"); location != "/stream?file=jazz%2Fsong.mp3&"+redirectHopParam+"=1&quality=low" {
+		t.Fatalf("redirected to %q", location)
+	}
+}
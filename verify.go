@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultVerifyWorkers = 8
+	defaultVerifyTimeout = 5 * time.Minute
+	verifyObjectTimeout  = 30 * time.Second
+)
+
+// Number of objects a verify run checks at once, set from VERIFY_WORKERS
+var verifyWorkers = defaultVerifyWorkers
+
+type verifyFailure struct {
+	File    string `json:"file"`
+	Problem string `json:"problem"` // not_found, forbidden, empty, timeout or error
+	Status  int    `json:"status,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+type verifySummary struct {
+	Prefix    string          `json:"prefix"`
+	Objects   int             `json:"objects"`
+	Checked   int             `json:"checked"`
+	Servable  int             `json:"servable"`
+	Failed    []verifyFailure `json:"failed"`
+	Unchecked int             `json:"unchecked"` // left when the run timed out
+}
+
+// Check that every object under ?prefix= (the whole bucket without one) can
+// actually be read, by fetching its first byte. The run stops checking after
+// ?timeout= (default 5m) and reports what's left as unchecked.
+func verifyBucket(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	timeout := defaultVerifyTimeout
+	if value := req.URL.Query().Get("timeout"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "Invalid timeout parameter", http.StatusBadRequest)
+			return
+		}
+		timeout = parsed
+	}
+	prefix := req.URL.Query().Get("prefix")
+
+	b2Client, err := b2ClientFromEnv()
+	if err != nil {
+		http.Error(w, "Failed to create B2 client", http.StatusInternalServerError)
+		log.Printf("Failed to create B2 client: %v", err)
+		return
+	}
+
+	listing.refreshFor(req)
+	objects, err := listing.getObjects(b2Client)
+	if err != nil {
+		b2Error(w, "Failed to list files", err)
+		log.Printf("Failed to list files: %v", err)
+		return
+	}
+
+	var targets []objectInfo
+	for _, object := range objects {
+		if strings.HasPrefix(object.Key, prefix) {
+			targets = append(targets, object)
+		}
+	}
+
+	log.Printf("Verifying %d objects under %q", len(targets), prefix)
+
+	summary := verifySummary{Prefix: prefix, Objects: len(targets), Failed: []verifyFailure{}}
+	deadline := time.After(timeout)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	jobs := make(chan objectInfo)
+
+	for range max(verifyWorkers, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for object := range jobs {
+				failure, ok := verifyObject(b2Client, object)
+
+				mu.Lock()
+				summary.Checked++
+				if ok {
+					summary.Servable++
+				} else {
+					summary.Failed = append(summary.Failed, failure)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+dispatch:
+	for i, object := range targets {
+		select {
+		case jobs <- object:
+		case <-deadline:
+			summary.Unchecked = len(targets) - i
+			break dispatch
+		case <-req.Context().Done():
+			summary.Unchecked = len(targets) - i
+			break dispatch
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	log.Printf("Verify of %q complete: %d servable, %d failed, %d unchecked", prefix, summary.Servable, len(summary.Failed), summary.Unchecked)
+	writeJSON(w, summary)
+}
+
+// Read the first byte of an object, describing why it isn't servable when
+// that fails
+func verifyObject(b2Client B2, object objectInfo) (verifyFailure, bool) {
+	failure := verifyFailure{File: object.Key}
+	if object.Size == 0 {
+		failure.Problem = "empty"
+		return failure, false
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		fetched, err := b2Client.fetchRange(object.Key, "bytes=0-0")
+		if err == nil {
+			fetched.body.Close()
+		}
+		result <- err
+	}()
+
+	var err error
+	select {
+	case err = <-result:
+	case <-time.After(verifyObjectTimeout):
+		failure.Problem = "timeout"
+		return failure, false
+	}
+	if err == nil {
+		return failure, true
+	}
+
+	failure.Status = b2ResponseStatus(err)
+	failure.Error = err.Error()
+	switch {
+	case errors.Is(err, errNotFound):
+		failure.Problem = "not_found"
+	case failure.Status == http.StatusForbidden:
+		failure.Problem = "forbidden"
+	default:
+		failure.Problem = "error"
+	}
+	return failure, false
+}
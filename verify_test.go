@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+)
+
+func runVerify(t *testing.T, target string) verifySummary {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	verifyBucket(rec, httptest.NewRequest(http.MethodPost, target, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("%s: status %d: %s", target, rec.Code, rec.Body)
+	}
+	var summary verifySummary
+	if err := json.NewDecoder(rec.Body).Decode(&summary); err != nil {
+		t.Fatal(err)
+	}
+	return summary
+}
+
+func TestVerifyReportsUnservableObjects(t *testing.T) {
+	useListing(t, nil)
+	stub := newS3Stub(t, map[string][]byte{
+		"jazz/a.mp3":      []byte("audio"),
+		"jazz/b.mp3":      []byte("audio"),
+		"jazz/locked.mp3": []byte("audio"),
+		"jazz/empty.mp3":  {},
+		"rock/c.mp3":      []byte("audio"),
+	})
+	stub.forbidden = map[string]bool{"jazz/locked.mp3": true}
+	stub.useEnv(t)
+
+	summary := runVerify(t, "/admin/verify")
+	if summary.Objects != 5 || summary.Checked != 5 || summary.Servable != 3 || summary.Unchecked != 0 {
+		t.Fatalf("got %+v", summary)
+	}
+	sort.Slice(summary.Failed, func(i, j int) bool { return summary.Failed[i].File < summary.Failed[j].File })
+	if len(summary.Failed) != 2 {
+		t.Fatalf("failures %+v", summary.Failed)
+	}
+	if empty := summary.Failed[0]; empty.File != "jazz/empty.mp3" || empty.Problem != "empty" {
+		t.Errorf("got %+v, want jazz/empty.mp3 reported empty", empty)
+	}
+	if locked := summary.Failed[1]; locked.File != "jazz/locked.mp3" || locked.Problem != "forbidden" || locked.Status != http.StatusForbidden {
+		t.Errorf("got %+v, want jazz/locked.mp3 reported forbidden", locked)
+	}
+
+	if rock := runVerify(t, "/admin/verify?prefix=rock/"); rock.Objects != 1 || rock.Servable != 1 || len(rock.Failed) != 0 {
+		t.Fatalf("prefix run got %+v", rock)
+	}
+}
+
+func TestVerifyTimeoutLeavesRestUnchecked(t *testing.T) {
+	useListing(t, nil)
+	objects := map[string][]byte{}
+	for _, name := range []string{"a.mp3", "b.mp3", "c.mp3", "d.mp3", "e.mp3", "f.mp3"} {
+		objects[name] = []byte("audio")
+	}
+	stub := newS3Stub(t, objects)
+	stub.useEnv(t)
+
+	summary := runVerify(t, "/admin/verify?timeout=1ns")
+	if summary.Checked+summary.Unchecked != summary.Objects || summary.Objects != len(objects) {
+		t.Fatalf("got %+v, want every object either checked or unchecked", summary)
+	}
+
+	rec := httptest.NewRecorder()
+	verifyBucket(rec, httptest.NewRequest(http.MethodPost, "/admin/verify?timeout=soon", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status %d, want 400 for a bad timeout", rec.Code)
+	}
+}
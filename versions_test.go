@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVersionedStreamCachesUnderVersionKey(t *testing.T) {
+	t.Chdir(t.TempDir())
+	useStation(t, modeRandom)
+	stub := newS3Stub(t, map[string][]byte{"jazz/a.mp3": []byte("latest")})
+	stub.versions = map[string]map[string][]byte{"jazz/a.mp3": {"4_z27c88f1d": []byte("pinned")}}
+	stub.useEnv(t)
+	useListing(t, []string{"jazz/a.mp3"})
+
+	rec := httptest.NewRecorder()
+	newStreamHandler(t).stream(rec, httptest.NewRequest(http.MethodGet, "/stream?file=jazz/a.mp3&version=4_z27c88f1d", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "pinned" {
+		t.Fatalf("status %d body %q, want the pinned version", rec.Code, rec.Body)
+	}
+
+	rec = httptest.NewRecorder()
+	newStreamHandler(t).stream(rec, httptest.NewRequest(http.MethodGet, "/stream?file=jazz/a.mp3", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "latest" {
+		t.Fatalf("status %d body %q, want the latest version", rec.Code, rec.Body)
+	}
+
+	// Each version has its own cache file
+	for path, want := range map[string]string{
+		filepath.Join(cacheDir, versionsDir, "4_z27c88f1d", "jazz", "a.mp3"): "pinned",
+		filepath.Join(cacheDir, "jazz", "a.mp3"):                             "latest",
+	} {
+		if data, err := os.ReadFile(path); err != nil || string(data) != want {
+			t.Errorf("%s holds %q (%v), want %q", path, data, err, want)
+		}
+	}
+
+	// Pinned versions count against the cache limit like the latest copies
+	files, total, err := listCachedFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || total != int64(len("pinned")+len("latest")) {
+		t.Fatalf("%d cached files totalling %d bytes, want both versions", len(files), total)
+	}
+}
+
+func TestInvalidVersionRejected(t *testing.T) {
+	t.Chdir(t.TempDir())
+	useStation(t, modeRandom)
+	setB2Env(t)
+	useListing(t, []string{"a.mp3"})
+
+	for _, version := range []string{"..", "v1/../../x", "a b"} {
+		rec := httptest.NewRecorder()
+		newStreamHandler(t).stream(rec, httptest.NewRequest(http.MethodGet, "/stream?file=a.mp3&version="+url.QueryEscape(version), nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%q: status %d, want 400", version, rec.Code)
+		}
+	}
+}
+
+func TestVersionedKey(t *testing.T) {
+	if key := versionedKey("a.mp3", ""); key != "a.mp3" {
+		t.Fatalf("unversioned key %s, want it unchanged", key)
+	}
+	if key := versionedKey("jazz/a.mp3", "v1"); key != ".versions/v1/jazz/a.mp3" || filepath.Ext(key) != ".mp3" {
+		t.Fatalf("versioned key %s", key)
+	}
+}